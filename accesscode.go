@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Owners of private uploads can hand out access codes: six digits that are short enough to read out over the phone, and
+// that unlock the upload once, within minutes, on /unlock. Share links remain the way to give lasting access. As six
+// digits are easily guessed, every wrong guess counts against all the codes of the upload, and a few of them void the
+// codes. Only HMACs of the codes are stored.
+
+const (
+	defaultAccessCodeTTL  = 10 * time.Minute
+	maxAccessCodeTTL      = 24 * time.Hour
+	maxAccessCodes        = 10 // Unused codes an upload can have at once.
+	maxAccessCodeAttempts = 5  // Wrong guesses after which the codes of an upload stop working.
+
+	// How long the print, raw and bundle links of an unlocked upload work, which carry a share link's signature as
+	// the viewer has no other way to open them.
+	unlockedLinkTTL = 15 * time.Minute
+)
+
+var (
+	ErrAccessCode      = errors.New("the access code is wrong, has expired or was already used")
+	ErrAccessCodeLimit = fmt.Errorf("an upload can have at most %d unused access codes", maxAccessCodes)
+)
+
+func initAccessCodes() {
+	RegisterJob(&Job{
+		Name:     "access codes",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "DELETE FROM AccessCodes WHERE expires_at < $1 OR attempts >= $2",
+				time.Now().UTC().Unix(), maxAccessCodeAttempts)
+			return err
+		},
+	})
+}
+
+// accessCodeHash signs a code together with the upload it unlocks, so the stored hashes cannot be guessed without the
+// signing key.
+func accessCodeHash(hash, code string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("access code\n" + hash + "\n" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewAccessCode creates a code that unlocks an upload once until it expires.
+func NewAccessCode(ctx context.Context, upload *UploadModel, expires time.Time) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	// The row of the upload is locked while its codes are counted, so that concurrent requests, which would each count
+	// the codes before the others are inserted, cannot create more than maxAccessCodes.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var locked bool
+	err = tx.QueryRowContext(ctx, "SELECT TRUE FROM Uploads WHERE hash = $1 FOR UPDATE", upload.Hash).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return "", ErrUploadNotFound
+	} else if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC().Unix()
+	var count int
+	if err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM AccessCodes WHERE upload_hash = $1 AND expires_at >= $2 AND attempts < $3",
+		upload.Hash, now, maxAccessCodeAttempts).Scan(&count); err != nil {
+		return "", err
+	}
+	if count >= maxAccessCodes {
+		return "", ErrAccessCodeLimit
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO AccessCodes(upload_hash, code_hash, expires_at, created_at) VALUES ($1, $2, $3, $4)",
+		upload.Hash, accessCodeHash(upload.Hash, code), expires.UTC().Unix(), now); err != nil {
+		return "", err
+	}
+	return code, tx.Commit()
+}
+
+// RedeemAccessCode uses up a code of an upload, or returns ErrAccessCode and counts a wrong guess.
+func RedeemAccessCode(ctx context.Context, upload *UploadModel, code string) error {
+	code = strings.Join(strings.Fields(code), "") // Codes are read out in groups, like "123 456".
+	result, err := db.ExecContext(ctx, `DELETE FROM AccessCodes
+		WHERE upload_hash = $1 AND code_hash = $2 AND expires_at >= $3 AND attempts < $4`,
+		upload.Hash, accessCodeHash(upload.Hash, code), time.Now().UTC().Unix(), maxAccessCodeAttempts)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		return nil
+	}
+	if _, err = db.ExecContext(ctx, "UPDATE AccessCodes SET attempts = attempts + 1 WHERE upload_hash = $1",
+		upload.Hash); err != nil {
+		return err
+	}
+	return ErrAccessCode
+}
+
+// RevokeAccessCodes removes the unused codes of an upload.
+func RevokeAccessCodes(ctx context.Context, hash string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM AccessCodes WHERE upload_hash = $1", hash)
+	return err
+}
+
+// parseAccessCodeTTL reads how long an access code is valid, like "15m". An empty string selects the default.
+func parseAccessCodeTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultAccessCodeTTL, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl < time.Minute || ttl > maxAccessCodeTTL {
+		return 0, errors.New(`"ttl" must be a duration between 1m and 24h`)
+	}
+	return ttl, nil
+}
+
+func registerAccessCodeRoutes(r *gin.Engine) {
+	// Create an access code that expires after the "ttl" duration argument (10m by default).
+	r.POST("/api/v1/uploads/:hash/codes", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		ttl, err := parseAccessCodeTTL(c.Query("ttl"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		expires := time.Now().Add(ttl)
+		code, err := NewAccessCode(c.Request.Context(), upload, expires)
+		if err == ErrAccessCodeLimit {
+			respondError(c, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"id":         upload.ShortHash(),
+			"code":       code,
+			"url":        baseurl + "/unlock?id=" + upload.ShortHash(),
+			"expires_at": expires.UTC().Format(time.RFC3339),
+		})
+	})
+
+	// Revoke every unused access code of an upload.
+	r.DELETE("/api/v1/uploads/:hash/codes", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		if err := RevokeAccessCodes(c.Request.Context(), upload.Hash); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	renderUnlock := func(c *gin.Context, code int, err error) {
+		data := gin.H{
+			"Page": NewPageInfo(c, "Unlock an upload"),
+			"ID":   c.Request.FormValue("id"),
+		}
+		if err != nil {
+			data["Error"] = err.Error()
+		}
+		renderPage(c, code, "unlock.html", data)
+	}
+
+	r.GET("/unlock", func(c *gin.Context) {
+		renderUnlock(c, http.StatusOK, nil)
+	})
+
+	// Show an upload once to whoever has one of its access codes. Unknown uploads look like wrong codes, so that the
+	// form tells nothing about which private uploads exist.
+	r.POST("/unlock", func(c *gin.Context) {
+		upload, err := GetUpload(normalizeUploadID(strings.TrimSpace(c.PostForm("id"))))
+		if err != nil {
+			err = ErrAccessCode
+		} else if err = RedeemAccessCode(c.Request.Context(), upload, c.PostForm("code")); err != nil &&
+			err != ErrAccessCode {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if err != nil {
+			renderUnlock(c, http.StatusForbidden, err)
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		renderSharedUpload(c, upload.ShortHash(), upload, shareQuery(upload, time.Now().Add(unlockedLinkTTL)))
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pages can be rendered for how they are read: in high contrast, with larger text, and without any JavaScript for
+// screen readers and text browsers like lynx and w3m. The variants are picked with query arguments on any page,
+// ?contrast=high, ?text=large and ?js=off, or on /accessibility, and are remembered in a cookie for the pages after it;
+// ?contrast=normal, ?text=normal and ?js=on go back. Every variant is rendered on the server, so none of them needs a
+// script to apply, and pages without JavaScript leave out the controls that only work with it.
+
+const displayCookie = "copycat_display"
+
+// DisplayOptions are the rendering variants of a page.
+type DisplayOptions struct {
+	HighContrast bool
+	LargeText    bool
+	NoScript     bool
+}
+
+// displayArguments are the query arguments that pick each variant, with the values that turn it on and off, in the
+// order the variants are remembered in displayCookie.
+var displayArguments = []struct {
+	name, on, off string
+	option        func(*DisplayOptions) *bool
+}{
+	{"contrast", "high", "normal", func(d *DisplayOptions) *bool { return &d.HighContrast }},
+	{"text", "large", "normal", func(d *DisplayOptions) *bool { return &d.LargeText }},
+	{"js", "off", "on", func(d *DisplayOptions) *bool { return &d.NoScript }},
+}
+
+// Classes returns the classes of the body of a page, which style the variants in style.css.
+func (d DisplayOptions) Classes() string {
+	var classes []string
+	if d.HighContrast {
+		classes = append(classes, "high-contrast")
+	}
+	if d.LargeText {
+		classes = append(classes, "large-text")
+	}
+	if d.NoScript {
+		classes = append(classes, "no-script")
+	}
+	return strings.Join(classes, " ")
+}
+
+// requestDisplayOptions returns the rendering variants of a request: those remembered in its cookie, changed by its
+// query arguments. Changes are remembered for the next requests.
+func requestDisplayOptions(c *gin.Context) DisplayOptions {
+	var options DisplayOptions
+	remembered, _ := c.Cookie(displayCookie)
+	for _, name := range strings.Split(remembered, ".") {
+		for _, argument := range displayArguments {
+			if name == argument.name {
+				*argument.option(&options) = true
+			}
+		}
+	}
+
+	changed := options
+	for _, argument := range displayArguments {
+		switch c.Query(argument.name) {
+		case argument.on:
+			*argument.option(&changed) = true
+		case argument.off:
+			*argument.option(&changed) = false
+		}
+	}
+	if changed != options {
+		var names []string
+		for _, argument := range displayArguments {
+			if *argument.option(&changed) {
+				names = append(names, argument.name)
+			}
+		}
+		if len(names) == 0 {
+			c.SetCookie(displayCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+		} else {
+			c.SetCookie(displayCookie, strings.Join(names, "."), 365*24*60*60, "/", "", c.Request.TLS != nil, true)
+		}
+	}
+	return changed
+}
+
+func registerAccessibilityRoutes(r *gin.Engine) {
+	// Pick the rendering variants with a form that works in every browser; it submits its choices as query arguments
+	// back to this page.
+	r.GET("/accessibility", func(c *gin.Context) {
+		page := NewPageInfo(c, "Accessibility")
+		renderPage(c, http.StatusOK, "accessibility.html", gin.H{
+			"Page":  page,
+			"Saved": c.Request.URL.RawQuery != "",
+		})
+	})
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie   = "copycat_session"
+	sessionLifetime = 30 * 24 * time.Hour
+)
+
+var (
+	ErrLoginFailed      = errors.New("incorrect username or password")
+	ErrUsernameInvalid  = errors.New("usernames must be 2 to 32 lowercase letters, digits, dashes or underscores")
+	ErrUsernameTaken    = errors.New("that username is already taken")
+	ErrPasswordTooShort = errors.New("passwords must be at least 10 characters long")
+	ErrLoginRequired    = errors.New("you must be logged in to do that")
+	ErrAccountDisabled  = errors.New("this account has been deactivated")
+	ErrAccountNotFound  = errors.New("account not found")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9_-]{2,32}$`)
+
+// Account roles, from least to most privileged. Each role may do everything the roles before it can.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator" // May delete uploads.
+	RoleAdmin     = "admin"     // May also change roles and read the audit log.
+)
+
+var roleRanks = map[string]int{RoleUser: 1, RoleModerator: 2, RoleAdmin: 3}
+
+var ErrRoleInvalid = errors.New(`role must be "user", "moderator" or "admin"`)
+
+// An Account is a registered user. Anonymous uploads remain possible; accounts are needed for teams.
+type Account struct {
+	Id        int64
+	Username  string
+	Created   int64
+	Role      string
+	TwoFactor bool // Whether logging in needs a code from an authenticator app; see twofactor.go.
+	Disabled  bool // Deactivated accounts cannot log in or use their API token; see scim.go.
+
+	passwordHash string
+}
+
+// allowRegistration enables the public /register page. Without it accounts must be created by an operator.
+var allowRegistration atomic.Bool
+
+func initAccounts() {
+	loadFlag(&allowRegistration, "ALLOW_REGISTRATION")
+}
+
+// HasRole reports whether the account has role or a more privileged one.
+func (account *Account) HasRole(role string) bool {
+	return account != nil && roleRanks[account.Role] >= roleRanks[role]
+}
+
+const accountColumns = "id, username, created, role, password, totp_enabled, disabled"
+
+func scanAccount(row rowScanner) (*Account, error) {
+	account := new(Account)
+	if err := row.Scan(&account.Id, &account.Username, &account.Created, &account.Role, &account.passwordHash, &account.TwoFactor, &account.Disabled); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// CreateAccount registers a new account and returns it along with its API token, which is not stored in plaintext.
+func CreateAccount(username, password, role string) (*Account, string, error) {
+	if _, ok := roleRanks[role]; !ok {
+		return nil, "", ErrRoleInvalid
+	}
+	if !usernamePattern.MatchString(username) {
+		return nil, "", ErrUsernameInvalid
+	}
+	if len(password) < 10 {
+		return nil, "", ErrPasswordTooShort
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := randomToken()
+	account, err := scanAccount(db.QueryRow("INSERT INTO Accounts(username, password, api_token, created, role) VALUES ($1, $2, $3, $4, $5) RETURNING "+accountColumns,
+		username, string(hash), hashToken(token), time.Now().UTC().Unix(), role))
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok && err.Code == "23505" { // unique_violation
+			return nil, "", ErrUsernameTaken
+		}
+		return nil, "", err
+	}
+	return account, token, nil
+}
+
+// GetAccount fetches an account by its username.
+func GetAccount(username string) (*Account, error) {
+	return scanAccount(db.QueryRow("SELECT "+accountColumns+" FROM Accounts WHERE username = $1", username))
+}
+
+// GetAccountByID fetches an account by its id.
+func GetAccountByID(id int64) (*Account, error) {
+	return scanAccount(db.QueryRow("SELECT "+accountColumns+" FROM Accounts WHERE id = $1", id))
+}
+
+// GetAccountByToken fetches the account that owns an API token.
+func GetAccountByToken(token string) (*Account, error) {
+	return scanAccount(db.QueryRow("SELECT "+accountColumns+" FROM Accounts WHERE api_token = $1", hashToken(token)))
+}
+
+// Login checks a username and password, returning ErrLoginFailed if either is wrong. When LDAP is configured, passwords
+// that do not match a local account are checked against the directory; see ldap.go.
+func Login(username, password, ip string) (*Account, error) {
+	account, err := GetAccount(username)
+	if err == sql.ErrNoRows {
+		account = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if account != nil && bcrypt.CompareHashAndPassword([]byte(account.passwordHash), []byte(password)) == nil {
+		if account.Disabled {
+			return nil, ErrAccountDisabled
+		}
+		return account, nil
+	}
+	if ldapConfig.url == "" {
+		return nil, ErrLoginFailed
+	}
+	external, err := ldapLogin(username, password, ip)
+	if err != nil {
+		return nil, err
+	} else if account != nil && external.Id != account.Id {
+		// The directory user is linked to a different account than the one with this username.
+		return nil, ErrLoginFailed
+	}
+	return external, nil
+}
+
+// SetRole changes the role of an account.
+func SetRole(account *Account, role string) error {
+	if _, ok := roleRanks[role]; !ok {
+		return ErrRoleInvalid
+	}
+	_, err := db.Exec("UPDATE Accounts SET role = $1 WHERE id = $2", role, account.Id)
+	return err
+}
+
+// RenameAccount changes the username of an account.
+func RenameAccount(account *Account, username string) error {
+	if !usernamePattern.MatchString(username) {
+		return ErrUsernameInvalid
+	}
+	_, err := db.Exec("UPDATE Accounts SET username = $1 WHERE id = $2", username, account.Id)
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" { // unique_violation
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+// SetDisabled deactivates an account, logging out all of its sessions, or activates it again.
+func SetDisabled(account *Account, disabled bool) error {
+	if _, err := db.Exec("UPDATE Accounts SET disabled = $1 WHERE id = $2", disabled, account.Id); err != nil {
+		return err
+	}
+	account.Disabled = disabled
+	if disabled {
+		return RevokeOtherSessions(account, 0)
+	}
+	return nil
+}
+
+// CountAdmins returns the number of accounts with the admin role.
+func CountAdmins() (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM Accounts WHERE role = $1", RoleAdmin).Scan(&n)
+	return n, err
+}
+
+// DeleteAccount deletes an account with its team memberships, drafts, own paste templates and clip channels. Its
+// uploads must be deleted first.
+func DeleteAccount(account *Account) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// These tables also hold rows that belong to no account, with an account_id of 0, so they cannot reference Accounts
+	// and are cleaned up here instead.
+	for _, table := range []string{"Drafts", "PasteTemplates"} {
+		if _, err = tx.Exec("DELETE FROM "+table+" WHERE account_id = $1", account.Id); err != nil {
+			return err
+		}
+	}
+	rows, err := tx.Query("DELETE FROM ClipChannels WHERE account_id = $1 RETURNING id", account.Id)
+	if err != nil {
+		return err
+	}
+	var channels []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		channels = append(channels, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM Accounts WHERE id = $1", account.Id); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	// Devices still connected to the deleted channels are disconnected.
+	for _, id := range channels {
+		syncClipChannel(id)
+	}
+	return nil
+}
+
+// ResetAPIToken replaces the API token of an account and returns the new token.
+func ResetAPIToken(account *Account) (string, error) {
+	token := randomToken()
+	_, err := db.Exec("UPDATE Accounts SET api_token = $1 WHERE id = $2", hashToken(token), account.Id)
+	return token, err
+}
+
+// authenticate is a middleware that identifies the account making the request, either from an
+// "Authorization: Bearer <api token>" header or from the session cookie. Requests without either remain anonymous.
+func authenticate(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/scim/") {
+		// Identity providers authenticate to SCIM with their own token, not an account's; see scim.go.
+		c.Next()
+		return
+	}
+	var account *Account
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		account, _ = GetAccountByToken(token)
+		if account == nil {
+			respondError(c, http.StatusUnauthorized, errors.New("invalid API token"))
+			c.Abort()
+			return
+		}
+		c.Set("apiKey", apiKeyID(hashToken(token))) // Usage is accounted per token; see usage.go.
+	} else if session := sessionFromCookie(c); session != nil {
+		account, _ = GetAccountByID(session.AccountId)
+	}
+
+	if account != nil && account.Disabled {
+		respondError(c, http.StatusForbidden, ErrAccountDisabled)
+		c.Abort()
+		return
+	} else if account != nil {
+		c.Set("account", account)
+	}
+	c.Next()
+}
+
+// currentAccount returns the account making the request, or nil for anonymous requests.
+func currentAccount(c *gin.Context) *Account {
+	if account, ok := c.Get("account"); ok {
+		return account.(*Account)
+	}
+	return nil
+}
+
+// requireAccount returns the account making the request. Anonymous requests are answered with 401, and accounts that
+// have yet to enable the two-factor authentication required for their role with 403, and nil is returned.
+func requireAccount(c *gin.Context) *Account {
+	account := currentAccount(c)
+	if account == nil {
+		respondError(c, http.StatusUnauthorized, ErrLoginRequired)
+	} else if account.MustEnrollTwoFactor() {
+		respondError(c, http.StatusForbidden, ErrTwoFactorRequired)
+		return nil
+	}
+	return account
+}
+
+// requireRole is a middleware that only lets accounts with role, or a more privileged one, continue.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		account := requireAccount(c)
+		if account == nil {
+			c.Abort()
+			return
+		}
+		if !account.HasRole(role) {
+			respondError(c, http.StatusForbidden, fmt.Errorf("the %s role is required", role))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func registerAccountRoutes(r *gin.Engine) {
+	renderLogin := func(c *gin.Context, code int, register bool, err error) {
+		title := "Log in"
+		if register {
+			title = "Register"
+		}
+		data := gin.H{
+			"Page":     NewPageInfo(c, title),
+			"Register": register,
+			"SSO":      samlProvider != nil,
+		}
+		if err != nil {
+			data["Error"] = err.Error()
+		}
+		renderPage(c, code, "login.html", data)
+	}
+
+	r.GET("/login", func(c *gin.Context) {
+		renderLogin(c, http.StatusOK, false, nil)
+	})
+
+	r.POST("/login", func(c *gin.Context) {
+		account, err := Login(c.PostForm("username"), c.PostForm("password"), c.ClientIP())
+		if err == ErrLoginFailed || err == ErrExternalUsernameTaken || err == ErrAccountDisabled {
+			renderLogin(c, http.StatusUnauthorized, false, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if account.TwoFactor {
+			// The session only starts once POST /login/2fa accepts a code.
+			setTwoFactorPending(c, account)
+			renderPage(c, http.StatusOK, "login.html", gin.H{
+				"Page":      NewPageInfo(c, "Log in"),
+				"TwoFactor": true,
+			})
+			return
+		}
+		if err = setSession(c, account); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if account.MustEnrollTwoFactor() {
+			c.Redirect(http.StatusSeeOther, "/account/2fa")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/")
+	})
+
+	r.POST("/logout", func(c *gin.Context) {
+		clearSession(c)
+		c.Redirect(http.StatusSeeOther, "/")
+	})
+
+	r.GET("/register", func(c *gin.Context) {
+		if !allowRegistration.Load() {
+			route404(c)
+			return
+		}
+		renderLogin(c, http.StatusOK, true, nil)
+	})
+
+	r.POST("/register", func(c *gin.Context) {
+		if !allowRegistration.Load() {
+			route404(c)
+			return
+		}
+		account, token, err := CreateAccount(c.PostForm("username"), c.PostForm("password"), RoleUser)
+		if err == ErrUsernameInvalid || err == ErrUsernameTaken || err == ErrPasswordTooShort {
+			renderLogin(c, http.StatusBadRequest, true, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if err = setSession(c, account); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		renderPage(c, http.StatusOK, "token.html", gin.H{
+			"Page":  NewPageInfo(c, "API token"),
+			"Token": token,
+		})
+	})
+
+	// Replace the API token of the logged in account. The new token is only shown once.
+	r.POST("/api/v1/me/token", func(c *gin.Context) {
+		account := requireAccount(c)
+		if account == nil {
+			return
+		}
+		token, err := ResetAPIToken(account)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"token": token,
+		})
+	})
+}
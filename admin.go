@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const auditPageSize = 100
+
+// An AuditEntry records a privileged action: who did what to which target, and when.
+type AuditEntry struct {
+	Id        int64  `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Actor     string `json:"actor"`  // Username of the account, or "cli:<username>" for command line operations.
+	Action    string `json:"action"` // For example "upload.delete" or "account.role".
+	Target    string `json:"target"`
+	Details   string `json:"details"`
+	IP        string `json:"ip"` // Empty for command line operations.
+}
+
+// RecordAudit appends an entry to the audit log. Failures are logged rather than returned so that an action which
+// already happened is never reported as failed.
+func RecordAudit(actor, action, target, details, ip string) {
+	_, err := db.Exec("INSERT INTO AuditLog(timestamp, actor, action, target, details, ip) VALUES ($1, $2, $3, $4, $5, $6)",
+		time.Now().UTC().Unix(), actor, action, target, details, ip)
+	if err != nil {
+		log.Printf("failed to record audit entry %v %v %v: %v", actor, action, target, err)
+	}
+}
+
+// GetAuditLog returns a page of audit entries, newest first, and the cursor of the next page or nil if it is the last.
+// Entries older than the entry with id before are listed when it is not 0.
+func GetAuditLog(before int64, query ListQuery) ([]AuditEntry, *listCursor, error) {
+	query.HasAttachments, query.Language = nil, "" // Audit entries have no attachments or language to filter by.
+	clauses, args := query.clauses("timestamp", "id", []any{before})
+	rows, err := db.Query(`SELECT id, timestamp, actor, action, target, details, ip FROM AuditLog
+		WHERE ($1 = 0 OR id < $1)`+clauses, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err = rows.Scan(&e.Id, &e.Timestamp, &e.Actor, &e.Action, &e.Target, &e.Details, &e.IP); err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil || len(entries) <= query.Limit {
+		return entries, nil, err
+	}
+	entries = entries[:query.Limit]
+	last := entries[len(entries)-1]
+	return entries, &listCursor{Time: last.Timestamp, Id: last.Id}, nil
+}
+
+// PurgeUpload deletes the attachments of an upload from storage and then the upload from the database, and returns the
+// deleted upload with the keys of the objects deleted, which leave out those that other uploads share. When deleting
+// the attachments fails, the upload is kept so that purging it can be tried again.
+func PurgeUpload(ctx context.Context, hash string) (*UploadModel, []string, error) {
+	upload, err := scanUpload(db.QueryRowContext(ctx, "SELECT "+uploadColumns+" FROM Uploads WHERE hash = $1", hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	deleted, err := deleteObjects(ctx, upload, func(tx *sql.Tx) error {
+		return DeleteUpload(ctx, tx, hash)
+	})
+	invalidateUpload(hash)
+	if err != nil {
+		return upload, nil, err
+	}
+	purgeCDN(ctx, upload)
+	return upload, deleted, nil
+}
+
+// ErrObjectTakenDown is answered to downloads of an attachment that was taken down.
+var ErrObjectTakenDown = errors.New("this attachment has been taken down")
+
+// Takedown removes the content of an upload for legal reasons and leaves a tombstone with the reason in its place.
+func Takedown(ctx context.Context, upload *UploadModel, reason string) error {
+	// Objects that identical files uploaded by others share are kept for them, but are recorded so that they are not
+	// served anymore, whichever upload links to them.
+	_, err := deleteObjects(ctx, upload, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO TakenDownObjects(key, upload_hash, reason, taken_down_at)
+			SELECT unnest($1::text[]), $2, $3, $4 ON CONFLICT (key) DO NOTHING`,
+			pq.Array(upload.objectKeys()), upload.Hash, reason, time.Now().UTC().Unix())
+		if err != nil {
+			return err
+		}
+		return TakedownUpload(ctx, tx, upload.Hash, reason)
+	})
+	invalidateUpload(upload.Hash)
+	if err != nil {
+		return err
+	}
+	mediaCache.Remove(upload.objectKeys()...)
+	// The removed body must not be suggested as related to others anymore.
+	if err = IndexRelated(ctx, upload.Hash, ""); err != nil {
+		return err
+	}
+	purgeCDN(ctx, upload)
+	return nil
+}
+
+// objectTakenDown reports whether the object stored under key was taken down with an upload.
+func objectTakenDown(ctx context.Context, key string) (bool, error) {
+	var takenDown bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM TakenDownObjects WHERE key = $1)", key).Scan(&takenDown)
+	return takenDown, err
+}
+
+// checkTakedown answers the request with 451 and returns false when the object stored under key was taken down.
+func checkTakedown(c *gin.Context, key string) bool {
+	takenDown, err := objectTakenDown(c.Request.Context(), key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return false
+	} else if takenDown {
+		respondError(c, http.StatusUnavailableForLegalReasons, ErrObjectTakenDown)
+		return false
+	}
+	return true
+}
+
+func registerAdminRoutes(r *gin.Engine) {
+	// Moderators and admins may delete uploads. They stay in the trash for the grace period like any other deletion.
+	moderation := r.Group("/api/v1/moderation", requireRole(RoleModerator))
+
+	moderation.DELETE("/uploads/:hash", func(c *gin.Context) {
+		account := currentAccount(c)
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		if !checkHooks(c, &HookPayload{Event: HookPreDelete, Hash: upload.Hash, Files: upload.FileNames, Private: upload.Private}) {
+			return
+		}
+
+		if err = TrashUpload(c.Request.Context(), upload, account.Username); err != nil {
+			RecordAudit(account.Username, "upload.delete", upload.Hash, "failed: "+err.Error(), c.ClientIP())
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "upload.delete", upload.Hash, c.PostForm("reason"), c.ClientIP())
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload deleted",
+		})
+	})
+
+	// Only admins may change roles and read the audit log.
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	admin.POST("/accounts/:username/role", func(c *gin.Context) {
+		account := currentAccount(c)
+		target, err := GetAccount(c.Param("username"))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrAccountNotFound)
+			return
+		}
+
+		role := c.PostForm("role")
+		if target.Role == RoleAdmin && role != RoleAdmin {
+			admins, err := CountAdmins()
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			if admins <= 1 {
+				respondError(c, http.StatusConflict, errors.New("the last admin cannot be demoted"))
+				return
+			}
+		}
+		if err = SetRole(target, role); err == ErrRoleInvalid {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "account.role", target.Username, target.Role+" -> "+role, c.ClientIP())
+
+		c.JSON(http.StatusOK, gin.H{
+			"username": target.Username,
+			"role":     role,
+		})
+	})
+
+	// Replace an upload with a tombstone notice, e.g. in response to a legal request.
+	admin.POST("/uploads/:hash/takedown", func(c *gin.Context) {
+		account := currentAccount(c)
+		reason := c.PostForm("reason")
+		if reason == "" {
+			respondError(c, http.StatusBadRequest, errors.New(`a "reason" is required, it is shown on the tombstone page`))
+			return
+		}
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+
+		if err = Takedown(c.Request.Context(), upload, reason); err != nil {
+			RecordAudit(account.Username, "upload.takedown", upload.Hash, "failed: "+err.Error(), c.ClientIP())
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "upload.takedown", upload.Hash, reason, c.ClientIP())
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload taken down",
+		})
+	})
+
+	// Pages of the audit log are requested with the cursor of the previous page, or with the older
+	// ?before=<id of the last entry of the previous page>.
+	admin.GET("/audit", func(c *gin.Context) {
+		query, ok := parseListQuery(c)
+		if !ok {
+			return
+		}
+		before, _ := strconv.ParseInt(c.Query("before"), 10, 64)
+		entries, next, err := GetAuditLog(before, query)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"entries":     entries,
+			"next_cursor": setListLinks(c, next),
+		})
+	})
+}
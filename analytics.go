@@ -0,0 +1,277 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Owners that uploaded with an account can see how often their uploads were viewed and their attachments downloaded,
+// from which countries and from which sites. Only counts are kept: every event adds one to the count of its day,
+// country and referring site, so no address or time of a single request is stored. Counts are gathered in memory and
+// written every minute, and kept for ANALYTICS_DAYS. Analytics are only recorded when UPLOAD_ANALYTICS is true, and
+// never for browsers that send Do Not Track or Global Privacy Control.
+//
+// Downloads are counted by attachment, so identical files shared by several uploads share their counts, and downloads
+// served from the CDN cache are not counted at all.
+
+const (
+	analyticsView     = "view"
+	analyticsDownload = "download"
+
+	analyticsTop        = 10     // Countries and referrers listed.
+	maxAnalyticsPending = 100000 // Counts kept in memory between writes; events beyond are dropped.
+)
+
+var ErrAnalyticsDisabled = errors.New("analytics are turned off on this server")
+
+var (
+	uploadAnalytics atomic.Bool
+	analyticsDays   int64
+)
+
+// An analyticsKey is what events are counted by.
+type analyticsKey struct {
+	target   string // The upload hash of views, or the attachment key of downloads.
+	event    string
+	day      string // YYYY-MM-DD in UTC.
+	country  string
+	referrer string // The host of the referring site, or "" for direct visits and links on this site.
+}
+
+// pendingAnalytics are the counts that have not been written yet.
+var pendingAnalytics = struct {
+	sync.Mutex
+	counts map[analyticsKey]int64
+}{counts: make(map[analyticsKey]int64)}
+
+func initAnalytics() {
+	loadFlag(&uploadAnalytics, "UPLOAD_ANALYTICS")
+	analyticsDays = envInt64("ANALYTICS_DAYS", 90)
+	if analyticsDays <= 0 {
+		log.Fatal("ANALYTICS_DAYS environment variable must be positive")
+	}
+
+	// Every replica writes the counts it gathered.
+	RegisterJob(&Job{
+		Name:         "analytics",
+		Interval:     time.Minute,
+		EveryReplica: true,
+		Run:          flushAnalytics,
+	})
+	RegisterJob(&Job{
+		Name:     "analytics retention",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "DELETE FROM UploadAnalytics WHERE day < $1", analyticsCutoff())
+			return err
+		},
+	})
+}
+
+// analyticsCutoff returns the first day whose counts are kept.
+func analyticsCutoff() string {
+	return time.Now().UTC().AddDate(0, 0, -int(analyticsDays)+1).Format(time.DateOnly)
+}
+
+// recordAnalytics counts an event of a request.
+func recordAnalytics(c *gin.Context, event, target string) {
+	if !uploadAnalytics.Load() || c.GetHeader("DNT") == "1" || c.GetHeader("Sec-GPC") == "1" {
+		return
+	}
+	key := analyticsKey{
+		target:  target,
+		event:   event,
+		day:     time.Now().UTC().Format(time.DateOnly),
+		country: requestCountry(c),
+	}
+	if referer, err := url.Parse(c.Request.Referer()); err == nil && !strings.EqualFold(referer.Host, c.Request.Host) {
+		key.referrer = strings.ToLower(referer.Hostname())
+	}
+
+	pendingAnalytics.Lock()
+	defer pendingAnalytics.Unlock()
+	if _, ok := pendingAnalytics.counts[key]; ok || len(pendingAnalytics.counts) < maxAnalyticsPending {
+		pendingAnalytics.counts[key]++
+	}
+}
+
+// recordView counts a view of an upload, unless its owner is looking at it.
+func recordView(c *gin.Context, upload *UploadModel) {
+	if !upload.IsOwner(c) {
+		recordAnalytics(c, analyticsView, upload.Hash)
+	}
+}
+
+// flushAnalytics adds the pending counts to the UploadAnalytics table. Counts that could not be written are kept for
+// the next try.
+func flushAnalytics(ctx context.Context) error {
+	pendingAnalytics.Lock()
+	counts := pendingAnalytics.counts
+	pendingAnalytics.counts = make(map[analyticsKey]int64)
+	pendingAnalytics.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	err := writeAnalytics(ctx, counts)
+	if err != nil {
+		pendingAnalytics.Lock()
+		for key, count := range counts {
+			if _, ok := pendingAnalytics.counts[key]; ok || len(pendingAnalytics.counts) < maxAnalyticsPending {
+				pendingAnalytics.counts[key] += count
+			}
+		}
+		pendingAnalytics.Unlock()
+	}
+	return err
+}
+
+func writeAnalytics(ctx context.Context, counts map[analyticsKey]int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, count := range counts {
+		_, err = tx.ExecContext(ctx, `INSERT INTO UploadAnalytics(target, event, day, country, referrer, count)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (target, event, day, country, referrer) DO UPDATE SET count = UploadAnalytics.count + excluded.count`,
+			key.target, key.event, key.day, key.country, key.referrer, count)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UploadAnalytics are the counts of the views and downloads of an upload over the last Days days.
+type UploadAnalytics struct {
+	Days      int64            `json:"days"`
+	Views     int64            `json:"views"`
+	Downloads int64            `json:"downloads"`
+	PerDay    []AnalyticsDay   `json:"per_day"`   // Oldest first, only days with events.
+	Countries []AnalyticsCount `json:"countries"` // The most frequent first; "" is unknown.
+	Referrers []AnalyticsCount `json:"referrers"` // The most frequent first; "" is direct visits.
+}
+
+// An AnalyticsDay counts the events of one day.
+type AnalyticsDay struct {
+	Date      string `json:"date"` // YYYY-MM-DD in UTC.
+	Views     int64  `json:"views"`
+	Downloads int64  `json:"downloads"`
+}
+
+// An AnalyticsCount counts the events of one country or referring site.
+type AnalyticsCount struct {
+	Name      string `json:"name"`
+	Views     int64  `json:"views"`
+	Downloads int64  `json:"downloads"`
+}
+
+// GetUploadAnalytics adds up the counts of the views of an upload and the downloads of its attachments.
+func GetUploadAnalytics(upload *UploadModel) (*UploadAnalytics, error) {
+	rows, err := db.Query(`SELECT event, day, country, referrer, SUM(count) FROM UploadAnalytics
+		WHERE day >= $1 AND (target = $2 AND event = 'view' OR target = ANY($3) AND event = 'download')
+		GROUP BY event, day, country, referrer ORDER BY day`,
+		analyticsCutoff(), upload.Hash, pq.Array(upload.FileHashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	analytics := &UploadAnalytics{Days: analyticsDays, PerDay: []AnalyticsDay{}}
+	countries := make(map[string]*AnalyticsCount)
+	referrers := make(map[string]*AnalyticsCount)
+	add := func(counts map[string]*AnalyticsCount, name, event string, count int64) {
+		if counts[name] == nil {
+			counts[name] = &AnalyticsCount{Name: name}
+		}
+		if event == analyticsView {
+			counts[name].Views += count
+		} else {
+			counts[name].Downloads += count
+		}
+	}
+	for rows.Next() {
+		var event, day, country, referrer string
+		var count int64
+		if err := rows.Scan(&event, &day, &country, &referrer, &count); err != nil {
+			return nil, err
+		}
+		if len(analytics.PerDay) == 0 || analytics.PerDay[len(analytics.PerDay)-1].Date != day {
+			analytics.PerDay = append(analytics.PerDay, AnalyticsDay{Date: day})
+		}
+		today := &analytics.PerDay[len(analytics.PerDay)-1]
+		if event == analyticsView {
+			analytics.Views += count
+			today.Views += count
+		} else {
+			analytics.Downloads += count
+			today.Downloads += count
+		}
+		add(countries, country, event, count)
+		add(referrers, referrer, event, count)
+	}
+	analytics.Countries = topAnalytics(countries)
+	analytics.Referrers = topAnalytics(referrers)
+	return analytics, rows.Err()
+}
+
+// topAnalytics returns the analyticsTop counts with the most events.
+func topAnalytics(counts map[string]*AnalyticsCount) []AnalyticsCount {
+	top := make([]AnalyticsCount, 0, len(counts))
+	for _, count := range counts {
+		top = append(top, *count)
+	}
+	slices.SortFunc(top, func(a, b AnalyticsCount) int {
+		return cmp.Or(cmp.Compare(b.Views+b.Downloads, a.Views+a.Downloads), cmp.Compare(a.Name, b.Name))
+	})
+	return top[:min(len(top), analyticsTop)]
+}
+
+// ownerAnalytics returns the analytics of an upload for its page when the account viewing it uploaded it, or nil.
+func ownerAnalytics(c *gin.Context, upload *UploadModel) *UploadAnalytics {
+	account := currentAccount(c)
+	if !uploadAnalytics.Load() || account == nil || upload.AccountId != account.Id {
+		return nil
+	}
+	analytics, err := GetUploadAnalytics(upload)
+	if err != nil {
+		log.Printf("failed to read the analytics of upload %v: %v", upload.Hash, err)
+		return nil
+	}
+	return analytics
+}
+
+func registerAnalyticsRoutes(r *gin.Engine) {
+	// Fetch the analytics of an upload, as the account that uploaded it.
+	r.GET("/api/v1/uploads/:hash/analytics", requireRole(RoleUser), func(c *gin.Context) {
+		if !uploadAnalytics.Load() {
+			respondError(c, http.StatusNotFound, ErrAnalyticsDisabled)
+			return
+		}
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil || upload.AccountId != currentAccount(c).Id {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		analytics, err := GetUploadAnalytics(upload)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, analytics)
+	})
+}
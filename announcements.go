@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dismissedCookie lists the ids of the announcements that a browser dismissed, separated by dots.
+const dismissedCookie = "copycat_dismissed"
+
+// An Announcement is a banner shown at the top of every page between its start and end, for example to warn of
+// maintenance or a change of policy.
+type Announcement struct {
+	Id          int64  `json:"id"`
+	Message     string `json:"message"`
+	Level       string `json:"level"`       // "info" or "warning", which is drawn more prominently.
+	StartsAt    int64  `json:"starts_at"`   // Unix time, or 0 to show it right away.
+	EndsAt      int64  `json:"ends_at"`     // Unix time, or 0 to show it until it is deleted.
+	Dismissible bool   `json:"dismissible"` // Whether visitors may hide it.
+	CreatedBy   string `json:"created_by"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// Active reports whether the announcement is shown at the given time.
+func (a *Announcement) Active(now int64) bool {
+	return a.StartsAt <= now && (a.EndsAt == 0 || now < a.EndsAt)
+}
+
+// announcements holds every announcement that has not ended yet, so that rendering a page never queries them. Every
+// replica reloads them each minute, and right away after an admin changes them.
+var announcements atomic.Pointer[[]Announcement]
+
+func initAnnouncements() {
+	RegisterJob(&Job{
+		Name:         "announcements",
+		Interval:     time.Minute,
+		EveryReplica: true,
+		Run: func(context.Context) error {
+			return loadAnnouncements()
+		},
+	})
+}
+
+// ListAnnouncements returns the announcements that have not ended by the given time, the most recent first.
+func ListAnnouncements(now int64) ([]Announcement, error) {
+	rows, err := db.Query(`SELECT id, message, level, starts_at, ends_at, dismissible, created_by, created_at FROM Announcements
+		WHERE ends_at = 0 OR ends_at > $1 ORDER BY id DESC`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Announcement
+	for rows.Next() {
+		var a Announcement
+		if err = rows.Scan(&a.Id, &a.Message, &a.Level, &a.StartsAt, &a.EndsAt, &a.Dismissible, &a.CreatedBy, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func loadAnnouncements() error {
+	list, err := ListAnnouncements(time.Now().UTC().Unix())
+	if err != nil {
+		return err
+	}
+	announcements.Store(&list)
+	return nil
+}
+
+// CreateAnnouncement stores a new announcement and sets its id.
+func CreateAnnouncement(a *Announcement) error {
+	a.CreatedAt = time.Now().UTC().Unix()
+	return db.QueryRow(`INSERT INTO Announcements(message, level, starts_at, ends_at, dismissible, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		a.Message, a.Level, a.StartsAt, a.EndsAt, a.Dismissible, a.CreatedBy, a.CreatedAt).Scan(&a.Id)
+}
+
+// DeleteAnnouncement deletes an announcement, and reports whether it existed.
+func DeleteAnnouncement(id int64) (bool, error) {
+	result, err := db.Exec("DELETE FROM Announcements WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// dismissedAnnouncements returns the ids of the announcements dismissed by the browser of the request.
+func dismissedAnnouncements(c *gin.Context) []int64 {
+	cookie, _ := c.Cookie(dismissedCookie)
+	var ids []int64
+	for _, field := range strings.Split(cookie, ".") {
+		if id, err := strconv.ParseInt(field, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// pageAnnouncements returns the announcements to show on a page: those active now, without the ones dismissed.
+func pageAnnouncements(c *gin.Context) []Announcement {
+	list := announcements.Load()
+	if list == nil {
+		return nil
+	}
+	now := time.Now().UTC().Unix()
+	dismissed := dismissedAnnouncements(c)
+	var shown []Announcement
+	for _, a := range *list {
+		if a.Active(now) && !(a.Dismissible && slices.Contains(dismissed, a.Id)) {
+			shown = append(shown, a)
+		}
+	}
+	return shown
+}
+
+// parseAnnouncementTime parses an optional RFC 3339 form value into Unix time, or 0 when it is empty.
+func parseAnnouncementTime(c *gin.Context, field string) (int64, error) {
+	value := c.PostForm(field)
+	if value == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, errors.New(`"` + field + `" must be an RFC 3339 timestamp`)
+	}
+	return t.UTC().Unix(), nil
+}
+
+func registerAnnouncementRoutes(r *gin.Engine) {
+	// Hide an announcement in this browser, then go back to the page it was dismissed on.
+	r.POST("/announcements/:id/dismiss", func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			route404(c)
+			return
+		}
+		dismissed := dismissedAnnouncements(c)
+		if !slices.Contains(dismissed, id) {
+			dismissed = append(dismissed, id)
+		}
+		// Forget announcements that have ended, so that the cookie does not grow forever.
+		if list := announcements.Load(); list != nil {
+			dismissed = slices.DeleteFunc(dismissed, func(id int64) bool {
+				return !slices.ContainsFunc(*list, func(a Announcement) bool { return a.Id == id })
+			})
+		}
+		fields := make([]string, len(dismissed))
+		for i, id := range dismissed {
+			fields[i] = strconv.FormatInt(id, 10)
+		}
+		c.SetCookie(dismissedCookie, strings.Join(fields, "."), 365*24*60*60, "/", "", c.Request.TLS != nil, true)
+
+		redirect := "/"
+		if referer, err := url.Parse(c.Request.Referer()); err == nil && referer.Host == c.Request.Host {
+			redirect = referer.RequestURI()
+		}
+		c.Redirect(http.StatusSeeOther, redirect)
+	})
+
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	// List the announcements that are shown or scheduled.
+	admin.GET("/announcements", func(c *gin.Context) {
+		list, err := ListAnnouncements(time.Now().UTC().Unix())
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"announcements": list,
+		})
+	})
+
+	admin.POST("/announcements", func(c *gin.Context) {
+		a := &Announcement{
+			Message:     strings.TrimSpace(c.PostForm("message")),
+			Level:       c.DefaultPostForm("level", "info"),
+			Dismissible: c.DefaultPostForm("dismissible", "true") == "true",
+			CreatedBy:   currentAccount(c).Username,
+		}
+		if a.Message == "" {
+			respondError(c, http.StatusBadRequest, errors.New(`a "message" is required`))
+			return
+		}
+		if a.Level != "info" && a.Level != "warning" {
+			respondError(c, http.StatusBadRequest, errors.New(`"level" must be "info" or "warning"`))
+			return
+		}
+		var err error
+		if a.StartsAt, err = parseAnnouncementTime(c, "starts_at"); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if a.EndsAt, err = parseAnnouncementTime(c, "ends_at"); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if a.EndsAt != 0 && a.EndsAt <= a.StartsAt {
+			respondError(c, http.StatusBadRequest, errors.New(`"ends_at" must be after "starts_at"`))
+			return
+		}
+
+		if err = CreateAnnouncement(a); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(a.CreatedBy, "announcement.create", strconv.FormatInt(a.Id, 10), a.Message, c.ClientIP())
+		if err = loadAnnouncements(); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, a)
+	})
+
+	admin.DELETE("/announcements/:id", func(c *gin.Context) {
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		found, err := DeleteAnnouncement(id)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if !found {
+			respondError(c, http.StatusNotFound, errors.New("announcement not found"))
+			return
+		}
+		RecordAudit(currentAccount(c).Username, "announcement.delete", c.Param("id"), "", c.ClientIP())
+		if err = loadAnnouncements(); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Announcement deleted",
+		})
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	archiveRetrievalDays = 7             // How long a retrieved copy of an archived object stays readable.
+	archiveBatchSize     = 500           // Uploads archived per run of the archive job.
+	archiveRetryAfter    = 5 * time.Hour // Standard Glacier retrievals take 3 to 5 hours.
+)
+
+var ErrArchiveRetrieving = errors.New("this attachment is being retrieved from the archive; it will be available to download within a few hours")
+
+// ErrArchiveRestricted is answered to downloads of an archived attachment by anyone who may not start retrieving it.
+var ErrArchiveRestricted = errors.New("this attachment is archived; the owner of the upload can request it to have it retrieved")
+
+// archiveAfter is the age at which the attachments of uploads are moved to archive storage, or 0 to never archive.
+var archiveAfter time.Duration
+
+// s3StorageClass reads the storage class of new S3 objects from S3_STORAGE_CLASS, e.g. STANDARD_IA or
+// INTELLIGENT_TIERING. When it is unset the bucket's default is used.
+func s3StorageClass() (types.StorageClass, error) {
+	class := types.StorageClass(os.Getenv("S3_STORAGE_CLASS"))
+	if class != "" && !slices.Contains(class.Values(), class) {
+		return "", fmt.Errorf("unknown S3_STORAGE_CLASS %q, expected one of %v", class, class.Values())
+	}
+	return class, nil
+}
+
+func initArchive() {
+	archiveAfter = time.Duration(envInt64("ARCHIVE_AFTER_DAYS", 0)) * 24 * time.Hour
+	if archiveAfter == 0 {
+		return
+	}
+	store := objectStore
+	if replicated, ok := store.(replicatedStore); ok {
+		store = replicated.primary
+	}
+	if _, ok := store.(ArchivingStore); !ok {
+		log.Fatalf("ARCHIVE_AFTER_DAYS is set, but the %v object store cannot archive", objectStore)
+	}
+
+	RegisterJob(&Job{
+		Name:     "archive",
+		Interval: 6 * time.Hour,
+		Run:      archiveOldUploads,
+	})
+}
+
+// archiveOldUploads moves the attachments of uploads older than archiveAfter to archive storage.
+func archiveOldUploads(ctx context.Context) error {
+	store := objectStore.(ArchivingStore)
+	rows, err := db.QueryContext(ctx, "SELECT "+uploadColumns+` FROM Uploads
+		WHERE NOT archived AND deleted_at = 0 AND cardinality(files) > 0 AND timestamp < $1 ORDER BY timestamp LIMIT $2`,
+		time.Now().Add(-archiveAfter).UTC().Unix(), archiveBatchSize)
+	if err != nil {
+		return err
+	}
+	var uploads []*UploadModel
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		uploads = append(uploads, upload)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, upload := range uploads {
+		for _, key := range upload.FileHashes {
+			if err = store.Archive(ctx, key); err != nil {
+				return fmt.Errorf("failed to archive %v of upload %v: %v", key, upload.Hash, err)
+			}
+		}
+		if _, err = db.ExecContext(ctx, "UPDATE Uploads SET archived = TRUE WHERE hash = $1", upload.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retrieveArchived starts retrieving an archived object from store, if it can archive at all. Commands that read every
+// object, like backups, leave archived ones out and start retrieving them, so that running them again once the
+// retrievals finish includes them.
+func retrieveArchived(ctx context.Context, store ObjectStore, key string) error {
+	archiving, ok := store.(ArchivingStore)
+	if !ok {
+		return nil
+	}
+	if err := archiving.Retrieve(ctx, key); err != nil {
+		return fmt.Errorf("failed to retrieve %v from the archive: %v", key, err)
+	}
+	return nil
+}
+
+// mayRetrieve reports whether the request may start retrieving an archived object. Every retrieval is paid for, so
+// only moderators and the owners of the uploads with the object may, and not whoever follows a link to it.
+func mayRetrieve(c *gin.Context, key string) (bool, error) {
+	if currentAccount(c).HasRole(RoleModerator) {
+		return true, nil
+	}
+	rows, err := db.QueryContext(c.Request.Context(), `SELECT hash FROM Uploads
+		WHERE EXISTS(SELECT 1 FROM unnest(files) AS f WHERE substring(f from '[^/]*$') = $1) OR body_key = $1`, key)
+	if err != nil {
+		return false, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	for _, hash := range hashes {
+		if upload, err := GetUpload(hash); err == nil && upload.IsOwner(c) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// respondArchived starts retrieving an archived attachment and tells the client to come back once it is available.
+// Requests by anyone but its owners and moderators are refused instead; see mayRetrieve.
+func respondArchived(c *gin.Context, hash string) {
+	allowed, err := mayRetrieve(c, hash)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	} else if !allowed {
+		respondError(c, http.StatusForbidden, ErrArchiveRestricted)
+		return
+	}
+	if err = retrieveArchived(c.Request.Context(), objectStore, hash); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Header("Retry-After", fmt.Sprint(int(archiveRetryAfter.Seconds())))
+	respondError(c, http.StatusServiceUnavailable, ErrArchiveRetrieving)
+}
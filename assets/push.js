@@ -0,0 +1,25 @@
+// The service worker that shows Web Push messages as notifications; see webpush.go. Pages subscribe through
+// subscribeToPush, and clicking a notification opens the page it is about.
+
+self.addEventListener("push", (event) => {
+    const message = event.data ? event.data.json() : {};
+    event.waitUntil(self.registration.showNotification(message.title || "Copycat", {
+        body: message.body || "",
+        tag: message.tag,
+        data: { url: message.url || "/" },
+    }));
+});
+
+self.addEventListener("notificationclick", (event) => {
+    event.notification.close();
+    event.waitUntil((async () => {
+        let url = event.notification.data.url;
+        // The history of a clip channel is opened with the key this browser subscribed with, which the page kept.
+        const keys = await caches.open("copycat-clip-keys");
+        const key = await keys.match(url);
+        if (key) {
+            url += "?key=" + encodeURIComponent(await key.text());
+        }
+        return clients.openWindow(url);
+    })());
+});
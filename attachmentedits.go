@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// The owners of an upload can add attachments to it and remove them after it was submitted, for example to replace a
+// log with a newer one. Every change is recorded as a revision of the upload, with what changed and who changed it.
+// Added attachments count against the quota of the upload's owner like the ones it was submitted with, and objects
+// that no upload refers to anymore once an attachment is removed are deleted from storage. Uploads under review or
+// taken down cannot be changed.
+
+var (
+	ErrUploadLocked  = errors.New("this upload is held for review and cannot be changed")
+	ErrNoAttachments = errors.New(`at least one file is required in "files"`)
+)
+
+// An UploadRevision is a change made to an upload after it was submitted.
+type UploadRevision struct {
+	Revision int64
+	Action   string // "add_file" or "remove_file".
+	Name     string
+	Key      string
+	Actor    string // The username of the account that made the change, or "anonymous" for edit tokens.
+	Created  int64
+}
+
+// uploadQuota returns the quota that attachments added to an upload count against, which is the one it was submitted
+// under.
+func uploadQuota(ctx context.Context, upload *UploadModel) (*Quota, error) {
+	var ip string
+	if err := db.QueryRowContext(ctx, "SELECT uploader_ip FROM Uploads WHERE hash = $1", upload.Hash).Scan(&ip); err != nil {
+		return nil, err
+	}
+	var account *Account
+	var team *Team
+	if upload.AccountId != 0 {
+		account = &Account{Id: upload.AccountId}
+	}
+	if upload.TeamId != 0 {
+		team = &Team{Id: upload.TeamId}
+	}
+	return GetQuota(ip, account, team)
+}
+
+// changeAttachments replaces the attachments of an upload with what change makes of them, in one transaction with the
+// revisions recorded for it, and returns the number of the last revision. The size of the upload grows by delta.
+func changeAttachments(ctx context.Context, hash string, delta int64, change func(files []string) ([]string,
+	[]UploadRevision, error)) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var files []string
+	if err = tx.QueryRowContext(ctx, "SELECT files FROM Uploads WHERE hash = $1 FOR UPDATE", hash).
+		Scan((*pq.StringArray)(&files)); err != nil {
+		return 0, err
+	}
+	files, revisions, err := change(files)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE Uploads SET files = $1, size = GREATEST(size + $2, 0) WHERE hash = $3",
+		(*pq.StringArray)(&files), delta, hash); err != nil {
+		return 0, err
+	}
+	var revision int64
+	if err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(revision), 0) FROM UploadRevisions WHERE upload_hash = $1",
+		hash).Scan(&revision); err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC().Unix()
+	for _, r := range revisions {
+		revision++
+		if _, err = tx.ExecContext(ctx, `INSERT INTO UploadRevisions(upload_hash, revision, action, name, key, actor, created)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`, hash, revision, r.Action, r.Name, r.Key, r.Actor, now); err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	invalidateUpload(hash)
+	return revision, nil
+}
+
+// AddAttachments appends stored attachments, given as "filename/objectkey" pairs of the given total size, to an upload
+// on behalf of actor.
+func AddAttachments(ctx context.Context, upload *UploadModel, pairs []string, size int64, actor string) (int64, error) {
+	revision, err := changeAttachments(ctx, upload.Hash, size, func(files []string) ([]string, []UploadRevision, error) {
+		revisions := make([]UploadRevision, len(pairs))
+		for i, pair := range pairs {
+			name := fileName(pair)
+			revisions[i] = UploadRevision{Action: "add_file", Name: name, Key: fileKey(pair), Actor: actor}
+		}
+		return append(files, pairs...), revisions, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revision, reapplyObjectRules(ctx, upload.Hash)
+}
+
+// RemoveAttachment removes the first attachment of an upload stored as key on behalf of actor, and deletes its object
+// from storage when no upload refers to it anymore. Archived attachments cannot be removed until they are retrieved,
+// as their size, which is refunded to the quota, cannot be read before; ErrObjectArchived is returned for them.
+func RemoveAttachment(ctx context.Context, upload *UploadModel, key string, actor string) (int64, error) {
+	// The size of the file as downloaded is what the upload was charged for it.
+	var size int64
+	if file, contents, err := OpenFileObject(ctx, key); err == nil {
+		contents.Close()
+		size = file.Size
+	} else if errors.Is(err, ErrObjectArchived) {
+		return 0, err
+	} else {
+		log.Printf("failed to read the size of attachment %v: %v", key, err)
+	}
+
+	var name string
+	revision, err := changeAttachments(ctx, upload.Hash, -size, func(files []string) ([]string, []UploadRevision, error) {
+		for i, pair := range files {
+			if fileKey(pair) == key {
+				name = fileName(pair)
+				revision := UploadRevision{Action: "remove_file", Name: name, Key: key, Actor: actor}
+				return append(files[:i:i], files[i+1:]...), []UploadRevision{revision}, nil
+			}
+		}
+		return nil, nil, ErrAttachmentNotFound
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = reapplyObjectRules(ctx, upload.Hash); err != nil {
+		return revision, err
+	}
+
+	// The object is only deleted if no upload refers to it anymore, which is checked while holding its lock so that a
+	// submission cannot start to reuse it meanwhile.
+	if _, err = deleteObjects(ctx, &UploadModel{FileHashes: []string{key}}, nil); err != nil {
+		return revision, err
+	}
+	purgeCDN(ctx, &UploadModel{Hash: upload.Hash, FileNames: []string{name}, FileHashes: []string{key}})
+	return revision, nil
+}
+
+// reapplyObjectRules applies the country rule and watermarks of an upload to its attachments again after they changed.
+func reapplyObjectRules(ctx context.Context, hash string) error {
+	upload, err := GetUpload(hash)
+	if err != nil {
+		return err
+	}
+	if upload.GeoRule.Allow != nil || upload.GeoRule.Deny != nil {
+		if err = SetUploadGeoRule(ctx, upload, upload.GeoRule); err != nil {
+			return err
+		}
+	}
+	if upload.Watermark {
+		return SetUploadWatermark(ctx, upload, true)
+	}
+	return nil
+}
+
+// ListRevisions returns the changes made to an upload after it was submitted, the newest first.
+func ListRevisions(ctx context.Context, hash string) ([]UploadRevision, error) {
+	rows, err := db.QueryContext(ctx, `SELECT revision, action, name, key, actor, created FROM UploadRevisions
+		WHERE upload_hash = $1 ORDER BY revision DESC`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := []UploadRevision{}
+	for rows.Next() {
+		var r UploadRevision
+		if err = rows.Scan(&r.Revision, &r.Action, &r.Name, &r.Key, &r.Actor, &r.Created); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+func registerAttachmentEditRoutes(r *gin.Engine) {
+	// editableUpload returns the upload of the request if it was made by its owner and may be changed, or nil after
+	// responding with an error.
+	editableUpload := func(c *gin.Context) *UploadModel {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return nil
+		}
+		if upload.TakedownAt != 0 {
+			respondError(c, http.StatusUnavailableForLegalReasons, errors.New("this upload has been taken down"))
+			return nil
+		} else if upload.QuarantinedAt != 0 {
+			respondError(c, http.StatusConflict, ErrUploadLocked)
+			return nil
+		}
+		return upload
+	}
+	// actorName names who changes an upload in its revisions.
+	actorName := func(c *gin.Context) string {
+		if account := currentAccount(c); account != nil {
+			return account.Username
+		}
+		return "anonymous"
+	}
+
+	// Add the files of a multipart form to an upload, like they are submitted with it.
+	r.POST("/api/v1/uploads/:hash/files", meterUsage, rateLimit(PolicySubmit), limitConcurrency(submitConcurrency),
+		limitRequestBody(maxSubmitSize), func(c *gin.Context) {
+			upload := editableUpload(c)
+			if upload == nil {
+				return
+			}
+			form, err := c.MultipartForm()
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				respondTooLarge(c, -1, maxSubmitSize)
+				return
+			} else if err != nil {
+				respondError(c, http.StatusBadRequest, fmt.Errorf("invalid multipart form: %v", err))
+				return
+			}
+			fileHeaders := form.File["files"]
+			if len(fileHeaders) == 0 {
+				respondError(c, http.StatusBadRequest, ErrNoAttachments)
+				return
+			}
+			var size int64
+			for _, fileHeader := range fileHeaders {
+				size += fileHeader.Size
+			}
+			if size > maxUploadSize {
+				respondTooLarge(c, size, maxUploadSize)
+				return
+			}
+			if !checkTerms(c, c.PostForm("accept_terms") == "on") {
+				return
+			}
+			// Hooks may refuse the files as they would refuse them when submitted with the upload.
+			preSubmit := HookPayload{Event: HookPreSubmit, Hash: upload.Hash, Size: size, Private: upload.Private}
+			for _, fileHeader := range fileHeaders {
+				preSubmit.Files = append(preSubmit.Files, fileHeader.Filename)
+			}
+			if !checkHooks(c, &preSubmit) {
+				return
+			}
+			quota, err := uploadQuota(c.Request.Context(), upload)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			if err = quota.Check(size); err != nil {
+				respondError(c, http.StatusRequestEntityTooLarge, err)
+				return
+			}
+
+			clientChecksums := form.Value["sha256"]
+			if len(clientChecksums) != 0 && len(clientChecksums) != len(fileHeaders) {
+				respondError(c, http.StatusBadRequest, errors.New(`one "sha256" value is required per file, empty for files without one`))
+				return
+			}
+
+			keepMetadata := c.PostForm("keep_metadata") == "on"
+			pairs := make([]string, len(fileHeaders))
+			objects := make([][]byte, len(fileHeaders))
+			checksums := make([]string, len(fileHeaders))
+			var secrets []SecretFinding
+			for i, fileHeader := range fileHeaders {
+				fileObject, err := NewFileObject(fileHeader, time.Now())
+				if err != nil {
+					respondError(c, http.StatusInternalServerError, fmt.Errorf("failed to open file %q: %v", fileHeader.Filename, err))
+					return
+				}
+				if len(clientChecksums) != 0 && clientChecksums[i] != "" && !strings.EqualFold(clientChecksums[i], sha256Hex(fileObject.Contents)) {
+					respondError(c, http.StatusBadRequest, fmt.Errorf("%q does not match its SHA-256, it was corrupted in transit", fileHeader.Filename))
+					return
+				}
+				secrets = append(secrets, scanSecrets(fileHeader.Filename, fileObject.Contents)...)
+				pairs[i], objects[i], checksums[i], err = encodeAttachment(fileObject, stripMetadata.Load() && !keepMetadata, upload.salted())
+				if err != nil {
+					respondError(c, http.StatusBadRequest, err)
+					return
+				}
+			}
+			if !checkSecrets(c, secrets, c.PostForm("confirm_secrets") == "on") {
+				return
+			}
+			if err = storeAttachments(c.Request.Context(), upload.Hash, upload.AccountId, pairs, objects, checksums); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+
+			actor := actorName(c)
+			revision, err := AddAttachments(c.Request.Context(), upload, pairs, size, actor)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			RecordAudit(actor, "upload.add_files", upload.Hash, fmt.Sprintf("revision %d", revision), c.ClientIP())
+			notifyUploadWatchers(upload, "Attachments were added.")
+			if upload, err = GetUpload(upload.Hash); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"revision": revision,
+				"files":    uploadJSON(upload)["files"],
+				"sha256":   checksums,
+			})
+		})
+
+	// Remove an attachment from an upload by the hash it is stored under.
+	r.DELETE("/api/v1/uploads/:hash/files/:key", func(c *gin.Context) {
+		upload := editableUpload(c)
+		if upload == nil {
+			return
+		}
+		actor := actorName(c)
+		key := strings.ToLower(c.Param("key"))
+		revision, err := RemoveAttachment(c.Request.Context(), upload, key, actor)
+		if err == ErrAttachmentNotFound {
+			respondError(c, http.StatusNotFound, err)
+			return
+		} else if errors.Is(err, ErrObjectArchived) {
+			respondArchived(c, key)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(actor, "upload.remove_file", upload.Hash, fmt.Sprintf("revision %d", revision), c.ClientIP())
+		notifyUploadWatchers(upload, "An attachment was removed.")
+		c.JSON(http.StatusOK, gin.H{
+			"revision": revision,
+		})
+	})
+
+	// List the changes made to an upload by its owners.
+	r.GET("/api/v1/uploads/:hash/revisions", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		revisions, err := ListRevisions(c.Request.Context(), upload.Hash)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		list := make([]gin.H, len(revisions))
+		for i, r := range revisions {
+			list[i] = gin.H{
+				"revision": r.Revision,
+				"action":   r.Action,
+				"name":     r.Name,
+				"hash":     r.Key,
+				"actor":    r.Actor,
+				"created":  time.Unix(r.Created, 0).UTC().Format(time.RFC3339),
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"revisions": list,
+		})
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// stripMetadata removes EXIF and other metadata from uploaded images unless the submitter opts out.
+var stripMetadata atomic.Bool
+
+// encodeAttachment prepares an uploaded file for storage: metadata is stripped from images when strip is set, and the
+// contents are compressed and encoded. It returns the "filename/objectkey" pair stored with the upload, the encoded
+// object and the SHA-256 of the file contents as stored. The key is salted when salted is set; see attachmentKey. Errors
+// are caused by the file and can be shown to the uploader.
+func encodeAttachment(fileObject *FileObject, strip, salted bool) (pair string, object []byte, checksum string, err error) {
+	// Remove location and camera information from images before they are stored.
+	if strip {
+		contents, stripped, err := StripMetadata(fileObject.Contents)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("failed to strip metadata from %q: %v", fileObject.Filename, err)
+		}
+		if stripped {
+			fileObject.Contents = contents
+			fileObject.Size = int64(len(contents))
+		}
+	}
+
+	checksum = sha256Hex(fileObject.Contents)
+	name := strings.TrimSpace(fileObject.Filename)
+	var salt string
+	if salted {
+		salt = randomToken()
+	}
+	key := attachmentKey(name, fileObject.Contents, salt)
+	fileObject.Compress()
+
+	// Encode the FileObject for storage.
+	object, err = EncodeFileObject(fileObject)
+	if err != nil {
+		return "", nil, "", err
+	}
+	return fmt.Sprintf("%s/%s", name, key), object, checksum, nil
+}
+
+// attachmentKey returns the key an attachment is stored under, which is also used to retrieve the upload in the
+// database. Only the name and contents are hashed, and not the time of the upload stored with them, so the same file
+// uploaded again has the same key and its object is reused. Anyone holding a file can compute that key, though, and
+// confirm that an upload contains it by requesting /f/, so the attachments of private, embargoed, team and expiring
+// uploads are hashed with a salt that ends their key and are never reused.
+func attachmentKey(name string, contents []byte, salt string) string {
+	h := sha1.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(contents)
+	if salt != "" {
+		h.Write([]byte{0})
+		h.Write([]byte(salt))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)) + salt
+}
+
+// keySalt returns the salt at the end of a salted attachment key, or "" when the key is not salted.
+func keySalt(key string) string {
+	if len(key) > sha1.Size*2 {
+		return key[sha1.Size*2:]
+	}
+	return ""
+}
+
+// objectReservation is how long an object stored or reused for a submission is kept from being deleted, which is
+// ample time for the upload that refers to it to be added to the database.
+const objectReservation = time.Hour
+
+// storeAttachments puts the encoded attachments of an upload in the object store, tagged with the upload they belong
+// to, and records their checksums so that /api/v1/files/:hash/verify can detect corruption in storage later.
+func storeAttachments(ctx context.Context, hash string, accountId int64, pairs []string, objects [][]byte, checksums []string) error {
+	tags := uploadObjectTags(hash, accountId, time.Time{})
+	var stored []string
+	defer func() { requestVirusScan(stored) }()
+	for i, pair := range pairs {
+		// The same file uploaded before is stored already, and keeps its time and record.
+		key := fileKey(pair)
+		reused, err := reserveObject(ctx, key, tags, func() error {
+			if err := objectStore.Put(ctx, key, objects[i], tags); err != nil {
+				return err
+			}
+			return recordObject(ctx, key, objectStore, sha256Hex(objects[i]), len(objects[i]), checksums[i])
+		})
+		if err != nil {
+			return fmt.Errorf("object upload failed: %v", err)
+		}
+		if !reused {
+			stored = append(stored, key)
+		}
+	}
+	return nil
+}
+
+// lockObjects holds the locks of keys until tx ends. Objects are only reused and deleted while their lock is held, so
+// that no upload starts to share an object while it is being deleted. Keys are locked in order to avoid deadlocks.
+func lockObjects(ctx context.Context, tx *sql.Tx, keys []string) error {
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	for _, key := range slices.Compact(sorted) {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtextextended('object/' || $1, 0))", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveObject calls put to store the object under key, unless it is stored already and is reused instead, and
+// reserves it for objectReservation so that it is not deleted before the upload being submitted refers to it. A reused
+// object is tagged for the new upload, as its tags may be those of an upload in the trash, which lifecycle rules
+// expire. It returns whether the object was reused.
+func reserveObject(ctx context.Context, key string, tags ObjectTags, put func() error) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if err = lockObjects(ctx, tx, []string{key}); err != nil {
+		return false, err
+	}
+
+	reserve := func() (bool, error) {
+		result, err := tx.ExecContext(ctx, "UPDATE Objects SET reserved_until = $1 WHERE key = $2",
+			time.Now().Add(objectReservation).UTC().Unix(), key)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n == 1, err
+	}
+	// Only recorded objects are reused, as the reservation is kept with their record.
+	exists, err := objectStore.Exists(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	var reused bool
+	if exists {
+		if reused, err = reserve(); err != nil {
+			return false, err
+		}
+	}
+	if reused {
+		err = objectStore.SetTags(ctx, key, tags)
+	} else if err = put(); err == nil {
+		_, err = reserve()
+	}
+	if err != nil {
+		return false, err
+	}
+	return reused, tx.Commit()
+}
+
+// sharedObjectKeys returns which of keys an upload other than the one with hash refers to, or a submission has
+// reserved. Uploads of the same file share its object, and uploads of the same large body share the object holding it.
+func sharedObjectKeys(ctx context.Context, q querier, hash string, keys []string) (map[string]bool, error) {
+	rows, err := q.QueryContext(ctx, `SELECT DISTINCT substring(f from '[^/]*$') FROM Uploads, unnest(files) AS f
+		WHERE hash <> $1 AND substring(f from '[^/]*$') = ANY($2)
+		UNION SELECT body_key FROM Uploads WHERE hash <> $1 AND body_key = ANY($2)
+		UNION SELECT key FROM Objects WHERE key = ANY($2) AND reserved_until > $3`,
+		hash, pq.Array(keys), time.Now().UTC().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shared := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		shared[key] = true
+	}
+	return shared, rows.Err()
+}
+
+// exclusiveObjectKeys returns the keys of the objects of an upload that no other upload references, which are the ones
+// that may be deleted or tagged along with it.
+func exclusiveObjectKeys(ctx context.Context, upload *UploadModel) ([]string, error) {
+	keys := upload.objectKeys()
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	shared, err := sharedObjectKeys(ctx, db, upload.Hash, keys)
+	if err != nil {
+		return nil, err
+	}
+	exclusive := keys[:0:0]
+	for _, key := range keys {
+		if !shared[key] {
+			exclusive = append(exclusive, key)
+		}
+	}
+	return exclusive, nil
+}
+
+// deleteObjects deletes the objects of an upload that no other upload references, and then calls remove, if not nil,
+// to remove the upload in the same transaction, returning the keys of the objects deleted. The keys are locked while they are
+// checked and deleted, so that a submission cannot start to share one of them meanwhile. If deleting the objects fails,
+// the upload is kept, still referring to every object it had, so that deleting them can be tried again.
+func deleteObjects(ctx context.Context, upload *UploadModel, remove func(tx *sql.Tx) error) ([]string, error) {
+	keys := upload.objectKeys()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err = lockObjects(ctx, tx, keys); err != nil {
+		return nil, err
+	}
+	shared, err := sharedObjectKeys(ctx, tx, upload.Hash, keys)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, key := range keys {
+		if !shared[key] && !slices.Contains(deleted, key) {
+			deleted = append(deleted, key)
+		}
+	}
+	if len(deleted) > 0 {
+		if err = objectStore.Delete(ctx, deleted); err != nil {
+			return nil, err
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM Objects WHERE key = ANY($1)", pq.Array(deleted)); err != nil {
+			return nil, err
+		}
+	}
+	if remove != nil {
+		if err = remove(tx); err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	mediaCache.Remove(deleted...)
+	return deleted, nil
+}
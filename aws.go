@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/textproto"
-	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -17,24 +21,32 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
-var s3Actions S3Actions
-var s3Bucket string
+var (
+	awsConfig     aws.Config
+	awsConfigOnce sync.Once
+)
 
-func initAWS() {
-	s3Bucket = os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET variable not set")
-	}
+// NewS3Actions creates the S3 clients for a region, or for the region of the default AWS configuration when region is
+// empty. It is called by OpenStore for every S3 store.
+func NewS3Actions(region string) S3Actions {
+	awsConfigOnce.Do(func() {
+		// Initialize the Amazon Web Services SDK.
+		var err error
+		awsConfig, err = config.LoadDefaultConfig(context.TODO())
+		if err != nil {
+			log.Fatal("Could not load default AWS configuration:", err)
+		}
+		awsConfig.HTTPClient = countingHTTPClient{awsConfig.HTTPClient} // Collect the S3 statistics shown at /debug/vars.
+	})
 
-	// Initialize the Amazon Web Services SDK.
-	sdkConfig, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		log.Fatal("Could not load default AWS configuration:", err)
+	sdkConfig := awsConfig.Copy()
+	if region != "" {
+		sdkConfig.Region = region
 	}
-
-	s3Actions = S3Actions{
+	return S3Actions{
 		S3Client: s3.NewFromConfig(sdkConfig),
 		S3Manager: manager.NewUploader(s3.NewFromConfig(sdkConfig), func(u *manager.Uploader) {
 			// Define a strategy that will buffer the maximum upload size for files.
@@ -43,15 +55,22 @@ func initAWS() {
 	}
 }
 
-// A FileObject is the structure we store in the S3 bucket. We encode the structure as a gob before uploading.
+// A FileObject is the structure we store in the S3 bucket. We encode the structure as a gob before uploading, followed
+// by the contents themselves so that they can be streamed; see EncodeFileObject.
 type FileObject struct {
 	Filename string
 	Header   textproto.MIMEHeader
 	Size     int64
 	Modtime  time.Time // Last modified
 	Contents []byte
+
+	Compression string // "zstd" if Contents are compressed, or empty. Size is always the uncompressed size.
+	Trailing    bool   // The contents follow the encoded FileObject instead of being part of it.
 }
 
+// objectBufferSize bounds the memory used to stream an object to a client.
+const objectBufferSize = 64 * 1024
+
 // NewFileObject creates a FileObject by opening and reading the fields from a multipart FileHeader uploaded by a user.
 func NewFileObject(fileHeader *multipart.FileHeader, modtime time.Time) (*FileObject, error) {
 	object := new(FileObject)
@@ -73,6 +92,209 @@ func NewFileObject(fileHeader *multipart.FileHeader, modtime time.Time) (*FileOb
 	return object, nil
 }
 
+// ContentType returns the MIME type the file was uploaded with, falling back to a guess from the filename extension.
+func (f *FileObject) ContentType() string {
+	if contentType := f.Header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+	return mime.TypeByExtension(filepath.Ext(f.Filename))
+}
+
+// GetFileObject fetches the attachment stored under the hash key and decodes it into a FileObject.
+func GetFileObject(hash string) (*FileObject, error) {
+	data, err := objectStore.Get(context.TODO(), hash)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := DecodeFileObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object %v: %v", hash, err)
+	}
+	return file, nil
+}
+
+// OpenFileObject opens the attachment stored under the hash key for streaming. The returned FileObject has no
+// Contents; they are read from the returned reader instead, which the caller must close.
+func OpenFileObject(ctx context.Context, hash string) (*FileObject, io.ReadCloser, error) {
+	r, err := objectStore.Open(ctx, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, contents, _, err := readFileObject(r)
+	if err != nil {
+		r.Close()
+		return nil, nil, fmt.Errorf("failed to decode object %v: %v", hash, err)
+	}
+	return file, contents, nil
+}
+
+// SeekFileObject opens the attachment stored under the hash key like OpenFileObject, but returns a reader of its
+// contents that can seek, for answering Range requests. Seeking reads no more of the object than the ranges need when
+// its contents are stored uncompressed; see objectReader.
+func SeekFileObject(ctx context.Context, hash string) (*FileObject, io.ReadSeekCloser, error) {
+	r, err := objectStore.Open(ctx, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, contents, start, err := readFileObject(r)
+	if err != nil {
+		r.Close()
+		return nil, nil, fmt.Errorf("failed to decode object %v: %v", hash, err)
+	}
+	return file, &objectReader{ctx: ctx, key: hash, size: file.Size, start: start, body: contents}, nil
+}
+
+// An objectReader reads the contents of an attachment from wherever it was seeked to. Contents stored as they are
+// start at a known offset of the object, so they are read with a ranged request from the store; compressed contents
+// are decompressed from the start, skipping what comes before the offset.
+type objectReader struct {
+	ctx    context.Context
+	key    string
+	size   int64
+	start  int64         // The offset of the contents in the object, or -1 if they cannot be read from an offset.
+	offset int64         // Of the next read.
+	body   io.ReadCloser // Reads from pos, or nil when nothing has been opened.
+	pos    int64
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil || r.offset < r.pos || r.offset > r.pos && r.start >= 0 {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.offset > r.pos {
+		n, err := io.CopyN(io.Discard, r.body, r.offset-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	r.offset = r.pos
+	return n, err
+}
+
+// open starts reading the contents again, from the offset if the store can and from their start otherwise.
+func (r *objectReader) open() error {
+	r.Close()
+	if r.start < 0 {
+		_, contents, err := OpenFileObject(r.ctx, r.key)
+		if err != nil {
+			return err
+		}
+		r.body, r.pos = contents, 0
+		return nil
+	}
+	body, err := openObjectAt(r.ctx, objectStore, r.key, r.start+r.offset)
+	if err != nil {
+		return err
+	}
+	r.body, r.pos = body, r.offset
+	return nil
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the attachment")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// EncodeFileObject encodes a FileObject for storage. The gob of its fields is followed by the raw contents, so that
+// downloads can copy them to the client as they arrive instead of decoding the whole object first.
+func EncodeFileObject(f *FileObject) ([]byte, error) {
+	header := *f
+	header.Contents = nil
+	header.Trailing = true
+
+	buffer := new(bytes.Buffer)
+	if err := gob.NewEncoder(buffer).Encode(&header); err != nil {
+		return nil, err
+	}
+	buffer.Write(f.Contents)
+	return buffer.Bytes(), nil
+}
+
+// DecodeFileObject decodes the data of a stored object into a FileObject with its original contents.
+func DecodeFileObject(data []byte) (*FileObject, error) {
+	file, contents, _, err := readFileObject(io.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	defer contents.Close()
+	if file.Contents, err = io.ReadAll(contents); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// readFileObject decodes the FileObject at the start of a stored object and returns a reader of its original
+// contents, which closes r when it is closed, and the offset at which the object holds them as they are, or -1 when
+// they are compressed or inside the encoded FileObject.
+func readFileObject(r io.ReadCloser) (*FileObject, io.ReadCloser, int64, error) {
+	// The decoder reads exactly one value from an io.ByteReader, leaving any trailing contents in the buffer.
+	counted := &countingReader{ReadCloser: r}
+	buffered := bufio.NewReaderSize(counted, objectBufferSize)
+	file := new(FileObject)
+	if err := gob.NewDecoder(buffered).Decode(file); err != nil {
+		return nil, nil, 0, err
+	}
+	start := int64(-1)
+	if file.Trailing && file.Compression == "" {
+		start = counted.n - int64(buffered.Buffered())
+	}
+
+	var contents io.Reader = buffered
+	if !file.Trailing {
+		// Objects stored before contents were written after the encoded FileObject hold them inside it.
+		contents = bytes.NewReader(file.Contents)
+		file.Contents = nil
+	}
+	file.Trailing = false
+
+	decompressed, err := newDecompressor(contents, file.Compression)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	file.Compression = ""
+	return file, streamCloser{decompressed, func() error {
+		decompressed.Close()
+		return r.Close()
+	}}, start, nil
+}
+
+// streamCloser reads from a stream and calls close when it is closed.
+type streamCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (s streamCloser) Close() error {
+	return s.close()
+}
+
 // S3Actions wraps S3 service actions.
 type S3Actions struct {
 	S3Client  *s3.Client
@@ -83,13 +305,18 @@ type S3Actions struct {
 // The upload manager breaks large data into parts and uploads the parts concurrently.
 //
 // Code modified from: https://docs.aws.amazon.com/code-library/latest/ug/go_2_s3_code_examples.html#heading:r4v:
-func (actor S3Actions) UploadObject(ctx context.Context, bucket string, key string, contents []byte) (string, error) {
+// An empty storageClass uses the bucket's default. The tags are URL query encoded, as in "key1=value1&key2=value2".
+func (actor S3Actions) UploadObject(ctx context.Context, bucket string, key string, contents []byte, storageClass types.StorageClass, tags string) (string, error) {
 	var outKey string
 	input := &s3.PutObjectInput{
 		Bucket:            aws.String(bucket),
 		Key:               aws.String(key),
 		Body:              bytes.NewReader(contents),
 		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		StorageClass:      storageClass,
+	}
+	if tags != "" {
+		input.Tagging = aws.String(tags)
 	}
 	output, err := actor.S3Manager.Upload(ctx, input)
 	if err != nil {
@@ -127,7 +354,107 @@ func (actor S3Actions) DownloadLargeObject(bucketName string, objectKey string)
 		Key:    aws.String(objectKey),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to download large object %v: %v", objectKey, err)
+		return nil, fmt.Errorf("failed to download large object %v: %w", objectKey, err)
 	}
 	return buffer.Bytes(), err
 }
+
+// OpenObject starts downloading an object and returns its body, which the caller must close. Unlike
+// DownloadLargeObject, the object is read from the network as the body is read instead of being buffered in memory.
+// The body starts offset bytes into the object.
+func (actor S3Actions) OpenObject(ctx context.Context, bucket string, key string, offset int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	output, err := actor.S3Client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object %v: %w", key, err)
+	}
+	return output.Body, nil
+}
+
+// ObjectExists reports whether an object exists in a bucket.
+func (actor S3Actions) ObjectExists(ctx context.Context, bucket string, key string) (bool, error) {
+	_, err := actor.S3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PutObjectTags replaces the tags of an object.
+func (actor S3Actions) PutObjectTags(ctx context.Context, bucket string, key string, tags map[string]string) error {
+	tagSet := make([]types.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err := actor.S3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+// ArchiveObject moves an object to the Glacier Flexible Retrieval storage class by copying it onto itself.
+func (actor S3Actions) ArchiveObject(ctx context.Context, bucket string, key string) error {
+	_, err := actor.S3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(bucket + "/" + key),
+		StorageClass:      types.StorageClassGlacier,
+		MetadataDirective: types.MetadataDirectiveCopy,
+	})
+	return err
+}
+
+// RestoreArchivedObject requests a temporary copy of an archived object, readable for the given number of days once
+// the retrieval finishes. Requesting a retrieval that is already in progress is not an error.
+func (actor S3Actions) RestoreArchivedObject(ctx context.Context, bucket string, key string, days int32) error {
+	_, err := actor.S3Client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(days),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: types.TierStandard},
+		},
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
+
+// DeleteObjects deletes objects from a bucket. S3 accepts up to 1000 keys per request, so larger lists are split.
+func (actor S3Actions) DeleteObjects(ctx context.Context, bucket string, keys []string) error {
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 1000)]
+		keys = keys[len(batch):]
+
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		output, err := actor.S3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %v", err)
+		}
+		if len(output.Errors) > 0 {
+			e := output.Errors[0]
+			return fmt.Errorf("failed to delete %d objects, first %v: %v", len(output.Errors), aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A backupRow is a complete row of the Uploads table, as written to uploads.jsonl in a backup archive.
+type backupRow struct {
+	Hash             string   `json:"hash"`
+	Body             string   `json:"body"`
+	Files            []string `json:"files"` // filename/objectkey pairs.
+	Timestamp        int64    `json:"timestamp"`
+	Private          bool     `json:"private"`
+	EditToken        string   `json:"edit_token"` // Only the SHA-256 of the token.
+	ShareSecret      string   `json:"share_secret"`
+	PublishAt        int64    `json:"publish_at"`
+	UploaderIP       string   `json:"uploader_ip"`
+	Size             int64    `json:"size"`
+	AccountId        int64    `json:"account_id"`
+	TeamId           int64    `json:"team_id"`
+	TakedownReason   string   `json:"takedown_reason"`
+	TakedownAt       int64    `json:"takedown_at"`
+	DeletedAt        int64    `json:"deleted_at"`
+	BodyZstd         []byte   `json:"body_zstd,omitempty"` // The body compressed with zstd, in which case Body is empty.
+	ExpiresAt        int64    `json:"expires_at"`
+	BodyKey          string   `json:"body_key,omitempty"` // The object holding the body, in which case Body is empty.
+	Language         string   `json:"language,omitempty"`
+	ShortLength      int      `json:"short_length,omitempty"`
+	ShortAlphabet    string   `json:"short_alphabet,omitempty"`
+	GeoAllow         string   `json:"geo_allow,omitempty"` // Comma-separated country codes; see geo.go.
+	GeoDeny          string   `json:"geo_deny,omitempty"`
+	Watermark        bool     `json:"watermark,omitempty"`
+	QuarantineReason string   `json:"quarantine_reason,omitempty"`
+	QuarantinedAt    int64    `json:"quarantined_at,omitempty"`
+	DuplicateOf      string   `json:"duplicate_of,omitempty"`
+	Archived         bool     `json:"archived,omitempty"` // Its attachments are in archive storage; see archive.go.
+	LastAccessed     int64    `json:"last_accessed,omitempty"`
+	DeletedBy        string   `json:"deleted_by,omitempty"`
+}
+
+const backupColumns = "hash, body, files, timestamp, private, edit_token, share_secret, publish_at, uploader_ip, size, " +
+	"account_id, team_id, takedown_reason, takedown_at, deleted_at, body_zstd, expires_at, body_key, language, short_length, " +
+	"short_alphabet, geo_allow, geo_deny, watermark, quarantine_reason, quarantined_at, duplicate_of, archived, last_accessed, " +
+	"deleted_by"
+
+// fileKey returns the object key of a filename/objectkey pair.
+func fileKey(pair string) string {
+	return pair[strings.LastIndexByte(pair, '/')+1:]
+}
+
+// fileName returns the filename of a filename/objectkey pair. Keys never contain a slash, but filenames may.
+func fileName(pair string) string {
+	return pair[:max(strings.LastIndexByte(pair, '/'), 0)]
+}
+
+// BackupStats summarize what a backup or restore copied.
+type BackupStats struct {
+	Uploads, Objects int
+	Skipped          int      // Uploads or objects that already existed when restoring.
+	Archived         []string // Objects left out of a backup because they are archived; their retrieval was started.
+}
+
+// Backup writes a gzipped tar archive of every upload and the stored objects of its attachments and body to w. The objects come
+// first, under objects/<key>, followed by uploads.jsonl with one row of the Uploads table per line, so that a restore
+// never creates an upload before its attachments.
+func Backup(ctx context.Context, w io.Writer) (*BackupStats, error) {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	stats := new(BackupStats)
+
+	rows, err := db.QueryContext(ctx, "SELECT "+backupColumns+" FROM Uploads ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var index []backupRow
+	written := make(map[string]bool)
+	for rows.Next() {
+		var row backupRow
+		if err = rows.Scan(&row.Hash, &row.Body, (*pq.StringArray)(&row.Files), &row.Timestamp, &row.Private,
+			&row.EditToken, &row.ShareSecret, &row.PublishAt, &row.UploaderIP, &row.Size, &row.AccountId, &row.TeamId,
+			&row.TakedownReason, &row.TakedownAt, &row.DeletedAt, &row.BodyZstd, &row.ExpiresAt, &row.BodyKey, &row.Language,
+			&row.ShortLength, &row.ShortAlphabet, &row.GeoAllow, &row.GeoDeny, &row.Watermark, &row.QuarantineReason,
+			&row.QuarantinedAt, &row.DuplicateOf, &row.Archived, &row.LastAccessed, &row.DeletedBy); err != nil {
+			return nil, err
+		}
+		index = append(index, row)
+
+		keys := make([]string, len(row.Files))
+		for i, pair := range row.Files {
+			keys[i] = fileKey(pair)
+		}
+		if row.BodyKey != "" {
+			keys = append(keys, row.BodyKey)
+		}
+		for _, key := range keys {
+			if written[key] {
+				continue
+			}
+			data, err := objectStore.Get(ctx, key)
+			if errors.Is(err, ErrObjectArchived) {
+				if err = retrieveArchived(ctx, objectStore, key); err != nil {
+					return nil, err
+				}
+				written[key] = true
+				stats.Archived = append(stats.Archived, key)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if err = writeTarFile(archive, "objects/"+key, data); err != nil {
+				return nil, err
+			}
+			written[key] = true
+			stats.Objects++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var jsonl strings.Builder
+	encoder := json.NewEncoder(&jsonl)
+	for _, row := range index {
+		if err = encoder.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+	if err = writeTarFile(archive, "uploads.jsonl", []byte(jsonl.String())); err != nil {
+		return nil, err
+	}
+	stats.Uploads = len(index)
+
+	if err = archive.Close(); err != nil {
+		return nil, err
+	}
+	return stats, gz.Close()
+}
+
+func writeTarFile(archive *tar.Writer, name string, data []byte) error {
+	err := archive.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(data)
+	return err
+}
+
+// Restore reads an archive written by Backup, uploading its objects to the configured store and inserting its
+// uploads. Objects and uploads that already exist are left alone, so an interrupted restore can simply be repeated.
+func Restore(ctx context.Context, r io.Reader) (*BackupStats, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %v", err)
+	}
+	archive := tar.NewReader(gz)
+	stats := new(BackupStats)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if key, ok := strings.CutPrefix(header.Name, "objects/"); ok {
+			exists, err := objectStore.Exists(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				stats.Skipped++
+				continue
+			}
+			data, err := io.ReadAll(archive)
+			if err != nil {
+				return nil, err
+			}
+			if err = objectStore.Put(ctx, key, data, nil); err != nil {
+				return nil, err
+			}
+			stats.Objects++
+			continue
+		}
+
+		if header.Name != "uploads.jsonl" {
+			return nil, fmt.Errorf("unexpected file %v in backup archive", header.Name)
+		}
+		decoder := json.NewDecoder(archive)
+		for {
+			var row backupRow
+			if err = decoder.Decode(&row); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if row.Language == "" {
+				row.Language = "text" // Backups from before languages were recorded.
+			}
+			if row.ShortLength == 0 {
+				row.ShortLength = minShortHash // Backups from before short hashes were tuned.
+			}
+			if row.ShortAlphabet == "" {
+				row.ShortAlphabet = hexAlphabet.Name // Backups from before the alphabet could be chosen.
+			}
+			result, err := db.ExecContext(ctx, "INSERT INTO Uploads("+backupColumns+`)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24,
+					$25, $26, $27, $28, $29, $30) ON CONFLICT (hash) DO NOTHING`,
+				row.Hash, row.Body, (*pq.StringArray)(&row.Files), row.Timestamp, row.Private, row.EditToken,
+				row.ShareSecret, row.PublishAt, row.UploaderIP, row.Size, row.AccountId, row.TeamId,
+				row.TakedownReason, row.TakedownAt, row.DeletedAt, row.BodyZstd, row.ExpiresAt, row.BodyKey, row.Language,
+				row.ShortLength, row.ShortAlphabet, row.GeoAllow, row.GeoDeny, row.Watermark, row.QuarantineReason,
+				row.QuarantinedAt, row.DuplicateOf, row.Archived, row.LastAccessed, row.DeletedBy)
+			if err != nil {
+				return nil, fmt.Errorf("failed to restore upload %v: %v", row.Hash, err)
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				stats.Skipped++
+				continue
+			}
+			stats.Uploads++
+			if row.GeoAllow != "" || row.GeoDeny != "" || row.Watermark || row.QuarantinedAt != 0 {
+				if err = restoreObjectRules(ctx, row.Hash); err != nil {
+					return nil, fmt.Errorf("failed to restore upload %v: %v", row.Hash, err)
+				}
+			}
+		}
+	}
+	if stats.Uploads+stats.Objects+stats.Skipped == 0 {
+		return nil, errors.New("the backup archive is empty")
+	}
+	return stats, nil
+}
+
+// restoreObjectRules applies the country rule, watermark and quarantine of a restored upload to its attachments again,
+// as the tables that apply them to downloads are not part of the backup.
+func restoreObjectRules(ctx context.Context, hash string) error {
+	upload, err := scanUpload(db.QueryRowContext(ctx, "SELECT "+uploadColumns+" FROM Uploads WHERE hash = $1", hash))
+	if err != nil {
+		return err
+	}
+	if upload.GeoRule.Allow != nil || upload.GeoRule.Deny != nil {
+		if err = SetUploadGeoRule(ctx, upload, upload.GeoRule); err != nil {
+			return err
+		}
+	}
+	if upload.Watermark {
+		if err = SetUploadWatermark(ctx, upload, true); err != nil {
+			return err
+		}
+	}
+	if upload.QuarantinedAt != 0 {
+		keys, err := exclusiveObjectKeys(ctx, upload)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, err = db.ExecContext(ctx, `INSERT INTO QuarantinedObjects(key, upload_hash) VALUES ($1, $2)
+				ON CONFLICT DO NOTHING`, key, upload.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
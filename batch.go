@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchSize is how many hashes a batch request may name, so that one request cannot tie up the database for long.
+const maxBatchSize = 100
+
+var ErrBatchSize = fmt.Errorf("a batch must name between 1 and %v hashes", maxBatchSize)
+
+// batchRequest is the body of the batch endpoints.
+type batchRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+// bindBatch reads the hashes of a batch request. On failure an error has been sent and nil is returned.
+func bindBatch(c *gin.Context) []string {
+	var request batchRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return nil
+	}
+	if len(request.Hashes) == 0 || len(request.Hashes) > maxBatchSize {
+		respondError(c, http.StatusBadRequest, ErrBatchSize)
+		return nil
+	}
+	return request.Hashes
+}
+
+// batchResult describes the outcome for one hash of a batch, with the status code the single request would have had.
+func batchResult(c *gin.Context, hash string, status int, err error) gin.H {
+	result := gin.H{
+		"hash":   hash,
+		"status": status,
+	}
+	if err != nil {
+		result["code"] = errorCode(status, err)
+		result["message"] = translate(requestLanguage(c), err.Error())
+	}
+	return result
+}
+
+// batchUpload fetches an upload of a batch, or returns the status and error to report for it instead.
+func batchUpload(hash string) (*UploadModel, int, error) {
+	if !isUploadID(hash) {
+		return nil, http.StatusBadRequest, ErrHashInvalid
+	}
+	upload, err := GetUpload(hash)
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, ErrUploadNotFound
+	} else if err == ErrHashInvalid {
+		return nil, http.StatusBadRequest, err
+	} else if err != nil {
+		log.Printf("failed to fetch upload %v for a batch: %v", hash, err)
+		return nil, http.StatusInternalServerError, errors.New("the upload could not be fetched")
+	}
+	return upload, http.StatusOK, nil
+}
+
+// canView reports whether the request may read an upload through the API: public uploads that are published and not
+// quarantined are readable by anyone, team uploads by the members of the team, and every upload by its owner.
+func (upload *UploadModel) canView(c *gin.Context) (bool, error) {
+	if upload.IsOwner(c) {
+		return true, nil
+	}
+	if !upload.Published() || !upload.allowsCountry(c) || upload.hiddenByQuarantine(c) {
+		return false, nil
+	}
+	if upload.TeamId != 0 {
+		team, err := GetTeamByID(fmt.Sprint(upload.TeamId))
+		if err == sql.ErrNoRows {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		role, err := team.Role(currentAccount(c))
+		return role != "", err
+	}
+	return !upload.Private, nil
+}
+
+// uploadJSON describes an upload and its attachments for API clients.
+func uploadJSON(upload *UploadModel) gin.H {
+	files := make([]gin.H, len(upload.FileNames))
+	for i, attachment := range upload.Attachments() {
+		files[i] = gin.H{
+			"name": attachment.Name,
+			"hash": attachment.Key,
+			"url":  attachment.DownloadURL(),
+		}
+	}
+	described := gin.H{
+		"hash":      upload.Hash,
+		"body":      upload.Body,
+		"files":     files,
+		"timestamp": time.Unix(upload.Timestamp, 0).UTC().Format(time.RFC3339),
+		"private":   upload.Private,
+		"language":  upload.Language,
+	}
+	if upload.QuarantinedAt != 0 {
+		described["quarantine"] = gin.H{
+			"reason":         upload.QuarantineReason,
+			"quarantined_at": time.Unix(upload.QuarantinedAt, 0).UTC().Format(time.RFC3339),
+		}
+	}
+	if upload.DuplicateOf != "" {
+		described["duplicate_of"] = upload.DuplicateOf
+	}
+	if upload.ExpiresAt != 0 {
+		described["expires_at"] = time.Unix(upload.ExpiresAt, 0).UTC().Format(time.RFC3339)
+	}
+	return described
+}
+
+func registerBatchRoutes(r *gin.Engine) {
+	// Fetch many uploads at once. Every hash gets a result of its own, so one missing upload does not fail the batch;
+	// uploads the requester may not view are reported as missing, like on their pages.
+	r.POST("/api/v1/uploads/batch-get", func(c *gin.Context) {
+		hashes := bindBatch(c)
+		if hashes == nil {
+			return
+		}
+		results := make([]gin.H, len(hashes))
+		for i, hash := range hashes {
+			hash = strings.ToLower(hash)
+			upload, status, err := batchUpload(hash)
+			if err != nil {
+				results[i] = batchResult(c, hash, status, err)
+				continue
+			}
+			visible, err := upload.canView(c)
+			if err != nil {
+				log.Printf("failed to check access to upload %v for a batch: %v", hash, err)
+				results[i] = batchResult(c, hash, http.StatusInternalServerError, errors.New("the upload could not be fetched"))
+				continue
+			} else if !visible {
+				results[i] = batchResult(c, hash, http.StatusNotFound, ErrUploadNotFound)
+				continue
+			}
+			if upload.TakedownAt != 0 {
+				results[i] = batchResult(c, hash, http.StatusUnavailableForLegalReasons, errors.New("this upload has been taken down"))
+				continue
+			}
+			results[i] = batchResult(c, hash, http.StatusOK, nil)
+			results[i]["upload"] = uploadJSON(upload)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"results": results,
+		})
+	})
+
+	// Delete many uploads at once as their owner, moving them to the trash like deleting them one by one.
+	r.POST("/api/v1/uploads/batch-delete", func(c *gin.Context) {
+		hashes := bindBatch(c)
+		if hashes == nil {
+			return
+		}
+		results := make([]gin.H, len(hashes))
+		for i, hash := range hashes {
+			hash = strings.ToLower(hash)
+			upload, status, err := batchUpload(hash)
+			if err != nil {
+				results[i] = batchResult(c, hash, status, err)
+				continue
+			}
+			if !upload.IsOwner(c) {
+				results[i] = batchResult(c, hash, http.StatusForbidden, ErrNotUploadOwner)
+				continue
+			}
+			payload := &HookPayload{Event: HookPreDelete, Hash: upload.Hash, Files: upload.FileNames, Private: upload.Private}
+			if status, err = requestHooks(c, payload); err != nil {
+				results[i] = batchResult(c, hash, status, err)
+				continue
+			}
+			if err = TrashUpload(c.Request.Context(), upload, ""); err != nil {
+				log.Printf("failed to delete upload %v for a batch: %v", hash, err)
+				results[i] = batchResult(c, hash, http.StatusInternalServerError, errors.New("the upload could not be deleted"))
+				continue
+			}
+			results[i] = batchResult(c, hash, http.StatusOK, nil)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"results": results,
+		})
+	})
+}
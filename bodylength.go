@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBodyLength is the longest text body in bytes that an upload may have, or 0 for no limit other than the size of
+// the request. Longer bodies are refused, unless the submitter asks to keep only their end, which is the part that
+// matters in most log dumps.
+var maxBodyLength int64
+
+// truncationPreviewLength is how much of the start of a truncated body is shown to submitters before they agree to it.
+const truncationPreviewLength = 1024
+
+var ErrKeepLast = errors.New(`"keep_last_kb" must be a positive number of KiB`)
+
+func initBodyLength() {
+	maxBodyLength = envInt64("MAX_BODY_BYTES", 0)
+	if maxBodyLength < 0 {
+		log.Fatal("MAX_BODY_BYTES environment variable must not be negative")
+	}
+}
+
+// parseKeepLast reads how many KiB from the end of a body the submitter wants to keep when it is too long, and returns
+// it in bytes, never more than the maximum body length. An empty value returns 0: long bodies are refused instead.
+func parseKeepLast(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	kb, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || kb < 1 || kb > math.MaxInt64/1024 {
+		return 0, ErrKeepLast
+	}
+	keep := kb * 1024
+	if maxBodyLength != 0 && keep > maxBodyLength {
+		keep = maxBodyLength
+	}
+	return keep, nil
+}
+
+// truncateBody keeps at most keep bytes of the end of a body, starting after a line telling that the beginning was cut
+// off. The cut is moved forward to the start of the next line when one is close, so that the first line kept is
+// whole. It returns the body, unchanged when it is short enough, and how many bytes of it were cut off.
+func truncateBody(body string, keep int64) (string, int64) {
+	if keep == 0 || int64(len(body)) <= keep {
+		return body, 0
+	}
+	marker := fmt.Sprintf("[Truncated: only the end of %s of text was kept]\n", formatBytes(int64(len(body))))
+	tail := body[len(body)-int(max(keep-int64(len(marker)), 0)):]
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	if i := strings.IndexByte(tail, '\n'); i >= 0 && i < len(tail)/2 {
+		tail = tail[i+1:]
+	}
+	return marker + tail, int64(len(body) - len(tail))
+}
+
+// truncationPreview returns the start of what would be kept of a body when it is truncated to keep bytes.
+func truncationPreview(body string, keep int64) string {
+	truncated, _ := truncateBody(body, keep)
+	if len(truncated) <= truncationPreviewLength {
+		return truncated
+	}
+	preview := truncated[:truncationPreviewLength]
+	for len(preview) > 0 && !utf8.RuneStart(truncated[len(preview)]) {
+		preview = preview[:len(preview)-1]
+	}
+	return preview
+}
+
+// bodyTooLongError returns the error of a body of size bytes over the maximum body length.
+func bodyTooLongError(size int64) error {
+	return &codedError{"body_too_long", fmt.Sprintf(
+		"The text is %s, but at most %s of text can be uploaded. Upload it as a file, or keep only its end.",
+		formatBytes(size), formatBytes(maxBodyLength))}
+}
+
+// limitBodyLength truncates a body longer than the maximum body length to its last keep bytes, or refuses it when keep
+// is 0. The preview of the truncation is sent with the refusal, so that the submitter can decide to keep the end of
+// the body instead. On refusal false is returned.
+func limitBodyLength(c *gin.Context, body string, keep int64) (string, int64, bool) {
+	if keep == 0 && maxBodyLength != 0 && int64(len(body)) > maxBodyLength {
+		abortWithError(c, http.StatusRequestEntityTooLarge, bodyTooLongError(int64(len(body))), gin.H{
+			"max_bytes":          maxBodyLength,
+			"truncation_preview": truncationPreview(body, maxBodyLength),
+		})
+		return body, 0, false
+	}
+	truncated, cut := truncateBody(body, keep)
+	return truncated, cut, true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSubmitSize is the largest request accepted by /submit: the attachments, the text body and the multipart encoding
+// around them.
+const maxSubmitSize = maxUploadSize + 3*1024*1024
+
+// limitRequestBody refuses requests with a body over limit bytes. Requests that announce a larger Content-Length are
+// answered right away, before any of the body is read, and the body of the others is cut off at the limit so that a
+// handler reading it gets an *http.MaxBytesError instead of buffering whatever the client keeps sending.
+func limitRequestBody(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			respondTooLarge(c, c.Request.ContentLength, limit)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// respondTooLarge answers 413 with a message that can be shown to the uploader as is, and the limit in max_bytes so
+// that clients can check the size of uploads themselves. A size of -1 means the size is unknown.
+func respondTooLarge(c *gin.Context, size int64, limit int64) {
+	// The rest of the body is not read, so the connection cannot be reused.
+	c.Header("Connection", "close")
+	abortWithError(c, http.StatusRequestEntityTooLarge, tooLargeError(size, limit), gin.H{
+		"max_bytes": limit,
+	})
+}
+
+// tooLargeError returns the error of an upload of size bytes over the limit. A size of -1 means the size is unknown.
+func tooLargeError(size int64, limit int64) error {
+	message := fmt.Sprintf("The upload is too large. At most %s can be uploaded at once; remove or compress some files and try again.",
+		formatBytes(limit))
+	if size >= 0 {
+		message = fmt.Sprintf("The upload is %s, but at most %s can be uploaded at once; remove or compress some files and try again.",
+			formatBytes(size), formatBytes(limit))
+	}
+	return &codedError{"upload_too_large", message}
+}
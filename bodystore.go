@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// bodyObjectThreshold is the size in bytes above which upload bodies, such as huge log pastes, are stored as objects
+// in the object store instead of in the database, or 0 to keep every body in the database. Such uploads only keep the
+// key of the object in their body_key column.
+var bodyObjectThreshold int64
+
+// bodyObjectPrefix starts the keys of body objects, which are the SHA-256 of the body, so that they never collide with
+// the keys of attachments and can be told apart from them.
+const bodyObjectPrefix = "body-"
+
+func initBodyObjects() {
+	bodyObjectThreshold = envInt64("BODY_OBJECT_THRESHOLD_BYTES", 0)
+	if bodyObjectThreshold < 0 {
+		log.Fatal("BODY_OBJECT_THRESHOLD_BYTES environment variable must not be negative")
+	}
+}
+
+// storeBody stores the body of an upload as an object if it is over the threshold, and returns its key, or "" when
+// the body belongs in the database. The object is always compressed with zstd, as text compresses well. The same body
+// submitted before is stored already, and its object is reused.
+func storeBody(ctx context.Context, hash string, body string, accountId int64) (string, error) {
+	if bodyObjectThreshold == 0 || int64(len(body)) <= bodyObjectThreshold {
+		return "", nil
+	}
+	key := bodyObjectPrefix + sha256Hex([]byte(body))
+	tags := uploadObjectTags(hash, accountId, time.Time{})
+	_, err := reserveObject(ctx, key, tags, func() error {
+		compressed := zstdEncoder.EncodeAll([]byte(body), make([]byte, 0, len(body)/2))
+		if err := objectStore.Put(ctx, key, compressed, tags); err != nil {
+			return err
+		}
+		return recordObject(ctx, key, objectStore, sha256Hex(compressed), len(compressed), "")
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store the body of upload %v: %v", hash, err)
+	}
+	return key, nil
+}
+
+// loadBody reads the body of an upload from the object store if it is stored there.
+func (upload *UploadModel) loadBody(ctx context.Context) error {
+	if upload.bodyKey == "" {
+		return nil
+	}
+	data, err := objectStore.Get(ctx, upload.bodyKey)
+	if err != nil {
+		return fmt.Errorf("failed to read the body of upload %v: %v", upload.Hash, err)
+	}
+	body, err := decompress(data)
+	if err != nil {
+		return fmt.Errorf("failed to read the body of upload %v: %v", upload.Hash, err)
+	}
+	upload.Body = string(body)
+	return nil
+}
+
+// objectKeys returns the keys of every object of an upload: its attachments, and its body if it is stored as one.
+func (upload *UploadModel) objectKeys() []string {
+	if upload.bodyKey == "" {
+		return upload.FileHashes
+	}
+	return append(upload.FileHashes[:len(upload.FileHashes):len(upload.FileHashes)], upload.bodyKey)
+}
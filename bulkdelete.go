@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admins clean up spam waves and free storage by deleting every upload that matches some criteria at once, from the
+// API or the command line, after listing what would be deleted with a dry run. Uploads go to the trash like any other
+// deletion, unless they are purged. The text of uploads can be stored compressed or as an object, so the regular
+// expression is matched here rather than by the database, after the other criteria narrowed the uploads down.
+
+var (
+	ErrBulkCriteria  = errors.New("at least one of older_than, larger_than, ip and match is required")
+	ErrBulkOlderThan = errors.New(`"older_than" must be a duration like "12h" or a number of days like "30d"`)
+	ErrBulkIP        = errors.New(`"ip" must be an IP address or a network like 203.0.113.0/24`)
+)
+
+// DeleteCriteria select the uploads of a bulk deletion. Uploads must match all of the criteria that are set.
+type DeleteCriteria struct {
+	OlderThan  time.Duration  // Uploaded longer ago than this.
+	LargerThan int64          // More bytes of text and attachments than this.
+	IP         netip.Prefix   // Uploaded from an address in this network.
+	Match      *regexp.Regexp // Matching the text or the name of an attachment.
+}
+
+// String describes the criteria for the audit log.
+func (criteria *DeleteCriteria) String() string {
+	var parts []string
+	if criteria.OlderThan != 0 {
+		parts = append(parts, "older than "+criteria.OlderThan.String())
+	}
+	if criteria.LargerThan != 0 {
+		parts = append(parts, "larger than "+formatBytes(criteria.LargerThan))
+	}
+	if criteria.IP.IsValid() {
+		parts = append(parts, "from "+criteria.IP.String())
+	}
+	if criteria.Match != nil {
+		parts = append(parts, "matching "+strconv.Quote(criteria.Match.String()))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseDeleteCriteria reads the criteria of a bulk deletion as they are written in requests and command line flags.
+func parseDeleteCriteria(olderThan string, largerThan int64, ip, match string) (*DeleteCriteria, error) {
+	criteria := &DeleteCriteria{LargerThan: max(largerThan, 0)}
+	if olderThan != "" {
+		var err error
+		if days, ok := strings.CutSuffix(olderThan, "d"); ok {
+			var n int64
+			n, err = strconv.ParseInt(days, 10, 64)
+			criteria.OlderThan = time.Duration(n) * 24 * time.Hour
+		} else {
+			criteria.OlderThan, err = time.ParseDuration(olderThan)
+		}
+		if err != nil || criteria.OlderThan <= 0 {
+			return nil, ErrBulkOlderThan
+		}
+	}
+	if ip != "" {
+		var err error
+		if strings.Contains(ip, "/") {
+			criteria.IP, err = netip.ParsePrefix(ip)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(ip)
+			criteria.IP = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, ErrBulkIP
+		}
+		criteria.IP = criteria.IP.Masked()
+	}
+	if match != "" {
+		var err error
+		if criteria.Match, err = regexp.Compile(match); err != nil {
+			return nil, fmt.Errorf(`"match" is not a valid regular expression: %v`, err)
+		}
+	}
+	if criteria.OlderThan == 0 && criteria.LargerThan == 0 && !criteria.IP.IsValid() && criteria.Match == nil {
+		return nil, ErrBulkCriteria
+	}
+	return criteria, nil
+}
+
+// A bulkCandidate is an upload that passed the criteria checked by the database.
+type bulkCandidate struct {
+	*UploadModel
+	ip   string
+	size int64
+}
+
+// scanFunc adapts a function to the rowScanner interface.
+type scanFunc func(dest ...any) error
+
+func (f scanFunc) Scan(dest ...any) error { return f(dest...) }
+
+// matches reports whether an upload that passed the criteria checked by the database matches the others.
+func (criteria *DeleteCriteria) matches(ctx context.Context, upload bulkCandidate) (bool, error) {
+	if criteria.IP.IsValid() {
+		addr, err := netip.ParseAddr(upload.ip)
+		if err != nil || !criteria.IP.Contains(addr.Unmap()) {
+			return false, nil
+		}
+	}
+	if criteria.Match == nil {
+		return true, nil
+	}
+	for _, name := range upload.FileNames {
+		if criteria.Match.MatchString(name) {
+			return true, nil
+		}
+	}
+	if err := upload.loadBody(ctx); err != nil {
+		return false, err
+	}
+	return criteria.Match.MatchString(upload.Body), nil
+}
+
+// A BulkDeleteProgress reports on one upload of a bulk deletion.
+type BulkDeleteProgress struct {
+	Done      int    `json:"done"` // Uploads handled so far, including this one.
+	Total     int    `json:"total"`
+	Hash      string `json:"hash"`
+	Size      int64  `json:"size"`
+	Timestamp int64  `json:"timestamp"`
+	Status    string `json:"status"` // "matched" in dry runs, otherwise "deleted" or "failed".
+	Error     string `json:"error,omitempty"`
+}
+
+// BulkDeleteStats sums up a bulk deletion.
+type BulkDeleteStats struct {
+	Matched int      `json:"matched"`
+	Deleted int      `json:"deleted"`
+	Failed  int      `json:"failed"`
+	Bytes   int64    `json:"bytes"` // Size of the uploads matched.
+	DryRun  bool     `json:"dry_run"`
+	Skipped []string `json:"skipped"` // Uploads whose text could not be read to be matched.
+}
+
+// BulkDelete moves the uploads matching criteria to the trash, or deletes them for good with purge, and records each in
+// the audit log for actor. With dryRun, nothing is changed. report is called after each upload. Uploads that fail to be
+// matched or deleted are skipped.
+func BulkDelete(ctx context.Context, criteria *DeleteCriteria, purge, dryRun bool, actor, ip string,
+	report func(BulkDeleteProgress)) (*BulkDeleteStats, error) {
+	var before int64
+	if criteria.OlderThan != 0 {
+		before = time.Now().Add(-criteria.OlderThan).UTC().Unix()
+	}
+	rows, err := db.QueryContext(ctx, "SELECT uploader_ip, size, "+uploadColumns+` FROM Uploads
+		WHERE deleted_at = 0 AND ($1 = 0 OR timestamp < $1) AND ($2 = 0 OR size > $2) ORDER BY id`,
+		before, criteria.LargerThan)
+	if err != nil {
+		return nil, err
+	}
+	stats := &BulkDeleteStats{DryRun: dryRun}
+	var matched []bulkCandidate
+	for rows.Next() {
+		var upload bulkCandidate
+		upload.UploadModel, err = scanUpload(scanFunc(func(dest ...any) error {
+			return rows.Scan(append([]any{&upload.ip, &upload.size}, dest...)...)
+		}))
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ok, err := criteria.matches(ctx, upload)
+		if err != nil {
+			log.Printf("Skipped %s: %v", upload.Hash, err)
+			stats.Skipped = append(stats.Skipped, upload.Hash)
+			continue
+		}
+		upload.Body = "" // Only kept while matching, as there may be many uploads.
+		if ok {
+			matched = append(matched, upload)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	action := "upload.delete"
+	if purge {
+		action = "upload.purge"
+	}
+	stats.Matched = len(matched)
+	for i, upload := range matched {
+		if err = ctx.Err(); err != nil {
+			return stats, err
+		}
+		progress := BulkDeleteProgress{Done: i + 1, Total: len(matched), Hash: upload.Hash, Size: upload.size,
+			Timestamp: upload.Timestamp, Status: "matched"}
+		stats.Bytes += upload.size
+		if !dryRun {
+			// Hooks may refuse to have single uploads deleted, which fails those alone.
+			err = RunHooks(ctx, &HookPayload{Event: HookPreDelete, Hash: upload.Hash, Files: upload.FileNames,
+				Private: upload.Private, IP: ip})
+			if err == nil && purge {
+				_, _, err = PurgeUpload(ctx, upload.Hash)
+			} else if err == nil {
+				err = TrashUpload(ctx, upload.UploadModel, actor)
+			}
+			if err != nil {
+				RecordAudit(actor, action, upload.Hash, "failed: "+err.Error(), ip)
+				progress.Status, progress.Error = "failed", err.Error()
+				stats.Failed++
+			} else {
+				RecordAudit(actor, action, upload.Hash, "bulk: "+criteria.String(), ip)
+				progress.Status = "deleted"
+				stats.Deleted++
+			}
+		}
+		report(progress)
+	}
+	if !dryRun {
+		RecordAudit(actor, "upload.bulk_delete", "", fmt.Sprintf("%s: %d deleted, %d failed", criteria, stats.Deleted,
+			stats.Failed), ip)
+	}
+	return stats, nil
+}
+
+// bulkDeleteRequest is the body of POST /api/v1/admin/uploads/bulk-delete. Requests are dry runs unless they set
+// "dry_run": false or "confirm": true, so that criteria matching more than meant delete nothing by mistake.
+type bulkDeleteRequest struct {
+	OlderThan  string `json:"older_than"`
+	LargerThan int64  `json:"larger_than"`
+	IP         string `json:"ip"`
+	Match      string `json:"match"`
+	Purge      bool   `json:"purge"`
+	DryRun     *bool  `json:"dry_run"`
+	Confirm    bool   `json:"confirm"`
+}
+
+// dryRun reports whether the request only lists what it would delete.
+func (request *bulkDeleteRequest) dryRun() bool {
+	if request.DryRun != nil {
+		return *request.DryRun
+	}
+	return !request.Confirm
+}
+
+func registerBulkDeleteRoutes(r *gin.Engine) {
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	// Delete the uploads matching some criteria. The progress is streamed as one JSON object per line for each upload,
+	// followed by the totals, so that deleting many uploads does not look like a request that hangs.
+	admin.POST("/uploads/bulk-delete", func(c *gin.Context) {
+		var request bulkDeleteRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		criteria, err := parseDeleteCriteria(request.OlderThan, request.LargerThan, request.IP, request.Match)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		account := currentAccount(c)
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		out := json.NewEncoder(c.Writer)
+		stats, err := BulkDelete(c.Request.Context(), criteria, request.Purge, request.dryRun(), account.Username,
+			c.ClientIP(), func(progress BulkDeleteProgress) {
+				out.Encode(progress)
+				c.Writer.Flush()
+			})
+		// The status was sent already, so a failure is told in the last line.
+		if err != nil {
+			out.Encode(errorBody(c, http.StatusInternalServerError, err, nil))
+			return
+		}
+		out.Encode(gin.H{"done": true, "stats": stats})
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An upload can be downloaded whole as a gzipped tar archive, which Unix tools extract and scripts restore from without
+// anything else. The archive holds a folder named after the short hash of the upload, with its text in body.txt, the
+// signed manifest in manifest.json to check the rest against, and the attachments in files/. It is written to the
+// client as the attachments are read, so large uploads need no memory or disk on the server. Attachments that cannot
+// be downloaded on their own, because they are archived, infected, held back by a hook or refused for any other reason
+// /f/ would refuse them for, are left out and listed in missing.txt, and so are watermarked images.
+
+// bundleAttachmentPath returns where an attachment goes in a bundle. path.Base keeps names from escaping the folder
+// when the archive is extracted, and the position of the attachment tells apart those with the same name.
+func bundleAttachmentPath(dir string, i int, name string, seen map[string]bool) string {
+	name = path.Base(name)
+	if seen[name] {
+		name = fmt.Sprintf("%d-%s", i+1, name)
+	}
+	seen[name] = true
+	return dir + "/files/" + name
+}
+
+// withheldAttachment returns why the attachment stored under key is left out of a bundle or export for the request c,
+// or "" when it may be included. These are the checks that serveAttachment refuses single downloads for.
+func withheldAttachment(c *gin.Context, key string) (string, error) {
+	ctx := c.Request.Context()
+	if !allowDownload(c, key) {
+		return "linked from another site, download it from the upload page", nil
+	}
+	if takenDown, err := objectTakenDown(ctx, key); err != nil {
+		return "", err
+	} else if takenDown {
+		return "taken down", nil
+	}
+	if ok, err := allowObjectCountry(c, key); err != nil {
+		return "", err
+	} else if !ok {
+		return "not available in your country", nil
+	}
+	if hidden, err := hiddenAttachment(c, key); err != nil {
+		return "", err
+	} else if hidden {
+		return "not available", nil
+	}
+	if infected, err := attachmentInfected(ctx, key); err != nil {
+		return "", err
+	} else if infected && !currentAccount(c).HasRole(RoleModerator) {
+		return "contains malware", nil
+	}
+	if _, err := requestHooks(c, &HookPayload{Event: HookPreDownload, Object: key}); err != nil {
+		return "not available", nil
+	}
+	return "", nil
+}
+
+// writeBundleFile adds a file with the given contents to a tar archive.
+func writeBundleFile(archive *tar.Writer, name string, contents []byte, modtime time.Time) error {
+	if err := archive.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(contents)),
+		ModTime: modtime,
+	}); err != nil {
+		return err
+	}
+	_, err := archive.Write(contents)
+	return err
+}
+
+// WriteBundle writes the gzipped tar archive of an upload to w, for the request c that downloads it.
+func WriteBundle(c *gin.Context, upload *UploadModel, w io.Writer) error {
+	ctx := c.Request.Context()
+	dir := upload.ShortHash()
+	created := time.Unix(upload.Timestamp, 0)
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	if err := writeBundleFile(archive, dir+"/body.txt", []byte(upload.Body), created); err != nil {
+		return err
+	}
+	// Uploads with archived attachments have no manifest until they are restored.
+	if manifest, err := NewManifest(ctx, upload); err == nil {
+		data, _ := json.MarshalIndent(manifest, "", "  ")
+		if err = writeBundleFile(archive, dir+"/manifest.json", append(data, '\n'), created); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, ErrObjectArchived) {
+		return err
+	}
+
+	var missing []string
+	seen := make(map[string]bool)
+	for i, attachment := range upload.Attachments() {
+		if reason, err := withheldAttachment(c, attachment.Key); err != nil {
+			return err
+		} else if reason != "" {
+			missing = append(missing, attachment.Name+": "+reason)
+			continue
+		}
+		watermarked, err := isWatermarked(ctx, attachment.Key)
+		if err != nil {
+			return err
+		}
+		file, contents, err := OpenFileObject(ctx, attachment.Key)
+		if errors.Is(err, ErrObjectArchived) {
+			missing = append(missing, attachment.Name+": archived, restore it to download it")
+			continue
+		} else if err != nil {
+			return err
+		}
+		// Watermarked images are only sent with the watermark of each download.
+		r := bufio.NewReader(contents)
+		if _, image := imageMediaType(file, r); watermarked && image {
+			contents.Close()
+			missing = append(missing, attachment.Name+": watermarked, download it from the upload page")
+			continue
+		}
+		err = archive.WriteHeader(&tar.Header{
+			Name:    bundleAttachmentPath(dir, i, attachment.Name, seen),
+			Mode:    0644,
+			Size:    file.Size,
+			ModTime: file.Modtime,
+		})
+		if err == nil {
+			_, err = io.Copy(archive, r)
+		}
+		contents.Close()
+		if err != nil {
+			return fmt.Errorf("failed to bundle attachment %v: %v", attachment.Key, err)
+		}
+	}
+	if len(missing) != 0 {
+		if err := writeBundleFile(archive, dir+"/missing.txt", []byte(strings.Join(missing, "\n")+"\n"), time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func registerBundleRoutes(r *gin.Engine) {
+	// Download an upload with its attachments as a .tar.gz archive.
+	downloadBundle := func(c *gin.Context) {
+		upload := printableUpload(c, uploadParam(c))
+		if upload == nil {
+			return
+		}
+		c.Header("Content-Type", "application/gzip")
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": upload.ShortHash() + ".tar.gz"}))
+		c.Status(http.StatusOK)
+		throttleDownload(c)
+		if err := WriteBundle(c, upload, c.Writer); err != nil {
+			// The archive is already partially sent, so the best we can do is cut it off and log why.
+			log.Printf("failed to bundle upload %v: %v", upload.Hash, err)
+		}
+	}
+	r.GET("/p/:hash/bundle.tar.gz", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency),
+		downloadBundle)
+	r.GET("/:hash/bundle.tar.gz", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency),
+		legacyUploadRoute(downloadBundle))
+}
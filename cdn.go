@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cdnPurgeBatchSize is the number of URLs purged per request, the limit of Cloudflare's API.
+const cdnPurgeBatchSize = 30
+
+// CDN settings. cdnURL is where upload pages link attachments, and cdnPurgeURL the API that drops cached copies of
+// them; both are empty when attachments are served directly.
+var (
+	cdnURL        string
+	cdnPurgeURL   string
+	cdnPurgeToken string
+	cdnClient     = &http.Client{Timeout: 10 * time.Second}
+)
+
+func initCDN() {
+	cdnURL = strings.TrimSuffix(os.Getenv("CDN_URL"), "/")
+	cdnPurgeURL = os.Getenv("CDN_PURGE_URL")
+	cdnPurgeToken = os.Getenv("CDN_PURGE_TOKEN")
+}
+
+// setAttachmentCacheHeaders lets browsers and CDNs cache the attachment stored under key for a year. Objects are stored
+// under the hash of their contents, so the response at an attachment URL never changes. Attachments restricted to some
+// countries are not cached at all, as a CDN would serve the copy to clients from every country. With hotlink
+// protection, a response allowed only because of its Referer must not be cached for everyone else, so only signed
+// links are cached publicly.
+func setAttachmentCacheHeaders(c *gin.Context, key string) {
+	if restricted, err := geoRestricted(c.Request.Context(), key); err != nil || restricted {
+		c.Writer.Header().Set("Cache-Control", "private, no-store")
+		return
+	}
+	if hotlinkProtection.Load() && c.Query("sig") == "" {
+		c.Writer.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		return
+	}
+	c.Writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+// attachmentURLs returns the URLs under which the CDN may have cached the attachments of an upload.
+func attachmentURLs(upload *UploadModel) []string {
+	var urls []string
+	for i, hash := range upload.FileHashes {
+		urls = append(urls,
+			cdnURL+"/f/"+hash+"/"+url.PathEscape(upload.FileNames[i]),
+			cdnURL+"/download?hash="+hash,
+			cdnURL+"/stream/"+hash,
+		)
+	}
+	return urls
+}
+
+// purgeCDN asks the CDN to drop its cached copies of the attachments of an upload, so that deleted and taken down
+// attachments stop being served from its edge. The request is the one of Cloudflare's purge_cache API, a JSON object
+// listing the URLs under "files", authorized with a bearer token. Purging is best effort, so failures are logged
+// rather than returned. Signed links, used with hotlink protection, cannot be purged and expire on their own.
+func purgeCDN(ctx context.Context, upload *UploadModel) {
+	if cdnURL == "" || cdnPurgeURL == "" || len(upload.FileHashes) == 0 {
+		return
+	}
+	urls := attachmentURLs(upload)
+	for len(urls) > 0 {
+		batch := urls[:min(len(urls), cdnPurgeBatchSize)]
+		urls = urls[len(batch):]
+		if err := requestPurge(ctx, batch); err != nil {
+			log.Printf("failed to purge the attachments of upload %v from the CDN: %v", upload.Hash, err)
+			return
+		}
+	}
+}
+
+func requestPurge(ctx context.Context, urls []string) error {
+	body, err := json.Marshal(map[string][]string{"files": urls})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cdnPurgeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cdnPurgeToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cdnPurgeToken)
+	}
+	resp, err := cdnClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%v: %s", resp.Status, message)
+	}
+	return nil
+}
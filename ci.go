@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CI pipelines publish build logs and artifacts by uploading a tar archive of them, optionally compressed with gzip,
+// which becomes one upload with an attachment per file. Pipelines name how long the upload is kept with a retention
+// label rather than a duration, so that the durations are decided in one place: CI_RETENTION_LABELS maps each label to
+// an expiry in the format of parseExpiry, e.g. "pr=7d,build=30d,release=never". The response lists the URLs of the
+// upload and its files as JSON, as plain lines, or as GitHub Actions outputs.
+
+var (
+	ErrCIArchive       = errors.New("the request body must be a tar archive, optionally compressed with gzip")
+	ErrCIArchiveEmpty  = errors.New("the archive contains no files")
+	ErrCIFiles         = fmt.Errorf("an archive may contain at most %d files", maxCIFiles)
+	ErrCIBodyFile      = errors.New(`the file named by "X-Body-File" must be UTF-8 text in the archive`)
+	ErrRetentionLabel  = errors.New(`unknown retention label in "X-Retention"`)
+	ErrCIOutputFormat  = errors.New(`"format" must be "json", "github" or "urls"`)
+	errCIArchiveTooBig = errors.New("the files of the archive are too large")
+)
+
+// maxCIFiles is how many files an archive may contain.
+const maxCIFiles = 500
+
+// Output formats of CI uploads. The format is kept in the request context under ciFormatKey, so that errors are
+// answered in it too.
+const (
+	ciFormatKey    = "ciFormat"
+	ciFormatJSON   = "json"
+	ciFormatGitHub = "github" // Lines for $GITHUB_OUTPUT, and errors as workflow commands.
+	ciFormatURLs   = "urls"   // The URL of the upload, then one line per file.
+)
+
+// retentionLabels map the retention labels of CI uploads to how long the uploads are kept, where 0 keeps them.
+var retentionLabels map[string]time.Duration
+
+func initCI() {
+	spec, ok := os.LookupEnv("CI_RETENTION_LABELS")
+	if !ok {
+		spec = "pr=7d,build=30d,release=never"
+	}
+	retentionLabels = make(map[string]time.Duration)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		label, expiry, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(label) == "" {
+			log.Fatalf("CI_RETENTION_LABELS entry %q must be label=expiry", pair)
+		}
+		duration, err := parseExpiry(expiry)
+		if err != nil {
+			log.Fatalf("CI_RETENTION_LABELS entry %q: %v", pair, err)
+		}
+		retentionLabels[strings.ToLower(strings.TrimSpace(label))] = duration
+	}
+}
+
+// ciFormat is a middleware that reads the output format of a CI upload from the "format" argument.
+func ciFormat(c *gin.Context) {
+	format := c.DefaultQuery("format", ciFormatJSON)
+	switch format {
+	case ciFormatJSON, ciFormatGitHub, ciFormatURLs:
+		c.Set(ciFormatKey, format)
+	default:
+		abortWithError(c, http.StatusBadRequest, ErrCIOutputFormat, nil)
+	}
+}
+
+// githubEscape escapes a value for a workflow command, which ends at the first line break.
+func githubEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// artifactName returns the attachment name of a file in an archive. Attachment names cannot contain slashes, so the
+// directories of the path are joined to the name with underscores: "logs/build.txt" becomes "logs_build.txt".
+func artifactName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return strings.TrimSpace(strings.ReplaceAll(name, "/", "_"))
+}
+
+// readArtifacts reads the regular files of a tar archive, which may be compressed with gzip. Directories, links and
+// other entries are skipped.
+func readArtifacts(r io.Reader) ([]*FileObject, error) {
+	buffered := bufio.NewReader(r)
+	r = buffered
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, ErrCIArchive
+		}
+		defer decompressed.Close()
+		r = decompressed
+	}
+
+	var files []*FileObject
+	var size int64
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		var tooLarge *http.MaxBytesError
+		if err == io.EOF {
+			break
+		} else if errors.As(err, &tooLarge) {
+			return nil, err
+		} else if err != nil {
+			return nil, ErrCIArchive
+		}
+		name := artifactName(header.Name)
+		if header.Typeflag != tar.TypeReg || name == "" {
+			continue
+		}
+		// The archive itself is limited by the request body, and the files in it like uploaded ones.
+		if size += header.Size; size > maxUploadSize {
+			return nil, errCIArchiveTooBig
+		}
+		if len(files) == maxCIFiles {
+			return nil, ErrCIFiles
+		}
+		contents, err := io.ReadAll(archive)
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		} else if err != nil {
+			return nil, ErrCIArchive
+		}
+		modtime := header.ModTime
+		if modtime.IsZero() {
+			modtime = time.Now()
+		}
+		files = append(files, &FileObject{
+			Filename: name,
+			Header:   textproto.MIMEHeader{},
+			Size:     int64(len(contents)),
+			Modtime:  modtime,
+			Contents: contents,
+		})
+	}
+	if len(files) == 0 {
+		return nil, ErrCIArchiveEmpty
+	}
+	return files, nil
+}
+
+// takeBodyFile removes the file with the given name from files and returns its text.
+func takeBodyFile(files []*FileObject, name string) (string, []*FileObject, error) {
+	name = artifactName(name)
+	for i, file := range files {
+		if file.Filename != name {
+			continue
+		}
+		if !utf8.Valid(file.Contents) || bytes.IndexByte(file.Contents, 0) >= 0 {
+			break
+		}
+		return string(file.Contents), append(files[:i:i], files[i+1:]...), nil
+	}
+	return "", nil, ErrCIBodyFile
+}
+
+func registerCIRoutes(r *gin.Engine) {
+	// Upload a tar archive of build logs and artifacts as one upload, as an account authenticated with an API token:
+	//   tar -cz logs dist | curl --fail-with-body -H "Authorization: Bearer $TOKEN" -H "X-Retention: pr" \
+	//     -T - "https://example.com/api/v1/ci/uploads?format=github"
+	// The optional X-Body-File header names a text file of the archive to show as the text of the upload instead of as
+	// an attachment, such as the build log, and X-Keep-Last-KB keeps only the end of it when it is too long. X-Private:
+	// true makes the upload private, X-Language sets the language of its text, and X-Redact: true redacts personal data
+	// from it as /submit does.
+	r.PUT("/api/v1/ci/uploads", ciFormat, meterUsage, requireRole(RoleUser), rateLimit(PolicySubmit), limitConcurrency(submitConcurrency),
+		limitRequestBody(maxUploadSize), func(c *gin.Context) {
+			account := currentAccount(c)
+			label := strings.ToLower(strings.TrimSpace(c.GetHeader("X-Retention")))
+			expiry, ok := retentionLabels[label]
+			if label != "" && !ok {
+				labels := make([]string, 0, len(retentionLabels))
+				for known := range retentionLabels {
+					labels = append(labels, known)
+				}
+				sort.Strings(labels)
+				abortWithError(c, http.StatusBadRequest, ErrRetentionLabel, gin.H{"labels": labels})
+				return
+			}
+			language, err := parseLanguage(c.GetHeader("X-Language"))
+			if err != nil {
+				respondError(c, http.StatusBadRequest, err)
+				return
+			}
+			keepLast, err := parseKeepLast(c.GetHeader("X-Keep-Last-KB"))
+			if err != nil {
+				respondError(c, http.StatusBadRequest, err)
+				return
+			}
+
+			files, err := readArtifacts(c.Request.Body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) || errors.Is(err, errCIArchiveTooBig) {
+				respondTooLarge(c, -1, maxUploadSize)
+				return
+			} else if err != nil {
+				respondError(c, http.StatusBadRequest, err)
+				return
+			}
+			var body string
+			if name := c.GetHeader("X-Body-File"); name != "" {
+				if body, files, err = takeBodyFile(files, name); err != nil {
+					respondError(c, http.StatusBadRequest, err)
+					return
+				}
+			}
+
+			if !checkTerms(c, false) {
+				return
+			}
+			body, truncated, ok := limitBodyLength(c, body, keepLast)
+			if !ok {
+				return
+			}
+			// Personal data is redacted before hooks or anything else see the text.
+			var redacted map[string]int
+			if c.GetHeader("X-Redact") == "true" {
+				body, redacted = redactBody(body)
+			}
+
+			var attachmentsSize int64
+			preSubmit := HookPayload{Event: HookPreSubmit, Body: body, Private: c.GetHeader("X-Private") == "true"}
+			for _, file := range files {
+				attachmentsSize += file.Size
+				preSubmit.Files = append(preSubmit.Files, file.Filename)
+			}
+			preSubmit.Size = int64(len(body)) + attachmentsSize
+			if !checkHooks(c, &preSubmit) {
+				return
+			}
+			body = preSubmit.Body
+			options := UploadOptions{
+				Private:    preSubmit.Private,
+				UploaderIP: c.ClientIP(),
+				Size:       int64(len(body)) + attachmentsSize,
+				AccountId:  account.Id,
+				Language:   language,
+			}
+			if expiry != 0 {
+				options.ExpiresAt = time.Now().Add(expiry)
+			}
+
+			quota, err := GetQuota(options.UploaderIP, account, nil)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			if err = quota.Check(options.Size); err != nil {
+				respondError(c, http.StatusRequestEntityTooLarge, err)
+				return
+			}
+
+			secrets := scanSecrets("", []byte(body))
+			fileNameHashPairs := make([]string, len(files))
+			objects := make([][]byte, len(files))
+			checksums := make([]string, len(files))
+			for i, file := range files {
+				secrets = append(secrets, scanSecrets(file.Filename, file.Contents)...)
+				fileNameHashPairs[i], objects[i], checksums[i], err = encodeAttachment(file,
+					stripMetadata.Load() && c.GetHeader("X-Keep-Metadata") != "true", options.salted())
+				if err != nil {
+					respondError(c, http.StatusBadRequest, err)
+					return
+				}
+			}
+			if !checkSecrets(c, secrets, c.GetHeader("X-Confirm-Secrets") == "true") {
+				return
+			}
+
+			hash := UploadHash(body, fileNameHashPairs, options)
+			if err = storeAttachments(context.TODO(), hash, options.AccountId, fileNameHashPairs, objects, checksums); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			editToken, existing, err := SubmitUpload(hash, body, fileNameHashPairs, options)
+			if err != nil {
+				respondError(c, http.StatusConflict, err)
+				return
+			}
+			notifyHooks(HookPayload{Event: HookPostSubmit, Hash: hash, Body: body, Files: preSubmit.Files, Size: options.Size,
+				Private: options.Private, AccountId: options.AccountId, IP: options.UploaderIP})
+
+			upload, err := GetUpload(hash)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			link := baseurl + uploadPath(upload.ShortHash())
+			if options.Private {
+				link = baseurl + ShareLink(upload, time.Now().Add(defaultShareTTL))
+			}
+			described := uploadJSON(upload)
+			fileURLs := make([]string, len(upload.FileNames))
+			for i, file := range described["files"].([]gin.H) {
+				fileURLs[i] = file["url"].(string)
+			}
+
+			switch c.GetString(ciFormatKey) {
+			case ciFormatGitHub:
+				// Multiline outputs are delimited by a line that cannot appear in the URLs.
+				var out strings.Builder
+				fmt.Fprintf(&out, "id=%s\nurl=%s\n", upload.ShortHash(), link)
+				if !options.ExpiresAt.IsZero() {
+					fmt.Fprintf(&out, "expires_at=%s\n", options.ExpiresAt.UTC().Format(time.RFC3339))
+				}
+				if existing != nil {
+					fmt.Fprintf(&out, "deduplicated=true\n")
+				}
+				fmt.Fprintf(&out, "files<<COPYCAT_EOF\n%sCOPYCAT_EOF\n", strings.Join(append(fileURLs, ""), "\n"))
+				c.String(http.StatusCreated, "%s", out.String())
+			case ciFormatURLs:
+				c.String(http.StatusCreated, "%s\n", strings.Join(append([]string{link}, fileURLs...), "\n"))
+			default:
+				response := gin.H{
+					"id":        upload.ShortHash(),
+					"url":       link,
+					"files":     described["files"],
+					"retention": label,
+					"sha256":    checksums,
+				}
+				if !options.ExpiresAt.IsZero() {
+					response["expires_at"] = options.ExpiresAt.UTC().Format(time.RFC3339)
+				}
+				if editToken != "" {
+					response["edit_token"] = editToken
+				}
+				describeDuplicate(response, existing)
+				if truncated != 0 {
+					response["truncated_bytes"] = truncated
+				}
+				if len(secrets) != 0 {
+					response["secrets"] = secrets
+				}
+				if redacted != nil {
+					response["redacted"] = redacted
+				}
+				c.JSON(http.StatusCreated, response)
+			}
+		})
+}
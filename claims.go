@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Claim tokens let an anonymous browser manage its own uploads without an account. The first anonymous upload of a
+// browser issues a token, which is kept in a cookie signed with the signing key, and every upload made with the token
+// is recorded in the Claims table under its SHA-256. Clients without cookies can send the token in an X-Claim-Token
+// header instead. Holding the token of an upload counts as owning it, like its edit token.
+const (
+	claimCookie            = "copycat_claim"
+	claimLifetime          = 365 * 24 * time.Hour
+	claimedUploadsPageSize = 100
+)
+
+func claimSignature(token string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("claim\n" + token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestClaimToken returns the claim token of the request if its signature is valid, or "".
+func requestClaimToken(c *gin.Context) string {
+	value := c.GetHeader("X-Claim-Token")
+	if value == "" {
+		value, _ = c.Cookie(claimCookie)
+	}
+	token, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(claimSignature(token))) {
+		return ""
+	}
+	return token
+}
+
+// ensureClaimToken returns the claim token of the request, issuing a new one if it has none, and renews its cookie.
+// The signed value of the token is returned for clients that keep it themselves.
+func ensureClaimToken(c *gin.Context) (token, signed string) {
+	if token = requestClaimToken(c); token == "" {
+		token = randomToken()
+	}
+	signed = token + "." + claimSignature(token)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(claimCookie, signed, int(claimLifetime.Seconds()), "/", "", c.Request.TLS != nil, true)
+	return token, signed
+}
+
+// ClaimUpload records that the holder of a claim token owns an upload.
+func ClaimUpload(token, hash string) error {
+	_, err := db.Exec("INSERT INTO Claims(token_hash, upload_hash, created) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		hashToken(token), hash, time.Now().UTC().Unix())
+	return err
+}
+
+// claimAnonymousUpload gives the browser of an anonymous upload a claim on it, and returns the signed claim token.
+// Uploads by accounts belong to the account instead, so nothing is claimed for them and "" is returned. Only uploads
+// the request created are claimed, which SubmitUpload returned an editToken for: submitting the content of an existing
+// upload again must not make anyone its owner.
+func claimAnonymousUpload(c *gin.Context, hash string, editToken string) string {
+	if currentAccount(c) != nil || editToken == "" {
+		return ""
+	}
+	token, signed := ensureClaimToken(c)
+	if err := ClaimUpload(token, hash); err != nil {
+		// The upload itself succeeded, and its edit token still allows managing it.
+		log.Printf("failed to claim upload %v: %v", hash, err)
+	}
+	return signed
+}
+
+// IsClaimed reports whether the request holds a claim token for the upload.
+func (upload *UploadModel) IsClaimed(c *gin.Context) bool {
+	token := requestClaimToken(c)
+	if token == "" {
+		return false
+	}
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM Claims WHERE token_hash = $1 AND upload_hash = $2", hashToken(token), upload.Hash).Scan(&n)
+	if err != nil {
+		log.Printf("failed to check the claim on upload %v: %v", upload.Hash, err)
+	}
+	return n > 0
+}
+
+// ClaimedUploads returns the uploads claimed with a token that are not in the trash, the newest first.
+func ClaimedUploads(token string, query ListQuery) ([]*UploadModel, *listCursor, error) {
+	return pageUploads(query, "SELECT "+uploadColumns+` FROM Uploads WHERE deleted_at = 0
+		AND hash IN (SELECT upload_hash FROM Claims WHERE token_hash = $1)`, []any{hashToken(token)},
+		"timestamp", func(upload *UploadModel) int64 { return upload.Timestamp })
+}
+
+// A linkedUpload is an upload listed on a page such as /mine, with the link that opens it: a share link for private
+// uploads, which have no public page.
+type linkedUpload struct {
+	*UploadModel
+	Link string
+}
+
+func claimedUploadList(uploads []*UploadModel) []linkedUpload {
+	list := make([]linkedUpload, len(uploads))
+	for i, upload := range uploads {
+		list[i] = linkedUpload{upload, baseurl + uploadPath(upload.ShortHash())}
+		if upload.Private {
+			list[i].Link = baseurl + ShareLink(upload, time.Now().Add(defaultShareTTL))
+		}
+	}
+	return list
+}
+
+func registerClaimRoutes(r *gin.Engine) {
+	// The uploads of this browser, with buttons to delete them.
+	r.GET("/mine", func(c *gin.Context) {
+		var uploads []*UploadModel
+		if token := requestClaimToken(c); token != "" {
+			var err error
+			if uploads, _, err = ClaimedUploads(token, ListQuery{Limit: claimedUploadsPageSize}); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		renderPage(c, http.StatusOK, "mine.html", gin.H{
+			"Page":    NewPageInfo(c, "My uploads"),
+			"Uploads": claimedUploadList(uploads),
+		})
+	})
+
+	r.GET("/api/v1/claims/uploads", func(c *gin.Context) {
+		query, ok := parseListQuery(c)
+		if !ok {
+			return
+		}
+		list := []gin.H{}
+		var next *listCursor
+		if token := requestClaimToken(c); token != "" {
+			var uploads []*UploadModel
+			var err error
+			uploads, next, err = ClaimedUploads(token, query)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			for _, upload := range claimedUploadList(uploads) {
+				list = append(list, gin.H{
+					"hash":      upload.Hash,
+					"url":       upload.Link,
+					"timestamp": time.Unix(upload.Timestamp, 0).UTC().Format(time.RFC3339),
+					"private":   upload.Private,
+				})
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"uploads":     list,
+			"next_cursor": setListLinks(c, next),
+		})
+	})
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A command is an operation run from the command line, like `copycat role alice admin`, instead of the webserver.
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	// Declared in init because the help command refers to the map itself.
+	commands = map[string]command{
+		"useradd":         {"useradd [-role user|moderator|admin] <username>", "create an account, reading its password from stdin", cmdUseradd},
+		"role":            {"role <username> <role>", "change the role of an account", cmdRole},
+		"delete":          {"delete [-purge] <hash>...", "move uploads to the trash, or delete them for good", cmdDelete},
+		"undelete":        {"undelete <hash>...", "restore uploads from the trash", cmdUndelete},
+		"takedown":        {"takedown -reason <text> <hash>", "replace an upload with a tombstone notice", cmdTakedown},
+		"audit":           {"audit", "print the newest entries of the audit log", cmdAudit},
+		"export":          {"export -account <username> | -ip <address>", "write a zip of all data of a person to stdout", cmdExport},
+		"erase":           {"erase -account <username> | -ip <address> [-yes]", "erase all data of a person", cmdErase},
+		"backup":          {"backup [-o <file>]", "write a gzipped tar of all uploads and their objects, to stdout by default", cmdBackup},
+		"restore":         {"restore [<file>]", "restore a backup archive, from stdin by default", cmdRestore},
+		"migrate-storage": {"migrate-storage -from <store> -to <store>", "copy all attachments to another object store", cmdMigrateStorage},
+		"dedup":           {"dedup [-dry-run]", "merge attachment objects stored more than once", cmdDedup},
+		"bulk-delete":     {"bulk-delete <criteria> [-purge] [-dry-run]", "delete the uploads matching -older-than, -larger-than, -ip and -match", cmdBulkDelete},
+		"vapid-key":       {"vapid-key", "generate a key pair for sending Web Push messages", cmdVAPIDKey},
+		"help":            {"help", "show this help", cmdHelp},
+	}
+}
+
+// runCommand runs the command named by args[0] and exits.
+func runCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		cmdHelp(nil)
+		os.Exit(2)
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		log.Fatalf("%s: %v", args[0], err)
+	}
+	os.Exit(0)
+}
+
+func cmdHelp([]string) error {
+	fmt.Println("Usage: copycat [command]\n\nWithout a command the webserver is started. Commands:")
+	for _, name := range []string{"useradd", "role", "delete", "undelete", "takedown", "audit", "export", "erase", "backup", "restore", "migrate-storage", "dedup", "bulk-delete", "vapid-key", "help"} {
+		fmt.Printf("  %-52s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Println("\nPrivileged commands require COPYCAT_TOKEN to be the API token of an account with the needed role.")
+	return nil
+}
+
+// cliActor returns the account identified by the COPYCAT_TOKEN environment variable, if it has role.
+// Command line operations have direct database access, so this is what attributes them in the audit log.
+func cliActor(role string) (*Account, error) {
+	token := os.Getenv("COPYCAT_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("COPYCAT_TOKEN must be set to the API token of an account with the %s role", role)
+	}
+	account, err := GetAccountByToken(token)
+	if err != nil {
+		return nil, errors.New("COPYCAT_TOKEN does not belong to any account")
+	}
+	if !account.HasRole(role) {
+		return nil, fmt.Errorf("%s does not have the %s role", account.Username, role)
+	}
+	return account, nil
+}
+
+func cmdUseradd(args []string) error {
+	flags := flag.NewFlagSet("useradd", flag.ExitOnError)
+	role := flags.String("role", RoleUser, "role of the new account")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: " + commands["useradd"].usage)
+	}
+
+	// Anyone may create the first admin. After that, only admins may create accounts from the command line.
+	actor := "cli"
+	admins, err := CountAdmins()
+	if err != nil {
+		return err
+	}
+	if admins > 0 || *role != RoleAdmin {
+		account, err := cliActor(RoleAdmin)
+		if err != nil {
+			return err
+		}
+		actor = "cli:" + account.Username
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+
+	account, token, err := CreateAccount(flags.Arg(0), strings.TrimRight(password, "\r\n"), *role)
+	if err != nil {
+		return err
+	}
+	RecordAudit(actor, "account.create", account.Username, "role "+account.Role, "")
+	fmt.Printf("Created %s with role %s. API token: %s\n", account.Username, account.Role, token)
+	return nil
+}
+
+func cmdRole(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: " + commands["role"].usage)
+	}
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	target, err := GetAccount(args[0])
+	if err != nil {
+		return fmt.Errorf("account %s not found", args[0])
+	}
+	if err = SetRole(target, args[1]); err != nil {
+		return err
+	}
+	RecordAudit("cli:"+actor.Username, "account.role", target.Username, target.Role+" -> "+args[1], "")
+	fmt.Printf("%s is now %s\n", target.Username, args[1])
+	return nil
+}
+
+func cmdDelete(args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	purge := flags.Bool("purge", false, "delete right away instead of moving to the trash (admins only)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("usage: " + commands["delete"].usage)
+	}
+	role := RoleModerator
+	if *purge {
+		role = RoleAdmin
+	}
+	actor, err := cliActor(role)
+	if err != nil {
+		return err
+	}
+	initStorage()
+	initShortIDs() // IDs are folded to lower case only in alphabets where case does not matter.
+	initTrash()
+	initHooks()
+
+	action := "upload.delete"
+	if *purge {
+		action = "upload.purge"
+	}
+	for _, hash := range flags.Args() {
+		upload, err := GetUpload(normalizeUploadID(hash))
+		if err != nil && *purge {
+			upload, err = GetTrashedUpload(normalizeUploadID(hash))
+		}
+		if err != nil {
+			return fmt.Errorf("upload %s not found", hash)
+		}
+		err = RunHooks(context.Background(), &HookPayload{Event: HookPreDelete, Hash: upload.Hash, Files: upload.FileNames,
+			Private: upload.Private, AccountId: actor.Id})
+		if err == nil && *purge {
+			_, _, err = PurgeUpload(context.Background(), upload.Hash)
+		} else if err == nil {
+			err = TrashUpload(context.Background(), upload, "cli:"+actor.Username)
+		}
+		if err != nil {
+			RecordAudit("cli:"+actor.Username, action, upload.Hash, "failed: "+err.Error(), "")
+			return err
+		}
+		RecordAudit("cli:"+actor.Username, action, upload.Hash, "", "")
+		fmt.Println("Deleted", upload.Hash)
+	}
+	return nil
+}
+
+func cmdUndelete(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: " + commands["undelete"].usage)
+	}
+	actor, err := cliActor(RoleModerator)
+	if err != nil {
+		return err
+	}
+	initStorage()
+	initShortIDs() // IDs are folded to lower case only in alphabets where case does not matter.
+
+	for _, hash := range args {
+		upload, err := GetTrashedUpload(normalizeUploadID(hash))
+		if err != nil {
+			return fmt.Errorf("upload %s not found in the trash", hash)
+		}
+		if err = RestoreUpload(context.Background(), upload); err != nil {
+			return err
+		}
+		RecordAudit("cli:"+actor.Username, "upload.restore", upload.Hash, "", "")
+		fmt.Println("Restored", upload.Hash)
+	}
+	return nil
+}
+
+func cmdTakedown(args []string) error {
+	flags := flag.NewFlagSet("takedown", flag.ExitOnError)
+	reason := flags.String("reason", "", "reason shown on the tombstone page")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *reason == "" {
+		return errors.New("usage: " + commands["takedown"].usage)
+	}
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	initStorage()
+	initShortIDs() // IDs are folded to lower case only in alphabets where case does not matter.
+
+	upload, err := GetUpload(normalizeUploadID(flags.Arg(0)))
+	if err != nil {
+		return fmt.Errorf("upload %s not found", flags.Arg(0))
+	}
+	if err = Takedown(context.Background(), upload, *reason); err != nil {
+		RecordAudit("cli:"+actor.Username, "upload.takedown", upload.Hash, "failed: "+err.Error(), "")
+		return err
+	}
+	RecordAudit("cli:"+actor.Username, "upload.takedown", upload.Hash, *reason, "")
+	fmt.Println("Took down", upload.Hash)
+	return nil
+}
+
+func cmdAudit([]string) error {
+	if _, err := cliActor(RoleAdmin); err != nil {
+		return err
+	}
+	entries, _, err := GetAuditLog(0, ListQuery{Limit: auditPageSize})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fmt.Printf("%s  %-20s %-16s %s %s\n", time.Unix(e.Timestamp, 0).Format(time.DateTime), e.Actor, e.Action, e.Target, e.Details)
+	}
+	return nil
+}
+
+// parseDataSubject parses the -account or -ip flag shared by the export and erase commands.
+func parseDataSubject(flags *flag.FlagSet, args []string) (DataSubject, error) {
+	username := flags.String("account", "", "username of the account")
+	ip := flags.String("ip", "", "IP address of anonymous uploads")
+	flags.Parse(args)
+
+	switch {
+	case *username != "" && *ip == "":
+		account, err := GetAccount(*username)
+		if err != nil {
+			return DataSubject{}, fmt.Errorf("account %s not found", *username)
+		}
+		return DataSubject{Account: account}, nil
+	case *ip != "" && *username == "":
+		return DataSubject{IP: *ip}, nil
+	}
+	return DataSubject{}, errors.New("exactly one of -account or -ip is required")
+}
+
+func cmdExport(args []string) error {
+	subject, err := parseDataSubject(flag.NewFlagSet("export", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	initStorage()
+
+	RecordAudit("cli:"+actor.Username, "data.export", subject.String(), "", "")
+	return ExportData(subject, os.Stdout)
+}
+
+func cmdErase(args []string) error {
+	flags := flag.NewFlagSet("erase", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "erase instead of listing what would be erased")
+	subject, err := parseDataSubject(flags, args)
+	if err != nil {
+		return err
+	}
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if !*yes {
+		uploads, err := subject.Uploads()
+		if err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			fmt.Println(upload.Hash)
+		}
+		fmt.Printf("%d uploads of %v would be erased. Run again with -yes to erase them.\n", len(uploads), subject)
+		return nil
+	}
+
+	initStorage()
+	receipt, err := EraseData(context.Background(), subject)
+	if err != nil {
+		return err
+	}
+	RecordAudit("cli:"+actor.Username, "data.erase", receipt.Subject, fmt.Sprintf("%d uploads", len(receipt.Uploads)), "")
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(receipt)
+}
+
+func cmdBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "file to write the archive to instead of stdout")
+	flags.Parse(args)
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	initStorage()
+
+	// The archive is written next to the output file and renamed to it once it is complete, so that a failed backup
+	// leaves no partial archive behind to be mistaken for a good one.
+	w := os.Stdout
+	if *output != "" {
+		if w, err = os.CreateTemp(filepath.Dir(*output), ".backup-*"); err != nil {
+			return err
+		}
+		defer os.Remove(w.Name())
+	}
+	stats, err := Backup(context.Background(), w)
+	if w != os.Stdout {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(w.Name(), *output)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	RecordAudit("cli:"+actor.Username, "data.backup", objectStore.String(), fmt.Sprintf("%d uploads, %d objects", stats.Uploads, stats.Objects), "")
+	fmt.Fprintf(os.Stderr, "Backed up %d uploads and %d objects\n", stats.Uploads, stats.Objects)
+	if len(stats.Archived) > 0 {
+		fmt.Fprintf(os.Stderr, "%d archived objects were left out and are being retrieved; back up again in a few hours to include them: %s\n",
+			len(stats.Archived), strings.Join(stats.Archived, " "))
+	}
+	return nil
+}
+
+func cmdRestore(args []string) error {
+	// Before there were backups, restore took uploads out of the trash, and scripts may still call it that way.
+	if restoresUploads(args) {
+		fmt.Fprintln(os.Stderr, `"restore <hash>..." is deprecated, use "undelete <hash>..." instead`)
+		return cmdUndelete(args)
+	}
+	if len(args) > 1 {
+		return errors.New("usage: " + commands["restore"].usage)
+	}
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	initStorage()
+
+	r := os.Stdin
+	if len(args) == 1 {
+		if r, err = os.Open(args[0]); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+	stats, err := Restore(context.Background(), r)
+	if err != nil {
+		return err
+	}
+	RecordAudit("cli:"+actor.Username, "data.restore", objectStore.String(), fmt.Sprintf("%d uploads, %d objects", stats.Uploads, stats.Objects), "")
+	fmt.Printf("Restored %d uploads and %d objects, skipped %d that already existed\n", stats.Uploads, stats.Objects, stats.Skipped)
+	return nil
+}
+
+// restoresUploads reports whether the arguments of restore name uploads to undelete rather than a backup archive:
+// more than one argument, or one that is no file.
+func restoresUploads(args []string) bool {
+	if len(args) > 1 {
+		return true
+	}
+	if len(args) == 1 {
+		_, err := os.Stat(args[0])
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	return false
+}
+
+func cmdMigrateStorage(args []string) error {
+	flags := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	fromSpec := flags.String("from", "", `source store, "s3://<bucket>" or "fs:<directory>"`)
+	toSpec := flags.String("to", "", "destination store")
+	flags.Parse(args)
+	if *fromSpec == "" || *toSpec == "" || flags.NArg() != 0 {
+		return errors.New("usage: " + commands["migrate-storage"].usage)
+	}
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	from, err := OpenStore(*fromSpec)
+	if err != nil {
+		return err
+	}
+	to, err := OpenStore(*toSpec)
+	if err != nil {
+		return err
+	}
+	if from.String() == to.String() {
+		return errors.New("the source and destination are the same store")
+	}
+
+	stats, err := MigrateStorage(context.Background(), from, to)
+	if err != nil {
+		return fmt.Errorf("%v (run the command again to resume)", err)
+	}
+	RecordAudit("cli:"+actor.Username, "storage.migrate", to.String(),
+		fmt.Sprintf("from %v: %d copied, %d skipped, %d missing, %d archived", from, stats.Copied, stats.Skipped,
+			len(stats.Missing), len(stats.Archived)), "")
+	fmt.Printf("Copied %d objects to %v, skipped %d already copied.\n", stats.Copied, to, stats.Skipped)
+	if len(stats.Missing) > 0 {
+		fmt.Printf("%d objects were missing from %v: %s\n", len(stats.Missing), from, strings.Join(stats.Missing, " "))
+	}
+	if len(stats.Archived) > 0 {
+		fmt.Printf("%d objects are archived in %v and are being retrieved; run the command again in a few hours to copy them: %s\n",
+			len(stats.Archived), from, strings.Join(stats.Archived, " "))
+		return nil
+	}
+	fmt.Printf("Set STORAGE=%v and restart the server to use the new store.\n", to)
+	return nil
+}
+
+func cmdDedup(args []string) error {
+	flags := flag.NewFlagSet("dedup", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list what would be merged without changing anything")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("usage: " + commands["dedup"].usage)
+	}
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	initStorage()
+
+	stats, err := Deduplicate(context.Background(), *dryRun)
+	if err != nil {
+		return fmt.Errorf("%v (run the command again to resume)", err)
+	}
+	if *dryRun {
+		fmt.Printf("Checked %d objects, %d would be merged.\n", stats.Checked, stats.Merged)
+	} else {
+		RecordAudit("cli:"+actor.Username, "storage.dedup", objectStore.String(),
+			fmt.Sprintf("%d checked, %d merged, %d skipped", stats.Checked, stats.Merged, len(stats.Skipped)), "")
+		fmt.Printf("Checked %d objects and merged %d into others.\n", stats.Checked, stats.Merged)
+	}
+	if len(stats.Skipped) > 0 {
+		fmt.Printf("%d objects could not be read and were skipped: %s\n", len(stats.Skipped), strings.Join(stats.Skipped, " "))
+	}
+	return nil
+}
+
+func cmdBulkDelete(args []string) error {
+	flags := flag.NewFlagSet("bulk-delete", flag.ExitOnError)
+	olderThan := flags.String("older-than", "", `delete uploads older than a duration like "12h" or a number of days like "30d"`)
+	largerThan := flags.Int64("larger-than", 0, "delete uploads of more bytes than this")
+	ip := flags.String("ip", "", "delete uploads from an IP address or a network like 203.0.113.0/24")
+	match := flags.String("match", "", "delete uploads whose text or attachment names match a regular expression")
+	purge := flags.Bool("purge", false, "delete right away instead of moving to the trash")
+	dryRun := flags.Bool("dry-run", false, "list what would be deleted without changing anything")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("usage: " + commands["bulk-delete"].usage)
+	}
+	criteria, err := parseDeleteCriteria(*olderThan, *largerThan, *ip, *match)
+	if err != nil {
+		return err
+	}
+	actor, err := cliActor(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	initStorage()
+	initTrash()
+	initHooks()
+
+	stats, err := BulkDelete(context.Background(), criteria, *purge, *dryRun, "cli:"+actor.Username, "",
+		func(progress BulkDeleteProgress) {
+			line := fmt.Sprintf("[%d/%d] %s %s (%s, %s)", progress.Done, progress.Total, progress.Status, progress.Hash,
+				formatBytes(progress.Size), time.Unix(progress.Timestamp, 0).UTC().Format(time.DateOnly))
+			if progress.Error != "" {
+				line += ": " + progress.Error
+			}
+			fmt.Println(line)
+		})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("%d uploads of %s would be deleted.\n", stats.Matched, formatBytes(stats.Bytes))
+	} else {
+		fmt.Printf("Deleted %d of %d uploads, %d failed.\n", stats.Deleted, stats.Matched, stats.Failed)
+	}
+	if len(stats.Skipped) > 0 {
+		fmt.Printf("%d uploads could not be read and were skipped: %s\n", len(stats.Skipped), strings.Join(stats.Skipped, " "))
+	}
+	return nil
+}
+
+func cmdVAPIDKey(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: " + commands["vapid-key"].usage)
+	}
+	private, public, err := generateVAPIDKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("VAPID_PRIVATE_KEY=%s\n# The public key, which browsers subscribe with: %s\n", private, public)
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+func registerClipRoutes(r *gin.Engine) {
+	// Upload the raw request body as text and answer with nothing but its URL, for clipboard managers and keyboard
+	// shortcuts, as in: xclip -o | curl -T - https://example.com/clip
+	// The optional X-Expiry header deletes the upload after a while; see parseExpiry for its format. Text longer than
+	// MAX_BODY_BYTES is refused unless the X-Keep-Last-KB header asks to keep only that many KiB of its end. The
+	// X-Language header sets the language of the text instead of detecting it. Text containing credentials is refused or
+	// needs X-Confirm-Secrets: true depending on SECRET_SCAN_POLICY, and when it is uploaded X-Secrets-Found names them.
+	// With X-Redact: true, personal data is redacted from the text and X-Redacted tells how much of each kind was.
+	r.PUT("/clip", meterUsage, rateLimit(PolicySubmit), limitConcurrency(submitConcurrency), limitRequestBody(maxUploadSize), func(c *gin.Context) {
+		data, err := io.ReadAll(c.Request.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondTooLarge(c, -1, maxUploadSize)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		// Postgres text cannot hold invalid UTF-8 or NUL bytes, so binary data must be uploaded as an attachment.
+		if len(bytes.TrimSpace(data)) == 0 {
+			respondError(c, http.StatusBadRequest, errors.New("the request body must contain the text to upload"))
+			return
+		}
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			respondError(c, http.StatusBadRequest, errors.New("the request body must be UTF-8 text; upload files at /submit"))
+			return
+		}
+		expiry, err := parseExpiry(c.GetHeader("X-Expiry"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		language, err := parseLanguage(c.GetHeader("X-Language"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		// Log dumps that are too long can keep their last lines instead of being refused.
+		keepLast, err := parseKeepLast(c.GetHeader("X-Keep-Last-KB"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		if !checkTerms(c, false) {
+			return
+		}
+		text, truncated, ok := limitBodyLength(c, string(data), keepLast)
+		if !ok {
+			return
+		}
+		var redacted map[string]int
+		if c.GetHeader("X-Redact") == "true" {
+			text, redacted = redactBody(text)
+		}
+		preSubmit := HookPayload{Event: HookPreSubmit, Body: text, Size: int64(len(text))}
+		if !checkHooks(c, &preSubmit) {
+			return
+		}
+
+		body := preSubmit.Body
+		account := currentAccount(c)
+		options := UploadOptions{
+			UploaderIP: c.ClientIP(),
+			Size:       int64(len(body)),
+			Language:   language,
+		}
+		if account != nil {
+			options.AccountId = account.Id
+		}
+		if expiry != 0 {
+			options.ExpiresAt = time.Now().Add(expiry)
+		}
+
+		quota, err := GetQuota(options.UploaderIP, account, nil)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if err = quota.Check(options.Size); err != nil {
+			respondError(c, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+
+		secrets := scanSecrets("", []byte(body))
+		if !checkSecrets(c, secrets, c.GetHeader("X-Confirm-Secrets") == "true") {
+			return
+		}
+
+		hash := UploadHash(body, nil, options)
+		editToken, existing, err := SubmitUpload(hash, body, nil, options)
+		if err != nil {
+			respondError(c, http.StatusConflict, err)
+			return
+		}
+		notifyHooks(HookPayload{Event: HookPostSubmit, Hash: hash, Body: body, Size: options.Size, AccountId: options.AccountId,
+			IP: options.UploaderIP})
+
+		// The edit and claim tokens cannot be part of a plain text response, so they are sent in headers.
+		if editToken != "" {
+			c.Header("X-Edit-Token", editToken)
+		}
+		if claimToken := claimAnonymousUpload(c, hash, editToken); claimToken != "" {
+			c.Header("X-Claim-Token", claimToken)
+		}
+		// Text that was already uploaded is answered with 200 instead of 201, and the time it was first uploaded.
+		status := http.StatusCreated
+		if existing != nil {
+			status = http.StatusOK
+			c.Header("X-Deduplicated", "true")
+			c.Header("X-Created-At", time.Unix(existing.Timestamp, 0).UTC().Format(time.RFC3339))
+		}
+		if original := nearDuplicateOriginal(hash); original != nil {
+			c.Header("X-Duplicate-Of", uploadLocation(original))
+		}
+		if truncated != 0 {
+			c.Header("X-Truncated-Bytes", strconv.FormatInt(truncated, 10))
+		}
+		if len(secrets) != 0 {
+			c.Header("X-Secrets-Found", secretKinds(secrets))
+		}
+		if redacted != nil {
+			c.Header("X-Redacted", redactionSummary(redacted))
+		}
+		c.String(status, "%s%s\n", baseurl, uploadPath(ShortHash(hash)))
+	})
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"golang.org/x/net/websocket"
+)
+
+// Clip channels carry snippets between the devices of a person, like a clipboard they share. A channel is created with
+// a key, and every device holding a key of the channel pushes what it copies with PUT /clip/:channel, reads the latest
+// snippet back, and is sent the snippets of the others over a WebSocket as they are pushed. Other devices are paired
+// with keys of their own, which the key the channel was created with can revoke; see clipdevices.go. Each channel keeps
+// its last CLIP_HISTORY_LENGTH snippets, which its history lists, and is deleted CLIP_CHANNEL_DAYS after its last
+// snippet. Snippets are not uploads: they have no page of their own and are only ever shown to those holding the key.
+
+// clipNotifyChannel is the Postgres channel on which replicas announce new snippets, with the id of the clip channel
+// as the payload.
+const clipNotifyChannel = "copycat_clip"
+
+// maxClipDevice is the longest name a device may give itself in X-Clip-Device.
+const maxClipDevice = 64
+
+var (
+	ErrClipChannelNotFound = errors.New("clip channel not found, or the key is wrong")
+	ErrClipEmpty           = errors.New("the request body must contain the text to push")
+	ErrClipDevice          = fmt.Errorf("X-Clip-Device must be at most %d characters", maxClipDevice)
+)
+
+var (
+	clipHistoryLength   int64         // The snippets kept per channel.
+	clipChannelLifetime time.Duration // How long a channel is kept after its last snippet.
+)
+
+// A ClipChannel shares snippets between the devices holding its key.
+type ClipChannel struct {
+	Id        string
+	AccountId int64 // The account that created the channel, or 0.
+	Seq       int64 // The number of snippets pushed to the channel.
+	CreatedAt int64
+	UpdatedAt int64
+	// The paired device whose key opened the channel, or nil for the key the channel was created with.
+	Device *ClipDevice
+}
+
+// A ClipSnippet is text pushed to a clip channel by one of its devices.
+type ClipSnippet struct {
+	Seq       int64  `json:"seq"`
+	Body      string `json:"body"`
+	Device    string `json:"device,omitempty"` // The name the device gave itself, like "laptop".
+	CreatedAt int64  `json:"created_at"`
+}
+
+func initClipChannels() {
+	clipHistoryLength = max(envInt64("CLIP_HISTORY_LENGTH", 50), 1)
+	clipChannelLifetime = time.Duration(envInt64("CLIP_CHANNEL_DAYS", 30)) * 24 * time.Hour
+
+	RegisterJob(&Job{
+		Name:     "clip channels",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "DELETE FROM ClipChannels WHERE updated_at < $1", time.Now().Add(-clipChannelLifetime).UTC().Unix())
+			return err
+		},
+	})
+
+	listenForClips()
+}
+
+// CreateClipChannel creates a channel for an account, or for no account with 0, and returns it with its key, which is
+// only ever returned here.
+func CreateClipChannel(accountId int64) (*ClipChannel, string, error) {
+	channel := &ClipChannel{Id: randomToken(), AccountId: accountId, CreatedAt: time.Now().UTC().Unix()}
+	channel.UpdatedAt = channel.CreatedAt
+	key := randomToken()
+	_, err := db.Exec("INSERT INTO ClipChannels(id, key_hash, account_id, seq, created_at, updated_at) VALUES ($1, $2, $3, 0, $4, $4)",
+		channel.Id, hashToken(key), channel.AccountId, channel.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return channel, key, nil
+}
+
+// OpenClipChannel returns a channel for the holder of its key, or of the key of one of its paired devices. A wrong key
+// is answered like a missing channel, so that the ids of channels cannot be probed.
+func OpenClipChannel(id, key string) (*ClipChannel, error) {
+	if key == "" {
+		return nil, ErrClipChannelNotFound
+	}
+	channel := new(ClipChannel)
+	device := new(ClipDevice)
+	err := db.QueryRow(`SELECT c.id, c.account_id, c.seq, c.created_at, c.updated_at,
+			COALESCE(d.id, ''), COALESCE(d.name, ''), COALESCE(d.created_at, 0), COALESCE(d.last_seen_at, 0)
+		FROM ClipChannels c LEFT JOIN ClipDevices d ON d.channel_id = c.id AND d.key_hash = $2
+		WHERE c.id = $1 AND (c.key_hash = $2 OR d.id IS NOT NULL)`,
+		id, hashToken(key)).Scan(&channel.Id, &channel.AccountId, &channel.Seq, &channel.CreatedAt, &channel.UpdatedAt,
+		&device.Id, &device.Name, &device.CreatedAt, &device.LastSeenAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrClipChannelNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if device.Id != "" {
+		channel.Device = device
+		touchClipDevice(device)
+	}
+	return channel, nil
+}
+
+// DeleteClipChannel deletes a channel with its history and its paired devices.
+func DeleteClipChannel(id string) error {
+	_, err := db.Exec("DELETE FROM ClipChannels WHERE id = $1", id)
+	return err
+}
+
+// PushClip adds a snippet to a channel, setting its number and time, and forgets the snippets beyond the history.
+func PushClip(id string, snippet *ClipSnippet) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	snippet.CreatedAt = time.Now().UTC().Unix()
+	err = tx.QueryRow("UPDATE ClipChannels SET seq = seq + 1, updated_at = $2 WHERE id = $1 RETURNING seq",
+		id, snippet.CreatedAt).Scan(&snippet.Seq)
+	if err == sql.ErrNoRows {
+		return ErrClipChannelNotFound
+	} else if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO ClipSnippets(channel_id, seq, body, device, created_at) VALUES ($1, $2, $3, $4, $5)",
+		id, snippet.Seq, snippet.Body, snippet.Device, snippet.CreatedAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM ClipSnippets WHERE channel_id = $1 AND seq <= $2", id, snippet.Seq-clipHistoryLength)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClipHistory returns the snippets of a channel pushed after the one numbered after, the latest first.
+func ClipHistory(id string, after int64) ([]ClipSnippet, error) {
+	rows, err := db.Query("SELECT seq, body, device, created_at FROM ClipSnippets WHERE channel_id = $1 AND seq > $2 ORDER BY seq DESC",
+		id, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snippets := []ClipSnippet{}
+	for rows.Next() {
+		var snippet ClipSnippet
+		if err = rows.Scan(&snippet.Seq, &snippet.Body, &snippet.Device, &snippet.CreatedAt); err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, snippet)
+	}
+	return snippets, rows.Err()
+}
+
+// A clipHub sends the snippets pushed to a channel to the devices connected to this server.
+type clipHub struct {
+	id      string
+	mu      sync.Mutex
+	seq     int64                       // The last snippet sent to the devices.
+	devices map[chan ClipSnippet]string // The id of the paired device of each connection, or "".
+}
+
+var clipHubs = struct {
+	sync.Mutex
+	m map[string]*clipHub
+}{m: make(map[string]*clipHub)}
+
+// joinClipChannel connects a device to a channel, to be sent the snippets pushed after seq.
+func joinClipChannel(channel *ClipChannel, device chan ClipSnippet) *clipHub {
+	clipHubs.Lock()
+	defer clipHubs.Unlock()
+	hub := clipHubs.m[channel.Id]
+	if hub == nil {
+		hub = &clipHub{id: channel.Id, seq: channel.Seq, devices: make(map[chan ClipSnippet]string)}
+		clipHubs.m[channel.Id] = hub
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.devices[device] = ""
+	if channel.Device != nil {
+		hub.devices[device] = channel.Device.Id
+	}
+	return hub
+}
+
+// leave disconnects a device.
+func (hub *clipHub) leave(device chan ClipSnippet) {
+	clipHubs.Lock()
+	defer clipHubs.Unlock()
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.dropLocked(device)
+	if len(hub.devices) == 0 && clipHubs.m[hub.id] == hub {
+		delete(clipHubs.m, hub.id)
+	}
+}
+
+func (hub *clipHub) dropLocked(device chan ClipSnippet) {
+	if _, ok := hub.devices[device]; ok {
+		delete(hub.devices, device)
+		close(device)
+	}
+}
+
+// sync sends the snippets pushed since the last sync to the devices. Devices that do not keep up are disconnected,
+// and read the history when they reconnect, as are revoked devices and all of them once the channel is deleted.
+func (hub *clipHub) sync() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.devices) == 0 {
+		return
+	}
+	paired, found, err := pairedClipDevices(hub.id)
+	if err != nil {
+		log.Printf("failed to check the devices of clip channel %v: %v", hub.id, err)
+		return
+	}
+	for device, id := range hub.devices {
+		if !found || id != "" && !paired[id] {
+			hub.dropLocked(device)
+		}
+	}
+	snippets, err := ClipHistory(hub.id, hub.seq)
+	if err != nil {
+		log.Printf("failed to relay the snippets of clip channel %v: %v", hub.id, err)
+		return
+	}
+	for i := len(snippets) - 1; i >= 0; i-- {
+		for device := range hub.devices {
+			select {
+			case device <- snippets[i]:
+			default:
+				hub.dropLocked(device)
+			}
+		}
+		hub.seq = snippets[i].Seq
+	}
+}
+
+// syncClipChannel sends the snippets pushed to a channel to its devices on every server, and disconnects those that
+// were revoked.
+func syncClipChannel(id string) {
+	clipHubs.Lock()
+	hub := clipHubs.m[id]
+	clipHubs.Unlock()
+	if hub != nil {
+		hub.sync()
+	}
+	if _, err := db.Exec("SELECT pg_notify($1, $2)", clipNotifyChannel, id); err != nil {
+		log.Printf("failed to notify other servers of the snippet pushed to clip channel %v: %v", id, err)
+	}
+}
+
+// listenForClips relays the snippets that other replicas notify of on clipNotifyChannel.
+func listenForClips() {
+	listener := pq.NewListener(dbConnStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("clip listener: %v", err)
+		}
+	})
+	if err := listener.Listen(clipNotifyChannel); err != nil {
+		log.Fatal("failed to listen for clips: ", err)
+	}
+	go func() {
+		for notification := range listener.Notify {
+			clipHubs.Lock()
+			var hubs []*clipHub
+			if notification == nil {
+				// The connection was lost and reestablished, so notifications may have been missed.
+				for _, hub := range clipHubs.m {
+					hubs = append(hubs, hub)
+				}
+			} else if hub := clipHubs.m[notification.Extra]; hub != nil {
+				hubs = append(hubs, hub)
+			}
+			clipHubs.Unlock()
+			for _, hub := range hubs {
+				hub.sync()
+			}
+		}
+	}()
+}
+
+// serveClipDevice sends the snippets pushed to a channel to a device connected over a WebSocket until it disconnects.
+func serveClipDevice(ws *websocket.Conn, channel *ClipChannel) {
+	device := make(chan ClipSnippet, 64)
+	hub := joinClipChannel(channel, device)
+	defer hub.leave(device)
+
+	// Nothing is received; reading notices when the device disconnects.
+	go func() {
+		io.Copy(io.Discard, ws)
+		hub.leave(device)
+	}()
+	for snippet := range device {
+		ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := websocket.JSON.Send(ws, snippet); err != nil {
+			break
+		}
+	}
+	ws.Close()
+}
+
+// clipKey returns the key a request holds for a clip channel, from the X-Clip-Key header, or the "key" query argument
+// for browsers, which cannot set headers on links and WebSockets.
+func clipKey(c *gin.Context) string {
+	if key := c.GetHeader("X-Clip-Key"); key != "" {
+		return key
+	}
+	return c.Query("key")
+}
+
+// openClipChannel returns the channel of a request for the holder of its key. On failure an error has been sent and
+// nil is returned.
+func openClipChannel(c *gin.Context) *ClipChannel {
+	channel, err := OpenClipChannel(c.Param("channel"), clipKey(c))
+	if errors.Is(err, ErrClipChannelNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return nil
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil
+	}
+	return channel
+}
+
+func registerClipChannelRoutes(r *gin.Engine) {
+	// Create a channel, answering with its id and its key, which is shown only once.
+	r.POST("/api/v1/clip/channels", rateLimit(PolicySubmit), func(c *gin.Context) {
+		var accountId int64
+		if account := currentAccount(c); account != nil {
+			accountId = account.Id
+		}
+		channel, key, err := CreateClipChannel(accountId)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"channel": channel.Id,
+			"key":     key,
+			"url":     fmt.Sprintf("%s/clip/%s", baseurl, channel.Id),
+			"history": fmt.Sprintf("%s/clip/%s/history?key=%s", baseurl, channel.Id, key),
+		})
+	})
+
+	// Delete a channel and its history.
+	r.DELETE("/api/v1/clip/channels/:channel", func(c *gin.Context) {
+		channel := openClipChannel(c)
+		if channel == nil {
+			return
+		}
+		if channel.Device != nil {
+			respondError(c, http.StatusForbidden, ErrNotClipOwner)
+			return
+		}
+		if err := DeleteClipChannel(channel.Id); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		syncClipChannel(channel.Id)
+		c.Status(http.StatusNoContent)
+	})
+
+	// Push the raw request body to a channel, as in: xclip -o | curl -T - -H "X-Clip-Key: $KEY" https://example.com/clip/$CHANNEL
+	// Snippets of paired devices are named after them in the history, and the optional X-Clip-Device header names the
+	// others.
+	r.PUT("/clip/:channel", meterUsage, rateLimit(PolicySubmit), limitRequestBody(maxUploadSize), func(c *gin.Context) {
+		channel := openClipChannel(c)
+		if channel == nil {
+			return
+		}
+		data, err := io.ReadAll(c.Request.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondTooLarge(c, -1, maxUploadSize)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			respondError(c, http.StatusBadRequest, ErrClipEmpty)
+			return
+		}
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			respondError(c, http.StatusBadRequest, errors.New("the request body must be UTF-8 text"))
+			return
+		}
+		if maxBodyLength != 0 && int64(len(data)) > maxBodyLength {
+			respondTooLarge(c, int64(len(data)), maxBodyLength)
+			return
+		}
+		snippet := &ClipSnippet{Body: string(data), Device: c.GetHeader("X-Clip-Device")}
+		if utf8.RuneCountInString(snippet.Device) > maxClipDevice {
+			respondError(c, http.StatusBadRequest, ErrClipDevice)
+			return
+		}
+		if channel.Device != nil {
+			snippet.Device = channel.Device.Name
+		}
+		if err = PushClip(channel.Id, snippet); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		syncClipChannel(channel.Id)
+		notifyClipPushed(channel, snippet)
+		c.JSON(http.StatusCreated, snippet)
+	})
+
+	// Read the latest snippet of a channel as plain text, as in: curl -H "X-Clip-Key: $KEY" https://example.com/clip/$CHANNEL | xclip
+	r.GET("/clip/:channel", func(c *gin.Context) {
+		channel := openClipChannel(c)
+		if channel == nil {
+			return
+		}
+		snippets, err := ClipHistory(channel.Id, channel.Seq-1)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if len(snippets) == 0 {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.Header("X-Clip-Seq", strconv.FormatInt(snippets[0].Seq, 10))
+		c.String(http.StatusOK, "%s", snippets[0].Body)
+	})
+
+	// List the snippets of a channel, the latest first, or only those pushed after the one numbered "after".
+	r.GET("/api/v1/clip/:channel/history", func(c *gin.Context) {
+		channel := openClipChannel(c)
+		if channel == nil {
+			return
+		}
+		after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errors.New(`"after" must be the number of a snippet`))
+			return
+		}
+		snippets, err := ClipHistory(channel.Id, after)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"channel":  channel.Id,
+			"seq":      channel.Seq,
+			"snippets": snippets,
+		})
+	})
+
+	// The page of the history, which adds the snippets pushed while it is open. The key is part of its URL, so it is
+	// never sent on to the sites the snippets link to.
+	r.GET("/clip/:channel/history", func(c *gin.Context) {
+		c.Header("Referrer-Policy", "no-referrer")
+		channel, err := OpenClipChannel(c.Param("channel"), clipKey(c))
+		if errors.Is(err, ErrClipChannelNotFound) {
+			route404(c)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		snippets, err := ClipHistory(channel.Id, 0)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		renderPage(c, http.StatusOK, "clip.html", gin.H{
+			"Page":     NewPageInfo(c, "Clipboard history"),
+			"Channel":  channel,
+			"Snippets": snippets,
+			"Key":      clipKey(c),
+			"PushKey":  vapidPublicKey, // Empty without Web Push.
+		})
+	})
+
+	// Be sent each snippet as JSON as it is pushed. The key is required like everywhere else, so the origin of the page
+	// that connects does not matter.
+	r.GET("/api/v1/clip/:channel/socket", func(c *gin.Context) {
+		channel := openClipChannel(c)
+		if channel == nil {
+			return
+		}
+		server := websocket.Server{
+			Handler: func(ws *websocket.Conn) {
+				serveClipDevice(ws, channel)
+			},
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+	})
+}
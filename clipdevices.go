@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Devices are paired with a clip channel by scanning a QR code, which holds the link to the history of the channel
+// with a key made for the device alone. Only the key the channel was created with pairs devices, lists them and revokes
+// them; a revoked key stops working at once, and the WebSockets it opened are closed on every server.
+
+// clipDeviceSeenInterval is how often the last time a paired device was seen is written, at most.
+const clipDeviceSeenInterval = 10 * time.Minute
+
+var (
+	ErrNotClipOwner       = errors.New("only the key the clip channel was created with may manage its devices")
+	ErrClipDeviceNotFound = errors.New("paired device not found")
+	ErrClipDeviceName     = fmt.Errorf("the name of a device must be 1 to %d characters", maxClipDevice)
+)
+
+// A ClipDevice holds a key of its own to a clip channel.
+type ClipDevice struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"created_at"`
+	LastSeenAt int64  `json:"last_seen_at"` // The last time the device used its key, within clipDeviceSeenInterval.
+}
+
+// PairClipDevice pairs a device with a channel, and returns it with its key, which is only ever returned here.
+func PairClipDevice(channelId, name string) (*ClipDevice, string, error) {
+	device := &ClipDevice{Id: randomToken(), Name: name, CreatedAt: time.Now().UTC().Unix()}
+	key := randomToken()
+	_, err := db.Exec("INSERT INTO ClipDevices(id, channel_id, name, key_hash, created_at, last_seen_at) VALUES ($1, $2, $3, $4, $5, 0)",
+		device.Id, channelId, device.Name, hashToken(key), device.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return device, key, nil
+}
+
+// ListClipDevices returns the devices paired with a channel, the first paired first.
+func ListClipDevices(channelId string) ([]ClipDevice, error) {
+	rows, err := db.Query("SELECT id, name, created_at, last_seen_at FROM ClipDevices WHERE channel_id = $1 ORDER BY created_at, id",
+		channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := []ClipDevice{}
+	for rows.Next() {
+		var device ClipDevice
+		if err = rows.Scan(&device.Id, &device.Name, &device.CreatedAt, &device.LastSeenAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// RevokeClipDevice unpairs a device from a channel, so that its key no longer opens it.
+func RevokeClipDevice(channelId, deviceId string) error {
+	result, err := db.Exec("DELETE FROM ClipDevices WHERE channel_id = $1 AND id = $2", channelId, deviceId)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrClipDeviceNotFound
+	}
+	return nil
+}
+
+// pairedClipDevices returns the ids of the devices paired with a channel, and whether the channel still exists.
+func pairedClipDevices(channelId string) (map[string]bool, bool, error) {
+	var found bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM ClipChannels WHERE id = $1)", channelId).Scan(&found); err != nil {
+		return nil, false, err
+	}
+	devices, err := ListClipDevices(channelId)
+	if err != nil {
+		return nil, false, err
+	}
+	paired := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		paired[device.Id] = true
+	}
+	return paired, found, nil
+}
+
+// touchClipDevice remembers that a device used its key, unless it was seen recently.
+func touchClipDevice(device *ClipDevice) {
+	now := time.Now().UTC().Unix()
+	if now-device.LastSeenAt < int64(clipDeviceSeenInterval.Seconds()) {
+		return
+	}
+	device.LastSeenAt = now
+	if _, err := db.Exec("UPDATE ClipDevices SET last_seen_at = $1 WHERE id = $2", now, device.Id); err != nil {
+		log.Printf("failed to record the use of clip device %v: %v", device.Id, err)
+	}
+}
+
+// clipPairingURL returns the link that a paired device opens the history of a channel with, which its QR code holds.
+func clipPairingURL(channelId, key string) string {
+	return fmt.Sprintf("%s/clip/%s/history?key=%s", baseurl, channelId, url.QueryEscape(key))
+}
+
+// checkClipDeviceName returns the name of a device to pair without surrounding spaces, or an error if it is empty or
+// too long.
+func checkClipDeviceName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxClipDevice {
+		return "", ErrClipDeviceName
+	}
+	return name, nil
+}
+
+// ownedClipChannel returns the channel of a request for the holder of the key it was created with. On failure an
+// error has been sent and nil is returned.
+func ownedClipChannel(c *gin.Context) *ClipChannel {
+	channel := openClipChannel(c)
+	if channel != nil && channel.Device != nil {
+		respondError(c, http.StatusForbidden, ErrNotClipOwner)
+		return nil
+	}
+	return channel
+}
+
+// respondRevokeClipDevice revokes the device of a request and disconnects it, answering an error on failure and
+// returning whether it was revoked.
+func respondRevokeClipDevice(c *gin.Context, channel *ClipChannel) bool {
+	err := RevokeClipDevice(channel.Id, c.Param("device"))
+	if errors.Is(err, ErrClipDeviceNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return false
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return false
+	}
+	syncClipChannel(channel.Id)
+	return true
+}
+
+func registerClipDeviceRoutes(r *gin.Engine) {
+	// Pair a device named "name", answering its key and the link it opens the channel with, also as a QR code image.
+	r.POST("/api/v1/clip/channels/:channel/devices", rateLimit(PolicySubmit), func(c *gin.Context) {
+		channel := ownedClipChannel(c)
+		if channel == nil {
+			return
+		}
+		name, err := checkClipDeviceName(c.PostForm("name"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		device, key, err := PairClipDevice(channel.Id, name)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		link := clipPairingURL(channel.Id, key)
+		qr, err := qrCodeDataURL(link)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"device":  device,
+			"key":     key,
+			"url":     link,
+			"qr_code": qr, // A PNG data URL.
+		})
+	})
+
+	// List the paired devices, with the last time each used its key.
+	r.GET("/api/v1/clip/channels/:channel/devices", func(c *gin.Context) {
+		channel := ownedClipChannel(c)
+		if channel == nil {
+			return
+		}
+		devices, err := ListClipDevices(channel.Id)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"devices": devices})
+	})
+
+	// Revoke a device, which is disconnected at once.
+	r.DELETE("/api/v1/clip/channels/:channel/devices/:device", func(c *gin.Context) {
+		channel := ownedClipChannel(c)
+		if channel == nil {
+			return
+		}
+		if respondRevokeClipDevice(c, channel) {
+			c.Status(http.StatusNoContent)
+		}
+	})
+
+	// The page that pairs and revokes devices. Like the history, it is opened with the key in its URL, which is never
+	// sent on to other sites.
+	renderDevices := func(c *gin.Context, channel *ClipChannel, paired gin.H) {
+		devices, err := ListClipDevices(channel.Id)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		renderPage(c, http.StatusOK, "clipdevices.html", gin.H{
+			"Page":    NewPageInfo(c, "Paired devices"),
+			"Channel": channel,
+			"Devices": devices,
+			"Key":     clipKey(c),
+			"Paired":  paired,
+		})
+	}
+	r.GET("/clip/:channel/devices", func(c *gin.Context) {
+		c.Header("Referrer-Policy", "no-referrer")
+		channel, err := OpenClipChannel(c.Param("channel"), clipKey(c))
+		if errors.Is(err, ErrClipChannelNotFound) || err == nil && channel.Device != nil {
+			route404(c)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		renderDevices(c, channel, nil)
+	})
+
+	// The forms of the page, which work without JavaScript. A new device is shown once, with its QR code to scan.
+	r.POST("/clip/:channel/devices", formPost, rateLimit(PolicySubmit), func(c *gin.Context) {
+		c.Header("Referrer-Policy", "no-referrer")
+		channel := ownedClipChannel(c)
+		if channel == nil {
+			return
+		}
+		name, err := checkClipDeviceName(c.PostForm("name"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		device, key, err := PairClipDevice(channel.Id, name)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		link := clipPairingURL(channel.Id, key)
+		qr, err := qrCodeDataURL(link)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		renderDevices(c, channel, gin.H{"Device": device, "URL": link, "QRCode": qr})
+	})
+	r.POST("/clip/:channel/devices/:device/revoke", formPost, func(c *gin.Context) {
+		channel := ownedClipChannel(c)
+		if channel == nil {
+			return
+		}
+		if respondRevokeClipDevice(c, channel) {
+			respondFormRedirect(c, fmt.Sprintf("/clip/%s/devices?key=%s", channel.Id, url.QueryEscape(clipKey(c))))
+		}
+	})
+}
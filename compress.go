@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressThreshold is the size in bytes from which bodies and attachments are stored compressed with zstd, or 0 to
+// store everything as is.
+var compressThreshold int64
+
+// The encoder and decoder are safe for concurrent use with EncodeAll and DecodeAll.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func initCompression() {
+	compressThreshold = envInt64("COMPRESS_THRESHOLD_BYTES", 16*1024)
+	if compressThreshold < 0 {
+		log.Fatal("COMPRESS_THRESHOLD_BYTES environment variable must not be negative")
+	}
+}
+
+// compress returns data compressed with zstd, or nil if it is under the threshold or does not compress well enough
+// to be worth decompressing on every read, like images and archives that are compressed already.
+func compress(data []byte) []byte {
+	if compressThreshold == 0 || int64(len(data)) < compressThreshold {
+		return nil
+	}
+	compressed := zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if len(compressed) > len(data)-len(data)/8 {
+		return nil
+	}
+	return compressed
+}
+
+func decompress(compressed []byte) ([]byte, error) {
+	data, err := zstdDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %v", err)
+	}
+	return data, nil
+}
+
+// Compress replaces the contents of the file with their zstd compression if that makes them smaller.
+func (f *FileObject) Compress() {
+	if compressed := compress(f.Contents); compressed != nil {
+		f.Contents = compressed
+		f.Compression = "zstd"
+	}
+}
+
+// newDecompressor returns a reader of the original contents of r, which were compressed with the given compression.
+// Streams are decompressed with a single goroutine and a bounded window, to keep the memory of each download small.
+func newDecompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "":
+		return io.NopCloser(r), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
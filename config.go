@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// envInt64 reads an integer environment variable, returning fallback when it is unset.
+// The server refuses to start if the variable is set to something other than an integer.
+func envInt64(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("%s environment variable must be an integer: %v", name, err)
+	}
+	return n
+}
+
+// envBool reports whether an environment variable is set to "true".
+func envBool(name string) bool {
+	return os.Getenv(name) == "true"
+}
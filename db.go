@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"database/sql"
 	"errors"
@@ -12,14 +13,19 @@ import (
 	"time"
 
 	"github.com/lib/pq"
-	"github.com/lpernett/godotenv"
 )
 
 var db *sql.DB
 
+// dbConnStr is kept for connections outside of the pool, such as the listener of upload changes.
+var dbConnStr string
+
 var (
 	ErrConstraintUnique = errors.New("a field failed the UNIQUE constraint")
-	ErrHashInvalid      = errors.New("hash is not valid hex or has a length less than 10 or greater than 40")
+	ErrHashInvalid      = errors.New("hash is not a valid upload ID")
+
+	ErrUploadNotFound     = errors.New("upload not found")
+	ErrAttachmentNotFound = errors.New("attachment not found")
 )
 
 // The UploadModel represents a row in the database.
@@ -30,11 +36,51 @@ type UploadModel struct {
 	FileNames  []string
 	FileHashes []string
 	Timestamp  int64
+	Private    bool  // Private uploads can only be viewed through signed share links.
+	PublishAt  int64 // Unix time before which the upload is embargoed, or 0 to publish immediately.
+	AccountId  int64 // The account that submitted the upload, or 0 for anonymous uploads.
+	TeamId     int64 // The team the upload belongs to, or 0. Team uploads are only visible to members.
+
+	TakedownReason string  // Why the content was removed for legal reasons, shown on the tombstone page.
+	TakedownAt     int64   // Unix time of the takedown, or 0 if the upload has not been taken down.
+	DeletedAt      int64   // Unix time the upload was moved to the trash, or 0.
+	ExpiresAt      int64   // Unix time after which the upload is deleted, or 0 to keep it.
+	Language       string  // What the body is written in, one of languages.
+	GeoRule        GeoRule // The countries the owner allows to view and download the upload.
+	Watermark      bool    // Whether downloaded images are watermarked with who downloaded them.
+	ShortLength    int     // How many characters of the hash its links use; see ShortHash.
+	ShortAlphabet  string  // The alphabet the hash is written in by its links, "hex" or "base56".
+
+	QuarantineReason string // Why the upload is held for review, shown to its owner.
+	QuarantinedAt    int64  // Unix time the upload was quarantined, or 0; see dlp.go.
+	DuplicateOf      string // Hash of the upload this one is almost the same as, or ""; see nearduplicates.go.
+
+	editToken   string // SHA-256 of the token that authorizes the submitter to manage the upload.
+	shareSecret string // Mixed into share link signatures; rotating it revokes every link.
+	bodyKey     string // Key of the object holding the body when it is too large for the database, or empty.
+}
+
+// UploadOptions describe a new upload beyond its body and attachments.
+type UploadOptions struct {
+	Private    bool
+	PublishAt  time.Time // The zero time publishes immediately.
+	UploaderIP string
+	AccountId  int64
+	TeamId     int64
+	Size       int64     // Total bytes of the body and attachments, counted against the uploader's quota.
+	ExpiresAt  time.Time // The zero time keeps the upload until it is deleted.
+	Language   string    // One of languages, or "" to detect it.
+}
+
+// salted reports whether the upload is private, embargoed, for a team or expiring. The hash of such an upload and the
+// keys of its attachments are salted, so that they cannot be derived from its contents.
+func (options UploadOptions) salted() bool {
+	return options.Private || !options.PublishAt.IsZero() || options.TeamId != 0 || !options.ExpiresAt.IsZero()
 }
 
 func init() {
 	// Open the .env file and load the variables into the environment.
-	err := godotenv.Load()
+	err := loadEnvFile()
 	if err != nil {
 		log.Fatal("Error loading .env file:", err)
 	}
@@ -44,10 +90,10 @@ func init() {
 	dbUser := os.Getenv("DB_USER")
 	dbPass := os.Getenv("DB_PASS")
 
-	connStr := fmt.Sprintf("postgresql://%s:%s@%s?sslmode=require&port=%s", dbUser, dbPass, dbHost, dbPort)
+	dbConnStr = fmt.Sprintf("postgresql://%s:%s@%s?sslmode=require&port=%s", dbUser, dbPass, dbHost, dbPort)
 
 	// Connect to the PostgreSQL database using the connection string.
-	db, err = sql.Open("postgres", connStr)
+	db, err = sql.Open("postgres", dbConnStr)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -58,19 +104,463 @@ func init() {
 	}
 }
 
-func initDB(db *sql.DB) error {
-	query := `
-	CREATE TABLE IF NOT EXISTS Uploads(
+// schema is executed in order every time the server starts, so each statement must be safe to run repeatedly.
+// New columns are added with ALTER TABLE statements appended to the end.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS Uploads(
 		id BIGSERIAL PRIMARY KEY,
 		hash CHAR(40) NOT NULL UNIQUE,
 		body TEXT,
 		files TEXT ARRAY,
 		timestamp BIGINT NOT NULL
-	)
-	`
+	)`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS private BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS edit_token TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS share_secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS publish_at BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS uploader_ip TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS uploads_uploader_ip ON Uploads(uploader_ip)`,
+	`CREATE TABLE IF NOT EXISTS Accounts(
+		id BIGSERIAL PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL,
+		api_token TEXT NOT NULL UNIQUE,
+		created BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS Teams(
+		id BIGSERIAL PRIMARY KEY,
+		slug TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		created BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS TeamMembers(
+		team_id BIGINT NOT NULL REFERENCES Teams(id) ON DELETE CASCADE,
+		account_id BIGINT NOT NULL REFERENCES Accounts(id) ON DELETE CASCADE,
+		role TEXT NOT NULL,
+		joined BIGINT NOT NULL,
+		PRIMARY KEY (team_id, account_id)
+	)`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS account_id BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS team_id BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS uploads_account_id ON Uploads(account_id)`,
+	`CREATE INDEX IF NOT EXISTS uploads_team_id ON Uploads(team_id, timestamp)`,
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS takedown_reason TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS takedown_at BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS deleted_at BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS uploads_deleted_at ON Uploads(deleted_at) WHERE deleted_at <> 0`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS archived BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS Objects(
+		key TEXT PRIMARY KEY,
+		store TEXT NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		size BIGINT NOT NULL,
+		updated BIGINT NOT NULL
+	)`,
+	`ALTER TABLE Objects ADD COLUMN IF NOT EXISTS content_sha256 TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS body_zstd BYTEA NOT NULL DEFAULT ''`, // Replaces body when compressed.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS expires_at BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS uploads_expires_at ON Uploads(expires_at) WHERE expires_at <> 0`,
+	`CREATE TABLE IF NOT EXISTS AuditLog(
+		id BIGSERIAL PRIMARY KEY,
+		timestamp BIGINT NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		details TEXT NOT NULL,
+		ip TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS Announcements(
+		id BIGSERIAL PRIMARY KEY,
+		message TEXT NOT NULL,
+		level TEXT NOT NULL,
+		starts_at BIGINT NOT NULL,
+		ends_at BIGINT NOT NULL,
+		dismissible BOOLEAN NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS Terms(
+		version BIGSERIAL PRIMARY KEY,
+		text TEXT NOT NULL,
+		published_at BIGINT NOT NULL,
+		published_by TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS TermsAcceptances(
+		account_id BIGINT NOT NULL REFERENCES Accounts(id) ON DELETE CASCADE,
+		version BIGINT NOT NULL REFERENCES Terms(version),
+		accepted_at BIGINT NOT NULL,
+		ip TEXT NOT NULL,
+		PRIMARY KEY (account_id, version)
+	)`,
+	`CREATE TABLE IF NOT EXISTS Claims(
+		token_hash CHAR(64) NOT NULL,
+		upload_hash CHAR(40) NOT NULL REFERENCES Uploads(hash) ON DELETE CASCADE,
+		created BIGINT NOT NULL,
+		PRIMARY KEY (token_hash, upload_hash)
+	)`,
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`, // Of the last accepted code.
+	`CREATE TABLE IF NOT EXISTS RecoveryCodes(
+		account_id BIGINT NOT NULL REFERENCES Accounts(id) ON DELETE CASCADE,
+		code_hash CHAR(64) NOT NULL,
+		PRIMARY KEY (account_id, code_hash)
+	)`,
+	`CREATE TABLE IF NOT EXISTS Sessions(
+		id BIGSERIAL PRIMARY KEY,
+		token_hash CHAR(64) NOT NULL UNIQUE,
+		account_id BIGINT NOT NULL REFERENCES Accounts(id) ON DELETE CASCADE,
+		created BIGINT NOT NULL,
+		last_seen BIGINT NOT NULL,
+		expires BIGINT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_account_id ON Sessions(account_id)`,
+	// The id of accounts at an external identity provider, or '' for accounts with a password; see identity.go.
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS external_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS accounts_external_id ON Accounts(external_id) WHERE external_id <> ''`,
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+	// Accounts created through SCIM, with the id the identity provider gave them; see scim.go.
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS provisioned BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS scim_external_id TEXT NOT NULL DEFAULT ''`,
+	// When an upload was last read from the database, to warm the upload cache with; see uploadcache.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS last_accessed BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS uploads_last_accessed ON Uploads(last_accessed)`,
+	// Objects referenced by uploads that were deleted from storage outside of copycat; see storageevents.go.
+	`CREATE TABLE IF NOT EXISTS MissingObjects(
+		key TEXT PRIMARY KEY,
+		since BIGINT NOT NULL,
+		reason TEXT NOT NULL
+	)`,
+	// When objects were last verified by the integrity job, and when they were found corrupted; see integrity.go.
+	`ALTER TABLE Objects ADD COLUMN IF NOT EXISTS verified BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE Objects ADD COLUMN IF NOT EXISTS corrupted_at BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS objects_verified ON Objects(verified)`,
+	// The key of the object holding the body of uploads too large for the database; see bodystore.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS body_key TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS uploads_body_key ON Uploads(body_key) WHERE body_key <> ''`, // Bodies are shared; see attachments.go.
+	// What the body of uploads is written in; see language.go. Uploads from before are plain text.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS language TEXT NOT NULL DEFAULT 'text'`,
+	// The responses to submissions made with an idempotency key, with a status of 0 while in progress; see idempotency.go.
+	`CREATE TABLE IF NOT EXISTS IdempotencyKeys(
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		response BYTEA,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (scope, key)
+	)`,
+	// Text being composed, owned by an account or by the holder of a claim token; see drafts.go.
+	`CREATE TABLE IF NOT EXISTS Drafts(
+		id BIGSERIAL PRIMARY KEY,
+		account_id BIGINT NOT NULL DEFAULT 0,
+		claim_hash TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		language TEXT NOT NULL,
+		revision BIGINT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS drafts_account_id ON Drafts(account_id) WHERE account_id <> 0`,
+	`CREATE INDEX IF NOT EXISTS drafts_claim_hash ON Drafts(claim_hash) WHERE claim_hash <> ''`,
+	`CREATE INDEX IF NOT EXISTS drafts_updated_at ON Drafts(updated_at)`,
+	// Text that pre-fills the upload page, shared with everyone or owned by an account; see pastetemplates.go.
+	`CREATE TABLE IF NOT EXISTS PasteTemplates(
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		body TEXT NOT NULL,
+		language TEXT NOT NULL,
+		account_id BIGINT NOT NULL DEFAULT 0,
+		created_by TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS paste_templates_account_id ON PasteTemplates(account_id)`,
+	// Text being written together before it is uploaded, and the changes made to it; see liveedit.go.
+	`CREATE TABLE IF NOT EXISTS LiveDocuments(
+		id TEXT PRIMARY KEY,
+		account_id BIGINT NOT NULL REFERENCES Accounts(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		revision BIGINT NOT NULL,
+		published_hash TEXT NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS live_documents_updated_at ON LiveDocuments(updated_at)`,
+	`CREATE TABLE IF NOT EXISTS LiveEditOps(
+		document_id TEXT NOT NULL REFERENCES LiveDocuments(id) ON DELETE CASCADE,
+		revision BIGINT NOT NULL,
+		operation TEXT NOT NULL,
+		author TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (document_id, revision)
+	)`,
+	// Daily counts of the views of uploads and the downloads of attachments; see analytics.go.
+	`CREATE TABLE IF NOT EXISTS UploadAnalytics(
+		target TEXT NOT NULL,
+		event TEXT NOT NULL,
+		day TEXT NOT NULL,
+		country TEXT NOT NULL,
+		referrer TEXT NOT NULL,
+		count BIGINT NOT NULL,
+		PRIMARY KEY (target, event, day, country, referrer)
+	)`,
+	`CREATE INDEX IF NOT EXISTS upload_analytics_day ON UploadAnalytics(day)`,
+	// Countries that owners allow to view an upload and download its attachments, as comma-separated codes; see geo.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS geo_allow TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS geo_deny TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS ObjectGeoRules(
+		key TEXT PRIMARY KEY,
+		upload_hash TEXT NOT NULL,
+		allow TEXT NOT NULL,
+		deny TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS object_geo_rules_upload ON ObjectGeoRules(upload_hash)`,
+	// Codes that unlock an upload once; see accesscode.go.
+	`CREATE TABLE IF NOT EXISTS AccessCodes(
+		upload_hash TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		created_at BIGINT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (upload_hash, code_hash)
+	)`,
+	// Sensitive uploads, whose images are watermarked when downloaded; see watermark.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS watermark BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS WatermarkedObjects(
+		key TEXT NOT NULL,
+		upload_hash TEXT NOT NULL,
+		PRIMARY KEY (key, upload_hash)
+	)`,
+	`CREATE INDEX IF NOT EXISTS watermarked_objects_upload ON WatermarkedObjects(upload_hash)`,
+	// Keys of objects merged into others by the dedup command, which downloads are redirected from; see dedup.go.
+	`CREATE TABLE IF NOT EXISTS ObjectAliases(
+		key TEXT PRIMARY KEY,
+		target TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS object_aliases_target ON ObjectAliases(target)`,
+	// The storage and transfers of accounts and their API keys per month; see usage.go.
+	`CREATE TABLE IF NOT EXISTS MonthlyUsage(
+		month TEXT NOT NULL,
+		account_id BIGINT NOT NULL,
+		api_key TEXT NOT NULL,
+		stored_bytes BIGINT NOT NULL DEFAULT 0,
+		peak_stored_bytes BIGINT NOT NULL DEFAULT 0,
+		received_bytes BIGINT NOT NULL DEFAULT 0,
+		sent_bytes BIGINT NOT NULL DEFAULT 0,
+		requests BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (month, account_id, api_key)
+	)`,
+	// How many characters of the hash the links of an upload use; see shorthash.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS short_length INTEGER NOT NULL DEFAULT 10`,
+	// Uploads held for review after a compliance scan, and their attachments that downloads are refused for; see dlp.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS quarantine_reason TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS quarantined_at BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS uploads_quarantined_at ON Uploads(quarantined_at) WHERE quarantined_at <> 0`,
+	`CREATE TABLE IF NOT EXISTS QuarantinedObjects(
+		key TEXT NOT NULL,
+		upload_hash TEXT NOT NULL,
+		PRIMARY KEY (key, upload_hash)
+	)`,
+	`CREATE INDEX IF NOT EXISTS quarantined_objects_upload ON QuarantinedObjects(upload_hash)`,
+	// Uploads starred by accounts, and uploads pinned to the browse page by admins; see favorites.go.
+	`CREATE TABLE IF NOT EXISTS Favorites(
+		account_id BIGINT NOT NULL REFERENCES Accounts(id) ON DELETE CASCADE,
+		upload_hash CHAR(40) NOT NULL REFERENCES Uploads(hash) ON DELETE CASCADE,
+		created BIGINT NOT NULL,
+		PRIMARY KEY (account_id, upload_hash)
+	)`,
+	`CREATE INDEX IF NOT EXISTS favorites_upload ON Favorites(upload_hash)`,
+	`CREATE TABLE IF NOT EXISTS PinnedUploads(
+		upload_hash CHAR(40) PRIMARY KEY REFERENCES Uploads(hash) ON DELETE CASCADE,
+		pinned_by TEXT NOT NULL,
+		pinned_at BIGINT NOT NULL
+	)`,
+	// MinHash signatures of upload bodies, and the buckets of their bands, to suggest related uploads; see related.go.
+	`CREATE TABLE IF NOT EXISTS UploadSignatures(
+		upload_hash CHAR(40) PRIMARY KEY REFERENCES Uploads(hash) ON DELETE CASCADE,
+		signature BIGINT ARRAY NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS UploadBands(
+		upload_hash CHAR(40) NOT NULL REFERENCES Uploads(hash) ON DELETE CASCADE,
+		bucket BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS upload_bands_bucket ON UploadBands(bucket)`,
+	`CREATE INDEX IF NOT EXISTS upload_bands_upload ON UploadBands(upload_hash)`,
+	// The upload a new upload is almost the same as; see nearduplicates.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS duplicate_of TEXT NOT NULL DEFAULT ''`,
+	// What the last malware scan of an object found, and with which signature database; see virusscan.go.
+	`ALTER TABLE Objects ADD COLUMN IF NOT EXISTS scan_status TEXT NOT NULL DEFAULT 'pending'`,
+	`ALTER TABLE Objects ADD COLUMN IF NOT EXISTS scan_result TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Objects ADD COLUMN IF NOT EXISTS scan_version TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE Objects ADD COLUMN IF NOT EXISTS scanned_at BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS objects_scanned_at ON Objects(scanned_at)`,
+	// Response headers set by owners for the raw views of their uploads; see raw.go.
+	`CREATE TABLE IF NOT EXISTS RawHeaders(
+		upload_hash CHAR(40) NOT NULL REFERENCES Uploads(hash) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (upload_hash, name)
+	)`,
+	// Attachments added to and removed from uploads after they were submitted; see attachmentedits.go.
+	`CREATE TABLE IF NOT EXISTS UploadRevisions(
+		upload_hash CHAR(40) NOT NULL REFERENCES Uploads(hash) ON DELETE CASCADE,
+		revision INT NOT NULL,
+		action TEXT NOT NULL,
+		name TEXT NOT NULL,
+		key TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		created BIGINT NOT NULL,
+		PRIMARY KEY (upload_hash, revision)
+	)`,
+	// The alphabet the links of an upload write its hash in; see shorthash.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS short_alphabet TEXT NOT NULL DEFAULT 'hex'`,
+	// Channels sharing snippets between devices, and their last snippets; see clipchannels.go.
+	`CREATE TABLE IF NOT EXISTS ClipChannels(
+		id TEXT PRIMARY KEY,
+		key_hash TEXT NOT NULL,
+		account_id BIGINT NOT NULL DEFAULT 0,
+		seq BIGINT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS clip_channels_updated_at ON ClipChannels(updated_at)`,
+	`CREATE TABLE IF NOT EXISTS ClipSnippets(
+		channel_id TEXT NOT NULL REFERENCES ClipChannels(id) ON DELETE CASCADE,
+		seq BIGINT NOT NULL,
+		body TEXT NOT NULL,
+		device TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (channel_id, seq)
+	)`,
+	// The devices paired with clip channels, each with a key of its own; see clipdevices.go.
+	`CREATE TABLE IF NOT EXISTS ClipDevices(
+		id TEXT PRIMARY KEY,
+		channel_id TEXT NOT NULL REFERENCES ClipChannels(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at BIGINT NOT NULL,
+		last_seen_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS clip_devices_channel_id ON ClipDevices(channel_id)`,
+	// The browsers that are sent Web Push messages, and what each subscribed to; see webpush.go.
+	`CREATE TABLE IF NOT EXISTS PushSubscriptions(
+		endpoint TEXT PRIMARY KEY,
+		p256dh TEXT NOT NULL,
+		auth TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ClipPushSubscriptions(
+		channel_id TEXT NOT NULL REFERENCES ClipChannels(id) ON DELETE CASCADE,
+		device_id TEXT REFERENCES ClipDevices(id) ON DELETE CASCADE,
+		endpoint TEXT NOT NULL REFERENCES PushSubscriptions(endpoint) ON DELETE CASCADE,
+		PRIMARY KEY (channel_id, endpoint)
+	)`,
+	`CREATE TABLE IF NOT EXISTS UploadWatches(
+		upload_hash TEXT NOT NULL,
+		endpoint TEXT NOT NULL REFERENCES PushSubscriptions(endpoint) ON DELETE CASCADE,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (upload_hash, endpoint)
+	)`,
+	// Objects stored or reused for a submission are kept until its upload refers to them; see attachments.go.
+	`ALTER TABLE Objects ADD COLUMN IF NOT EXISTS reserved_until BIGINT NOT NULL DEFAULT 0`,
+	// Objects taken down with an upload, which are not served even to the uploads sharing them; see admin.go.
+	`CREATE TABLE IF NOT EXISTS TakenDownObjects(
+		key TEXT PRIMARY KEY,
+		upload_hash TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		taken_down_at BIGINT NOT NULL
+	)`,
+	// Wrong codes entered at the second step of logging in, which end it after a few; see twofactor.go.
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS totp_failures INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE Accounts ADD COLUMN IF NOT EXISTS totp_failed_at BIGINT NOT NULL DEFAULT 0`,
+	// The IP address that started an anonymous draft, which limits how many one address keeps; see drafts.go.
+	`ALTER TABLE Drafts ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS drafts_ip ON Drafts(ip) WHERE ip <> ''`,
+	// Uploads offered to accounts, which only become theirs once they accept; see transfer.go.
+	`CREATE TABLE IF NOT EXISTS TransferOffers(
+		upload_hash CHAR(40) PRIMARY KEY REFERENCES Uploads(hash) ON DELETE CASCADE,
+		account_id BIGINT NOT NULL REFERENCES Accounts(id) ON DELETE CASCADE,
+		from_account_id BIGINT NOT NULL,
+		from_team_id BIGINT NOT NULL,
+		offered_by TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS transfer_offers_account_id ON TransferOffers(account_id)`,
+	// Who moved an upload to the trash, or '' for its owner, whom only moderators restore for; see trash.go.
+	`ALTER TABLE Uploads ADD COLUMN IF NOT EXISTS deleted_by TEXT NOT NULL DEFAULT ''`,
+}
 
-	_, err := db.Exec(query)
-	return err
+func initDB(db *sql.DB) error {
+	for _, query := range schema {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadColumns lists the columns read by scanUpload, in order.
+const uploadColumns = "id, hash, body, files, timestamp, private, edit_token, share_secret, publish_at, account_id, team_id, " +
+	"takedown_reason, takedown_at, deleted_at, body_zstd, expires_at, body_key, language, geo_allow, geo_deny, watermark, short_length, " +
+	"quarantine_reason, quarantined_at, duplicate_of, short_alphabet"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// scanUpload reads a row selected with uploadColumns into an UploadModel.
+func scanUpload(row rowScanner) (*UploadModel, error) {
+	upload := new(UploadModel)
+	var files []string
+	var bodyZstd []byte
+	var geoAllow, geoDeny string
+	if err := row.Scan(&upload.Id, &upload.Hash, &upload.Body, (*pq.StringArray)(&files), &upload.Timestamp,
+		&upload.Private, &upload.editToken, &upload.shareSecret, &upload.PublishAt,
+		&upload.AccountId, &upload.TeamId, &upload.TakedownReason, &upload.TakedownAt, &upload.DeletedAt, &bodyZstd,
+		&upload.ExpiresAt, &upload.bodyKey, &upload.Language, &geoAllow, &geoDeny, &upload.Watermark,
+		&upload.ShortLength, &upload.QuarantineReason, &upload.QuarantinedAt,
+		&upload.DuplicateOf, &upload.ShortAlphabet); err != nil {
+		return nil, err
+	}
+	upload.GeoRule = parseGeoRule(geoAllow, geoDeny)
+	if len(bodyZstd) > 0 {
+		body, err := decompress(bodyZstd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the body of upload %v: %v", upload.Hash, err)
+		}
+		upload.Body = string(body)
+	}
+
+	// Separate the filenames from the hashes so we can pass it into the templates without issues.
+	upload.FileNames = make([]string, len(files))
+	upload.FileHashes = make([]string, len(files))
+	for i, file := range files {
+		// Example: mytextdocument.txt/9a3b4fa77a9c243f132ab23
+		upload.FileNames[i], upload.FileHashes[i] = fileName(file), fileKey(file)
+	}
+
+	return upload, nil
+}
+
+// Published reports whether the upload's embargo, if it has one, has passed.
+func (upload *UploadModel) Published() bool {
+	return time.Now().Unix() >= upload.PublishAt
+}
+
+// salted reports whether the keys of attachments added to the upload are salted, as they are when it is submitted with
+// options that are salted.
+func (upload *UploadModel) salted() bool {
+	return upload.Private || upload.PublishAt != 0 || upload.TeamId != 0 || upload.ExpiresAt != 0
 }
 
 func isValidHex(s string) bool {
@@ -83,60 +573,247 @@ func isValidHex(s string) bool {
 }
 
 // GetUpload fetches a row from the database matching the hash, by checking if the row's hash string begins with the hash parameter string.
-// The hash must be a valid hex string in lowercase, and must have a length >= 10 and <= 40.
+// The hash is the ID of an upload in any alphabet, or its full hash; see shorthash.go.
 func GetUpload(hash string) (*UploadModel, error) {
 	// Validate the hash before querying
-	if len(hash) < 10 || len(hash) > 40 || !isValidHex(hash) {
-		return nil, ErrHashInvalid
+	condition, args, err := uploadCondition(hash)
+	if err != nil {
+		return nil, err
 	}
 
-	upload := new(UploadModel)
-	var files []string
-
 	// Fetch the row matching the hash parameter as a prefix or a perfect match.
-	// Notice that it was not possible to write LIKE '$1%', as that would cause an error with our PostgreSQL driver, pq.
-	// Instead, it was recommended to join the strings using the '||' operator.
-	row := db.QueryRow("SELECT * FROM Uploads WHERE hash LIKE $1 || '%'", hash)
-	if err := row.Scan(&upload.Id, &upload.Hash, &upload.Body, (*pq.StringArray)(&files), &upload.Timestamp); err != nil {
+	// Expired uploads are hidden right away, even though the expiry job only deletes them periodically.
+	if upload := uploadCache.Get(hash); upload != nil {
+		return upload, nil
+	}
+	upload, err := scanUpload(db.QueryRow("SELECT "+uploadColumns+" FROM Uploads WHERE "+condition+
+		fmt.Sprintf(" AND deleted_at = 0 AND (expires_at = 0 OR expires_at > $%d) ORDER BY id LIMIT 1", len(args)+1),
+		append(args, time.Now().UTC().Unix())...))
+	if err != nil {
 		return nil, err
 	}
-
-	// Separate the filenames from the hashes so we can pass it into the templates without issues.
-	upload.FileNames = make([]string, len(files))
-	upload.FileHashes = make([]string, len(files))
-	for i, file := range files {
-		parts := strings.Split(file, "/") // Example: mytextdocument.txt/9a3b4fa77a9c243f132ab23
-		upload.FileNames[i] = parts[0]
-		upload.FileHashes[i] = parts[1]
+	if err = upload.loadBody(context.Background()); err != nil {
+		return nil, err
+	}
+	uploadCache.Put(hash, upload)
+	if recordAccess {
+		go touchUpload(upload.Hash)
 	}
-
 	return upload, nil
 }
 
-// SubmitUpload creates a row in the database containing the plaintext body parameter and a sequence of filename/hash pairs.
-// The plaintext body and filename/hash pairs are hashed together using SHA-1 to create uniqueness in the database.
-func SubmitUpload(body string, fileNameHashPairs []string) (string, error) {
+// GetTrashedUpload fetches an upload in the trash, by the same hash prefix as GetUpload.
+func GetTrashedUpload(hash string) (*UploadModel, error) {
+	condition, args, err := uploadCondition(hash)
+	if err != nil {
+		return nil, err
+	}
+	return scanUpload(db.QueryRow("SELECT "+uploadColumns+" FROM Uploads WHERE "+condition+" AND deleted_at <> 0 ORDER BY id LIMIT 1", args...))
+}
+
+// UploadHash returns the hash identifying an upload of the plaintext body and a sequence of filename/hash pairs.
+// The body and pairs are hashed together using SHA-1 to create uniqueness in the database.
+func UploadHash(body string, fileNameHashPairs []string, options UploadOptions) string {
 	// Combine the body and fileHashes into a single buffer.
 	buffer := new(bytes.Buffer)
 	buffer.WriteString(body)
 	buffer.WriteString(strings.Join(fileNameHashPairs, ""))
 
+	// Private, embargoed and team uploads are never deduplicated. Salting their hash prevents anyone from confirming
+	// that such an upload exists by submitting the same content again. Expiring uploads are not deduplicated either, so
+	// that an upload never disappears because someone else submitted the same content with an expiry.
+	if options.salted() {
+		buffer.WriteString(randomToken())
+	}
+
 	// Generate a hash of the buffer, which makes it unique to those exact files uploaded and/or the plaintext body.
-	hash := fmt.Sprintf("%x", sha1.Sum(buffer.Bytes()))
+	return fmt.Sprintf("%x", sha1.Sum(buffer.Bytes()))
+}
+
+// SubmitUpload creates a row in the database containing the plaintext body parameter and a sequence of filename/hash
+// pairs, under the hash returned by UploadHash. The returned edit token authorizes the submitter to manage the upload.
+// When the upload already existed, no token is returned but the existing upload is, so that submitters can be told.
+func SubmitUpload(hash string, body string, fileNameHashPairs []string, options UploadOptions) (editToken string, existing *UploadModel, err error) {
+	editToken = randomToken()
+
+	var publishAt, expiresAt int64
+	if !options.PublishAt.IsZero() {
+		publishAt = options.PublishAt.Unix()
+	}
+	if !options.ExpiresAt.IsZero() {
+		expiresAt = options.ExpiresAt.Unix()
+	}
+
+	language := options.Language
+	if language == "" {
+		names := make([]string, len(fileNameHashPairs))
+		for i, pair := range fileNameHashPairs {
+			names[i] = fileName(pair)
+		}
+		language = detectLanguage(body, names)
+	}
+
+	// Huge bodies are stored as objects, and large ones compressed in body_zstd instead, leaving body empty.
+	text := body
+	bodyKey, err := storeBody(context.Background(), hash, body, options.AccountId)
+	if err != nil {
+		return "", nil, err
+	}
+	var bodyZstd []byte
+	if bodyKey != "" {
+		body = ""
+	} else if bodyZstd = compress([]byte(body)); bodyZstd != nil {
+		body = ""
+	}
 
-	_, err := db.Exec("INSERT INTO Uploads(hash, body, files, timestamp) VALUES ($1, $2, $3, $4)", hash, body, (*pq.StringArray)(&fileNameHashPairs), time.Now().UTC().Unix())
+	_, err = db.Exec(`INSERT INTO Uploads(hash, body, files, timestamp, private, edit_token, share_secret, publish_at, uploader_ip, size,
+		account_id, team_id, body_zstd, expires_at, body_key, language, short_length) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`,
+		hash, body, (*pq.StringArray)(&fileNameHashPairs), time.Now().UTC().Unix(), options.Private, hashToken(editToken), randomToken(), publishAt,
+		options.UploaderIP, options.Size, options.AccountId, options.TeamId, bodyZstd, expiresAt, bodyKey, language, len(hash))
 	if err != nil {
 		// See: https://www.postgresql.org/docs/current/protocol-error-fields.html
 		if err, ok := err.(*pq.Error); ok {
 			// See: https://www.postgresql.org/docs/current/errcodes-appendix.html
 			switch err.Code {
 			case "23505": // unique_violation
-				// return "", ErrConstraintUnique
-				return hash, nil // This thing already exists, so let's say we added it and redirect them to it.
+				// This thing already exists, so let's say we added it and redirect them to it. An upload in the trash,
+				// which may have been deleted by a moderator, is only brought back by its owner restoring it.
+				existing, err := scanUpload(db.QueryRow("SELECT "+uploadColumns+" FROM Uploads WHERE hash = $1", hash))
+				if err == nil && existing.DeletedAt != 0 {
+					return "", nil, ErrUploadInTrash
+				}
+				return "", existing, err
 			}
 		}
-		return "", err
+		return "", nil, err
+	}
+
+	// Until then the upload is only found by its full hash, which is what its links use if this fails.
+	if err = assignShortHash(context.Background(), hash); err != nil {
+		log.Printf("failed to assign a short hash to %v: %v", hash, err)
+	}
+	requestDLPScan(hash, text, fileNameHashPairs, options)
+	linkNearDuplicate(hash, text, options)
+	indexRelated(hash, text)
+	return editToken, nil, nil
+}
+
+// ListUploads returns every upload matching the condition, oldest first. The condition is part of the query and must
+// not contain user input, which is passed in args instead.
+func ListUploads(condition string, args ...any) ([]*UploadModel, error) {
+	rows, err := db.Query("SELECT "+uploadColumns+" FROM Uploads WHERE "+condition+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []*UploadModel
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// DeleteUpload removes an upload from the database in tx, or returns sql.ErrNoRows if there is none. Its attachments
+// must be deleted from storage separately.
+func DeleteUpload(ctx context.Context, tx *sql.Tx, hash string) error {
+	result, err := tx.ExecContext(ctx, "DELETE FROM Uploads WHERE hash = $1", hash)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
 	}
+	for _, table := range []string{"ObjectGeoRules", "WatermarkedObjects", "QuarantinedObjects", "AccessCodes", "UploadWatches"} {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE upload_hash = $1", hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TakedownUpload removes the body and attachment list of an upload in tx and marks it as taken down, so that its page
+// shows a tombstone notice from now on. The attachments must be deleted from storage separately.
+func TakedownUpload(ctx context.Context, tx *sql.Tx, hash string, reason string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE Uploads SET body = '', body_zstd = '', body_key = '', files = '{}', takedown_reason = $1, takedown_at = $2 WHERE hash = $3",
+		reason, time.Now().UTC().Unix(), hash)
+	return err
+}
+
+// SetUploadDeleted moves an upload to the trash at the given time on behalf of deletedBy, or restores it from the trash
+// when deletedAt is 0.
+func SetUploadDeleted(hash string, deletedAt int64, deletedBy string) error {
+	_, err := db.Exec("UPDATE Uploads SET deleted_at = $1, deleted_by = $2 WHERE hash = $3", deletedAt, deletedBy, hash)
+	invalidateUpload(hash)
+	return err
+}
+
+// ListTrash lists a page of uploads in the trash, most recently deleted first. With column empty, all of them are
+// listed.
+func ListTrash(column string, value any, query ListQuery) ([]*UploadModel, *listCursor, error) {
+	selection := "SELECT " + uploadColumns + " FROM Uploads WHERE deleted_at <> 0"
+	args := []any{}
+	if column != "" {
+		selection += " AND " + column + " = $1"
+		args = append(args, value)
+	}
+	return pageUploads(query, selection, args, "deleted_at", func(upload *UploadModel) int64 { return upload.DeletedAt })
+}
+
+// ExpiredTrash returns the hashes of uploads that were moved to the trash before the given time.
+func ExpiredTrash(before int64) ([]string, error) {
+	rows, err := db.Query("SELECT hash FROM Uploads WHERE deleted_at <> 0 AND deleted_at < $1", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// ExpiredUploads returns the hashes of uploads whose expiry time has passed.
+func ExpiredUploads(now int64) ([]string, error) {
+	rows, err := db.Query("SELECT hash FROM Uploads WHERE expires_at <> 0 AND expires_at <= $1", now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// RotateShareSecret replaces the share secret of an upload, invalidating every share link signed with the old one.
+func RotateShareSecret(hash string) error {
+	_, err := db.Exec("UPDATE Uploads SET share_secret = $1 WHERE hash = $2", randomToken(), hash)
+	invalidateUpload(hash)
+	return err
+}
 
-	return hash, nil
+// GetUsage returns the total number of bytes stored by uploads whose column equals value, leaving out those in the
+// trash, which are checked against the quota again when they are restored.
+// The column must be one of "uploader_ip", "account_id" or "team_id".
+func GetUsage(column string, value any) (int64, error) {
+	var used int64
+	err := db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM Uploads WHERE "+column+" = $1 AND deleted_at = 0", value).Scan(&used)
+	return used, err
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/gin-gonic/gin"
+)
+
+// s3Stats counts the requests made to S3 and how often they could reuse a pooled connection.
+var s3Stats struct {
+	InFlight    atomic.Int64
+	Requests    atomic.Int64
+	Errors      atomic.Int64
+	NewConns    atomic.Int64
+	ReusedConns atomic.Int64
+}
+
+// countingHTTPClient wraps the HTTP client of the AWS SDK to collect s3Stats.
+type countingHTTPClient struct {
+	aws.HTTPClient
+}
+
+func (client countingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				s3Stats.ReusedConns.Add(1)
+			} else {
+				s3Stats.NewConns.Add(1)
+			}
+		},
+	}
+	s3Stats.Requests.Add(1)
+	s3Stats.InFlight.Add(1)
+	defer s3Stats.InFlight.Add(-1)
+
+	resp, err := client.HTTPClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		s3Stats.Errors.Add(1)
+	}
+	return resp, err
+}
+
+func init() {
+	// expvar already publishes "memstats" (heap and GC) and "cmdline".
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("s3", expvar.Func(func() any {
+		return map[string]int64{
+			"in_flight":    s3Stats.InFlight.Load(),
+			"requests":     s3Stats.Requests.Load(),
+			"errors":       s3Stats.Errors.Load(),
+			"new_conns":    s3Stats.NewConns.Load(),
+			"reused_conns": s3Stats.ReusedConns.Load(),
+		}
+	}))
+	expvar.Publish("media_cache", expvar.Func(func() any {
+		objects, bytes := mediaCache.Stats()
+		return map[string]int64{
+			"objects":  int64(objects),
+			"bytes":    bytes,
+			"capacity": mediaCacheSize,
+		}
+	}))
+	expvar.Publish("upload_cache", expvar.Func(func() any {
+		return map[string]int{
+			"uploads": uploadCache.Stats(),
+		}
+	}))
+}
+
+func registerDebugRoutes(r *gin.Engine) {
+	// Load balancers and monitoring check that the server is up and can reach its database.
+	r.GET("/healthz", func(c *gin.Context) {
+		if err := db.PingContext(c.Request.Context()); err != nil {
+			respondError(c, http.StatusServiceUnavailable, errors.New("the database cannot be reached"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// Profiles can reveal memory contents, so they are limited to admins.
+	debug := r.Group("/debug", requireRole(RoleAdmin))
+
+	debug.GET("/vars", gin.WrapH(expvar.Handler()))
+
+	// The pprof handlers expect to be mounted at /debug/pprof/. Profiles are downloaded with an
+	// "Authorization: Bearer <token>" header and then opened with `go tool pprof`.
+	servePprof := func(c *gin.Context) {
+		switch c.Param("name") {
+		case "/cmdline":
+			pprof.Cmdline(c.Writer, c.Request)
+		case "/profile":
+			pprof.Profile(c.Writer, c.Request)
+		case "/symbol":
+			pprof.Symbol(c.Writer, c.Request)
+		case "/trace":
+			pprof.Trace(c.Writer, c.Request)
+		default:
+			pprof.Index(c.Writer, c.Request)
+		}
+	}
+	debug.GET("/pprof/*name", servePprof)
+	debug.POST("/pprof/*name", servePprof)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Attachments are stored under a key derived from their name and contents, so uploads of the same file share one
+// object. The deduplication report shows how much storage that saves, and which contents are stored more than once:
+// under other names, which are kept apart because the name is part of the object, or under the keys of objects stored
+// before attachments were keyed by their contents. The dedup command merges the latter into one object under the
+// current key, and downloads of the old keys are redirected to it.
+
+const dedupReportClusters = 50 // Clusters listed in the report, the ones saving the most first.
+
+// A DedupReport shows how much storage is saved by sharing attachment objects between uploads.
+type DedupReport struct {
+	Objects          int64          `json:"objects"`           // Attachment objects referenced by uploads.
+	References       int64          `json:"references"`        // Attachments of uploads, which are references to objects.
+	StoredBytes      int64          `json:"stored_bytes"`      // Stored size of the objects.
+	SavedBytes       int64          `json:"saved_bytes"`       // Stored size the shared objects would have taken again.
+	DuplicateBytes   int64          `json:"duplicate_bytes"`   // Stored size of objects whose contents another object has too.
+	UncheckedObjects int64          `json:"unchecked_objects"` // Objects whose contents have no recorded checksum yet.
+	Clusters         []DedupCluster `json:"clusters"`
+}
+
+// A DedupCluster is contents referenced more than once, by several uploads or stored in several objects.
+type DedupCluster struct {
+	SHA256         string        `json:"sha256"`
+	References     int64         `json:"references"`
+	SavedBytes     int64         `json:"saved_bytes"`
+	DuplicateBytes int64         `json:"duplicate_bytes"`
+	Objects        []DedupObject `json:"objects"`
+}
+
+// A DedupObject is an object in a DedupCluster, with the number of attachments referencing it.
+type DedupObject struct {
+	Key        string `json:"key"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	References int64  `json:"references"`
+}
+
+// GetDedupReport counts the references to every attachment object and groups the objects by their contents.
+func GetDedupReport(ctx context.Context) (*DedupReport, error) {
+	rows, err := db.QueryContext(ctx, `SELECT r.key, r.name, r.refs, o.size, o.content_sha256
+		FROM (SELECT substring(f from '[^/]*$') AS key, MIN(substring(f from '^(.*)/')) AS name, COUNT(*) AS refs
+			FROM Uploads, unnest(files) AS f GROUP BY 1) AS r
+		JOIN Objects AS o ON o.key = r.key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &DedupReport{Clusters: []DedupCluster{}}
+	clusters := make(map[string]*DedupCluster)
+	for rows.Next() {
+		var object DedupObject
+		var checksum string
+		if err = rows.Scan(&object.Key, &object.Name, &object.References, &object.Size, &checksum); err != nil {
+			return nil, err
+		}
+		report.Objects++
+		report.References += object.References
+		report.StoredBytes += object.Size
+		report.SavedBytes += (object.References - 1) * object.Size
+		if checksum == "" {
+			report.UncheckedObjects++
+			continue
+		}
+		cluster := clusters[checksum]
+		if cluster == nil {
+			cluster = &DedupCluster{SHA256: checksum}
+			clusters[checksum] = cluster
+		}
+		cluster.Objects = append(cluster.Objects, object)
+		cluster.References += object.References
+		cluster.SavedBytes += (object.References - 1) * object.Size
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, cluster := range clusters {
+		if cluster.References < 2 {
+			continue
+		}
+		// Every object but the smallest of the contents is a duplicate.
+		slices.SortFunc(cluster.Objects, func(a, b DedupObject) int {
+			return cmp.Or(cmp.Compare(a.Size, b.Size), cmp.Compare(a.Key, b.Key))
+		})
+		for _, object := range cluster.Objects[1:] {
+			cluster.DuplicateBytes += object.Size
+		}
+		report.DuplicateBytes += cluster.DuplicateBytes
+		report.Clusters = append(report.Clusters, *cluster)
+	}
+	slices.SortFunc(report.Clusters, func(a, b DedupCluster) int {
+		return cmp.Or(cmp.Compare(b.SavedBytes+b.DuplicateBytes, a.SavedBytes+a.DuplicateBytes), cmp.Compare(a.SHA256, b.SHA256))
+	})
+	report.Clusters = report.Clusters[:min(len(report.Clusters), dedupReportClusters)]
+	return report, nil
+}
+
+// DedupStats summarize a deduplication.
+type DedupStats struct {
+	Checked int      // Objects read.
+	Merged  int      // Objects merged into another one and deleted.
+	Skipped []string // Objects that could not be read, like archived ones.
+}
+
+// Deduplicate reads every attachment object to find the key it would be stored under today, and merges the objects of
+// the same name and contents into the one under that key. Uploads are changed to reference it, the old keys are kept as
+// aliases that downloads are redirected from, and the old objects are deleted. The checksums of contents that were not
+// recorded yet are recorded along the way. With dryRun, nothing is changed.
+func Deduplicate(ctx context.Context, dryRun bool) (*DedupStats, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT f FROM Uploads, unnest(files) AS f")
+	if err != nil {
+		return nil, err
+	}
+	var pairs []string
+	for rows.Next() {
+		var pair string
+		if err = rows.Scan(&pair); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(pairs)
+
+	stats := new(DedupStats)
+	// The names and keys of the objects stored under each current key.
+	type object struct{ name, key string }
+	groups := make(map[string][]object)
+	var order []string
+	for i, pair := range pairs {
+		name, key := pair[:len(pair)-len(fileKey(pair))-1], fileKey(pair)
+		current, err := currentObjectKey(ctx, name, key, dryRun)
+		if err != nil {
+			log.Printf("Skipped %s: %v", key, err)
+			stats.Skipped = append(stats.Skipped, key)
+			continue
+		}
+		stats.Checked++
+		if groups[current] == nil {
+			order = append(order, current)
+		}
+		groups[current] = append(groups[current], object{name, key})
+		if (i+1)%1000 == 0 {
+			log.Printf("Checked %d/%d objects", i+1, len(pairs))
+		}
+	}
+
+	for _, current := range order {
+		objects := groups[current]
+		if len(objects) < 2 {
+			continue // Objects stored once are left under their key, even an old one.
+		}
+		var old []string
+		for _, o := range objects {
+			if o.key != current {
+				old = append(old, o.key)
+			}
+		}
+		log.Printf("Merging %v into %s", old, current)
+		if dryRun {
+			stats.Merged += len(old)
+			continue
+		}
+		if err = mergeObjects(ctx, objects[0].name, current, old); err != nil {
+			return stats, fmt.Errorf("failed to merge into %v: %v", current, err)
+		}
+		stats.Merged += len(old)
+	}
+	return stats, nil
+}
+
+// currentObjectKey reads an object and returns the key it would be stored under today. Salted keys keep their salt, so
+// that they are never merged with the keys of other uploads. The checksum of its contents is recorded if it was not yet,
+// unless dryRun is set.
+func currentObjectKey(ctx context.Context, name, key string, dryRun bool) (string, error) {
+	_, contents, err := OpenFileObject(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer contents.Close()
+	keyHash, contentHash := sha1.New(), sha256.New()
+	keyHash.Write([]byte(name))
+	keyHash.Write([]byte{0})
+	if _, err = io.Copy(io.MultiWriter(keyHash, contentHash), contents); err != nil {
+		return "", err
+	}
+	salt := keySalt(key)
+	if salt != "" {
+		keyHash.Write([]byte{0})
+		keyHash.Write([]byte(salt))
+	}
+	if !dryRun {
+		_, err = db.ExecContext(ctx, "UPDATE Objects SET content_sha256 = $1 WHERE key = $2 AND content_sha256 = ''",
+			hex.EncodeToString(contentHash.Sum(nil)), key)
+	}
+	return hex.EncodeToString(keyHash.Sum(nil)) + salt, err
+}
+
+// mergeObjects replaces the objects under the old keys with the one under the current key, copying one of them there
+// if there is none yet. The keys are locked throughout, like deleteObjects does, so that no upload starts or stops
+// sharing one of them meanwhile.
+func mergeObjects(ctx context.Context, name, current string, old []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = lockObjects(ctx, tx, append([]string{current}, old...)); err != nil {
+		return err
+	}
+
+	exists, err := objectStore.Exists(ctx, current)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		data, err := objectStore.Get(ctx, old[0])
+		if err != nil {
+			return err
+		}
+		if err = objectStore.Put(ctx, current, data, nil); err != nil {
+			return err
+		}
+		var contentChecksum string
+		err = db.QueryRowContext(ctx, "SELECT content_sha256 FROM Objects WHERE key = $1", old[0]).Scan(&contentChecksum)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err = recordObject(ctx, current, objectStore, sha256Hex(data), len(data), contentChecksum); err != nil {
+			return err
+		}
+	}
+
+	var hashes []string
+	for _, key := range old {
+		rows, err := tx.QueryContext(ctx, "UPDATE Uploads SET files = array_replace(files, $1, $2) WHERE $1 = ANY(files) RETURNING hash",
+			name+"/"+key, name+"/"+current)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var hash string
+			if err = rows.Scan(&hash); err != nil {
+				rows.Close()
+				return err
+			}
+			hashes = append(hashes, hash)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// Restrictions, scans and counts move to the merged object; where both have a rule, the one already there is
+		// kept, and of two scans the latest.
+		statements := []string{
+			`INSERT INTO ObjectGeoRules(key, upload_hash, allow, deny) SELECT $2, upload_hash, allow, deny
+				FROM ObjectGeoRules WHERE key = $1 ON CONFLICT DO NOTHING`,
+			`INSERT INTO WatermarkedObjects(key, upload_hash) SELECT $2, upload_hash FROM WatermarkedObjects WHERE key = $1
+				ON CONFLICT DO NOTHING`,
+			`INSERT INTO QuarantinedObjects(key, upload_hash) SELECT $2, upload_hash FROM QuarantinedObjects WHERE key = $1
+				ON CONFLICT DO NOTHING`,
+			`INSERT INTO TakenDownObjects(key, upload_hash, reason, taken_down_at)
+				SELECT $2, upload_hash, reason, taken_down_at FROM TakenDownObjects WHERE key = $1 ON CONFLICT DO NOTHING`,
+			`UPDATE Objects AS merged SET scan_status = o.scan_status, scan_result = o.scan_result,
+				scan_version = o.scan_version, scanned_at = o.scanned_at
+				FROM Objects AS o WHERE merged.key = $2 AND o.key = $1 AND o.scanned_at > merged.scanned_at`,
+			`INSERT INTO UploadAnalytics(target, event, day, country, referrer, count)
+				SELECT $2, event, day, country, referrer, count FROM UploadAnalytics WHERE target = $1 AND event = 'download'
+				ON CONFLICT (target, event, day, country, referrer) DO UPDATE SET count = UploadAnalytics.count + excluded.count`,
+			`INSERT INTO ObjectAliases(key, target) VALUES ($1, $2)
+				ON CONFLICT (key) DO UPDATE SET target = excluded.target`,
+			// Aliases of the old key follow it, so that a link is never redirected twice.
+			`UPDATE ObjectAliases SET target = $2 WHERE target = $1`,
+		}
+		for _, statement := range statements {
+			if _, err = tx.ExecContext(ctx, statement, key, current); err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"ObjectGeoRules", "WatermarkedObjects", "QuarantinedObjects", "Objects"} {
+			if _, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE key = $1", key); err != nil {
+				return err
+			}
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM UploadAnalytics WHERE target = $1 AND event = 'download'", key); err != nil {
+			return err
+		}
+	}
+	// The old objects are deleted while their keys are still locked, as deleteObjects does.
+	if err = objectStore.Delete(ctx, old); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	mediaCache.Remove(old...)
+	for _, hash := range hashes {
+		invalidateUpload(hash)
+	}
+	return nil
+}
+
+// objectAlias returns the key an object was merged into, or "" if it was not.
+func objectAlias(ctx context.Context, key string) (string, error) {
+	var target string
+	err := db.QueryRowContext(ctx, "SELECT target FROM ObjectAliases WHERE key = $1", key).Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return target, err
+}
+
+// redirectObjectAlias redirects the download of an object that was merged into another one, and reports whether it
+// did. The new link carries its own download token, since the old one was checked already.
+func redirectObjectAlias(c *gin.Context, key string) bool {
+	target, err := objectAlias(c.Request.Context(), key)
+	if err != nil {
+		log.Printf("failed to look up the alias of object %v: %v", key, err)
+		return false
+	} else if target == "" {
+		return false
+	}
+	location := "/f/" + target + "/" + url.PathEscape(c.Param("filename")) + DownloadQuery(target)
+	if c.Param("filename") == "" {
+		location = "/download?hash=" + target + strings.Replace(DownloadQuery(target), "?", "&", 1)
+	}
+	c.Redirect(http.StatusMovedPermanently, location)
+	return true
+}
+
+func registerDedupRoutes(r *gin.Engine) {
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	// Report the storage saved by sharing attachment objects, and the contents stored more than once.
+	admin.GET("/dedup", func(c *gin.Context) {
+		report, err := GetDedupReport(c.Request.Context())
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiVersion is the version of the HTTP API, which only changes with incompatible changes to existing endpoints.
+const apiVersion = "v1"
+
+// instanceCapabilities describes the limits and features of this instance for clients, which read them from
+// /.well-known/copycat.json to adapt to the instance instead of discovering them through failed requests.
+func instanceCapabilities() gin.H {
+	return gin.H{
+		"name":        "copycat",
+		"version":     releaseVersion(),
+		"api_version": apiVersion,
+		"api_base":    baseurl + "/api/" + apiVersion,
+		"limits": gin.H{
+			"max_request_bytes":         maxSubmitSize,
+			"max_attachments_bytes":     maxUploadSize,
+			"max_clip_bytes":            maxUploadSize,
+			"quota_ip_bytes":            ipQuota, // 0 means there is no limit.
+			"quota_account_bytes":       accountQuota,
+			"quota_team_bytes":          teamQuota,
+			"download_bytes_per_second": connectionRate,
+			"rate_limits":               rateLimitPolicies(),
+		},
+		"expiry": gin.H{
+			// X-Expiry of PUT /clip: seconds, a Go duration like "90m", or days like "7d".
+			"supported":   true,
+			"max_seconds": int64(maxExpiry.Seconds()),
+			"formats":     []string{"seconds", "duration", "days", "never"},
+		},
+		"short_ids": gin.H{
+			"alphabet":   shortAlphabet.Name, // Of new uploads; "hex" or "base56".
+			"min_length": shortLength,
+		},
+		"share_links": gin.H{
+			"default_ttl_seconds": int64(defaultShareTTL.Seconds()),
+			"max_ttl_seconds":     int64(maxShareTTL.Seconds()),
+		},
+		"languages": languageNames, // The default language first.
+		"auth": gin.H{
+			"anonymous_uploads": true,
+			"registration":      allowRegistration.Load(),
+			"schemes":           []string{"session", "bearer"}, // Bearer API tokens in the Authorization header.
+			"terms_required":    requireTerms,                  // Accepted with the version from /api/v1/terms in X-Accept-Terms.
+			"two_factor":        true,
+			"saml":              samlProvider != nil,  // Browsers log in at /saml/login.
+			"ldap":              ldapConfig.url != "", // Directory passwords are accepted by /login.
+			"scim":              scimToken != "",      // At /scim/v2.
+		},
+		"features": gin.H{
+			"private_uploads":     true,
+			"embargo":             true,
+			"teams":               true,
+			"encryption":          false, // Uploads are not end-to-end encrypted.
+			"strip_metadata":      stripMetadata.Load(),
+			"client_checksums":    true, // "sha256" values on /submit.
+			"preflight":           true, // POST /api/v1/uploads/preflight.
+			"trash_days":          int64(trashGrace.Hours() / 24),
+			"hotlink_protection":  hotlinkProtection.Load(),
+			"cdn":                 cdnURL,
+			"public_stats":        publicStats.Load(),
+			"clip":                true,
+			"clip_channels":       true, // POST /api/v1/clip/channels.
+			"clip_device_pairing": true,
+			"web_push":            vapidKey != nil, // The VAPID public key is at /api/v1/push/key.
+			"sharex":              true,
+			"federation":          len(peers) > 0,
+			"ci_uploads":          true, // Tar archives at PUT /api/v1/ci/uploads.
+			"analytics":           uploadAnalytics.Load(),
+			"geo_restrictions":    true, // Owner rules at /api/v1/uploads/:hash/geo.
+			"access_codes":        true,
+			"watermarks":          true,         // Sensitive uploads at /api/v1/uploads/:hash/watermark.
+			"dlp_scanning":        dlpURL != "", // New public uploads are sent to a compliance scanner.
+			"login_required":      requireLogin.Load(),
+			"favorites":           true,
+			"related_uploads":     true,
+			"near_duplicates":     true,
+			"virus_scanning":      clamdAddress != "",
+			"raw_headers":         true,
+			"tar_bundles":         true,
+			"attachment_edits":    true,
+			"accessibility":       true, // ?contrast=high, ?text=large and ?js=off on any page.
+		},
+	}
+}
+
+func registerDiscoveryRoutes(r *gin.Engine) {
+	r.GET("/.well-known/copycat.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, instanceCapabilities())
+	})
+}
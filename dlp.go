@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sites bound by data loss prevention or compliance rules can have every new public upload checked by their scanner.
+// Once an upload is stored, it is POSTed to DLP_URL in the background, with its text, or only the SHA-256 of the text
+// when DLP_SEND is "hash", and the scanner answers with a verdict. Uploads it quarantines look missing to everyone but
+// their owners and moderators, attachments included, until a moderator releases or deletes them. Private and team
+// uploads are not public, so they are not sent.
+
+var (
+	ErrNotQuarantined   = errors.New("this upload is not quarantined")
+	ErrQuarantineReason = errors.New(`a "reason" is required, it is shown to the owner of the upload`)
+)
+
+var (
+	dlpURL        string
+	dlpSecret     string
+	dlpSendHash   bool
+	dlpTimeout    time.Duration
+	dlpFailClosed atomic.Bool // Quarantine uploads that could not be scanned, rather than leave them public.
+)
+
+// initDLP loads the scanner that new public uploads are sent to, if any.
+func initDLP() {
+	dlpURL = os.Getenv("DLP_URL")
+	dlpSecret = os.Getenv("DLP_SECRET")
+	switch send := os.Getenv("DLP_SEND"); send {
+	case "", "body":
+	case "hash":
+		dlpSendHash = true
+	default:
+		log.Fatalf(`DLP_SEND must be "body" or "hash", not %q`, send)
+	}
+	dlpTimeout = time.Duration(envInt64("DLP_TIMEOUT_SECONDS", 30)) * time.Second
+	loadFlag(&dlpFailClosed, "DLP_FAIL_CLOSED")
+}
+
+// dlpFile describes an attachment to the scanner.
+type dlpFile struct {
+	Name   string `json:"name"`
+	Key    string `json:"key"`
+	SHA256 string `json:"sha256,omitempty"` // Of the contents, when known.
+	URL    string `json:"url,omitempty"`    // Only sent along with the text.
+}
+
+// dlpRequest is the body POSTed to DLP_URL.
+type dlpRequest struct {
+	Hash       string    `json:"hash"`
+	URL        string    `json:"url"`
+	Body       string    `json:"body,omitempty"`
+	BodySHA256 string    `json:"body_sha256"`
+	Files      []dlpFile `json:"files"`
+	AccountId  int64     `json:"account_id,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+}
+
+// dlpVerdict is the response of the scanner.
+type dlpVerdict struct {
+	Verdict string `json:"verdict"` // "allow" or "quarantine".
+	Reason  string `json:"reason"`
+}
+
+// requestDLPScan sends a new upload to the scanner in the background, if there is one and the upload is public.
+func requestDLPScan(hash, body string, fileNameHashPairs []string, options UploadOptions) {
+	if dlpURL == "" || options.Private || options.TeamId != 0 {
+		return
+	}
+	request := &dlpRequest{
+		Hash:       hash,
+		URL:        baseurl + uploadPath(hash),
+		BodySHA256: sha256Hex([]byte(body)),
+		Files:      make([]dlpFile, len(fileNameHashPairs)),
+		AccountId:  options.AccountId,
+		IP:         options.UploaderIP,
+	}
+	if !dlpSendHash {
+		request.Body = body
+	}
+	for i, pair := range fileNameHashPairs {
+		name := fileName(pair)
+		request.Files[i] = dlpFile{Name: name, Key: fileKey(pair)}
+		if !dlpSendHash {
+			request.Files[i].URL = baseurl + "/f/" + fileKey(pair) + "/" + url.PathEscape(name) + DownloadQuery(fileKey(pair))
+		}
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dlpTimeout)
+		defer cancel()
+		verdict, err := scanDLP(ctx, request)
+		if err != nil {
+			log.Printf("DLP scan of %v failed: %v", hash, err)
+			if !dlpFailClosed.Load() {
+				return
+			}
+			verdict = &dlpVerdict{Verdict: "quarantine", Reason: "the upload could not be scanned"}
+		}
+		if verdict.Verdict != "quarantine" {
+			return
+		}
+		upload, err := GetUpload(hash)
+		if err == nil {
+			err = QuarantineUpload(context.Background(), upload, verdict.Reason)
+		}
+		if err != nil {
+			RecordAudit("dlp", "upload.quarantine", hash, "failed: "+err.Error(), "")
+			log.Printf("failed to quarantine %v: %v", hash, err)
+			return
+		}
+		RecordAudit("dlp", "upload.quarantine", hash, verdict.Reason, "")
+	}()
+}
+
+// scanDLP POSTs an upload to the scanner, signed like webhooks with an HMAC-SHA256 of the body in X-Copycat-Signature
+// when DLP_SECRET is set, and returns its verdict. The contents of attachments are looked up by their keys.
+func scanDLP(ctx context.Context, request *dlpRequest) (*dlpVerdict, error) {
+	for i := range request.Files {
+		err := db.QueryRowContext(ctx, "SELECT content_sha256 FROM Objects WHERE key = $1", request.Files[i].Key).
+			Scan(&request.Files[i].SHA256)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dlpURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if dlpSecret != "" {
+		mac := hmac.New(sha256.New, []byte(dlpSecret))
+		mac.Write(body)
+		req.Header.Set("X-Copycat-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("the scanner answered %v", resp.Status)
+	}
+	verdict := new(dlpVerdict)
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(verdict); err != nil {
+		return nil, fmt.Errorf("the scanner answered an invalid verdict: %v", err)
+	}
+	switch verdict.Verdict {
+	case "allow":
+	case "quarantine":
+		if verdict.Reason == "" {
+			verdict.Reason = "flagged by the compliance scanner"
+		}
+	default:
+		return nil, fmt.Errorf("the scanner answered the unknown verdict %q", verdict.Verdict)
+	}
+	return verdict, nil
+}
+
+// QuarantineUpload hides an upload and the attachments that no other upload has until it is released, and purges
+// them from the CDN.
+func QuarantineUpload(ctx context.Context, upload *UploadModel, reason string) error {
+	keys, err := exclusiveObjectKeys(ctx, upload)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "UPDATE Uploads SET quarantine_reason = $1, quarantined_at = $2 WHERE hash = $3",
+		reason, time.Now().UTC().Unix(), upload.Hash); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err = tx.ExecContext(ctx, `INSERT INTO QuarantinedObjects(key, upload_hash) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`, key, upload.Hash); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	mediaCache.Remove(keys...)
+	invalidateUpload(upload.Hash)
+	purgeCDN(ctx, upload)
+	return nil
+}
+
+// ReleaseUpload makes a quarantined upload and its attachments visible again.
+func ReleaseUpload(ctx context.Context, upload *UploadModel) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "UPDATE Uploads SET quarantine_reason = '', quarantined_at = 0 WHERE hash = $1",
+		upload.Hash); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM QuarantinedObjects WHERE upload_hash = $1", upload.Hash); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	invalidateUpload(upload.Hash)
+	return nil
+}
+
+// ListQuarantine lists a page of quarantined uploads, most recently quarantined first.
+func ListQuarantine(query ListQuery) ([]*UploadModel, *listCursor, error) {
+	selection := "SELECT " + uploadColumns + " FROM Uploads WHERE quarantined_at <> 0 AND deleted_at = 0"
+	return pageUploads(query, selection, []any{}, "quarantined_at", func(upload *UploadModel) int64 {
+		return upload.QuarantinedAt
+	})
+}
+
+// hiddenByQuarantine reports whether an upload is quarantined and the request may not see it, which only its owner and
+// moderators may.
+func (upload *UploadModel) hiddenByQuarantine(c *gin.Context) bool {
+	return upload.QuarantinedAt != 0 && !upload.IsOwner(c) && !currentAccount(c).HasRole(RoleModerator)
+}
+
+// hiddenAttachment reports whether an attachment belongs to quarantined uploads that the request may not see.
+func hiddenAttachment(c *gin.Context, key string) (bool, error) {
+	rows, err := db.QueryContext(c.Request.Context(), "SELECT upload_hash FROM QuarantinedObjects WHERE key = $1", key)
+	if err != nil {
+		return false, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	if len(hashes) == 0 || currentAccount(c).HasRole(RoleModerator) {
+		return false, nil
+	}
+	for _, hash := range hashes {
+		if upload, err := GetUpload(hash); err == nil && upload.IsOwner(c) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// allowQuarantinedDownload reports whether an attachment may be downloaded by the request, which attachments of
+// quarantined uploads may only be by moderators and the owners of the uploads. Otherwise the attachment looks missing.
+func allowQuarantinedDownload(c *gin.Context, key string) bool {
+	hidden, err := hiddenAttachment(c, key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return false
+	} else if hidden {
+		route404(c)
+		return false
+	}
+	return true
+}
+
+func quarantineJSON(uploads []*UploadModel) []gin.H {
+	list := make([]gin.H, len(uploads))
+	for i, upload := range uploads {
+		list[i] = gin.H{
+			"hash":           upload.Hash,
+			"url":            baseurl + uploadPath(upload.ShortHash()),
+			"reason":         upload.QuarantineReason,
+			"quarantined_at": time.Unix(upload.QuarantinedAt, 0).UTC().Format(time.RFC3339),
+		}
+	}
+	return list
+}
+
+func registerDLPRoutes(r *gin.Engine) {
+	moderation := r.Group("/api/v1/moderation", requireRole(RoleModerator))
+
+	// List the uploads waiting for review, most recently quarantined first.
+	moderation.GET("/quarantine", func(c *gin.Context) {
+		query, ok := parseListQuery(c)
+		if !ok {
+			return
+		}
+		uploads, next, err := ListQuarantine(query)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"uploads":     quarantineJSON(uploads),
+			"next_cursor": setListLinks(c, next),
+		})
+	})
+
+	// Quarantine an upload by hand, e.g. after a report.
+	moderation.POST("/uploads/:hash/quarantine", func(c *gin.Context) {
+		account := currentAccount(c)
+		reason := c.PostForm("reason")
+		if reason == "" {
+			respondError(c, http.StatusBadRequest, ErrQuarantineReason)
+			return
+		}
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		if err = QuarantineUpload(c.Request.Context(), upload, reason); err != nil {
+			RecordAudit(account.Username, "upload.quarantine", upload.Hash, "failed: "+err.Error(), c.ClientIP())
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "upload.quarantine", upload.Hash, reason, c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload quarantined",
+		})
+	})
+
+	// Release an upload that was reviewed and found fine. Uploads that were not are deleted like any other.
+	moderation.POST("/uploads/:hash/release", func(c *gin.Context) {
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		if upload.QuarantinedAt == 0 {
+			respondError(c, http.StatusConflict, ErrNotQuarantined)
+			return
+		}
+		if err = ReleaseUpload(c.Request.Context(), upload); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(currentAccount(c).Username, "upload.release", upload.Hash, c.PostForm("note"), c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload released",
+		})
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Drafts keep the text being composed on the upload page on the server, which autosaves it every few seconds, so that
+// a crashed or closed browser does not lose a long paste. A draft belongs to the account that saved it, or to the claim
+// token of an anonymous browser, and is deleted once it is uploaded, discarded, or left untouched for DRAFT_DAYS.
+
+const (
+	maxDrafts          = 20  // The most drafts an account or claim token may keep.
+	maxIPDrafts        = 100 // The most anonymous drafts an IP address may keep, whatever claim tokens it uses.
+	draftPreviewLength = 100 // Characters of the body shown when drafts are listed.
+)
+
+var (
+	ErrDraftNotFound   = errors.New("draft not found")
+	ErrDraftConflict   = errors.New("the draft was changed elsewhere since this revision; reload it before saving")
+	ErrTooManyDrafts   = fmt.Errorf("at most %v drafts can be kept; upload or discard some first", maxDrafts)
+	ErrTooManyIPDrafts = errors.New("too many drafts were started from this address; upload or discard some first")
+)
+
+// draftLifetime is how long a draft is kept after it was last saved.
+var draftLifetime time.Duration
+
+// A Draft is text being composed for an upload.
+type Draft struct {
+	Id        int64  `json:"id"`
+	Body      string `json:"body,omitempty"`
+	Language  string `json:"language"` // The language chosen for the upload, or "" to detect it.
+	Revision  int64  `json:"revision"` // Incremented by every save, so that saves from two tabs do not overwrite each other.
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// draftOwner identifies who drafts belong to: an account, or the holder of a claim token.
+type draftOwner struct {
+	accountId int64
+	claimHash string
+}
+
+func initDrafts() {
+	draftLifetime = time.Duration(envInt64("DRAFT_DAYS", 7)) * 24 * time.Hour
+
+	RegisterJob(&Job{
+		Name:     "drafts",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "DELETE FROM Drafts WHERE updated_at < $1", time.Now().Add(-draftLifetime).UTC().Unix())
+			return err
+		},
+	})
+}
+
+// requestDraftOwner returns the owner of the drafts of a request. Anonymous browsers without a claim token are given
+// one when issue is set, and own no drafts otherwise.
+func requestDraftOwner(c *gin.Context, issue bool) (owner draftOwner, signedClaim string) {
+	if account := currentAccount(c); account != nil {
+		return draftOwner{accountId: account.Id}, ""
+	}
+	token := requestClaimToken(c)
+	if token == "" && issue {
+		token, signedClaim = ensureClaimToken(c)
+	}
+	if token == "" {
+		return draftOwner{}, ""
+	}
+	return draftOwner{claimHash: hashToken(token)}, signedClaim
+}
+
+// ownerClause restricts a query on Drafts to the drafts of the owner, whose id and claim hash are the parameters n and
+// n+1.
+func ownerClause(n int) string {
+	return fmt.Sprintf("(account_id = $%d AND account_id <> 0 OR claim_hash = $%d AND claim_hash <> '')", n, n+1)
+}
+
+// ListDrafts returns the drafts of an owner with only the start of their bodies, the most recently saved first.
+func ListDrafts(owner draftOwner) ([]Draft, error) {
+	rows, err := db.Query(`SELECT id, language, revision, created_at, updated_at, substring(body for $3) FROM Drafts
+		WHERE `+ownerClause(1)+` ORDER BY updated_at DESC`, owner.accountId, owner.claimHash, draftPreviewLength)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	drafts := []Draft{}
+	for rows.Next() {
+		var draft Draft
+		if err = rows.Scan(&draft.Id, &draft.Language, &draft.Revision, &draft.CreatedAt, &draft.UpdatedAt, &draft.Body); err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, draft)
+	}
+	return drafts, rows.Err()
+}
+
+// GetDraft returns a draft of an owner, or ErrDraftNotFound.
+func GetDraft(owner draftOwner, id int64) (*Draft, error) {
+	draft := new(Draft)
+	err := db.QueryRow("SELECT id, body, language, revision, created_at, updated_at FROM Drafts WHERE id = $1 AND "+ownerClause(2),
+		id, owner.accountId, owner.claimHash).Scan(&draft.Id, &draft.Body, &draft.Language, &draft.Revision, &draft.CreatedAt, &draft.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrDraftNotFound
+	}
+	return draft, err
+}
+
+// CreateDraft stores a new draft for an owner and sets its id, or returns ErrTooManyDrafts. Anonymous drafts are
+// recorded with the IP address they were started from, and ErrTooManyIPDrafts is returned when it has too many, as
+// anyone can get new claim tokens.
+func CreateDraft(owner draftOwner, draft *Draft, ip string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM Drafts WHERE "+ownerClause(1), owner.accountId, owner.claimHash).Scan(&count)
+	if err != nil {
+		return err
+	} else if count >= maxDrafts {
+		return ErrTooManyDrafts
+	}
+	if owner.accountId != 0 {
+		ip = ""
+	} else {
+		if err = db.QueryRow("SELECT COUNT(*) FROM Drafts WHERE ip = $1 AND account_id = 0", ip).Scan(&count); err != nil {
+			return err
+		} else if count >= maxIPDrafts {
+			return ErrTooManyIPDrafts
+		}
+	}
+	draft.CreatedAt = time.Now().UTC().Unix()
+	draft.UpdatedAt, draft.Revision = draft.CreatedAt, 1
+	return db.QueryRow(`INSERT INTO Drafts(account_id, claim_hash, body, language, revision, created_at, updated_at, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $7) RETURNING id`, owner.accountId, owner.claimHash, draft.Body, draft.Language,
+		draft.Revision, draft.CreatedAt, ip).Scan(&draft.Id)
+}
+
+// SaveDraft replaces the body and language of a draft of an owner and increments its revision. Unless revision is 0,
+// the draft must still be at that revision, or ErrDraftConflict is returned.
+func SaveDraft(owner draftOwner, draft *Draft, revision int64) error {
+	draft.UpdatedAt = time.Now().UTC().Unix()
+	err := db.QueryRow(`UPDATE Drafts SET body = $1, language = $2, revision = revision + 1, updated_at = $3
+		WHERE id = $4 AND ($5 = 0 OR revision = $5) AND `+ownerClause(6)+` RETURNING revision, created_at`,
+		draft.Body, draft.Language, draft.UpdatedAt, draft.Id, revision, owner.accountId, owner.claimHash).Scan(&draft.Revision, &draft.CreatedAt)
+	if err == sql.ErrNoRows {
+		if _, err = GetDraft(owner, draft.Id); err == nil {
+			return ErrDraftConflict
+		}
+	}
+	return err
+}
+
+// DeleteDraft deletes a draft of an owner, and reports whether it existed.
+func DeleteDraft(owner draftOwner, id int64) (bool, error) {
+	result, err := db.Exec("DELETE FROM Drafts WHERE id = $1 AND "+ownerClause(2), id, owner.accountId, owner.claimHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// bindDraft reads the body and language of a draft from a request. On failure an error has been sent and false is
+// returned. Drafts hold no files, so the request may be no larger than an upload of text, and the body no longer than
+// an uploaded one.
+func bindDraft(c *gin.Context, draft *Draft) bool {
+	// An unreadable form must not be saved as an empty draft over the text it held.
+	err := c.Request.ParseMultipartForm(maxUploadSize)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondTooLarge(c, -1, maxUploadSize)
+		return false
+	} else if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		respondError(c, http.StatusBadRequest, fmt.Errorf("invalid form: %v", err))
+		return false
+	}
+	draft.Body = c.PostForm("body")
+	if !utf8.ValidString(draft.Body) {
+		respondError(c, http.StatusBadRequest, errors.New(`"body" must be UTF-8 text`))
+		return false
+	}
+	if maxBodyLength != 0 && int64(len(draft.Body)) > maxBodyLength {
+		abortWithError(c, http.StatusRequestEntityTooLarge, bodyTooLongError(int64(len(draft.Body))), gin.H{
+			"max_bytes": maxBodyLength,
+		})
+		return false
+	}
+	if draft.Language, err = parseLanguage(c.PostForm("language")); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func registerDraftRoutes(r *gin.Engine) {
+	drafts := r.Group("/api/v1/drafts")
+
+	drafts.GET("", func(c *gin.Context) {
+		owner, _ := requestDraftOwner(c, false)
+		list := []Draft{}
+		if owner != (draftOwner{}) {
+			var err error
+			if list, err = ListDrafts(owner); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"drafts": list,
+		})
+	})
+
+	// Start a draft. Anonymous browsers are given a claim token to keep it with, which is also answered for clients
+	// without cookies.
+	drafts.POST("", rateLimit(PolicySubmit), limitRequestBody(maxUploadSize), func(c *gin.Context) {
+		draft := new(Draft)
+		if !bindDraft(c, draft) {
+			return
+		}
+		owner, signedClaim := requestDraftOwner(c, true)
+		if err := CreateDraft(owner, draft, c.ClientIP()); errors.Is(err, ErrTooManyDrafts) || errors.Is(err, ErrTooManyIPDrafts) {
+			respondError(c, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		response := gin.H{
+			"id":         draft.Id,
+			"revision":   draft.Revision,
+			"updated_at": draft.UpdatedAt,
+		}
+		if signedClaim != "" {
+			response["claim_token"] = signedClaim
+		}
+		c.JSON(http.StatusCreated, response)
+	})
+
+	drafts.GET("/:id", func(c *gin.Context) {
+		owner, _ := requestDraftOwner(c, false)
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		draft, err := GetDraft(owner, id)
+		if errors.Is(err, ErrDraftNotFound) {
+			respondError(c, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, draft)
+	})
+
+	// Save a draft. With the "revision" it was loaded at, saves from elsewhere in the meantime are not overwritten.
+	drafts.PUT("/:id", limitRequestBody(maxUploadSize), func(c *gin.Context) {
+		owner, _ := requestDraftOwner(c, false)
+		draft := new(Draft)
+		draft.Id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+		revision, err := strconv.ParseInt(c.DefaultPostForm("revision", "0"), 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errors.New(`"revision" must be a number`))
+			return
+		}
+		if !bindDraft(c, draft) {
+			return
+		}
+		err = SaveDraft(owner, draft, revision)
+		switch {
+		case errors.Is(err, ErrDraftConflict):
+			respondError(c, http.StatusConflict, err)
+		case errors.Is(err, ErrDraftNotFound):
+			respondError(c, http.StatusNotFound, err)
+		case err != nil:
+			respondError(c, http.StatusInternalServerError, err)
+		default:
+			c.JSON(http.StatusOK, gin.H{
+				"id":         draft.Id,
+				"revision":   draft.Revision,
+				"updated_at": draft.UpdatedAt,
+			})
+		}
+	})
+
+	drafts.DELETE("/:id", func(c *gin.Context) {
+		owner, _ := requestDraftOwner(c, false)
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		found, err := DeleteDraft(owner, id)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if !found {
+			respondError(c, http.StatusNotFound, ErrDraftNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Draft discarded",
+		})
+	})
+}
@@ -5,4 +5,4 @@ set -xe
 GOARCH=amd64 GOOS=linux go build -o bin/application .
 
 # Zip the runtime dependencies for Elastic Beanstalk
-zip -r uploadThis.zip bin templates assets .ebextensions .env
+zip -r uploadThis.zip bin templates assets locales .ebextensions .env
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every error is answered with the same JSON shape, so that clients can branch on the kind of error rather than on its
+// message, which is translated and may be reworded:
+//
+//	{"code": "rate_limited", "message": "...", "details": {...}, "request_id": "..."}
+//
+// The code of an error never changes once released. Details are only present for errors that have more to tell, such as
+// the limit that was exceeded, and the request id is the one logged with the error and sent in X-Request-Id.
+
+// errorCodes are the codes of the errors that clients may want to tell apart. Other errors have the code of their
+// status in statusCodes.
+var errorCodes = map[error]string{
+	ErrLoginFailed:           "login_failed",
+	ErrUsernameInvalid:       "username_invalid",
+	ErrUsernameTaken:         "username_taken",
+	ErrPasswordTooShort:      "password_too_short",
+	ErrLoginRequired:         "login_required",
+	ErrAccountDisabled:       "account_disabled",
+	ErrRoleInvalid:           "role_invalid",
+	ErrBatchSize:             "batch_size",
+	ErrKeepLast:              "keep_last_invalid",
+	ErrConstraintUnique:      "conflict",
+	ErrHashInvalid:           "hash_invalid",
+	ErrHotlink:               "hotlink_denied",
+	ErrExternalUsernameTaken: "username_taken",
+	ErrLanguage:              "language_invalid",
+	ErrOverloaded:            "overloaded",
+	ErrMalformedImage:        "image_malformed",
+	ErrListLimit:             "limit_invalid",
+	ErrListCursor:            "cursor_invalid",
+	ErrListTime:              "time_invalid",
+	ErrListFilter:            "filter_invalid",
+	ErrRateLimited:           "rate_limited",
+	ErrSAMLResponseInvalid:   "saml_response_invalid",
+	ErrSecretsFound:          "secrets_found",
+	ErrSecretsUnconfirmed:    "secrets_unconfirmed",
+	ErrShareExpired:          "share_expired",
+	ErrShareSignature:        "share_invalid",
+	ErrObjectArchived:        "archived",
+	ErrStorageEventInvalid:   "storage_event_invalid",
+	ErrTeamSlugInvalid:       "team_name_invalid",
+	ErrTeamSlugTaken:         "team_name_taken",
+	ErrTeamRoleInvalid:       "team_role_invalid",
+	ErrNotTeamMember:         "not_team_member",
+	ErrTeamPermission:        "team_permission",
+	ErrLastTeamOwner:         "last_team_owner",
+	ErrTermsNotAccepted:      "terms_not_accepted",
+	ErrTwoFactorFailed:       "two_factor_failed",
+	ErrTwoFactorRequired:     "two_factor_required",
+	ErrTwoFactorLocked:       "two_factor_locked",
+	ErrArchiveRetrieving:     "archive_retrieving",
+	ErrArchiveRestricted:     "archive_restricted",
+	ErrHookUnavailable:       "hook_unavailable",
+	ErrUploadNotFound:        "upload_not_found",
+	ErrAttachmentNotFound:    "attachment_not_found",
+	ErrAccountNotFound:       "account_not_found",
+	ErrNotUploadOwner:        "not_upload_owner",
+	ErrNotInTrash:            "not_in_trash",
+	ErrUploadInTrash:         "upload_in_trash",
+	ErrDeletedByModerator:    "deleted_by_moderator",
+	ErrIdempotencyKey:        "idempotency_key_invalid",
+	ErrIdempotencyKeyReused:  "idempotency_key_reused",
+	ErrIdempotencyInProgress: "idempotency_in_progress",
+	ErrDraftNotFound:         "draft_not_found",
+	ErrDraftConflict:         "draft_conflict",
+	ErrTooManyDrafts:         "too_many_drafts",
+	ErrTooManyIPDrafts:       "too_many_drafts",
+	ErrTemplateNotFound:      "template_not_found",
+	ErrTemplateName:          "template_name_invalid",
+	ErrLiveDocumentNotFound:  "live_document_not_found",
+	ErrLiveDocumentPublished: "live_document_published",
+	ErrLiveDocumentTooLong:   "live_document_too_long",
+	ErrLiveDocumentEmpty:     "live_document_empty",
+	ErrLiveRevision:          "live_revision_unknown",
+	ErrLiveEditTooFast:       "rate_limited",
+	ErrNotLiveDocumentOwner:  "not_live_document_owner",
+	ErrOperationLength:       "live_operation_mismatch",
+	ErrOperationMalformed:    "live_operation_invalid",
+	ErrCIArchive:             "archive_invalid",
+	ErrCIArchiveEmpty:        "archive_empty",
+	ErrCIFiles:               "archive_files",
+	ErrCIBodyFile:            "body_file_invalid",
+	ErrRetentionLabel:        "retention_label_invalid",
+	ErrCIOutputFormat:        "format_invalid",
+	ErrAnalyticsDisabled:     "analytics_disabled",
+	ErrGeoRule:               "geo_rule_invalid",
+	ErrGeoBlocked:            "geo_blocked",
+	ErrAccessCode:            "access_code_invalid",
+	ErrAccessCodeLimit:       "access_code_limit",
+	ErrWatermark:             "watermark_failed",
+	ErrUsageMonth:            "month_invalid",
+	ErrNoJSON:                "no_json_representation",
+	ErrPreflightSize:         "preflight_invalid",
+	ErrBulkCriteria:          "criteria_missing",
+	ErrBulkOlderThan:         "older_than_invalid",
+	ErrBulkIP:                "ip_invalid",
+	ErrNotQuarantined:        "not_quarantined",
+	ErrQuarantineReason:      "reason_missing",
+	ErrTransferTarget:        "transfer_target_missing",
+	ErrTransferSame:          "transfer_unchanged",
+	ErrTransferOfferNotFound: "transfer_offer_not_found",
+	ErrPinNotPublic:          "pin_not_public",
+	ErrPinLimit:              "pin_limit",
+	ErrAttachmentInfected:    "attachment_infected",
+	ErrObjectTakenDown:       "attachment_taken_down",
+	ErrUploadLocked:          "upload_locked",
+	ErrNoAttachments:         "files_missing",
+	ErrIDTypo:                "id_typo",
+	ErrClipChannelNotFound:   "clip_channel_not_found",
+	ErrClipEmpty:             "clip_empty",
+	ErrClipDevice:            "clip_device_invalid",
+	ErrNotClipOwner:          "clip_not_owner",
+	ErrClipDeviceNotFound:    "clip_device_not_found",
+	ErrClipDeviceName:        "clip_device_name_invalid",
+	ErrPushSubscription:      "push_subscription_invalid",
+}
+
+// statusCodes are the codes of errors that have no code of their own.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:                 "bad_request",
+	http.StatusUnauthorized:               "unauthorized",
+	http.StatusForbidden:                  "forbidden",
+	http.StatusNotFound:                   "not_found",
+	http.StatusMethodNotAllowed:           "method_not_allowed",
+	http.StatusNotAcceptable:              "not_acceptable",
+	http.StatusConflict:                   "conflict",
+	http.StatusGone:                       "gone",
+	http.StatusRequestEntityTooLarge:      "too_large",
+	http.StatusUnsupportedMediaType:       "unsupported_media_type",
+	http.StatusUnprocessableEntity:        "invalid",
+	http.StatusTooManyRequests:            "rate_limited",
+	http.StatusUnavailableForLegalReasons: "unavailable_for_legal_reasons",
+	http.StatusInternalServerError:        "internal_error",
+	http.StatusBadGateway:                 "bad_gateway",
+	http.StatusServiceUnavailable:         "unavailable",
+	http.StatusGatewayTimeout:             "timeout",
+}
+
+// A codedError is an error with a code of its own, for errors whose message is made for each request.
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e *codedError) Error() string     { return e.message }
+func (e *codedError) ErrorCode() string { return e.code }
+
+// errorCode returns the code of an error answered with the given status. Errors can also give their own code with an
+// ErrorCode method.
+func errorCode(status int, err error) string {
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	for known, code := range errorCodes {
+		if errors.Is(err, known) {
+			return code
+		}
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return "internal_error"
+	}
+	return "bad_request"
+}
+
+// errorBody returns the body of an error response, with the message translated for the request. details may be nil.
+func errorBody(c *gin.Context, status int, err error, details gin.H) gin.H {
+	body := gin.H{
+		"code":       errorCode(status, err),
+		"message":    translate(requestLanguage(c), err.Error()),
+		"request_id": requestID(c),
+	}
+	if len(details) != 0 {
+		body["details"] = details
+	}
+	return body
+}
+
+// respondError answers a request with an error, logging it and tracking it when it is the server's fault.
+func respondError(c *gin.Context, code int, err error) {
+	writeError(c, code, errorBody(c, code, err, nil))
+	log.Printf("Error encountered serving request %s: %v", requestID(c), err)
+	if code >= http.StatusInternalServerError {
+		if errorTracking {
+			trackError(c, err)
+		} else {
+			debug.PrintStack()
+		}
+	}
+}
+
+// abortWithError answers a request with an error and its details and stops the handlers after the current one, for
+// middleware and checks that refuse requests by policy, such as rate limits. These refusals are not logged, so that a
+// flood of them does not flood the logs too.
+func abortWithError(c *gin.Context, code int, err error, details gin.H) {
+	c.Abort()
+	writeError(c, code, errorBody(c, code, err, details))
+}
+
+// writeError writes the body of an error response: as JSON, as a workflow command that shows the message in the log of
+// the failed step for CI requests that asked for GitHub Actions output, see ci.go, or as a page for plain HTML form
+// posts, see forms.go.
+func writeError(c *gin.Context, code int, body gin.H) {
+	if c.GetString(ciFormatKey) == ciFormatGitHub {
+		c.String(code, "::error title=copycat %v::%v\n", body["code"], githubEscape(body["message"].(string)))
+		return
+	}
+	if isFormPost(c) {
+		renderFormError(c, code, body["message"].(string))
+		return
+	}
+	c.JSON(code, body)
+}
+
+// validRequestID matches the request ids that are accepted from proxies in front of the server.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// assignRequestID is a middleware that gives every request an id, sent back in X-Request-Id and in error responses,
+// so that a failed request can be found in the logs. An id set by a proxy in X-Request-Id is kept.
+func assignRequestID(c *gin.Context) {
+	id := c.GetHeader("X-Request-Id")
+	if !validRequestID.MatchString(id) {
+		id = randomToken()
+	}
+	c.Set("requestID", id)
+	c.Header("X-Request-Id", id)
+	c.Next()
+}
+
+// requestID returns the id of the request.
+func requestID(c *gin.Context) string {
+	return c.GetString("requestID")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime/debug"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// version is the release reported with tracked errors. Release builds set it with
+// -ldflags "-X main.version=<version>"; otherwise the VCS revision the binary was built from is used.
+var version = ""
+
+// errorTracking is set when SENTRY_DSN is configured, after which server errors are sent to Sentry, or any service
+// accepting the Sentry protocol, instead of only being printed.
+var errorTracking bool
+
+func initErrorTracking() {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              dsn,
+		Release:          releaseVersion(),
+		Environment:      os.Getenv("SENTRY_ENVIRONMENT"),
+		AttachStacktrace: true,
+	})
+	if err != nil {
+		log.Fatalln("Failed to initialize error tracking:", err)
+	}
+	errorTracking = true
+}
+
+// releaseVersion returns version, or the VCS revision recorded by the Go toolchain when it is not set.
+func releaseVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "dev"
+}
+
+// trackError reports err to the error tracker along with the request it happened in and the requesting account.
+func trackError(c *gin.Context, err error) {
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetRequest(c.Request)
+		scope.SetTag("route", c.FullPath())
+		scope.SetTag("request_id", requestID(c))
+		if account := currentAccount(c); account != nil {
+			scope.SetUser(sentry.User{ID: account.Username, Username: account.Username})
+		}
+	})
+	hub.CaptureException(err)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxExpiry is the longest an upload may be set to expire after.
+const maxExpiry = 365 * 24 * time.Hour
+
+func initExpiry() {
+	RegisterJob(&Job{
+		Name:     "expiry",
+		Interval: 10 * time.Minute,
+		Run:      purgeExpiredUploads,
+	})
+}
+
+// parseExpiry reads how long until an upload expires: a number of seconds, a duration like "90m" or "48h", or a number
+// of days like "7d". An empty string or "never" keeps the upload, which is returned as 0.
+func parseExpiry(s string) (time.Duration, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" || s == "never" {
+		return 0, nil
+	}
+
+	var expiry time.Duration
+	var err error
+	if seconds, parseErr := strconv.ParseInt(s, 10, 64); parseErr == nil {
+		expiry = time.Duration(seconds) * time.Second
+	} else if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int64
+		n, err = strconv.ParseInt(days, 10, 64)
+		expiry = time.Duration(n) * 24 * time.Hour
+	} else {
+		expiry, err = time.ParseDuration(s)
+	}
+	if err != nil || expiry <= 0 || expiry > maxExpiry {
+		return 0, errors.New(`expiry must be a number of seconds, a duration like "90m" or a number of days like "7d", of at most 365 days`)
+	}
+	return expiry, nil
+}
+
+// purgeExpiredUploads permanently deletes the uploads whose expiry time has passed. They skip the trash, as the
+// uploader asked for them to be gone.
+func purgeExpiredUploads(ctx context.Context) error {
+	hashes, err := ExpiredUploads(time.Now().UTC().Unix())
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, _, err = PurgeUpload(ctx, hash); err != nil {
+			return fmt.Errorf("failed to purge %v: %v", hash, err)
+		}
+		RecordAudit("system", "upload.expire", hash, "", "")
+	}
+	return nil
+}
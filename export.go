@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An upload can be exported as a single HTML file to archive it outside of copycat. The file needs nothing from the
+// site to be read: the stylesheet is inlined, and attachments small enough are embedded as data URIs, with images shown
+// in the page. Larger attachments are linked on the site, so they only download while it still has them, and so are
+// watermarked images. Attachments that /f/ would refuse to download are neither.
+
+// maxEmbeddedAttachmentSize is the largest attachment embedded in an export.
+const maxEmbeddedAttachmentSize = 2 * 1024 * 1024
+
+// An exportedAttachment is an attachment in an export, embedded or linked, or the reason it is neither.
+type exportedAttachment struct {
+	Name     string
+	URL      template.URL // A data URI when the attachment is embedded, otherwise its link on the site.
+	Embedded bool
+	Image    bool // Whether the embedded attachment is an image shown in the page.
+	Reason   string
+}
+
+// exportedAttachments embeds or links the attachments of an upload for its export.
+func exportedAttachments(c *gin.Context, upload *UploadModel) []exportedAttachment {
+	attachments := make([]exportedAttachment, len(upload.FileNames))
+	for i, name := range upload.FileNames {
+		hash := upload.FileHashes[i]
+		attachments[i] = exportedAttachment{
+			Name: name,
+			URL:  template.URL(baseurl + "/f/" + hash + "/" + url.PathEscape(name)),
+		}
+		if reason, err := withheldAttachment(c, hash); err != nil || reason != "" {
+			if err != nil {
+				log.Printf("failed to check attachment %v for an export: %v", hash, err)
+			}
+			attachments[i] = exportedAttachment{Name: name, Reason: "This attachment is not available."}
+			continue
+		}
+		watermarked, err := isWatermarked(c.Request.Context(), hash)
+		if err != nil {
+			log.Printf("failed to check the watermark of attachment %v for an export: %v", hash, err)
+			continue
+		}
+		file, contents, err := OpenFileObject(c.Request.Context(), hash)
+		if err != nil {
+			if !errors.Is(err, ErrObjectArchived) {
+				log.Printf("failed to open attachment %v for an export: %v", hash, err)
+			}
+			continue
+		}
+		// Watermarked images are linked, so that they are downloaded with a watermark.
+		r := bufio.NewReader(contents)
+		if _, image := imageMediaType(file, r); watermarked && image {
+			contents.Close()
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(r, maxEmbeddedAttachmentSize+1))
+		contents.Close()
+		if err != nil {
+			log.Printf("failed to read attachment %v for an export: %v", hash, err)
+			continue
+		} else if len(data) > maxEmbeddedAttachmentSize {
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(file.ContentType())
+		if err != nil {
+			mediaType = "application/octet-stream"
+		}
+		attachments[i].URL = template.URL("data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data))
+		attachments[i].Embedded = true
+		attachments[i].Image = strings.HasPrefix(mediaType, "image/")
+	}
+	return attachments
+}
+
+// exportStyle returns the stylesheet of the site to inline in exports, which is empty if it cannot be read.
+func exportStyle() template.CSS {
+	file, err := assetsFS().Open("/style.css")
+	if err != nil {
+		log.Printf("failed to open the stylesheet for an export: %v", err)
+		return ""
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("failed to read the stylesheet for an export: %v", err)
+		return ""
+	}
+	return template.CSS(data)
+}
+
+func registerExportRoutes(r *gin.Engine) {
+	// Download an upload as a self-contained HTML file.
+	showExport := func(c *gin.Context) {
+		upload := printableUpload(c, uploadParam(c))
+		if upload == nil {
+			return
+		}
+
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": upload.ShortHash() + ".html"}))
+		throttleDownload(c)
+		renderPage(c, http.StatusOK, "export.html", gin.H{
+			"Page":        NewPageInfo(c, upload.ShortHash()),
+			"Upload":      upload,
+			"URL":         baseurl + uploadPath(upload.ShortHash()),
+			"ExportedAt":  time.Now().UTC().Format(time.RFC3339),
+			"Style":       exportStyle(),
+			"Attachments": exportedAttachments(c, upload),
+		})
+	}
+	r.GET("/p/:hash/export.html", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency), showExport)
+	r.GET("/:hash/export.html", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency),
+		legacyUploadRoute(showExport))
+}
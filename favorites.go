@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Accounts can star the uploads they view to find them again at /me/favorites, and admins pin uploads to /browse for
+// everyone. Only uploads that anyone may view can be pinned, so the browse page never lists anything else; uploads are
+// not listed there otherwise, as public uploads are only meant for those who have their link.
+
+const (
+	maxPinnedUploads  = 100 // Pinned uploads shown on /browse.
+	favoritesPageSize = 100 // Favorites shown on /me/favorites.
+)
+
+var (
+	ErrPinNotPublic = errors.New("only public uploads can be pinned")
+	ErrPinLimit     = errors.New("too many uploads are pinned already, unpin some first")
+)
+
+// SetFavorite stars or unstars an upload for an account.
+func SetFavorite(account *Account, hash string, favorite bool) error {
+	var err error
+	if favorite {
+		_, err = db.Exec(`INSERT INTO Favorites(account_id, upload_hash, created) VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING`, account.Id, hash, time.Now().UTC().Unix())
+	} else {
+		_, err = db.Exec("DELETE FROM Favorites WHERE account_id = $1 AND upload_hash = $2", account.Id, hash)
+	}
+	return err
+}
+
+// IsFavorite reports whether an account starred an upload.
+func IsFavorite(account *Account, hash string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Favorites WHERE account_id = $1 AND upload_hash = $2)",
+		account.Id, hash).Scan(&exists)
+	return exists, err
+}
+
+// FavoriteUploads returns the uploads starred by an account that are not in the trash, the newest first.
+func FavoriteUploads(account *Account, query ListQuery) ([]*UploadModel, *listCursor, error) {
+	return pageUploads(query, "SELECT "+uploadColumns+` FROM Uploads WHERE deleted_at = 0
+		AND hash IN (SELECT upload_hash FROM Favorites WHERE account_id = $1)`, []any{account.Id},
+		"timestamp", func(upload *UploadModel) int64 { return upload.Timestamp })
+}
+
+// PinUpload pins a public upload to the browse page.
+func PinUpload(upload *UploadModel, by string) error {
+	if upload.Private || upload.TeamId != 0 {
+		return ErrPinNotPublic
+	}
+	var pinned int
+	if err := db.QueryRow("SELECT COUNT(*) FROM PinnedUploads").Scan(&pinned); err != nil {
+		return err
+	} else if pinned >= maxPinnedUploads {
+		return ErrPinLimit
+	}
+	_, err := db.Exec(`INSERT INTO PinnedUploads(upload_hash, pinned_by, pinned_at) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, upload.Hash, by, time.Now().UTC().Unix())
+	return err
+}
+
+// UnpinUpload removes an upload from the browse page, and reports whether it was pinned.
+func UnpinUpload(hash string) (bool, error) {
+	result, err := db.Exec("DELETE FROM PinnedUploads WHERE upload_hash = $1", hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// PinnedUploads returns the pinned uploads that anyone may view now, the most recently pinned first.
+func PinnedUploads() ([]*UploadModel, error) {
+	rows, err := db.Query("SELECT "+uploadColumns+` FROM Uploads JOIN PinnedUploads ON upload_hash = hash
+		WHERE NOT private AND team_id = 0 AND deleted_at = 0 AND takedown_at = 0 AND quarantined_at = 0
+		AND publish_at <= $1 AND (expires_at = 0 OR expires_at > $1) ORDER BY pinned_at DESC LIMIT $2`,
+		time.Now().UTC().Unix(), maxPinnedUploads)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	uploads := []*UploadModel{}
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// visibleUploadList links the uploads of a list that the request may view, leaving out the others.
+func visibleUploadList(c *gin.Context, uploads []*UploadModel) []linkedUpload {
+	list := []linkedUpload{}
+	for _, upload := range uploads {
+		if ok, err := upload.canView(c); err != nil {
+			log.Printf("failed to check access to upload %v: %v", upload.Hash, err)
+			continue
+		} else if !ok {
+			continue
+		}
+		link := uploadLocation(upload)
+		if link == "" {
+			link = baseurl + ShareLink(upload, time.Now().Add(defaultShareTTL))
+		}
+		list = append(list, linkedUpload{upload, link})
+	}
+	return list
+}
+
+func uploadListJSON(list []linkedUpload) []gin.H {
+	described := make([]gin.H, len(list))
+	for i, upload := range list {
+		described[i] = gin.H{
+			"hash":      upload.Hash,
+			"url":       upload.Link,
+			"timestamp": time.Unix(upload.Timestamp, 0).UTC().Format(time.RFC3339),
+			"private":   upload.Private,
+		}
+	}
+	return described
+}
+
+// favoriteButton returns what the star button shows on an upload page, or nil for anonymous viewers.
+func favoriteButton(c *gin.Context, upload *UploadModel) gin.H {
+	account := currentAccount(c)
+	if account == nil {
+		return nil
+	}
+	favorite, err := IsFavorite(account, upload.Hash)
+	if err != nil {
+		log.Printf("failed to check whether %v starred %v: %v", account.Username, upload.Hash, err)
+		return nil
+	}
+	return gin.H{
+		"Action":   uploadPath(upload.Hash) + "/favorite",
+		"Favorite": favorite,
+	}
+}
+
+// viewableUpload fetches the upload of an API request, or returns nil after responding with an error when it does
+// not exist or the request may not view it.
+func viewableUpload(c *gin.Context) *UploadModel {
+	upload, err := GetUpload(uploadParam(c))
+	if err != nil {
+		respondError(c, http.StatusNotFound, ErrUploadNotFound)
+		return nil
+	}
+	if ok, err := upload.canView(c); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil
+	} else if !ok {
+		respondError(c, http.StatusNotFound, ErrUploadNotFound)
+		return nil
+	}
+	return upload
+}
+
+func registerFavoriteRoutes(r *gin.Engine) {
+	// The uploads pinned by the admins.
+	r.GET("/browse", func(c *gin.Context) {
+		uploads, err := PinnedUploads()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		renderPage(c, http.StatusOK, "uploads.html", gin.H{
+			"Page":    NewPageInfo(c, "Browse"),
+			"Intro":   "Uploads picked by the admins of this site.",
+			"Uploads": visibleUploadList(c, uploads),
+		})
+	})
+
+	r.GET("/api/v1/pins", func(c *gin.Context) {
+		uploads, err := PinnedUploads()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"uploads": uploadListJSON(visibleUploadList(c, uploads)),
+		})
+	})
+
+	// The uploads starred by the logged in account.
+	r.GET("/me/favorites", func(c *gin.Context) {
+		account := currentAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		uploads, _, err := FavoriteUploads(account, ListQuery{Limit: favoritesPageSize})
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		renderPage(c, http.StatusOK, "uploads.html", gin.H{
+			"Page":    NewPageInfo(c, "Favorites"),
+			"Intro":   "The uploads you starred.",
+			"Uploads": visibleUploadList(c, uploads),
+		})
+	})
+
+	r.GET("/api/v1/me/favorites", requireRole(RoleUser), func(c *gin.Context) {
+		query, ok := parseListQuery(c)
+		if !ok {
+			return
+		}
+		uploads, next, err := FavoriteUploads(currentAccount(c), query)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"uploads":     uploadListJSON(visibleUploadList(c, uploads)),
+			"next_cursor": setListLinks(c, next),
+		})
+	})
+
+	// Star and unstar an upload that the account may view.
+	setFavorite := func(favorite bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			upload := viewableUpload(c)
+			if upload == nil {
+				return
+			}
+			if err := SetFavorite(currentAccount(c), upload.Hash, favorite); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"hash":     upload.Hash,
+				"favorite": favorite,
+			})
+		}
+	}
+	r.PUT("/api/v1/uploads/:hash/favorite", requireRole(RoleUser), setFavorite(true))
+	r.DELETE("/api/v1/uploads/:hash/favorite", requireRole(RoleUser), setFavorite(false))
+
+	// The star button on the upload page, which leads back to the page.
+	r.POST("/p/:hash/favorite", func(c *gin.Context) {
+		account := currentAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		upload := viewableUpload(c)
+		if upload == nil {
+			return
+		}
+		if err := SetFavorite(account, upload.Hash, c.PostForm("favorite") == "true"); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		redirect := "/me/favorites"
+		if referer, err := url.Parse(c.Request.Referer()); err == nil && referer.Host == c.Request.Host {
+			redirect = referer.RequestURI()
+		}
+		c.Redirect(http.StatusSeeOther, redirect)
+	})
+
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	// Pin an upload to the browse page, or unpin it.
+	admin.PUT("/uploads/:hash/pin", func(c *gin.Context) {
+		account := currentAccount(c)
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		if err = PinUpload(upload, account.Username); err == ErrPinNotPublic || err == ErrPinLimit {
+			respondError(c, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "upload.pin", upload.Hash, "", c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload pinned",
+		})
+	})
+
+	admin.DELETE("/uploads/:hash/pin", func(c *gin.Context) {
+		account := currentAccount(c)
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		if found, err := UnpinUpload(upload.Hash); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if !found {
+			respondError(c, http.StatusNotFound, errors.New("this upload is not pinned"))
+			return
+		}
+		RecordAudit(account.Username, "upload.unpin", upload.Hash, "", c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload unpinned",
+		})
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// peerClockSkew is how far the clocks of two instances may drift apart before their signed requests are refused.
+const peerClockSkew = 5 * time.Minute
+
+// Federation settings. Uploads missing from this instance are looked up on the peers, which are the base URLs of other
+// instances sharing federationKey, and mirrored here when found.
+var (
+	peers         []string
+	federationKey []byte
+	peerClient    = &http.Client{Timeout: 30 * time.Second}
+)
+
+func initFederation() {
+	for _, peer := range strings.Split(os.Getenv("FEDERATION_PEERS"), ",") {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	federationKey = []byte(os.Getenv("FEDERATION_KEY"))
+	if len(peers) > 0 && len(federationKey) == 0 {
+		log.Fatal("FEDERATION_KEY environment variable must be set along with FEDERATION_PEERS")
+	}
+}
+
+// A federatedUpload is an upload as sent to peers. Only what is needed to show it is included; the uploader, their
+// tokens and their account stay on the instance the upload was submitted to.
+type federatedUpload struct {
+	Hash      string   `json:"hash"`
+	Body      string   `json:"body"`
+	Files     []string `json:"files"` // filename/objectkey pairs.
+	Timestamp int64    `json:"timestamp"`
+}
+
+// peerSignature signs a request between instances. The time is included so that a captured request cannot be
+// replayed for long.
+func peerSignature(method, path string, timestamp int64) string {
+	mac := hmac.New(sha256.New, federationKey)
+	mac.Write([]byte(method + "\n" + path + "\n" + strconv.FormatInt(timestamp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requirePeer refuses requests that are not signed by a peer with the federation key.
+func requirePeer(c *gin.Context) {
+	timestamp, err := strconv.ParseInt(c.GetHeader("X-Copycat-Timestamp"), 10, 64)
+	valid := err == nil && len(federationKey) > 0 &&
+		time.Since(time.Unix(timestamp, 0)).Abs() <= peerClockSkew &&
+		hmac.Equal([]byte(c.GetHeader("X-Copycat-Signature")), []byte(peerSignature(c.Request.Method, c.Request.URL.Path, timestamp)))
+	if !valid {
+		respondError(c, http.StatusUnauthorized, errors.New("invalid or missing peer signature"))
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// peerGet makes a signed request to a peer and returns the response if it succeeded. A missing resource is returned as
+// a nil response without an error.
+func peerGet(ctx context.Context, peer, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("X-Copycat-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Copycat-Signature", peerSignature(http.MethodGet, req.URL.Path, timestamp))
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v answered %v", peer, resp.Status)
+	}
+	return resp, nil
+}
+
+// MirrorFromPeers looks up an upload by hash prefix on the peers and copies the first one found, with its attachments,
+// into this instance. It returns sql.ErrNoRows when no peer has the upload.
+func MirrorFromPeers(ctx context.Context, hash string) (*UploadModel, error) {
+	for _, peer := range peers {
+		upload, err := mirrorFromPeer(ctx, peer, hash)
+		if err != nil {
+			log.Printf("failed to mirror %v from %v: %v", hash, peer, err)
+			continue
+		}
+		if upload != nil {
+			return upload, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func mirrorFromPeer(ctx context.Context, peer, hash string) (*UploadModel, error) {
+	resp, err := peerGet(ctx, peer, "/api/v1/federation/uploads/"+hash)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var upload federatedUpload
+	if err = json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return nil, err
+	}
+	if len(upload.Hash) != 40 || !isValidHex(upload.Hash) || !matchesUploadID(upload.Hash, hash) {
+		return nil, fmt.Errorf("peer sent upload %q for %v", upload.Hash, hash)
+	}
+
+	// Attachments are copied first, so that the upload never exists here without them.
+	tags := uploadObjectTags(upload.Hash, 0, time.Time{})
+	size := int64(len(upload.Body))
+	for _, pair := range upload.Files {
+		fileSize, err := mirrorObject(ctx, peer, fileKey(pair), tags)
+		if err != nil {
+			return nil, err
+		}
+		size += fileSize
+	}
+
+	// Nobody holds an edit token for a mirrored upload; it is managed on the instance it was submitted to.
+	result, err := db.ExecContext(ctx, `INSERT INTO Uploads(hash, body, files, timestamp, edit_token, share_secret, uploader_ip, size,
+		short_length) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (hash) DO NOTHING`,
+		upload.Hash, upload.Body, (*pq.StringArray)(&upload.Files), upload.Timestamp, hashToken(randomToken()), randomToken(),
+		"peer:"+peer, size, len(upload.Hash))
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 1 {
+		if err = assignShortHash(ctx, upload.Hash); err != nil {
+			log.Printf("failed to assign a short hash to %v: %v", upload.Hash, err)
+		}
+	}
+	log.Printf("Mirrored upload %v from %v", upload.Hash, peer)
+	return GetUpload(upload.Hash)
+}
+
+// mirrorObject copies a stored object from a peer unless it is here already, and returns the size of the file in it.
+// Object keys are the SHA-1 of the object, which is checked so that a peer cannot store anything but the object that
+// was asked for.
+func mirrorObject(ctx context.Context, peer, key string, tags ObjectTags) (int64, error) {
+	if exists, err := objectStore.Exists(ctx, key); err != nil {
+		return 0, err
+	} else if exists {
+		file, contents, err := OpenFileObject(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		contents.Close()
+		return file.Size, nil
+	}
+
+	resp, err := peerGet(ctx, peer, "/api/v1/federation/objects/"+key)
+	if err != nil {
+		return 0, err
+	}
+	if resp == nil {
+		return 0, fmt.Errorf("object %v is missing", key)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSubmitSize))
+	if err != nil {
+		return 0, err
+	}
+	file, err := DecodeFileObject(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode object %v: %v", key, err)
+	}
+	// Objects stored before attachment keys were made from the name and contents are keyed by the hash of the object.
+	if attachmentKey(strings.TrimSpace(file.Filename), file.Contents, keySalt(key)) != key && fmt.Sprintf("%x", sha1.Sum(data)) != key {
+		return 0, fmt.Errorf("object %v does not match its key", key)
+	}
+	if err = objectStore.Put(ctx, key, data, tags); err != nil {
+		return 0, err
+	}
+	return file.Size, recordObject(ctx, key, objectStore, sha256Hex(data), len(data), sha256Hex(file.Contents))
+}
+
+// restrictedObject reports whether downloads of an object are restricted by the country rule, watermark or quarantine
+// of an upload, which peers would not apply to their copies.
+func restrictedObject(ctx context.Context, key string) (bool, error) {
+	var restricted bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM ObjectGeoRules WHERE key = $1)
+		OR EXISTS (SELECT 1 FROM WatermarkedObjects WHERE key = $1) OR EXISTS (SELECT 1 FROM QuarantinedObjects WHERE key = $1)`,
+		key).Scan(&restricted)
+	return restricted, err
+}
+
+func registerFederationRoutes(r *gin.Engine) {
+	federation := r.Group("/api/v1/federation", requirePeer)
+
+	// Only uploads anyone could view on this instance are shared with peers. Peers would serve their copies without the
+	// country rule or watermark of an upload, so uploads with either are not shared either.
+	federation.GET("/uploads/:hash", func(c *gin.Context) {
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil || upload.Private || upload.TeamId != 0 || !upload.Published() || upload.TakedownAt != 0 || upload.ExpiresAt != 0 ||
+			upload.QuarantinedAt != 0 || upload.GeoRule.Allow != nil || upload.GeoRule.Deny != nil || upload.Watermark {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		files := make([]string, len(upload.FileNames))
+		for i := range files {
+			files[i] = upload.FileNames[i] + "/" + upload.FileHashes[i]
+		}
+		c.JSON(http.StatusOK, federatedUpload{
+			Hash:      upload.Hash,
+			Body:      upload.Body,
+			Files:     files,
+			Timestamp: upload.Timestamp,
+		})
+	})
+
+	federation.GET("/objects/:key", func(c *gin.Context) {
+		if restricted, err := restrictedObject(c.Request.Context(), c.Param("key")); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if restricted {
+			respondError(c, http.StatusNotFound, errors.New("object not found"))
+			return
+		}
+		object, err := objectStore.Open(c.Request.Context(), c.Param("key"))
+		if errors.Is(err, ErrObjectArchived) {
+			respondArchived(c, c.Param("key"))
+			return
+		} else if err != nil {
+			respondError(c, http.StatusNotFound, errors.New("object not found"))
+			return
+		}
+		defer object.Close()
+		c.DataFromReader(http.StatusOK, -1, "application/octet-stream", object, nil)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An Attachment is a file of an upload, which is stored as the object Key under the name it was uploaded with.
+type Attachment struct {
+	Name string
+	Key  string
+}
+
+// Attachments pairs the names of the attachments of an upload with their objects.
+func (upload *UploadModel) Attachments() []Attachment {
+	attachments := make([]Attachment, len(upload.FileNames))
+	for i, name := range upload.FileNames {
+		attachments[i] = Attachment{Name: name, Key: upload.FileHashes[i]}
+	}
+	return attachments
+}
+
+// Link returns the link that downloads the attachment from the CDN, or from this site relative to it.
+func (a Attachment) Link() string {
+	return cdnURL + "/f/" + a.Key + "/" + url.PathEscape(a.Name) + DownloadQuery(a.Key)
+}
+
+// StreamLink returns the link that plays the attachment inline, like Link.
+func (a Attachment) StreamLink() string {
+	return cdnURL + "/stream/" + a.Key + DownloadQuery(a.Key)
+}
+
+// DownloadURL returns the absolute URL that downloads the attachment.
+func (a Attachment) DownloadURL() string {
+	if cdnURL != "" {
+		return a.Link()
+	}
+	return baseurl + a.Link()
+}
+
+// An AttachmentListing describes an attachment to API clients. Its size, media type and checksum are those of the file
+// as downloaded, and are left out for archived attachments, which cannot be read until they are restored.
+type AttachmentListing struct {
+	Filename    string `json:"filename"`
+	Size        *int64 `json:"size,omitempty"`
+	MIME        string `json:"mime,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	DownloadURL string `json:"download_url"`
+	Archived    bool   `json:"archived,omitempty"`
+}
+
+// ListAttachments describes every attachment of an upload, in the order they were uploaded.
+func ListAttachments(ctx context.Context, upload *UploadModel) ([]AttachmentListing, error) {
+	listings := make([]AttachmentListing, len(upload.FileNames))
+	for i, attachment := range upload.Attachments() {
+		listings[i] = AttachmentListing{Filename: attachment.Name, DownloadURL: attachment.DownloadURL()}
+		file, checksum, err := attachmentChecksum(ctx, attachment.Key)
+		if errors.Is(err, ErrObjectArchived) {
+			listings[i].Archived = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		listings[i].Size, listings[i].MIME, listings[i].SHA256 = &file.Size, file.ContentType(), checksum
+	}
+	return listings, nil
+}
+
+func registerFileRoutes(r *gin.Engine) {
+	// List the attachments of an upload. Whoever can read the upload through the API or a share link can list them.
+	r.GET("/api/v1/uploads/:hash/files", func(c *gin.Context) {
+		upload := sharedUpload(c, uploadParam(c))
+		if upload == nil {
+			return
+		}
+		files, err := ListAttachments(c.Request.Context(), upload)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"hash":  upload.Hash,
+			"files": files,
+		})
+	})
+}
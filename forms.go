@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Forms like the one on the index page are also posted by browsers without JavaScript, as plain HTML forms. Browsers
+// ask for HTML first in their Accept header, while scripts and command line clients accept anything or ask for JSON,
+// so the same endpoint answers a form post with a redirect to the page of what it created, and with an error page
+// instead of JSON when it fails.
+
+// formPostKey marks requests that are plain HTML form posts in the context of the request.
+const formPostKey = "formPost"
+
+// formPost is a middleware for endpoints that browsers post forms to, which marks plain HTML form posts; see
+// isFormPost.
+func formPost(c *gin.Context) {
+	switch c.ContentType() {
+	case gin.MIMEPOSTForm, gin.MIMEMultipartPOSTForm:
+		if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+			c.Set(formPostKey, true)
+		}
+	}
+	c.Next()
+}
+
+// isFormPost reports whether the request is a plain HTML form post from a browser, which is answered with pages
+// instead of JSON.
+func isFormPost(c *gin.Context) bool {
+	return c.GetBool(formPostKey)
+}
+
+// respondFormRedirect answers a form post that succeeded by sending the browser to the page at url, with a GET request.
+func respondFormRedirect(c *gin.Context, url string) {
+	c.Redirect(http.StatusSeeOther, url)
+}
+
+// renderFormError answers a form post that failed with a page showing the message of the error.
+func renderFormError(c *gin.Context, code int, message string) {
+	renderPage(c, code, "error.html", gin.H{
+		"Page":  NewPageInfo(c, http.StatusText(code)),
+		"Error": message,
+	})
+}
+
+// submittedForm returns the values and files of a form, which is multipart when it has files and may be URL-encoded
+// when it only has values.
+func submittedForm(c *gin.Context) (*multipart.Form, error) {
+	if c.ContentType() == gin.MIMEPOSTForm {
+		if err := c.Request.ParseForm(); err != nil {
+			return nil, err
+		}
+		return &multipart.Form{Value: c.Request.PostForm, File: map[string][]*multipart.FileHeader{}}, nil
+	}
+	return c.MultipartForm()
+}
+
+// formTimeLayouts are the layouts of the times browsers send from datetime-local inputs, which have no time zone.
+var formTimeLayouts = []string{"2006-01-02T15:04", "2006-01-02T15:04:05"}
+
+// parseFormTime parses an RFC 3339 timestamp, or the time of a datetime-local input as UTC, as forms posted without
+// JavaScript cannot send the time zone of the browser.
+func parseFormTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range formTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("not a timestamp")
+}
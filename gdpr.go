@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A DataSubject is the person whose data is exported or erased, identified by their account or, for anonymous
+// uploads, the IP address they uploaded from.
+type DataSubject struct {
+	Account *Account
+	IP      string
+}
+
+func (s DataSubject) String() string {
+	if s.Account != nil {
+		return "account:" + s.Account.Username
+	}
+	return "ip:" + s.IP
+}
+
+// Uploads lists every upload associated with the subject. The uploads of an IP address are only its anonymous ones:
+// those of accounts and teams belong to them, whichever address they were uploaded from.
+func (s DataSubject) Uploads() ([]*UploadModel, error) {
+	if s.Account != nil {
+		return ListUploads("account_id = $1", s.Account.Id)
+	}
+	return ListUploads("uploader_ip = $1 AND account_id = 0 AND team_id = 0", s.IP)
+}
+
+// exportedUpload is the description of an upload written to uploads.json in an export archive.
+type exportedUpload struct {
+	Hash        string   `json:"hash"`
+	Timestamp   int64    `json:"timestamp"`
+	Private     bool     `json:"private"`
+	PublishAt   int64    `json:"publish_at,omitempty"`
+	Attachments []string `json:"attachments"`
+	Archived    []string `json:"archived_attachments,omitempty"` // Left out while they are retrieved from the archive.
+}
+
+// exportedClipChannel is a clip channel of an account written to clip_channels.json in an export archive.
+type exportedClipChannel struct {
+	Id        string        `json:"id"`
+	CreatedAt int64         `json:"created_at"`
+	Devices   []ClipDevice  `json:"devices"`
+	Snippets  []ClipSnippet `json:"snippets"`
+}
+
+// exportJSON writes v to the archive as an indented JSON file.
+func exportJSON(archive *zip.Writer, name string, v any) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// exportAccountData writes what an account keeps besides its uploads to the archive: its drafts, its own paste
+// templates and its clip channels with their snippets and paired devices.
+func exportAccountData(archive *zip.Writer, account *Account) error {
+	rows, err := db.Query(`SELECT id, body, language, revision, created_at, updated_at FROM Drafts WHERE account_id = $1
+		ORDER BY id`, account.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	drafts := []Draft{}
+	for rows.Next() {
+		var draft Draft
+		if err = rows.Scan(&draft.Id, &draft.Body, &draft.Language, &draft.Revision, &draft.CreatedAt, &draft.UpdatedAt); err != nil {
+			return err
+		}
+		drafts = append(drafts, draft)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if err = exportJSON(archive, "drafts.json", drafts); err != nil {
+		return err
+	}
+
+	templates, err := ListPasteTemplates(account)
+	if err != nil {
+		return err
+	}
+	own := []PasteTemplate{}
+	for _, t := range templates {
+		if t.AccountId == account.Id {
+			own = append(own, t)
+		}
+	}
+	if err = exportJSON(archive, "templates.json", own); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT id, created_at FROM ClipChannels WHERE account_id = $1 ORDER BY created_at, id", account.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	channels := []exportedClipChannel{}
+	for rows.Next() {
+		var channel exportedClipChannel
+		if err = rows.Scan(&channel.Id, &channel.CreatedAt); err != nil {
+			return err
+		}
+		channels = append(channels, channel)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i := range channels {
+		if channels[i].Devices, err = ListClipDevices(channels[i].Id); err != nil {
+			return err
+		}
+		if channels[i].Snippets, err = ClipHistory(channels[i].Id, 0); err != nil {
+			return err
+		}
+	}
+	return exportJSON(archive, "clip_channels.json", channels)
+}
+
+// ExportData writes a zip archive of everything stored about the subject to w: an uploads.json index, and a folder
+// per upload holding its body and attachments. For accounts, drafts.json, templates.json and clip_channels.json hold
+// the rest of what they keep.
+func ExportData(subject DataSubject, w io.Writer) error {
+	uploads, err := subject.Uploads()
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	index := make([]exportedUpload, len(uploads))
+	for i, upload := range uploads {
+		index[i] = exportedUpload{
+			Hash:        upload.Hash,
+			Timestamp:   upload.Timestamp,
+			Private:     upload.Private,
+			PublishAt:   upload.PublishAt,
+			Attachments: upload.FileNames,
+		}
+
+		if err = upload.loadBody(context.TODO()); err != nil {
+			return err
+		}
+		body, err := archive.Create(upload.Hash + "/body.txt")
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(body, upload.Body); err != nil {
+			return err
+		}
+
+		for j, fileHash := range upload.FileHashes {
+			_, contents, err := OpenFileObject(context.TODO(), fileHash)
+			if errors.Is(err, ErrObjectArchived) {
+				// The subject can export again once the attachment is retrieved.
+				if err = retrieveArchived(context.TODO(), objectStore, fileHash); err != nil {
+					return err
+				}
+				index[i].Archived = append(index[i].Archived, upload.FileNames[j])
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to export attachment %v: %v", fileHash, err)
+			}
+			// Prefix the index to keep attachments with the same name apart. path.Base removes anything that could
+			// escape the folder when the archive is extracted.
+			attachment, err := archive.Create(fmt.Sprintf("%s/attachments/%d-%s", upload.Hash, j+1, path.Base(upload.FileNames[j])))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(attachment, contents)
+			contents.Close()
+			if err != nil {
+				return fmt.Errorf("failed to export attachment %v: %v", fileHash, err)
+			}
+		}
+	}
+
+	if err = exportJSON(archive, "uploads.json", gin.H{
+		"subject":     subject.String(),
+		"exported_at": time.Now().UTC().Format(time.RFC3339),
+		"uploads":     index,
+	}); err != nil {
+		return err
+	}
+	if subject.Account != nil {
+		if err = exportAccountData(archive, subject.Account); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// An ErasureReceipt confirms what was erased. The signature is an HMAC of the other fields made with the server's
+// signing key, so a receipt presented later can be checked with VerifyReceipt.
+type ErasureReceipt struct {
+	Subject   string   `json:"subject"`
+	ErasedAt  string   `json:"erased_at"`
+	Uploads   []string `json:"uploads"`
+	Objects   int      `json:"objects"` // Stored objects deleted, leaving out those that other uploads share.
+	Account   bool     `json:"account_deleted"`
+	Signature string   `json:"signature"`
+}
+
+func (r *ErasureReceipt) sign() string {
+	unsigned := *r
+	unsigned.Signature = ""
+	payload, _ := json.Marshal(unsigned)
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("receipt\n"))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyReceipt reports whether a receipt was issued by this server and has not been altered.
+func VerifyReceipt(r *ErasureReceipt) bool {
+	return hmac.Equal([]byte(r.Signature), []byte(r.sign()))
+}
+
+// EraseData deletes every upload of the subject along with its attachments, and the subject's account if it has one,
+// which takes its drafts, paste templates and clip channels with it.
+func EraseData(ctx context.Context, subject DataSubject) (*ErasureReceipt, error) {
+	uploads, err := subject.Uploads()
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &ErasureReceipt{Subject: subject.String(), Uploads: []string{}}
+	for _, upload := range uploads {
+		_, deleted, err := PurgeUpload(ctx, upload.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to erase upload %v: %v", upload.Hash, err)
+		}
+		receipt.Uploads = append(receipt.Uploads, upload.Hash)
+		receipt.Objects += len(deleted)
+	}
+
+	if subject.Account != nil {
+		if err = DeleteAccount(subject.Account); err != nil {
+			return nil, err
+		}
+		receipt.Account = true
+	}
+
+	receipt.ErasedAt = time.Now().UTC().Format(time.RFC3339)
+	receipt.Signature = receipt.sign()
+	return receipt, nil
+}
+
+// adminDataSubject reads the subject of an admin export or erasure from the "account" or "ip" argument.
+func adminDataSubject(c *gin.Context) (DataSubject, error) {
+	if username := c.Query("account"); username != "" {
+		account, err := GetAccount(username)
+		if err != nil {
+			return DataSubject{}, ErrAccountNotFound
+		}
+		return DataSubject{Account: account}, nil
+	}
+	if ip := c.Query("ip"); ip != "" {
+		return DataSubject{IP: ip}, nil
+	}
+	return DataSubject{}, errors.New(`an "account" or "ip" argument is required`)
+}
+
+// sendExport streams the export archive of subject to the client.
+func sendExport(c *gin.Context, subject DataSubject) {
+	filename := fmt.Sprintf("copycat-export-%s.zip", time.Now().UTC().Format("20060102"))
+	c.Writer.Header().Set("Content-Type", "application/zip")
+	c.Writer.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	if err := ExportData(subject, c.Writer); err != nil {
+		// The archive is already partially sent, so the best we can do is cut it off and log why.
+		log.Printf("failed to export data of %v: %v", subject, err)
+	}
+}
+
+func registerDataRoutes(r *gin.Engine) {
+	// Export everything the logged in account has uploaded.
+	r.GET("/api/v1/me/export", func(c *gin.Context) {
+		account := requireAccount(c)
+		if account == nil {
+			return
+		}
+		sendExport(c, DataSubject{Account: account})
+	})
+
+	// Erase the logged in account and everything it has uploaded. The password must be entered again to confirm.
+	r.POST("/api/v1/me/erase", func(c *gin.Context) {
+		account := requireAccount(c)
+		if account == nil {
+			return
+		}
+		if _, err := Login(account.Username, c.PostForm("password"), c.ClientIP()); err != nil {
+			respondError(c, http.StatusForbidden, errors.New("the account password is required to confirm erasure"))
+			return
+		}
+
+		receipt, err := EraseData(c.Request.Context(), DataSubject{Account: account})
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "data.erase", receipt.Subject, fmt.Sprintf("%d uploads", len(receipt.Uploads)), c.ClientIP())
+		clearSession(c)
+		c.JSON(http.StatusOK, receipt)
+	})
+
+	// Check that an erasure receipt was issued by this server.
+	r.POST("/api/v1/receipts/verify", func(c *gin.Context) {
+		receipt := new(ErasureReceipt)
+		if err := c.ShouldBindJSON(receipt); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"valid": VerifyReceipt(receipt),
+		})
+	})
+
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	// Export the data of any account or IP address, e.g. to answer a subject access request.
+	admin.GET("/export", func(c *gin.Context) {
+		subject, err := adminDataSubject(c)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		RecordAudit(currentAccount(c).Username, "data.export", subject.String(), "", c.ClientIP())
+		sendExport(c, subject)
+	})
+
+	// Erase the data of any account or IP address. Without confirm=<the account or ip argument> nothing is deleted,
+	// and the uploads that would be are listed instead.
+	admin.POST("/erase", func(c *gin.Context) {
+		subject, err := adminDataSubject(c)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		if confirm := c.Query("confirm"); confirm == "" || confirm != c.Query("account")+c.Query("ip") {
+			uploads, err := subject.Uploads()
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			hashes := make([]string, len(uploads))
+			for i, upload := range uploads {
+				hashes[i] = upload.Hash
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"dry_run": true,
+				"subject": subject.String(),
+				"uploads": hashes,
+			})
+			return
+		}
+
+		receipt, err := EraseData(c.Request.Context(), subject)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(currentAccount(c).Username, "data.erase", receipt.Subject, fmt.Sprintf("%d uploads", len(receipt.Uploads)), c.ClientIP())
+		c.JSON(http.StatusOK, receipt)
+	})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The country a request comes from is read from a header that the CDN or proxy in front of the server sets from the
+// address of the client, named by COUNTRY_HEADER: CF-IPCountry on Cloudflare, or CloudFront-Viewer-Country on
+// CloudFront. Without one, the address is looked up in the GeoIP database of GEOIP_DATABASE, if there is one; see
+// GeoDatabase. Otherwise the country of every request is unknown.
+//
+// Countries can be kept from viewing and downloading uploads: every upload by GEO_ALLOW or GEO_DENY, and single uploads
+// by rules their owners set. An allow list keeps out every other country, and requests from unknown countries too; a
+// deny list only keeps out the countries on it.
+
+var (
+	ErrGeoRule    = errors.New(`a rule has either "allow" or "deny", a list of two-letter country codes`)
+	ErrGeoBlocked = errors.New("this content is not available in your country")
+)
+
+// countryHeader is the header holding the country of a request, or "".
+var countryHeader string
+
+// A GeoDatabase finds the country of an IP address, as an ISO 3166-1 alpha-2 code, or "" if it is unknown.
+type GeoDatabase interface {
+	Country(addr netip.Addr) string
+}
+
+// geoDatabase holds the GeoDatabase that addresses are looked up in, or nil.
+var geoDatabase atomic.Pointer[GeoDatabase]
+
+// siteGeoRule holds the *GeoRule of every upload.
+var siteGeoRule atomic.Pointer[GeoRule]
+
+// geoExemptPaths are not restricted by the site's rule, so that admins, peers and identity providers are never locked
+// out by it.
+var geoExemptPaths = []string{"/api/v1/admin/", "/api/v1/federation/", "/scim/"}
+
+func initGeo() {
+	countryHeader = os.Getenv("COUNTRY_HEADER")
+	if err := loadGeoConfig(); err != nil {
+		log.Fatal(err)
+	}
+	RegisterReloader("geo restrictions", loadGeoConfig)
+}
+
+// loadGeoConfig reads the GeoIP database and the rule of the site.
+func loadGeoConfig() error {
+	rule := &GeoRule{Allow: strings.Split(os.Getenv("GEO_ALLOW"), ","), Deny: strings.Split(os.Getenv("GEO_DENY"), ",")}
+	if err := rule.normalize(); err != nil {
+		return fmt.Errorf("GEO_ALLOW and GEO_DENY: %v", err)
+	}
+
+	var database GeoDatabase
+	if path := os.Getenv("GEOIP_DATABASE"); path != "" {
+		var err error
+		if database, err = openGeoDatabase(path); err != nil {
+			return fmt.Errorf("GEOIP_DATABASE: %v", err)
+		}
+	} else if (len(rule.Allow) != 0 || len(rule.Deny) != 0) && countryHeader == "" {
+		log.Print("GEO_ALLOW or GEO_DENY is set without COUNTRY_HEADER or GEOIP_DATABASE, so every country is unknown")
+	}
+	geoDatabase.Store(&database)
+	siteGeoRule.Store(rule)
+	return nil
+}
+
+// openGeoDatabase opens the GeoIP database in a file. Only CSV files of address ranges are supported; see
+// readRangeDatabase.
+func openGeoDatabase(path string) (GeoDatabase, error) {
+	if !strings.HasSuffix(strings.ToLower(path), ".csv") {
+		return nil, errors.New("the database must be a .csv file of start,end,country address ranges")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readRangeDatabase(file)
+}
+
+// requestCountry returns the ISO 3166-1 alpha-2 code of the country a request comes from, or "" if it is unknown.
+func requestCountry(c *gin.Context) string {
+	if countryHeader != "" {
+		return countryCode(c.GetHeader(countryHeader))
+	}
+	if database := geoDatabase.Load(); database != nil && *database != nil {
+		if addr, err := netip.ParseAddr(c.ClientIP()); err == nil {
+			return (*database).Country(addr.Unmap())
+		}
+	}
+	return ""
+}
+
+// countryCode returns a country code in upper case, or "" if it is not one.
+func countryCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' || code == "XX" {
+		return ""
+	}
+	return code
+}
+
+// A geoRange is a range of addresses in one country.
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// A rangeDatabase is a GeoDatabase of address ranges sorted by their start.
+type rangeDatabase []geoRange
+
+// readRangeDatabase reads a CSV file of address ranges with the first address, the last address and the country code of
+// each range in its first three columns, such as the free databases of DB-IP and IP2Location LITE. Addresses are
+// written as IP addresses or as decimal numbers. A header line is skipped.
+func readRangeDatabase(r io.Reader) (rangeDatabase, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	var database rangeDatabase
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d has fewer than 3 columns", line)
+		}
+		start, startErr := parseGeoAddr(record[0])
+		end, endErr := parseGeoAddr(record[1])
+		if startErr != nil || endErr != nil {
+			if line == 1 {
+				continue // The header.
+			}
+			return nil, fmt.Errorf("line %d: %v", line, errors.Join(startErr, endErr))
+		}
+		if country := countryCode(record[2]); country != "" {
+			database = append(database, geoRange{start, end, country})
+		}
+	}
+	sort.Slice(database, func(i, j int) bool { return database[i].start.Less(database[j].start) })
+	return database, nil
+}
+
+// parseGeoAddr parses an address written as an IP address or as a decimal number, which is an IPv4 address below 2^32
+// and an IPv6 address otherwise.
+func parseGeoAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), nil
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return netip.Addr{}, fmt.Errorf("%q is not an address", s)
+	}
+	if n.BitLen() <= 32 {
+		var b [4]byte
+		return netip.AddrFrom4([4]byte(n.FillBytes(b[:]))), nil
+	}
+	var b [16]byte
+	return netip.AddrFrom16([16]byte(n.FillBytes(b[:]))).Unmap(), nil
+}
+
+func (database rangeDatabase) Country(addr netip.Addr) string {
+	// The last range that starts at or before the address is the only one that can contain it.
+	i := sort.Search(len(database), func(i int) bool { return addr.Less(database[i].start) }) - 1
+	if i < 0 || database[i].end.Less(addr) {
+		return ""
+	}
+	return database[i].country
+}
+
+// A GeoRule lists the countries that may view and download an upload, or the ones that may not.
+type GeoRule struct {
+	Allow []string `json:"allow,omitempty"` // Only these countries are allowed, and unknown countries are not.
+	Deny  []string `json:"deny,omitempty"`  // These countries are not allowed.
+}
+
+// normalize writes the country codes of the rule in upper case and drops empty ones, and returns ErrGeoRule if the rule
+// is invalid.
+func (rule *GeoRule) normalize() error {
+	var err error
+	if rule.Allow, err = normalizeCountries(rule.Allow); err != nil {
+		return err
+	}
+	if rule.Deny, err = normalizeCountries(rule.Deny); err != nil {
+		return err
+	}
+	if len(rule.Allow) != 0 && len(rule.Deny) != 0 {
+		return ErrGeoRule
+	}
+	return nil
+}
+
+func normalizeCountries(codes []string) ([]string, error) {
+	var countries []string
+	for _, code := range codes {
+		if strings.TrimSpace(code) == "" {
+			continue
+		}
+		country := countryCode(code)
+		if country == "" {
+			return nil, ErrGeoRule
+		}
+		if !slices.Contains(countries, country) {
+			countries = append(countries, country)
+		}
+	}
+	return countries, nil
+}
+
+// Allows reports whether requests from a country, or "" if it is unknown, are allowed by the rule.
+func (rule *GeoRule) Allows(country string) bool {
+	if len(rule.Allow) != 0 {
+		return country != "" && slices.Contains(rule.Allow, country)
+	}
+	return country == "" || !slices.Contains(rule.Deny, country)
+}
+
+// restrictCountries is a middleware that keeps the countries the site's rule does not allow from viewing and
+// downloading, which are the GET and HEAD requests.
+func restrictCountries(c *gin.Context) {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return
+	}
+	rule := siteGeoRule.Load()
+	if len(rule.Allow) == 0 && len(rule.Deny) == 0 {
+		return
+	}
+	for _, prefix := range geoExemptPaths {
+		if strings.HasPrefix(c.Request.URL.Path, prefix) {
+			return
+		}
+	}
+	if !rule.Allows(requestCountry(c)) {
+		respondGeoBlocked(c)
+		c.Abort()
+	}
+}
+
+// respondGeoBlocked answers a request from a country that is not allowed, with a page for browsers.
+func respondGeoBlocked(c *gin.Context) {
+	path := c.Request.URL.Path
+	if strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/f/") || strings.HasPrefix(path, "/stream/") ||
+		path == "/download" || wantsJSON(c) {
+		respondError(c, http.StatusUnavailableForLegalReasons, ErrGeoBlocked)
+		return
+	}
+	renderPage(c, http.StatusUnavailableForLegalReasons, "unavailable.html", gin.H{
+		"Page": NewPageInfo(c, "Not available"),
+	})
+}
+
+// allowsCountry reports whether the owner's rule of an upload allows the country of a request. Owners are always
+// allowed.
+func (upload *UploadModel) allowsCountry(c *gin.Context) bool {
+	return upload.GeoRule.Allows(requestCountry(c)) || upload.IsOwner(c)
+}
+
+// allowObjectCountry reports whether the rule of the upload an attachment belongs to allows the country of a request.
+// Attachments identical to the files of other uploads have no rule, as they can be downloaded through those anyway.
+func allowObjectCountry(c *gin.Context, key string) (bool, error) {
+	var allow, deny string
+	err := db.QueryRowContext(c.Request.Context(), "SELECT allow, deny FROM ObjectGeoRules WHERE key = $1", key).
+		Scan(&allow, &deny)
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	rule := parseGeoRule(allow, deny)
+	return rule.Allows(requestCountry(c)), nil
+}
+
+// geoRestricted reports whether downloads of an attachment depend on the country of the client, by the site's rule or
+// by the rule of its upload, so that a response must not be cached for clients elsewhere.
+func geoRestricted(ctx context.Context, key string) (bool, error) {
+	if rule := siteGeoRule.Load(); len(rule.Allow) != 0 || len(rule.Deny) != 0 {
+		return true, nil
+	}
+	var restricted bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM ObjectGeoRules WHERE key = $1)", key).Scan(&restricted)
+	return restricted, err
+}
+
+// allowCountryDownload reports whether an attachment may be downloaded from the country of a request, or responds with
+// an error.
+func allowCountryDownload(c *gin.Context, key string) bool {
+	ok, err := allowObjectCountry(c, key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return false
+	} else if !ok {
+		respondGeoBlocked(c)
+	}
+	return ok
+}
+
+// parseGeoRule reads a rule stored as comma-separated country codes.
+func parseGeoRule(allow, deny string) GeoRule {
+	var rule GeoRule
+	if allow != "" {
+		rule.Allow = strings.Split(allow, ",")
+	}
+	if deny != "" {
+		rule.Deny = strings.Split(deny, ",")
+	}
+	return rule
+}
+
+// SetUploadGeoRule replaces the rule of an upload, and of the attachments that no other upload has. An empty rule
+// allows every country. The attachments are purged from the CDN so that no cached copy is served to the countries the
+// rule leaves out.
+func SetUploadGeoRule(ctx context.Context, upload *UploadModel, rule GeoRule) error {
+	keys, err := exclusiveObjectKeys(ctx, upload)
+	if err != nil {
+		return err
+	}
+	allow, deny := strings.Join(rule.Allow, ","), strings.Join(rule.Deny, ",")
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "UPDATE Uploads SET geo_allow = $1, geo_deny = $2 WHERE hash = $3",
+		allow, deny, upload.Hash); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM ObjectGeoRules WHERE upload_hash = $1", upload.Hash); err != nil {
+		return err
+	}
+	if allow != "" || deny != "" {
+		for _, key := range keys {
+			_, err = tx.ExecContext(ctx, `INSERT INTO ObjectGeoRules(key, upload_hash, allow, deny) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (key) DO UPDATE SET upload_hash = excluded.upload_hash, allow = excluded.allow, deny = excluded.deny`,
+				key, upload.Hash, allow, deny)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	invalidateUpload(upload.Hash)
+	if allow != "" || deny != "" {
+		purgeCDN(ctx, upload)
+	}
+	return nil
+}
+
+func registerGeoRoutes(r *gin.Engine) {
+	// Fetch the countries an upload may or may not be viewed and downloaded from.
+	r.GET("/api/v1/uploads/:hash/geo", func(c *gin.Context) {
+		if upload := ownedUpload(c); upload != nil {
+			c.JSON(http.StatusOK, upload.GeoRule)
+		}
+	})
+
+	// Replace the rule of an upload with {"allow": [...]} or {"deny": [...]}.
+	r.PUT("/api/v1/uploads/:hash/geo", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		var rule GeoRule
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err := rule.normalize(); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err := SetUploadGeoRule(c.Request.Context(), upload, rule); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, rule)
+	})
+
+	// Remove the rule of an upload, allowing every country the site allows.
+	r.DELETE("/api/v1/uploads/:hash/geo", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		if err := SetUploadGeoRule(c.Request.Context(), upload, GeoRule{}); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
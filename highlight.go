@@ -0,0 +1,235 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Bodies are highlighted on the server for documents rendered without a browser, such as PDF exports. The highlighting
+// is lexical only: comments, strings, numbers and keywords are told apart by simple rules for each family of languages,
+// which is enough to make code easier to read on paper.
+
+// A tokenKind is what a highlighted part of a text is.
+type tokenKind int
+
+const (
+	tokenPlain tokenKind = iota
+	tokenKeyword
+	tokenString
+	tokenComment
+	tokenNumber
+	tokenInserted // Lines added in a diff.
+	tokenDeleted  // Lines removed in a diff.
+	tokenMeta     // Headers of a diff.
+)
+
+// A token is a part of a text with the same highlighting.
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// syntax holds the lexical rules of a family of languages.
+type syntax struct {
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string
+	keywords      map[string]bool
+}
+
+func keywordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+var cLike = [][2]string{{"/*", "*/"}}
+
+// syntaxes are the rules of the languages that are highlighted. Languages without rules, such as plain text and logs,
+// are not.
+var syntaxes = map[string]*syntax{
+	"c": {[]string{"//"}, cLike, `"'`, keywordSet(`auto break case char const continue default do double else enum extern
+		float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned
+		void volatile while #include #define #ifdef #ifndef #endif #if #else NULL`)},
+	"cpp": {[]string{"//"}, cLike, `"'`, keywordSet(`auto bool break case catch char class const constexpr continue default
+		delete do double else enum explicit extern false float for friend goto if inline int long namespace new nullptr
+		operator private protected public return short signed sizeof static struct switch template this throw true try
+		typedef typename union unsigned using virtual void volatile while #include #define #ifdef #ifndef #endif`)},
+	"csharp": {[]string{"//"}, cLike, `"'`, keywordSet(`abstract async await base bool break case catch class const continue
+		default do double else enum false finally float for foreach if in int interface internal is long namespace new null
+		object out override private protected public readonly ref return static string struct switch this throw true try
+		using var virtual void while`)},
+	"go": {[]string{"//"}, cLike, "\"'`", keywordSet(`break case chan const continue default defer else fallthrough for func
+		go goto if import interface map package range return select struct switch type var nil true false iota`)},
+	"java": {[]string{"//"}, cLike, `"'`, keywordSet(`abstract boolean break byte case catch char class continue default do
+		double else enum extends false final finally float for if implements import instanceof int interface long new null
+		package private protected public return short static super switch this throw throws true try void while`)},
+	"kotlin": {[]string{"//"}, cLike, `"'`, keywordSet(`as break class continue do else false for fun if import in interface
+		is null object package return super this throw true try typealias val var when while`)},
+	"javascript": {[]string{"//"}, cLike, "\"'`", keywordSet(`async await break case catch class const continue default
+		delete do else export extends false finally for function if import in instanceof let new null return super switch
+		this throw true try typeof undefined var void while yield`)},
+	"typescript": {[]string{"//"}, cLike, "\"'`", keywordSet(`any as async await boolean break case catch class const
+		continue default do else enum export extends false finally for function if implements import in interface let new
+		null number private public readonly return string super switch this throw true try type typeof undefined var void
+		while`)},
+	"rust": {[]string{"//"}, cLike, `"`, keywordSet(`as async await break const continue crate else enum extern false fn for
+		if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where
+		while`)},
+	"swift": {[]string{"//"}, cLike, `"`, keywordSet(`as break case catch class continue default defer do else enum extension
+		false for func guard if import in init let nil protocol return self struct switch throw throws true try var while`)},
+	"php": {[]string{"//", "#"}, cLike, `"'`, keywordSet(`abstract array as break case catch class const continue default do
+		echo else elseif extends false finally for foreach function if implements interface namespace new null private
+		protected public return static switch throw true try use while`)},
+	"css":    {nil, cLike, `"'`, nil},
+	"python": {[]string{"#"}, nil, `"'`, keywordSet(`and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield`)},
+	"ruby":   {[]string{"#"}, nil, `"'`, keywordSet(`begin break case class def do else elsif end ensure false for if in module next nil not or rescue return self super then true unless until when while yield`)},
+	"perl":   {[]string{"#"}, nil, `"'`, keywordSet(`else elsif for foreach if last my next our package return sub unless until use while`)},
+	"shell":  {[]string{"#"}, nil, `"'`, keywordSet(`case do done elif else esac export fi for function if in local return then until while`)},
+	"yaml":   {[]string{"#"}, nil, `"'`, keywordSet(`true false null yes no`)},
+	"toml":   {[]string{"#"}, nil, `"'`, keywordSet(`true false`)},
+	"lua":    {[]string{"--"}, [][2]string{{"--[[", "]]"}}, `"'`, keywordSet(`and break do else elseif end false for function if in local nil not or repeat return then true until while`)},
+	"sql": {[]string{"--"}, cLike, `'"`, keywordSet(`ADD ALTER AND AS ASC BETWEEN BY CASE CREATE DELETE DESC DISTINCT DROP ELSE END
+		EXISTS FROM GROUP HAVING IN INDEX INNER INSERT INTO IS JOIN LEFT LIKE LIMIT NOT NULL ON OR ORDER OUTER PRIMARY KEY
+		RIGHT SELECT SET TABLE THEN UNION UPDATE VALUES WHERE WITH`)},
+	"json": {nil, nil, `"`, keywordSet(`true false null`)},
+	"xml":  {nil, [][2]string{{"<!--", "-->"}}, `"'`, nil},
+	"html": {nil, [][2]string{{"<!--", "-->"}}, `"'`, nil},
+}
+
+// highlight splits a text into tokens by the rules of its language.
+func highlight(language, text string) []token {
+	if language == "diff" {
+		return highlightDiff(text)
+	}
+	rules := syntaxes[language]
+	if rules == nil {
+		return []token{{tokenPlain, text}}
+	}
+	caseless := language == "sql"
+
+	// Tokens are slices of the text; a token ends where the next part of the text has a different kind.
+	var tokens []token
+	start, kind := 0, tokenPlain
+	emit := func(i int, k tokenKind) {
+		if k != kind {
+			if i > start {
+				tokens = append(tokens, token{kind, text[start:i]})
+			}
+			start, kind = i, k
+		}
+	}
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		if end := matchComment(rules, rest); end > 0 {
+			emit(i, tokenComment)
+			i += end
+			continue
+		}
+		c := rest[0]
+		switch {
+		case strings.IndexByte(rules.quotes, c) >= 0:
+			emit(i, tokenString)
+			i += stringEnd(rest)
+		case c >= '0' && c <= '9':
+			end := strings.IndexFunc(rest, func(r rune) bool { return !isWordRune(r) && r != '.' })
+			if end < 0 {
+				end = len(rest)
+			}
+			emit(i, tokenNumber)
+			i += end
+		default:
+			r, size := utf8.DecodeRuneInString(rest)
+			if !isWordRune(r) && r != '#' {
+				emit(i, tokenPlain)
+				i += size
+				break
+			}
+			end := strings.IndexFunc(rest[size:], func(r rune) bool { return !isWordRune(r) })
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += size
+			}
+			word := rest[:end]
+			if rules.keywords[word] || caseless && rules.keywords[strings.ToUpper(word)] {
+				emit(i, tokenKeyword)
+			} else {
+				emit(i, tokenPlain)
+			}
+			i += end
+		}
+	}
+	if start < len(text) {
+		tokens = append(tokens, token{kind, text[start:]})
+	}
+	return tokens
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// matchComment returns the length of the comment at the start of a text, or 0 if there is none.
+func matchComment(rules *syntax, text string) int {
+	for _, delimiters := range rules.blockComments {
+		if strings.HasPrefix(text, delimiters[0]) {
+			if end := strings.Index(text[len(delimiters[0]):], delimiters[1]); end >= 0 {
+				return len(delimiters[0]) + end + len(delimiters[1])
+			}
+			return len(text)
+		}
+	}
+	for _, prefix := range rules.lineComments {
+		if strings.HasPrefix(text, prefix) {
+			if end := strings.IndexByte(text, '\n'); end >= 0 {
+				return end
+			}
+			return len(text)
+		}
+	}
+	return 0
+}
+
+// stringEnd returns the length of the string literal at the start of a text, which ends at the same quote, or at the
+// end of the line for quotes other than backquotes.
+func stringEnd(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		case '\n':
+			if quote != '`' {
+				return i
+			}
+		}
+	}
+	return len(text)
+}
+
+// highlightDiff highlights the added, removed and header lines of a diff.
+func highlightDiff(text string) []token {
+	var tokens []token
+	for _, line := range strings.SplitAfter(text, "\n") {
+		kind := tokenPlain
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"), strings.HasPrefix(line, "@@"),
+			strings.HasPrefix(line, "diff "), strings.HasPrefix(line, "index "):
+			kind = tokenMeta
+		case strings.HasPrefix(line, "+"):
+			kind = tokenInserted
+		case strings.HasPrefix(line, "-"):
+			kind = tokenDeleted
+		}
+		if line != "" {
+			tokens = append(tokens, token{kind, line})
+		}
+	}
+	return tokens
+}
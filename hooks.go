@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"plugin"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A HookEvent is a point in the life of an upload where hooks run. Hooks of the pre- events may deny the operation.
+type HookEvent string
+
+const (
+	HookPreSubmit   HookEvent = "pre-submit"
+	HookPostSubmit  HookEvent = "post-submit"
+	HookPreDownload HookEvent = "pre-download"
+	HookPreDelete   HookEvent = "pre-delete"
+)
+
+var hookEvents = []HookEvent{HookPreSubmit, HookPostSubmit, HookPreDownload, HookPreDelete}
+
+// A HookPayload describes the operation that hooks run for. Hooks of pre-submit may change Body and Private; changes
+// to the other fields are ignored.
+type HookPayload struct {
+	Event     HookEvent `json:"event"`
+	Hash      string    `json:"hash,omitempty"`   // The upload, which is not known yet before it is submitted.
+	Object    string    `json:"object,omitempty"` // The attachment of pre-download.
+	Body      string    `json:"body,omitempty"`
+	Files     []string  `json:"files,omitempty"` // The file names of the attachments.
+	Size      int64     `json:"size,omitempty"`
+	Private   bool      `json:"private,omitempty"`
+	AccountId int64     `json:"account_id,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+}
+
+// A Hook runs at an event. An error from a hook of a pre- event denies the operation: a *HookDeniedError with its
+// reason shown to the client, any other error as a failure of the hook. Errors of post- hooks are only logged.
+type Hook func(ctx context.Context, payload *HookPayload) error
+
+// HookDeniedError is returned by a hook that refuses an operation.
+type HookDeniedError struct {
+	Reason string
+}
+
+func (e *HookDeniedError) Error() string {
+	return e.Reason
+}
+
+func (e *HookDeniedError) ErrorCode() string {
+	return "hook_denied"
+}
+
+var ErrHookUnavailable = errors.New("the operation could not be checked against the site's policy, try again later")
+
+var (
+	hooks       = make(map[HookEvent][]Hook)
+	hookTimeout time.Duration
+	hookSecret  string
+)
+
+// RegisterHook adds a hook to run at an event, after the hooks registered before it.
+func RegisterHook(event HookEvent, hook Hook) {
+	hooks[event] = append(hooks[event], hook)
+}
+
+// initHooks registers the configured hooks: Go plugins from HOOK_PLUGINS, a script from HOOK_COMMAND and a webhook
+// from HOOK_URL, in that order. HOOK_EVENTS limits the events of the script and the webhook, which get all of them
+// by default.
+func initHooks() {
+	hookTimeout = time.Duration(envInt64("HOOK_TIMEOUT_SECONDS", 5)) * time.Second
+	hookSecret = os.Getenv("HOOK_SECRET")
+
+	for _, path := range strings.Split(os.Getenv("HOOK_PLUGINS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			loadHookPlugin(path)
+		}
+	}
+
+	events := hookEvents
+	if list := os.Getenv("HOOK_EVENTS"); list != "" {
+		events = nil
+		for _, name := range strings.Split(list, ",") {
+			event := HookEvent(strings.TrimSpace(name))
+			if !slices.Contains(hookEvents, event) {
+				log.Fatalf("HOOK_EVENTS contains unknown event %q", event)
+			}
+			events = append(events, event)
+		}
+	}
+	if command := os.Getenv("HOOK_COMMAND"); command != "" {
+		for _, event := range events {
+			RegisterHook(event, commandHook(command))
+		}
+	}
+	if url := os.Getenv("HOOK_URL"); url != "" {
+		for _, event := range events {
+			RegisterHook(event, webhookHook(url))
+		}
+	}
+}
+
+// loadHookPlugin opens a Go plugin built with -buildmode=plugin that exports
+//
+//	func Hook(ctx context.Context, event string, payload map[string]any) error
+//
+// which runs at every event. The payload holds the JSON fields of HookPayload, and any error denies the operation.
+func loadHookPlugin(path string) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		log.Fatalf("Could not open hook plugin %s: %v", path, err)
+	}
+	symbol, err := p.Lookup("Hook")
+	if err != nil {
+		log.Fatalf("Hook plugin %s does not export Hook: %v", path, err)
+	}
+	fn, ok := symbol.(func(context.Context, string, map[string]any) error)
+	if !ok {
+		log.Fatalf("Hook of plugin %s has the wrong signature", path)
+	}
+
+	hook := func(ctx context.Context, payload *HookPayload) error {
+		fields, err := payloadFields(payload)
+		if err != nil {
+			return err
+		}
+		if err = fn(ctx, string(payload.Event), fields); err != nil {
+			return &HookDeniedError{err.Error()}
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, payload)
+	}
+	for _, event := range hookEvents {
+		RegisterHook(event, hook)
+	}
+}
+
+func payloadFields(payload *HookPayload) (map[string]any, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	return fields, json.Unmarshal(data, &fields)
+}
+
+// commandHook runs an executable with the event as its argument and the payload as JSON on its standard input. An
+// exit status of 0 allows the operation, with the payload replaced by the JSON the command prints, if any. Any other
+// status denies it, with what the command printed to standard error as the reason.
+func commandHook(command string) Hook {
+	return func(ctx context.Context, payload *HookPayload) error {
+		input, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, command, string(payload.Event))
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			return &HookDeniedError{hookReason(stderr.String())}
+		} else if err != nil {
+			return fmt.Errorf("hook command failed: %v", err)
+		}
+		if output := bytes.TrimSpace(stdout.Bytes()); len(output) != 0 {
+			return json.Unmarshal(output, payload)
+		}
+		return nil
+	}
+}
+
+// webhookHook POSTs the payload as JSON to a URL, signed like federation requests with an HMAC-SHA256 of the body in
+// X-Copycat-Signature when HOOK_SECRET is set. A 2xx response allows the operation, with the payload replaced by the
+// JSON in the response, if any. A 403 or 422 response denies it, with the "message" of a JSON response or else the
+// plain text response as the reason.
+func webhookHook(url string) Hook {
+	return func(ctx context.Context, payload *HookPayload) error {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Copycat-Event", string(payload.Event))
+		if hookSecret != "" {
+			mac := hmac.New(sha256.New, []byte(hookSecret))
+			mac.Write(body)
+			req.Header.Set("X-Copycat-Signature", hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("hook webhook failed: %v", err)
+		}
+		defer resp.Body.Close()
+		response, err := io.ReadAll(io.LimitReader(resp.Body, maxSubmitSize))
+		if err != nil {
+			return fmt.Errorf("hook webhook failed: %v", err)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnprocessableEntity:
+			var message struct {
+				Message string `json:"message"`
+			}
+			if json.Unmarshal(response, &message) == nil && message.Message != "" {
+				return &HookDeniedError{message.Message}
+			}
+			return &HookDeniedError{hookReason(string(response))}
+		case resp.StatusCode < 200 || resp.StatusCode > 299:
+			return fmt.Errorf("hook webhook answered %v", resp.Status)
+		}
+		if response = bytes.TrimSpace(response); len(response) != 0 {
+			return json.Unmarshal(response, payload)
+		}
+		return nil
+	}
+}
+
+func hookReason(text string) string {
+	if text = strings.TrimSpace(text); text != "" {
+		return text
+	}
+	return "denied by the site's policy"
+}
+
+// RunHooks runs the hooks of the payload's event in order, each with HOOK_TIMEOUT_SECONDS to finish, and returns the
+// first error.
+func RunHooks(ctx context.Context, payload *HookPayload) error {
+	for _, hook := range hooks[payload.Event] {
+		before := *payload
+		ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+		err := hook(ctx, payload)
+		cancel()
+
+		// Keep what hooks may change, and restore the rest.
+		body, private := payload.Body, payload.Private
+		*payload = before
+		if payload.Event == HookPreSubmit {
+			payload.Body, payload.Private = body, private
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHooks runs the hooks of a pre- event for a request, filling in the client of the payload. When a hook denies
+// the operation or fails, an error has been sent and false is returned.
+func checkHooks(c *gin.Context, payload *HookPayload) bool {
+	if code, err := requestHooks(c, payload); err != nil {
+		respondError(c, code, err)
+		return false
+	}
+	return true
+}
+
+// requestHooks runs the hooks of a pre- event like checkHooks, but returns the status code and error to answer with
+// instead of answering, for requests such as batches that report on many operations.
+func requestHooks(c *gin.Context, payload *HookPayload) (int, error) {
+	if len(hooks[payload.Event]) == 0 {
+		return http.StatusOK, nil
+	}
+	payload.IP = c.ClientIP()
+	if account := currentAccount(c); account != nil {
+		payload.AccountId = account.Id
+	}
+
+	err := RunHooks(c.Request.Context(), payload)
+	var denied *HookDeniedError
+	if errors.As(err, &denied) {
+		return http.StatusForbidden, err
+	} else if err != nil {
+		log.Printf("%s hook failed: %v", payload.Event, err)
+		return http.StatusServiceUnavailable, ErrHookUnavailable
+	}
+	return http.StatusOK, nil
+}
+
+// notifyHooks runs the hooks of a post- event in the background, so that they do not delay the response.
+func notifyHooks(payload HookPayload) {
+	if len(hooks[payload.Event]) == 0 {
+		return
+	}
+	go func() {
+		if err := RunHooks(context.Background(), &payload); err != nil {
+			log.Printf("%s hook failed for %v: %v", payload.Event, payload.Hash, err)
+		}
+	}()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// downloadTokenTTL is how long the download links on an upload page keep working with hotlink protection enabled.
+const downloadTokenTTL = 6 * time.Hour
+
+var ErrHotlink = errors.New("attachments may only be downloaded from this site; open the upload page to get a download link")
+
+// Hotlink protection settings. With hotlinkProtection, attachments are only served to requests referred by one of
+// siteHosts or carrying a download token signed by this server.
+var (
+	hotlinkProtection atomic.Bool
+	siteHosts         atomic.Pointer[[]string]
+)
+
+func initHotlinkProtection() {
+	loadHotlinkProtection()
+	RegisterReloader("hotlink protection", loadHotlinkProtection)
+}
+
+func loadHotlinkProtection() error {
+	// BASEURL may be given with or without a scheme.
+	host := os.Getenv("BASEURL")
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	hosts := []string{strings.ToLower(host)}
+	for _, host := range strings.Split(os.Getenv("HOTLINK_ALLOWED_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, strings.ToLower(host))
+		}
+	}
+	siteHosts.Store(&hosts)
+	hotlinkProtection.Store(envBool("HOTLINK_PROTECTION"))
+	return nil
+}
+
+// downloadSignature signs an attachment hash and the expiry of a download token.
+func downloadSignature(hash string, expires int64) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("download\n" + hash + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// DownloadQuery returns the query string to append to the download link of an attachment, which is empty unless
+// hotlink protection is enabled.
+func DownloadQuery(hash string) string {
+	if !hotlinkProtection.Load() {
+		return ""
+	}
+	expires := time.Now().Add(downloadTokenTTL).Unix()
+	return "?exp=" + strconv.FormatInt(expires, 10) + "&sig=" + downloadSignature(hash, expires)
+}
+
+// allowDownload reports whether an attachment may be served to the request: always without hotlink protection, and
+// otherwise when it was referred by this site or carries a valid download token.
+func allowDownload(c *gin.Context, hash string) bool {
+	if !hotlinkProtection.Load() {
+		return true
+	}
+	if referer, err := url.Parse(c.Request.Referer()); err == nil {
+		for _, host := range *siteHosts.Load() {
+			if strings.EqualFold(referer.Host, host) {
+				return true
+			}
+		}
+	}
+
+	expires, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(c.Query("sig")), []byte(downloadSignature(hash, expires)))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+// Message catalogs translate the English messages of pages and errors, keyed by the English text. They are loaded from
+// locales/<language>.json, for example locales/de.json, and messages missing from a catalog are shown in English.
+var (
+	catalogs        = make(map[string]map[string]string)
+	languageNames   []string // The languages of languageMatcher, in the same order.
+	languageMatcher language.Matcher
+)
+
+// initI18n loads the message catalogs. DEFAULT_LANGUAGE selects the language of requests that accept none of the
+// available languages, which is English unless it is set.
+func initI18n() {
+	tags := []language.Tag{language.English}
+	languageNames = []string{"en"}
+	files, err := filepath.Glob("locales/*.json")
+	if err != nil {
+		log.Fatal("Could not list the message catalogs: ", err)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		tag, err := language.Parse(name)
+		if err != nil {
+			log.Fatalf("Message catalog %s is not named after a language: %v", file, err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal("Could not read a message catalog: ", err)
+		}
+		catalog := make(map[string]string)
+		if err = json.Unmarshal(data, &catalog); err != nil {
+			log.Fatalf("Could not parse message catalog %s: %v", file, err)
+		}
+		catalogs[name] = catalog
+		tags = append(tags, tag)
+		languageNames = append(languageNames, name)
+	}
+
+	// The matcher falls back to its first language.
+	if name := os.Getenv("DEFAULT_LANGUAGE"); name != "" {
+		i := slices.Index(languageNames, name)
+		if i < 0 {
+			log.Fatalf("DEFAULT_LANGUAGE %q has no message catalog in locales/", name)
+		}
+		tags[0], tags[i] = tags[i], tags[0]
+		languageNames[0], languageNames[i] = languageNames[i], languageNames[0]
+	}
+	languageMatcher = language.NewMatcher(tags)
+}
+
+// requestLanguage negotiates the language of the response from the Accept-Language header of the request.
+func requestLanguage(c *gin.Context) string {
+	if languageMatcher == nil {
+		return "en"
+	}
+	if lang := c.GetString("lang"); lang != "" {
+		return lang
+	}
+	accepted, _, _ := language.ParseAcceptLanguage(c.GetHeader("Accept-Language"))
+	_, i, _ := languageMatcher.Match(accepted...)
+	c.Set("lang", languageNames[i])
+	return languageNames[i]
+}
+
+// translate returns the translation of an English message into lang, formatted with args like fmt.Sprintf when there
+// are any.
+func translate(lang string, message string, args ...any) string {
+	if translation, ok := catalogs[lang][message]; ok {
+		message = translation
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// T translates a message into the language of the page, for templates: {{ .Page.T "Upload" }}.
+func (page *PageInfo) T(message string, args ...any) string {
+	return translate(page.Lang, message, args...)
+}
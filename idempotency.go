@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Clients can send an Idempotency-Key header with /submit, so that a request retried after a dropped connection does
+// not create a second upload: private, embargoed, expiring and team uploads get a new hash every time. The first
+// response to a key is stored and answered again to every retry of the same request with it, headers and edit token
+// included. The response is encrypted with a key derived from the idempotency key, so the edit and claim tokens in it
+// cannot be read from the database. Keys belong to the account, or the IP address of anonymous clients, and are
+// forgotten after IDEMPOTENCY_KEY_HOURS.
+
+var (
+	ErrIdempotencyKey        = errors.New(`"Idempotency-Key" must be 1 to 255 printable ASCII characters`)
+	ErrIdempotencyKeyReused  = errors.New("this Idempotency-Key was already used for a different request")
+	ErrIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still being processed, try again in a few seconds")
+)
+
+// idempotencyKeyTTL is how long the response to an idempotency key is kept.
+var idempotencyKeyTTL time.Duration
+
+func initIdempotency() {
+	idempotencyKeyTTL = time.Duration(envInt64("IDEMPOTENCY_KEY_HOURS", 24)) * time.Hour
+
+	RegisterJob(&Job{
+		Name:     "idempotency keys",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "DELETE FROM IdempotencyKeys WHERE created_at < $1",
+				time.Now().Add(-idempotencyKeyTTL).UTC().Unix())
+			return err
+		},
+	})
+}
+
+// validIdempotencyKey reports whether a key is one that clients may send.
+func validIdempotencyKey(key string) bool {
+	if len(key) == 0 || len(key) > 255 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestFingerprint returns the SHA-256 of the fields and files of a form, which tells retries of a request apart from
+// other requests reusing its idempotency key.
+func requestFingerprint(c *gin.Context) (string, error) {
+	form, err := submittedForm(c)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	names := make([]string, 0, len(form.Value))
+	for name := range form.Value {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, value := range form.Value[name] {
+			fmt.Fprintf(h, "%q=%q\n", name, value)
+		}
+	}
+	names = names[:0]
+	for name := range form.File {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, fileHeader := range form.File[name] {
+			file, err := fileHeader.Open()
+			if err != nil {
+				return "", err
+			}
+			contents := sha256.New()
+			_, err = io.Copy(contents, file)
+			file.Close()
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%q:%q=%x\n", name, fileHeader.Filename, contents.Sum(nil))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// idempotencyScope returns who an idempotency key belongs to: the account of the request, or its IP address.
+func idempotencyScope(c *gin.Context) string {
+	if account := currentAccount(c); account != nil {
+		return "account:" + strconv.FormatInt(account.Id, 10)
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// idempotent is a middleware that answers retries of a request carrying an Idempotency-Key with the response to the
+// first one. Only successful responses are kept; after an error the key can be used again, for example with the
+// confirmation that was missing.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+	if !validIdempotencyKey(key) {
+		abortWithError(c, http.StatusBadRequest, ErrIdempotencyKey, nil)
+		return
+	}
+	fingerprint, err := requestFingerprint(c)
+	if err != nil {
+		c.Next() // The handler reports the malformed form.
+		return
+	}
+	scope := idempotencyScope(c)
+
+	result, err := db.Exec(`INSERT INTO IdempotencyKeys(scope, key, fingerprint, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`, scope, key, fingerprint, time.Now().UTC().Unix())
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		c.Abort()
+		return
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		replayIdempotent(c, scope, key, fingerprint)
+		return
+	}
+
+	// A handler that panics leaves no response to store, and must not leave the key in progress until it expires.
+	stored := false
+	defer func() {
+		if !stored {
+			forgetIdempotencyKey(scope, key)
+		}
+	}()
+
+	recorder := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	c.Next()
+
+	status := c.Writer.Status()
+	if !c.Writer.Written() || status < 200 || status >= 300 {
+		return
+	}
+	response, err := sealIdempotentResponse(scope, key, idempotentResponse{Header: c.Writer.Header(), Body: recorder.body.Bytes()})
+	if err == nil {
+		_, err = db.Exec("UPDATE IdempotencyKeys SET status = $1, response = $2 WHERE scope = $3 AND key = $4",
+			status, response, scope, key)
+	}
+	if err != nil {
+		// The upload was answered already; a retry will be processed like a new request.
+		log.Printf("failed to store the response to idempotency key %q: %v", key, err)
+		return
+	}
+	stored = true
+}
+
+// forgetIdempotencyKey deletes a key whose request failed, so that it can be used again.
+func forgetIdempotencyKey(scope, key string) {
+	if _, err := db.Exec("DELETE FROM IdempotencyKeys WHERE scope = $1 AND key = $2", scope, key); err != nil {
+		log.Printf("failed to delete idempotency key %q: %v", key, err)
+	}
+}
+
+// An idempotentResponse is the response to the first request with an idempotency key, as it is stored.
+type idempotentResponse struct {
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// idempotencyCipher returns the cipher that the response to an idempotency key is encrypted with. Its key is derived
+// from the idempotency key, which only the client knows, and the signing key, so that neither suffices alone.
+func idempotencyCipher(scope, key string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("idempotency\x00" + scope + "\x00" + key))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealIdempotentResponse encrypts a response to store it.
+func sealIdempotentResponse(scope, key string, response idempotentResponse) ([]byte, error) {
+	aead, err := idempotencyCipher(scope, key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openIdempotentResponse decrypts a stored response.
+func openIdempotentResponse(scope, key string, sealed []byte) (*idempotentResponse, error) {
+	aead, err := idempotencyCipher(scope, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("stored response is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	response := new(idempotentResponse)
+	return response, json.Unmarshal(plaintext, response)
+}
+
+// replayIdempotent answers a request whose idempotency key was used before.
+func replayIdempotent(c *gin.Context, scope, key, fingerprint string) {
+	var storedFingerprint string
+	var status int
+	var sealed []byte
+	err := db.QueryRow("SELECT fingerprint, status, response FROM IdempotencyKeys WHERE scope = $1 AND key = $2",
+		scope, key).Scan(&storedFingerprint, &status, &sealed)
+	switch {
+	case err == sql.ErrNoRows:
+		// The first request failed or the key expired in the meantime.
+		abortWithError(c, http.StatusConflict, ErrIdempotencyInProgress, nil)
+	case err != nil:
+		respondError(c, http.StatusInternalServerError, err)
+		c.Abort()
+	case storedFingerprint != fingerprint:
+		abortWithError(c, http.StatusUnprocessableEntity, ErrIdempotencyKeyReused, nil)
+	case status == 0:
+		c.Header("Retry-After", "5")
+		abortWithError(c, http.StatusConflict, ErrIdempotencyInProgress, nil)
+	default:
+		response, err := openIdempotentResponse(scope, key, sealed)
+		if err != nil {
+			// A response stored before responses were encrypted cannot be replayed; the retry after this one is processed.
+			log.Printf("failed to decrypt the response to idempotency key %q: %v", key, err)
+			forgetIdempotencyKey(scope, key)
+			c.Header("Retry-After", "1")
+			abortWithError(c, http.StatusConflict, ErrIdempotencyInProgress, nil)
+			return
+		}
+		// Headers set for this request, such as its request id, are kept, except for cookies, which are all sent.
+		header := c.Writer.Header()
+		for name, values := range response.Header {
+			if name == "Set-Cookie" {
+				header[name] = append(header[name], values...)
+			} else if _, ok := header[name]; !ok {
+				header[name] = values
+			}
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(status, response.Header.Get("Content-Type"), response.Body)
+		c.Abort()
+	}
+}
+
+// recordingWriter keeps a copy of the body of a response as it is written.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
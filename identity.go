@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
+
+// Accounts can also be managed by an external identity provider, which vouches for who logs in instead of a password.
+// Such accounts are linked to the provider by their external id, so that renaming a user at the provider does not
+// hand their account to someone else. The groups the provider reports can grant roles and team memberships.
+
+var ErrExternalUsernameTaken = errors.New("an account with that username already exists and is not linked to the identity provider")
+
+// A GroupMapping translates the groups of an identity provider into roles and team memberships, from variables like
+// "admins=admin,support=moderator" for roles and "engineering=eng" for teams.
+type GroupMapping struct {
+	Roles map[string]string // Group to account role.
+	Teams map[string]string // Group to team slug.
+}
+
+// parseGroupMap parses a comma separated list of group=value pairs.
+func parseGroupMap(list string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		group, value, ok := strings.Cut(pair, "=")
+		if group, value = strings.TrimSpace(group), strings.TrimSpace(value); ok && group != "" && value != "" {
+			m[group] = value
+		}
+	}
+	return m
+}
+
+// Validate checks that the mapping only names valid roles.
+func (m *GroupMapping) Validate() error {
+	for _, role := range m.Roles {
+		if _, ok := roleRanks[role]; !ok {
+			return ErrRoleInvalid
+		}
+	}
+	return nil
+}
+
+// externalUsername turns a name from an identity provider, such as an email address, into a valid username.
+func externalUsername(name string) string {
+	name, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(name)), "@")
+	username := []rune(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, name))
+	if len(username) > 32 {
+		username = username[:32]
+	}
+	return string(username)
+}
+
+// ExternalAccount returns the account linked to an external id, creating it with the given username the first time.
+// The new account gets a random password that nobody knows, so it can only log in through the identity provider. An
+// account provisioned through SCIM with that username is linked instead of creating one.
+func ExternalAccount(externalId, username string) (*Account, bool, error) {
+	account, err := scanAccount(db.QueryRow("SELECT "+accountColumns+" FROM Accounts WHERE external_id = $1", externalId))
+	if err == nil && account.Disabled {
+		return nil, false, ErrAccountDisabled
+	} else if err != sql.ErrNoRows {
+		return account, false, err
+	}
+
+	account, err = scanAccount(db.QueryRow("UPDATE Accounts SET external_id = $1 WHERE username = $2 AND provisioned AND external_id = '' RETURNING "+accountColumns,
+		externalId, username))
+	if err == nil && account.Disabled {
+		return nil, false, ErrAccountDisabled
+	} else if err != sql.ErrNoRows {
+		return account, false, err
+	}
+
+	account, _, err = CreateAccount(username, randomToken(), RoleUser)
+	if err == ErrUsernameTaken {
+		return nil, false, ErrExternalUsernameTaken
+	} else if err != nil {
+		return nil, false, err
+	}
+	if _, err = db.Exec("UPDATE Accounts SET external_id = $1 WHERE id = $2", externalId, account.Id); err != nil {
+		return nil, false, err
+	}
+	return account, true, nil
+}
+
+// Apply gives the account the most privileged role its groups map to, or the user role if none do, and adds it to or
+// removes it from the mapped teams. Roles are left alone when no roles are mapped, and teams that are not mapped are
+// left alone, so that they can still be managed in copycat. Team owners are never removed, so no team loses its
+// last owner.
+func (m *GroupMapping) Apply(account *Account, groups []string, ip string) error {
+	if len(m.Roles) > 0 {
+		role := RoleUser
+		for _, group := range groups {
+			if mapped, ok := m.Roles[group]; ok && roleRanks[mapped] > roleRanks[role] {
+				role = mapped
+			}
+		}
+		if role != account.Role {
+			if err := SetRole(account, role); err != nil {
+				return err
+			}
+			RecordAudit("identity provider", "account.role", account.Username, account.Role+" -> "+role, ip)
+			account.Role = role
+		}
+	}
+
+	member := make(map[string]bool)
+	for _, group := range groups {
+		if slug, ok := m.Teams[group]; ok {
+			member[slug] = true
+		}
+	}
+	for _, slug := range m.Teams {
+		team, err := GetTeam(slug)
+		if err == sql.ErrNoRows {
+			log.Printf("team %v of the group mapping does not exist", slug)
+			continue
+		} else if err != nil {
+			return err
+		}
+		role, err := team.Role(account)
+		if err != nil {
+			return err
+		}
+		if member[slug] && role == "" {
+			err = team.SetMember(account, TeamRoleMember)
+		} else if !member[slug] && role != "" && role != TeamRoleOwner {
+			err = team.RemoveMember(account)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
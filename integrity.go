@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sha256Hex returns the hex encoded SHA-256 of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verification results.
+const (
+	VerifyOK         = "ok"
+	VerifyMismatch   = "mismatch"   // The stored object no longer matches the checksum recorded when it was stored.
+	VerifyUnrecorded = "unrecorded" // The object was stored before checksums were recorded.
+)
+
+// An ObjectVerification is the result of re-checking a stored object against its recorded checksums.
+type ObjectVerification struct {
+	Hash   string `json:"hash"`
+	Status string `json:"status"`
+	SHA256 string `json:"sha256"` // Of the file contents as read now.
+}
+
+// VerifyObject reads an object back from storage and compares it, and the file contents inside it, with the
+// checksums recorded when it was stored.
+func VerifyObject(ctx context.Context, key string) (*ObjectVerification, error) {
+	var objectChecksum, contentChecksum string
+	err := db.QueryRowContext(ctx, "SELECT sha256, content_sha256 FROM Objects WHERE key = $1", key).Scan(&objectChecksum, &contentChecksum)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	data, err := objectStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	result := &ObjectVerification{Hash: key, Status: VerifyOK}
+
+	file, decodeErr := DecodeFileObject(data)
+	if decodeErr == nil {
+		result.SHA256 = sha256Hex(file.Contents)
+	}
+
+	switch {
+	case objectChecksum == "":
+		result.Status = VerifyUnrecorded
+	case sha256Hex(data) != objectChecksum, decodeErr != nil, contentChecksum != "" && result.SHA256 != contentChecksum:
+		result.Status = VerifyMismatch
+		log.Printf("Object %v is corrupted: it no longer matches its recorded checksum", key)
+	}
+	return result, nil
+}
+
+// integritySampleSize is how many stored objects the integrity job verifies every hour, or 0 to not verify any.
+var integritySampleSize int64
+
+// integrityStats are the metrics of the integrity job, published under "integrity" at /debug/vars.
+var integrityStats struct {
+	Checked    atomic.Int64
+	Mismatched atomic.Int64
+	Unreadable atomic.Int64
+	Corrupted  atomic.Int64 // Objects currently recorded as corrupted.
+}
+
+func initIntegrity() {
+	integritySampleSize = envInt64("INTEGRITY_SAMPLE_SIZE", 0)
+	if integritySampleSize < 0 {
+		log.Fatal("INTEGRITY_SAMPLE_SIZE environment variable must not be negative")
+	}
+	expvar.Publish("integrity", expvar.Func(func() any {
+		return map[string]int64{
+			"checked":    integrityStats.Checked.Load(),
+			"mismatched": integrityStats.Mismatched.Load(),
+			"unreadable": integrityStats.Unreadable.Load(),
+			"corrupted":  integrityStats.Corrupted.Load(),
+		}
+	}))
+	if integritySampleSize == 0 {
+		return
+	}
+
+	RegisterJob(&Job{
+		Name:     "integrity",
+		Interval: time.Hour,
+		Run:      verifyObjectSample,
+	})
+}
+
+// verifyObjectSample verifies the objects that were verified longest ago, so that every object is checked in turn,
+// and records the ones that no longer match their checksums. Bit rot and tampering with the bucket would otherwise
+// only be noticed when someone downloads the object.
+func verifyObjectSample(ctx context.Context) error {
+	// Body objects are not FileObjects and have no recorded checksums to verify.
+	rows, err := db.QueryContext(ctx, "SELECT key FROM Objects WHERE store = $1 AND key NOT LIKE $2 ORDER BY verified, key LIMIT $3",
+		objectStore.String(), bodyObjectPrefix+"%", integritySampleSize)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err = verifySampledObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to verify %v: %v", key, err)
+		}
+	}
+
+	var corrupted int64
+	if err = db.QueryRowContext(ctx, "SELECT count(*) FROM Objects WHERE corrupted_at <> 0").Scan(&corrupted); err != nil {
+		return err
+	}
+	integrityStats.Corrupted.Store(corrupted)
+	return nil
+}
+
+// verifySampledObject verifies one object for the integrity job and records the result. Errors reading the object
+// are counted and logged rather than returned, so that one unreadable object does not stop the job.
+func verifySampledObject(ctx context.Context, key string) error {
+	now := time.Now().UTC().Unix()
+	result, err := VerifyObject(ctx, key)
+	if errors.Is(err, ErrObjectArchived) {
+		// Reading archived objects would mean retrieving them first; they are checked if they are ever retrieved.
+		_, err = db.ExecContext(ctx, "UPDATE Objects SET verified = $1 WHERE key = $2", now, key)
+		return err
+	} else if err != nil {
+		readErr := err
+		var referenced bool
+		if err = db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM Uploads, unnest(files) AS f WHERE f LIKE '%/' || $1)",
+			key).Scan(&referenced); err != nil {
+			return err
+		}
+		if !referenced {
+			// The object belonged to uploads that were purged since.
+			_, err = db.ExecContext(ctx, "DELETE FROM Objects WHERE key = $1", key)
+			return err
+		}
+		integrityStats.Unreadable.Add(1)
+		log.Printf("Integrity check could not read object %v: %v", key, readErr)
+		_, err = db.ExecContext(ctx, "UPDATE Objects SET verified = $1 WHERE key = $2", now, key)
+		return err
+	}
+
+	integrityStats.Checked.Add(1)
+	if result.Status != VerifyMismatch {
+		_, err = db.ExecContext(ctx, "UPDATE Objects SET verified = $1, corrupted_at = 0 WHERE key = $2", now, key)
+		return err
+	}
+	integrityStats.Mismatched.Add(1)
+	res, err := db.ExecContext(ctx, "UPDATE Objects SET verified = $1, corrupted_at = $1 WHERE key = $2 AND corrupted_at = 0", now, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		RecordAudit("storage", "object.corrupted", key, "no longer matches its recorded checksum", "")
+	} else {
+		_, err = db.ExecContext(ctx, "UPDATE Objects SET verified = $1 WHERE key = $2", now, key)
+	}
+	return err
+}
+
+func registerIntegrityRoutes(r *gin.Engine) {
+	// Re-check a stored attachment against the checksums recorded when it was uploaded.
+	r.GET("/api/v1/files/:hash/verify", func(c *gin.Context) {
+		hash := c.Param("hash")
+		result, err := VerifyObject(c.Request.Context(), hash)
+		if errors.Is(err, ErrObjectArchived) {
+			respondArchived(c, hash)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusNotFound, ErrAttachmentNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+}
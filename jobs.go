@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobLockKey is the Postgres advisory lock held by the replica that runs the scheduled jobs ("copycat" in ASCII).
+const jobLockKey int64 = 0x636f7079636174
+
+// leaderCheckInterval is how often a replica tries to become the leader, and how often the leader checks that it
+// still holds the lock.
+const leaderCheckInterval = 15 * time.Second
+
+// A Job is work run periodically in the background. With several replicas of the server sharing a database, only
+// the elected leader runs jobs, unless the job only updates state local to each replica.
+type Job struct {
+	Name         string
+	Interval     time.Duration
+	EveryReplica bool // Run on every replica instead of only on the leader, e.g. to refresh an in-memory cache.
+	Run          func(ctx context.Context) error
+
+	mu    sync.Mutex
+	stats JobStats
+}
+
+// JobStats are the metrics of a job, published under "jobs" at /debug/vars.
+type JobStats struct {
+	Runs         int64  `json:"runs"`
+	Failures     int64  `json:"failures"`
+	Running      bool   `json:"running"`
+	LastRun      int64  `json:"last_run"`
+	LastDuration string `json:"last_duration"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+var (
+	jobs     []*Job
+	isLeader atomic.Bool
+)
+
+func init() {
+	expvar.Publish("jobs", expvar.Func(func() any {
+		stats := make(map[string]JobStats, len(jobs))
+		for _, job := range jobs {
+			job.mu.Lock()
+			stats[job.Name] = job.stats
+			job.mu.Unlock()
+		}
+		return map[string]any{
+			"leader": isLeader.Load(),
+			"jobs":   stats,
+		}
+	}))
+}
+
+// RegisterJob adds a job to be run once startJobs is called.
+func RegisterJob(job *Job) {
+	jobs = append(jobs, job)
+}
+
+// startJobs starts leader election and runs every registered job at its interval.
+func startJobs() {
+	go electLeader()
+	for _, job := range jobs {
+		go job.loop()
+	}
+}
+
+// electLeader keeps trying to take the job lock. The lock belongs to a database session, so it is held on a
+// dedicated connection and released automatically by Postgres if this replica dies or the connection is lost.
+func electLeader() {
+	for {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			log.Println("Job leader election failed:", err)
+			time.Sleep(leaderCheckInterval)
+			continue
+		}
+
+		var acquired bool
+		err = conn.QueryRowContext(context.Background(), "SELECT pg_try_advisory_lock($1)", jobLockKey).Scan(&acquired)
+		if err == nil && acquired {
+			log.Println("This replica is now the job leader")
+			isLeader.Store(true)
+			holdLeadership(conn)
+			isLeader.Store(false)
+			log.Println("This replica lost the job leadership")
+		} else if err != nil {
+			log.Println("Job leader election failed:", err)
+		}
+		conn.Close()
+		time.Sleep(leaderCheckInterval)
+	}
+}
+
+// holdLeadership returns once the connection holding the job lock fails.
+func holdLeadership(conn *sql.Conn) {
+	for {
+		time.Sleep(leaderCheckInterval)
+		if err := conn.PingContext(context.Background()); err != nil {
+			log.Println("Lost the connection holding the job lock:", err)
+			return
+		}
+	}
+}
+
+func (job *Job) loop() {
+	for {
+		if maintenanceMessage.Load() != nil {
+			// Jobs change uploads and storage, which must stay as they are while the site is read-only.
+			time.Sleep(min(job.Interval, leaderCheckInterval))
+		} else if job.EveryReplica || isLeader.Load() {
+			job.run()
+			time.Sleep(job.Interval)
+		} else {
+			// Check again soon, so that a new leader picks up the job without waiting a whole interval.
+			time.Sleep(min(job.Interval, leaderCheckInterval))
+		}
+	}
+}
+
+func (job *Job) run() {
+	job.mu.Lock()
+	job.stats.Running = true
+	job.mu.Unlock()
+
+	start := time.Now()
+	err := job.Run(context.Background())
+	duration := time.Since(start)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.stats.Running = false
+	job.stats.Runs++
+	job.stats.LastRun = start.UTC().Unix()
+	job.stats.LastDuration = duration.String()
+	job.stats.LastError = ""
+	if err != nil {
+		job.stats.Failures++
+		job.stats.LastError = err.Error()
+		log.Printf("Job %s failed: %v", job.Name, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Every upload has a language, which is what its body is written in: a programming language, a data format, or just
+// text or a log. Submitters may choose it; otherwise it is detected from the body and the names of the attachments.
+// It is shown on the upload page, marks the body for highlighting, and filters upload lists.
+
+var ErrLanguage = errors.New(`"language" is not a known language`)
+
+// A Language is a language an upload can be written in.
+type Language struct {
+	Id   string
+	Name string
+}
+
+// languages are the known languages, in the order they are offered to submitters.
+var languages = []Language{
+	{"text", "Plain text"},
+	{"log", "Log"},
+	{"markdown", "Markdown"},
+	{"json", "JSON"},
+	{"yaml", "YAML"},
+	{"toml", "TOML"},
+	{"xml", "XML"},
+	{"html", "HTML"},
+	{"css", "CSS"},
+	{"diff", "Diff"},
+	{"shell", "Shell"},
+	{"sql", "SQL"},
+	{"c", "C"},
+	{"cpp", "C++"},
+	{"csharp", "C#"},
+	{"go", "Go"},
+	{"java", "Java"},
+	{"kotlin", "Kotlin"},
+	{"javascript", "JavaScript"},
+	{"lua", "Lua"},
+	{"typescript", "TypeScript"},
+	{"php", "PHP"},
+	{"python", "Python"},
+	{"ruby", "Ruby"},
+	{"perl", "Perl"},
+	{"rust", "Rust"},
+	{"swift", "Swift"},
+}
+
+// languageName returns the name of a language to show, or "" if the language is not known.
+func languageName(id string) string {
+	for _, language := range languages {
+		if language.Id == id {
+			return language.Name
+		}
+	}
+	return ""
+}
+
+// parseLanguage reads a language chosen by a submitter, where "" leaves it to be detected.
+func parseLanguage(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value != "" && languageName(value) == "" {
+		return "", ErrLanguage
+	}
+	return value, nil
+}
+
+// interpreterLanguages maps the interpreters named by shebang lines to the language of their scripts.
+var interpreterLanguages = map[string]string{
+	"sh": "shell", "bash": "shell", "zsh": "shell", "dash": "shell", "ksh": "shell",
+	"python": "python", "python2": "python", "python3": "python",
+	"node": "javascript", "deno": "typescript", "ruby": "ruby", "perl": "perl", "php": "php",
+}
+
+// extensionLanguages maps the extensions of attachments to their language. They also group attachments by language in
+// the statistics.
+var extensionLanguages = map[string]string{
+	".txt": "text", ".log": "log", ".md": "markdown", ".markdown": "markdown",
+	".json": "json", ".yaml": "yaml", ".yml": "yaml", ".toml": "toml", ".xml": "xml", ".html": "html", ".htm": "html",
+	".css": "css", ".diff": "diff", ".patch": "diff", ".sh": "shell", ".bash": "shell", ".sql": "sql",
+	".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp", ".hpp": "cpp", ".cs": "csharp", ".go": "go", ".java": "java",
+	".js": "javascript", ".mjs": "javascript", ".ts": "typescript", ".php": "php", ".py": "python", ".rb": "ruby",
+	".pl": "perl", ".rs": "rust", ".kt": "kotlin", ".lua": "lua", ".swift": "swift",
+}
+
+// A languageHint is a pattern of lines typical of a language.
+type languageHint struct {
+	language string
+	pattern  *regexp.Regexp
+}
+
+// languageHints are matched against each line of a body; the language with the most matching lines wins.
+var languageHints = []languageHint{
+	{"log", regexp.MustCompile(`^\[?\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}|^\[?\d{2}:\d{2}:\d{2}[.,\]]|^(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL)\b`)},
+	{"diff", regexp.MustCompile(`^(diff --git |--- a/|\+\+\+ b/|@@ -\d+(,\d+)? \+\d+(,\d+)? @@)`)},
+	{"markdown", regexp.MustCompile("^(#{1,6} \\S|```|\\* \\S|- \\[[ x]\\] )")},
+	{"go", regexp.MustCompile(`^(package \w+$|import \($|func (\(\w+ \*?\w+\) )?\w+\(|type \w+ (struct|interface) \{|\s+\w+ :?= )`)},
+	{"python", regexp.MustCompile(`^(\s*def \w+\(.*\):|\s*class \w+(\(.*\))?:|from [\w.]+ import |import [\w.]+$|if __name__ == |\s*elif .*:$)`)},
+	{"rust", regexp.MustCompile(`^\s*(pub )?(fn \w+[<(]|struct \w+|enum \w+|impl[< ]|use \w+::|let (mut )?\w+)`)},
+	{"javascript", regexp.MustCompile(`^\s*(const|let|var) \w+ = |^\s*function \w+\(|=> \{$|^\s*(module\.exports|export (default|const|function))|require\(['"]`)},
+	{"typescript", regexp.MustCompile(`^\s*(interface \w+ \{|type \w+ = |export (interface|type) |(const|let) \w+: \w+)`)},
+	{"java", regexp.MustCompile(`^\s*(public|private|protected) (static )?(final )?(class|void|int|String|boolean) |^import java\.|^package [\w.]+;$`)},
+	{"csharp", regexp.MustCompile(`^\s*using System|^\s*namespace [\w.]+|^\s*(public|private|internal) (static )?(async )?(class|void|Task|string) `)},
+	{"c", regexp.MustCompile(`^#include <\w+\.h>|^\s*(int|void|char|static) \*?\w+\(.*\)\s*\{?$|^\s*printf\(`)},
+	{"cpp", regexp.MustCompile(`^#include <\w+>$|std::|^\s*template <|^using namespace `)},
+	{"php", regexp.MustCompile(`^<\?php|^\s*\$\w+ = .*;$|^\s*(public )?function \w+\(.*\)`)},
+	{"ruby", regexp.MustCompile(`^\s*(def \w+[?!]?(\(.*\))?$|end$|require ['"]|class \w+ < \w+|\w+\.each do)`)},
+	{"shell", regexp.MustCompile(`^\s*(\$ |export \w+=|if \[\[? |fi$|done$|echo |cd |sudo |apt(-get)? |for \w+ in .*; do)`)},
+	{"sql", regexp.MustCompile(`(?i)^\s*(SELECT .* FROM |INSERT INTO |UPDATE \w+ SET |DELETE FROM |CREATE (TABLE|INDEX|VIEW) |ALTER TABLE )`)},
+	{"yaml", regexp.MustCompile(`^---$|^\s*[\w-]+:( [^{}]*)?$|^\s*- [\w-]+: `)},
+	{"toml", regexp.MustCompile(`^\[[\w.-]+\]$|^\w+ = ("|\d|\[|true|false)`)},
+	{"css", regexp.MustCompile(`^[.#]?[\w-]+( [.#]?[\w-]+)* \{$|^\s+[\w-]+: [^;]+;$`)},
+	{"html", regexp.MustCompile(`(?i)^\s*<(!doctype html|html|head|body|div|script|p|a|span|table)[ >]`)},
+	{"xml", regexp.MustCompile(`^<\?xml |^\s*<[\w:-]+( [\w:-]+="[^"]*")*/?>$`)},
+}
+
+// maxDetectionLines is how many lines of a body are looked at to detect its language.
+const maxDetectionLines = 200
+
+// detectLanguage guesses the language of an upload from a shebang line, from patterns typical of languages, or when
+// there is no body, from the extension of its attachments. Uploads that look like nothing in particular are text.
+func detectLanguage(body string, fileNames []string) string {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		for _, name := range fileNames {
+			if language, ok := extensionLanguages[strings.ToLower(filepath.Ext(name))]; ok {
+				return language
+			}
+		}
+		return "text"
+	}
+
+	if first, _, _ := strings.Cut(body, "\n"); strings.HasPrefix(first, "#!") {
+		// Both "#!/bin/bash" and "#!/usr/bin/env python3" name the interpreter.
+		fields := strings.Fields(first[2:])
+		if len(fields) > 1 && path.Base(fields[0]) == "env" {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			if language, ok := interpreterLanguages[path.Base(fields[0])]; ok {
+				return language
+			}
+		}
+	}
+	if (body[0] == '{' || body[0] == '[') && json.Valid([]byte(body)) {
+		return "json"
+	}
+
+	scores := make(map[string]int)
+	lines := strings.SplitN(body, "\n", maxDetectionLines+1)
+	if len(lines) > maxDetectionLines {
+		lines = lines[:maxDetectionLines]
+	}
+	counted := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		counted++
+		for _, hint := range languageHints {
+			if hint.pattern.MatchString(line) {
+				scores[hint.language]++
+			}
+		}
+	}
+
+	// A language needs at least a tenth of the lines, so that text merely quoting a line of code stays text. Ties go
+	// to the hint listed first.
+	best, bestScore := "text", 0
+	for _, hint := range languageHints {
+		if score := scores[hint.language]; score > bestScore {
+			best, bestScore = hint.language, score
+		}
+	}
+	if bestScore*10 < counted {
+		return "text"
+	}
+	return best
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// ldapConfig describes the LDAP or Active Directory server that passwords are checked against when they do not match a
+// local account. url is empty when LDAP_URL is not set.
+var ldapConfig struct {
+	url          string
+	startTLS     bool
+	bindDN       string // Service account that searches for users, or "" to search anonymously.
+	bindPassword string
+	baseDN       string
+	userFilter   string // With %s where the escaped username goes.
+	idAttribute  string
+	groups       GroupMapping
+}
+
+func initLDAP() {
+	if ldapConfig.url = os.Getenv("LDAP_URL"); ldapConfig.url == "" {
+		return
+	}
+	ldapConfig.startTLS = envBool("LDAP_STARTTLS")
+	ldapConfig.bindDN = os.Getenv("LDAP_BIND_DN")
+	ldapConfig.bindPassword = os.Getenv("LDAP_BIND_PASSWORD")
+	if ldapConfig.baseDN = os.Getenv("LDAP_BASE_DN"); ldapConfig.baseDN == "" {
+		log.Fatal("LDAP_BASE_DN environment variable must be set along with LDAP_URL")
+	}
+	if ldapConfig.userFilter = os.Getenv("LDAP_USER_FILTER"); ldapConfig.userFilter == "" {
+		ldapConfig.userFilter = "(uid=%s)"
+	}
+	if !strings.Contains(ldapConfig.userFilter, "%s") {
+		log.Fatalf("LDAP_USER_FILTER environment variable must contain %v where the username goes", "%s")
+	}
+	if ldapConfig.idAttribute = os.Getenv("LDAP_ID_ATTRIBUTE"); ldapConfig.idAttribute == "" {
+		ldapConfig.idAttribute = "entryUUID"
+	}
+	ldapConfig.groups = GroupMapping{
+		Roles: parseGroupMap(os.Getenv("LDAP_ROLE_MAP")),
+		Teams: parseGroupMap(os.Getenv("LDAP_TEAM_MAP")),
+	}
+	if err := ldapConfig.groups.Validate(); err != nil {
+		log.Fatal("LDAP_ROLE_MAP environment variable must map groups to roles: ", err)
+	}
+}
+
+// dialLDAP connects to the directory and binds as the service account.
+func dialLDAP() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(ldapConfig.url, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if ldapConfig.startTLS {
+		host, _, _ := strings.Cut(strings.TrimPrefix(ldapConfig.url, "ldap://"), ":")
+		if err = conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if ldapConfig.bindDN != "" {
+		err = conn.Bind(ldapConfig.bindDN, ldapConfig.bindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to bind as the LDAP service account: %w", err)
+	}
+	return conn, nil
+}
+
+// ldapGroups returns the groups a user is a member of, from the DNs of its memberOf attribute. Each group appears both
+// as its DN and as the value of its first component, such as its CN, so either can be mapped.
+func ldapGroups(entry *ldap.Entry) []string {
+	var groups []string
+	for _, dn := range entry.GetAttributeValues("memberOf") {
+		groups = append(groups, dn)
+		if parsed, err := ldap.ParseDN(dn); err == nil && len(parsed.RDNs) > 0 && len(parsed.RDNs[0].Attributes) > 0 {
+			groups = append(groups, parsed.RDNs[0].Attributes[0].Value)
+		}
+	}
+	return groups
+}
+
+// ldapId returns the id that links an account to its directory entry. Binary ids such as the objectGUID of Active
+// Directory are hex encoded.
+func ldapId(entry *ldap.Entry) string {
+	value := entry.GetRawAttributeValue(ldapConfig.idAttribute)
+	if len(value) == 0 {
+		return ""
+	} else if !utf8.Valid(value) {
+		return "ldap:" + hex.EncodeToString(value)
+	}
+	return "ldap:" + string(value)
+}
+
+// ldapLogin checks a username and password against the directory, and returns the account linked to the user,
+// creating it on its first login. Its role and team memberships are brought up to date with its groups.
+func ldapLogin(username, password, ip string) (*Account, error) {
+	if username == "" || password == "" {
+		// A bind with an empty password is an unauthenticated bind, which many servers let succeed.
+		return nil, ErrLoginFailed
+	}
+	conn, err := dialLDAP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result, err := conn.Search(ldap.NewSearchRequest(ldapConfig.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false, fmt.Sprintf(ldapConfig.userFilter, ldap.EscapeFilter(username)),
+		[]string{ldapConfig.idAttribute, "memberOf"}, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if result == nil || len(result.Entries) != 1 {
+		// An ambiguous filter must not let one user log in as another.
+		return nil, ErrLoginFailed
+	}
+	entry := result.Entries[0]
+	if err = conn.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrLoginFailed
+	} else if err != nil {
+		return nil, err
+	}
+
+	externalId := ldapId(entry)
+	if externalId == "" {
+		return nil, fmt.Errorf("the directory entry of %v has no %v attribute", username, ldapConfig.idAttribute)
+	}
+	account, created, err := ExternalAccount(externalId, externalUsername(username))
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		RecordAudit("identity provider", "account.create", account.Username, "ldap", ip)
+	}
+	if err = ldapConfig.groups.Apply(account, ldapGroups(entry), ip); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"golang.org/x/net/websocket"
+	"golang.org/x/time/rate"
+)
+
+// Live documents let several people write the text of an upload together before it is published. An account starts
+// one, and everyone it shares the link with edits the same text in their browser, which sends each change over a
+// WebSocket as a TextOperation. Changes are ordered by the database: every accepted change is transformed against the
+// ones accepted since the revision it was made on, stored in LiveEditOps, and sent to the other editors by the server
+// they are connected to, which the others are told of on liveEditChannel. Once the account publishes the document, it
+// becomes an ordinary, immutable upload, and the document can no longer be edited. Documents are deleted LIVE_EDIT_DAYS
+// after their last change.
+
+// liveEditChannel is the Postgres channel on which replicas announce changes to live documents, with the id of the
+// document as the payload.
+const liveEditChannel = "copycat_live_edit"
+
+const (
+	liveEditRate  = 30  // The changes per second that an editor may send on average.
+	liveEditBurst = 100 // The changes that an editor may send at once, such as after reconnecting.
+)
+
+var (
+	ErrLiveDocumentNotFound  = errors.New("live document not found")
+	ErrLiveDocumentPublished = errors.New("the live document was published and can no longer be edited")
+	ErrLiveDocumentTooLong   = errors.New("the text is longer than an upload may be")
+	ErrLiveDocumentEmpty     = errors.New("the live document is empty")
+	ErrLiveRevision          = errors.New("the change was made on an unknown revision of the text; reload it")
+	ErrLiveEditTooFast       = errors.New("changes are sent too quickly; reload the text")
+	ErrNotLiveDocumentOwner  = errors.New("only the account that started the live document may publish it")
+)
+
+// liveDocumentLifetime is how long a live document is kept after its last change.
+var liveDocumentLifetime time.Duration
+
+// A LiveDocument is text being written together before it is uploaded.
+type LiveDocument struct {
+	Id            string
+	AccountId     int64 // The account that started the document, and alone may publish it.
+	Body          string
+	Revision      int64  // The number of changes made to the text.
+	PublishedHash string // The hash of the upload the document was published as, or "".
+	CreatedAt     int64
+	UpdatedAt     int64
+}
+
+func initLiveEdit() {
+	liveDocumentLifetime = time.Duration(envInt64("LIVE_EDIT_DAYS", 7)) * 24 * time.Hour
+
+	RegisterJob(&Job{
+		Name:     "live documents",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "DELETE FROM LiveDocuments WHERE updated_at < $1", time.Now().Add(-liveDocumentLifetime).UTC().Unix())
+			return err
+		},
+	})
+
+	listenForLiveEdits()
+}
+
+func GetLiveDocument(id string) (*LiveDocument, error) {
+	doc := new(LiveDocument)
+	err := db.QueryRow("SELECT id, account_id, body, revision, published_hash, created_at, updated_at FROM LiveDocuments WHERE id = $1",
+		id).Scan(&doc.Id, &doc.AccountId, &doc.Body, &doc.Revision, &doc.PublishedHash, &doc.CreatedAt, &doc.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrLiveDocumentNotFound
+	}
+	return doc, err
+}
+
+// CreateLiveDocument starts a live document of an account with a text, and sets its id.
+func CreateLiveDocument(doc *LiveDocument) error {
+	doc.Id = randomToken()
+	doc.CreatedAt = time.Now().UTC().Unix()
+	doc.UpdatedAt = doc.CreatedAt
+	_, err := db.Exec(`INSERT INTO LiveDocuments(id, account_id, body, revision, created_at, updated_at) VALUES ($1, $2, $3, 0, $4, $4)`,
+		doc.Id, doc.AccountId, doc.Body, doc.CreatedAt)
+	return err
+}
+
+// checkLiveText returns an error if a text cannot be the body of a live document.
+func checkLiveText(text string) error {
+	if maxBodyLength != 0 && int64(len(text)) > maxBodyLength || len(text) > maxUploadSize {
+		return ErrLiveDocumentTooLong
+	}
+	return nil
+}
+
+// ApplyLiveEdit applies a change an editor made on a revision of a live document, after transforming it against the
+// changes accepted since, and returns the new revision. author identifies the connection of the editor, which is sent
+// an acknowledgement rather than the change.
+func ApplyLiveEdit(id, author string, revision int64, op *TextOperation) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var body, publishedHash string
+	var current int64
+	err = tx.QueryRow("SELECT body, revision, published_hash FROM LiveDocuments WHERE id = $1 FOR UPDATE", id).Scan(&body, &current, &publishedHash)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, ErrLiveDocumentNotFound
+	case err != nil:
+		return 0, err
+	case publishedHash != "":
+		return 0, ErrLiveDocumentPublished
+	case revision < 0 || revision > current:
+		return 0, ErrLiveRevision
+	}
+
+	rows, err := tx.Query("SELECT operation FROM LiveEditOps WHERE document_id = $1 AND revision > $2 ORDER BY revision", id, revision)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		concurrent := new(TextOperation)
+		if err = rows.Scan(&data); err != nil {
+			return 0, err
+		}
+		if err = json.Unmarshal(data, concurrent); err != nil {
+			return 0, err
+		}
+		if op, _, err = transformTextOperations(op, concurrent); err != nil {
+			return 0, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	text, err := op.Apply(utf16.Encode([]rune(body)))
+	if err != nil {
+		return 0, err
+	}
+	// Postgres text cannot hold NUL characters, nor invalid UTF-16 be stored as UTF-8 without changing its length.
+	if err = checkUTF16(text); err != nil {
+		return 0, err
+	} else if slices.Contains(text, 0) {
+		return 0, errors.New("the text must not contain NUL characters")
+	}
+	body = string(utf16.Decode(text))
+	if err = checkLiveText(body); err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(op)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC().Unix()
+	current++
+	_, err = tx.Exec("INSERT INTO LiveEditOps(document_id, revision, operation, author, created_at) VALUES ($1, $2, $3, $4, $5)",
+		id, current, data, author, now)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE LiveDocuments SET body = $1, revision = $2, updated_at = $3 WHERE id = $4", body, current, now, id)
+	if err != nil {
+		return 0, err
+	}
+	return current, tx.Commit()
+}
+
+// A liveMessage is sent to the editors of a live document: the text when they connect ("init"), a change made by
+// another editor ("operation"), the acknowledgement of their own change ("ack"), the upload the document was published
+// as ("published"), or the error that ends their connection ("error").
+type liveMessage struct {
+	Type      string          `json:"type"`
+	Revision  int64           `json:"revision,omitempty"`
+	Body      string          `json:"body,omitempty"`
+	Operation json.RawMessage `json:"operation,omitempty"`
+	Redirect  string          `json:"redirect,omitempty"`
+	Error     gin.H           `json:"error,omitempty"`
+}
+
+// A liveEditor is the connection of an editor to a live document.
+type liveEditor struct {
+	id       string
+	revision int64 // The revision of the text the editor was last sent.
+	send     chan liveMessage
+}
+
+// A liveHub relays the changes to a live document to the editors connected to this server.
+type liveHub struct {
+	id       string
+	mu       sync.Mutex
+	revision int64 // The last revision relayed to the editors.
+	editors  map[*liveEditor]bool
+}
+
+var liveHubs = struct {
+	sync.Mutex
+	m map[string]*liveHub
+}{m: make(map[string]*liveHub)}
+
+// joinLiveDocument connects an editor to a live document and sends them its text. The text is loaded before any lock
+// is taken, so that a slow query does not hold up the editors of every other document.
+func joinLiveDocument(id string, editor *liveEditor) (*liveHub, error) {
+	for {
+		doc, err := GetLiveDocument(id)
+		if err != nil {
+			return nil, err
+		} else if doc.PublishedHash != "" {
+			return nil, ErrLiveDocumentPublished
+		}
+		if hub := addLiveEditor(doc, editor); hub != nil {
+			return hub, nil
+		}
+	}
+}
+
+// addLiveEditor connects an editor to the hub of a live document and sends them its text. When the hub has relayed
+// changes newer than the text already, the editor would miss them, so nil is returned and the text must be loaded
+// again.
+func addLiveEditor(doc *LiveDocument, editor *liveEditor) *liveHub {
+	liveHubs.Lock()
+	defer liveHubs.Unlock()
+	hub := liveHubs.m[doc.Id]
+	if hub == nil {
+		hub = &liveHub{id: doc.Id, editors: make(map[*liveEditor]bool)}
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if len(hub.editors) == 0 {
+		hub.revision = doc.Revision
+	} else if hub.revision > doc.Revision {
+		return nil
+	}
+	liveHubs.m[doc.Id] = hub
+	hub.editors[editor] = true
+	editor.revision = doc.Revision
+	editor.send <- liveMessage{Type: "init", Revision: doc.Revision, Body: doc.Body}
+	return hub
+}
+
+// leave disconnects an editor.
+func (hub *liveHub) leave(editor *liveEditor) {
+	liveHubs.Lock()
+	defer liveHubs.Unlock()
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.dropLocked(editor)
+	if len(hub.editors) == 0 && liveHubs.m[hub.id] == hub {
+		delete(liveHubs.m, hub.id)
+	}
+}
+
+func (hub *liveHub) dropLocked(editor *liveEditor) {
+	if hub.editors[editor] {
+		delete(hub.editors, editor)
+		close(editor.send)
+	}
+}
+
+// deliver queues a message for an editor. Editors who do not keep up are disconnected, and reload the text when they
+// reconnect.
+func (hub *liveHub) deliver(editor *liveEditor, message liveMessage) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.deliverLocked(editor, message)
+}
+
+func (hub *liveHub) deliverLocked(editor *liveEditor, message liveMessage) {
+	if !hub.editors[editor] {
+		return
+	}
+	select {
+	case editor.send <- message:
+	default:
+		hub.dropLocked(editor)
+	}
+}
+
+// sync relays the changes accepted since the last sync to the editors, and disconnects them once the document is
+// published or deleted.
+func (hub *liveHub) sync() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.editors) == 0 {
+		return
+	}
+	if err := hub.syncLocked(); err != nil {
+		log.Printf("failed to relay the changes to live document %v: %v", hub.id, err)
+	}
+}
+
+func (hub *liveHub) syncLocked() error {
+	doc, err := GetLiveDocument(hub.id)
+	if errors.Is(err, ErrLiveDocumentNotFound) {
+		hub.closeLocked(liveMessage{Type: "error", Error: gin.H{"code": errorCodes[ErrLiveDocumentNotFound], "message": err.Error()}})
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if doc.PublishedHash != "" {
+		hub.closeLocked(liveMessage{Type: "published", Redirect: baseurl + uploadPath(ShortHash(doc.PublishedHash))})
+		return nil
+	}
+
+	rows, err := db.Query("SELECT revision, operation, author FROM LiveEditOps WHERE document_id = $1 AND revision > $2 ORDER BY revision",
+		hub.id, hub.revision)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var revision int64
+		var operation []byte
+		var author string
+		if err = rows.Scan(&revision, &operation, &author); err != nil {
+			return err
+		}
+		for editor := range hub.editors {
+			if revision <= editor.revision {
+				continue // Part of the text the editor was sent when connecting.
+			}
+			editor.revision = revision
+			if editor.id == author {
+				hub.deliverLocked(editor, liveMessage{Type: "ack", Revision: revision})
+			} else {
+				hub.deliverLocked(editor, liveMessage{Type: "operation", Revision: revision, Operation: operation})
+			}
+		}
+		hub.revision = revision
+	}
+	return rows.Err()
+}
+
+// closeLocked sends a last message to every editor and disconnects them.
+func (hub *liveHub) closeLocked(message liveMessage) {
+	for editor := range hub.editors {
+		hub.deliverLocked(editor, message)
+		hub.dropLocked(editor)
+	}
+}
+
+// syncLiveDocument relays the changes to a live document to its editors on every server.
+func syncLiveDocument(id string) {
+	liveHubs.Lock()
+	hub := liveHubs.m[id]
+	liveHubs.Unlock()
+	if hub != nil {
+		hub.sync()
+	}
+	if _, err := db.Exec("SELECT pg_notify($1, $2)", liveEditChannel, id); err != nil {
+		log.Printf("failed to notify other servers of the change of live document %v: %v", id, err)
+	}
+}
+
+// listenForLiveEdits relays the changes that other replicas notify of on liveEditChannel.
+func listenForLiveEdits() {
+	listener := pq.NewListener(dbConnStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("live edit listener: %v", err)
+		}
+	})
+	if err := listener.Listen(liveEditChannel); err != nil {
+		log.Fatal("failed to listen for live edits: ", err)
+	}
+	go func() {
+		for notification := range listener.Notify {
+			liveHubs.Lock()
+			var hubs []*liveHub
+			if notification == nil {
+				// The connection was lost and reestablished, so notifications may have been missed.
+				for _, hub := range liveHubs.m {
+					hubs = append(hubs, hub)
+				}
+			} else if hub := liveHubs.m[notification.Extra]; hub != nil {
+				hubs = append(hubs, hub)
+			}
+			liveHubs.Unlock()
+			for _, hub := range hubs {
+				hub.sync()
+			}
+		}
+	}()
+}
+
+// checkLiveOrigin refuses WebSocket connections opened by pages of other sites, which would edit as the account logged
+// in to this one.
+func checkLiveOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || r.Header.Get("Origin") != "" && origin.Host != r.Host {
+		return errors.New("cross-origin live editing is not allowed")
+	}
+	return nil
+}
+
+// serveLiveEditor relays the changes of an editor connected over a WebSocket until they disconnect.
+func serveLiveEditor(c *gin.Context, ws *websocket.Conn, id string) {
+	ws.MaxPayloadBytes = maxSubmitSize
+	editor := &liveEditor{id: randomToken(), send: make(chan liveMessage, 256)}
+	hub, err := joinLiveDocument(id, editor)
+	if err != nil {
+		websocket.JSON.Send(ws, liveMessage{Type: "error", Error: errorBody(c, http.StatusNotFound, err, nil)})
+		ws.Close()
+		return
+	}
+	defer hub.leave(editor)
+
+	go func() {
+		for message := range editor.send {
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := websocket.JSON.Send(ws, message); err != nil {
+				break
+			}
+		}
+		ws.Close()
+		for range editor.send {
+		}
+	}()
+
+	// Any error ends the connection, and the editor reloads the text, since their changes no longer apply to it.
+	fail := func(status int, err error) {
+		if status >= http.StatusInternalServerError {
+			log.Printf("Error encountered serving live document %v: %v", id, err)
+		}
+		hub.deliver(editor, liveMessage{Type: "error", Error: errorBody(c, status, err, nil)})
+	}
+	limiter := rate.NewLimiter(liveEditRate, liveEditBurst)
+	for {
+		var change struct {
+			Revision  int64         `json:"revision"`
+			Operation TextOperation `json:"operation"`
+		}
+		if err := websocket.JSON.Receive(ws, &change); errors.Is(err, ErrOperationMalformed) {
+			fail(http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			return // Disconnected.
+		}
+		if !limiter.Allow() {
+			fail(http.StatusTooManyRequests, ErrLiveEditTooFast)
+			return
+		}
+		if banner := maintenanceBanner(c); banner != "" {
+			fail(http.StatusServiceUnavailable, &codedError{"maintenance", banner})
+			return
+		}
+
+		_, err := ApplyLiveEdit(id, editor.id, change.Revision, &change.Operation)
+		switch {
+		case errors.Is(err, ErrLiveDocumentNotFound):
+			fail(http.StatusNotFound, err)
+			return
+		case errors.Is(err, ErrLiveDocumentPublished):
+			fail(http.StatusGone, err)
+			return
+		case errors.Is(err, ErrLiveDocumentTooLong):
+			fail(http.StatusRequestEntityTooLarge, err)
+			return
+		case errors.Is(err, ErrLiveRevision), errors.Is(err, ErrOperationLength):
+			fail(http.StatusConflict, err)
+			return
+		case err != nil:
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) {
+				fail(http.StatusInternalServerError, err)
+			} else {
+				fail(http.StatusBadRequest, err)
+			}
+			return
+		}
+		syncLiveDocument(id)
+	}
+}
+
+// publishLiveDocument uploads the text of a live document for its account, and ends the editing. Personal data is
+// redacted from the text first when the redact form field is on, and redacted counts what was. On failure an error has
+// been sent and "" is returned.
+func publishLiveDocument(c *gin.Context, account *Account, id string, language string) (hash, editToken string, redacted map[string]int) {
+	tx, err := db.Begin()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return "", "", nil
+	}
+	defer tx.Rollback()
+
+	// The document is locked until it is published, so that no change is made in the meantime, nor is it published twice.
+	var ownerId int64
+	var body, publishedHash string
+	err = tx.QueryRow("SELECT account_id, body, published_hash FROM LiveDocuments WHERE id = $1 FOR UPDATE", id).Scan(&ownerId, &body, &publishedHash)
+	switch {
+	case err == sql.ErrNoRows:
+		respondError(c, http.StatusNotFound, ErrLiveDocumentNotFound)
+		return "", "", nil
+	case err != nil:
+		respondError(c, http.StatusInternalServerError, err)
+		return "", "", nil
+	case ownerId != account.Id:
+		respondError(c, http.StatusForbidden, ErrNotLiveDocumentOwner)
+		return "", "", nil
+	case publishedHash != "":
+		respondError(c, http.StatusGone, ErrLiveDocumentPublished)
+		return "", "", nil
+	case body == "":
+		respondError(c, http.StatusBadRequest, ErrLiveDocumentEmpty)
+		return "", "", nil
+	}
+
+	// Personal data is redacted before hooks or anything else see the text.
+	if c.PostForm("redact") == "on" {
+		body, redacted = redactBody(body)
+	}
+	preSubmit := HookPayload{Event: HookPreSubmit, Body: body, Size: int64(len(body))}
+	if !checkHooks(c, &preSubmit) {
+		return "", "", nil
+	}
+	body = preSubmit.Body
+	options := UploadOptions{
+		UploaderIP: c.ClientIP(),
+		Size:       int64(len(body)),
+		Language:   language,
+		AccountId:  account.Id,
+	}
+	quota, err := GetQuota(options.UploaderIP, account, nil)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return "", "", nil
+	}
+	if err = quota.Check(options.Size); err != nil {
+		respondError(c, http.StatusRequestEntityTooLarge, err)
+		return "", "", nil
+	}
+	if !checkSecrets(c, scanSecrets("", []byte(body)), c.PostForm("confirm_secrets") == "on") {
+		return "", "", nil
+	}
+
+	hash = UploadHash(body, nil, options)
+	if editToken, _, err = SubmitUpload(hash, body, nil, options); err != nil {
+		respondError(c, http.StatusConflict, err)
+		return "", "", nil
+	}
+	// The changes are no longer needed once the text is published.
+	if _, err = tx.Exec("UPDATE LiveDocuments SET published_hash = $1, updated_at = $2 WHERE id = $3", hash, time.Now().UTC().Unix(), id); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return "", "", nil
+	}
+	if _, err = tx.Exec("DELETE FROM LiveEditOps WHERE document_id = $1", id); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return "", "", nil
+	}
+	if err = tx.Commit(); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return "", "", nil
+	}
+	notifyHooks(HookPayload{Event: HookPostSubmit, Hash: hash, Body: body, Size: options.Size, AccountId: options.AccountId,
+		IP: options.UploaderIP})
+	return hash, editToken, redacted
+}
+
+func registerLiveEditRoutes(r *gin.Engine) {
+	// The page that edits a live document. Published documents lead to their upload.
+	r.GET("/live/:id", func(c *gin.Context) {
+		doc, err := GetLiveDocument(c.Param("id"))
+		if errors.Is(err, ErrLiveDocumentNotFound) {
+			route404(c)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if doc.PublishedHash != "" {
+			c.Redirect(http.StatusSeeOther, uploadPath(ShortHash(doc.PublishedHash)))
+			return
+		}
+		terms, err := pendingTerms(c)
+		if err != nil {
+			log.Printf("failed to check the terms of service: %v", err)
+		}
+		account := currentAccount(c)
+		renderPage(c, http.StatusOK, "live.html", gin.H{
+			"Page":      NewPageInfo(c, "Live editing"),
+			"Id":        doc.Id,
+			"IsOwner":   account != nil && account.Id == doc.AccountId,
+			"Languages": languages,
+			"Terms":     terms,
+		})
+	})
+
+	// Everyone with the link may edit; the id of a document is as hard to guess as a token.
+	r.GET("/api/v1/live/:id/socket", func(c *gin.Context) {
+		id := c.Param("id")
+		server := websocket.Server{
+			Handshake: checkLiveOrigin,
+			Handler: func(ws *websocket.Conn) {
+				serveLiveEditor(c, ws, id)
+			},
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+	})
+
+	live := r.Group("/api/v1/live", requireRole(RoleUser))
+
+	// Start a live document, with the text in "body" if any.
+	live.POST("", limitRequestBody(maxSubmitSize), func(c *gin.Context) {
+		doc := &LiveDocument{AccountId: currentAccount(c).Id, Body: c.PostForm("body")}
+		if !utf8.ValidString(doc.Body) || slices.Contains([]byte(doc.Body), 0) {
+			respondError(c, http.StatusBadRequest, errors.New(`"body" must be UTF-8 text`))
+			return
+		}
+		if err := checkLiveText(doc.Body); err != nil {
+			respondError(c, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err := CreateLiveDocument(doc); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"id":  doc.Id,
+			"url": fmt.Sprintf("%s/live/%s", baseurl, doc.Id),
+		})
+	})
+
+	// Publish the text as an upload, which ends the editing.
+	live.POST("/:id/publish", func(c *gin.Context) {
+		language, err := parseLanguage(c.PostForm("language"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if !checkTerms(c, c.PostForm("accept_terms") == "on") {
+			return
+		}
+		id := c.Param("id")
+		hash, editToken, redacted := publishLiveDocument(c, currentAccount(c), id, language)
+		if hash == "" {
+			return
+		}
+		syncLiveDocument(id)
+
+		shortHash := ShortHash(hash)
+		response := gin.H{
+			"id":       shortHash,
+			"redirect": baseurl + uploadPath(shortHash),
+			"message":  "Successfully uploaded",
+		}
+		if editToken != "" {
+			response["edit_token"] = editToken
+		}
+		if redacted != nil {
+			response["redacted"] = redacted
+		}
+		c.JSON(http.StatusOK, response)
+	})
+}
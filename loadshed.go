@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrOverloaded = errors.New("the server is busy, please try again in a few seconds")
+
+// A concurrencyLimit caps how many requests of a kind are handled at once on this replica. Requests beyond the cap
+// wait in a queue as long as the cap for up to queueTimeout, and the rest are shed with 503, so that a burst of large
+// uploads cannot hold more bodies in memory than the cap allows.
+type concurrencyLimit struct {
+	name    string
+	slots   chan struct{} // nil when unlimited.
+	waiting atomic.Int64
+	shed    atomic.Int64
+}
+
+var (
+	submitConcurrency   = &concurrencyLimit{name: "submit"}
+	downloadConcurrency = &concurrencyLimit{name: "download"}
+	queueTimeout        time.Duration
+)
+
+func initLoadShedding() {
+	for _, limit := range []struct {
+		*concurrencyLimit
+		variable string
+	}{{submitConcurrency, "MAX_CONCURRENT_SUBMITS"}, {downloadConcurrency, "MAX_CONCURRENT_DOWNLOADS"}} {
+		n := envInt64(limit.variable, 0)
+		if n < 0 {
+			log.Fatal(limit.variable + " environment variable must not be negative")
+		}
+		if n > 0 {
+			limit.slots = make(chan struct{}, n)
+		}
+	}
+	queueTimeout = time.Duration(envInt64("QUEUE_TIMEOUT_SECONDS", 10)) * time.Second
+
+	expvar.Publish("concurrency", expvar.Func(func() any {
+		stats := make(map[string]map[string]int64)
+		for _, limit := range []*concurrencyLimit{submitConcurrency, downloadConcurrency} {
+			stats[limit.name] = map[string]int64{
+				"in_flight": int64(len(limit.slots)),
+				"capacity":  int64(cap(limit.slots)),
+				"waiting":   limit.waiting.Load(),
+				"shed":      limit.shed.Load(),
+			}
+		}
+		return stats
+	}))
+}
+
+// acquire takes a slot, waiting in the queue if there is room in it, and reports whether it got one.
+func (limit *concurrencyLimit) acquire(c *gin.Context) bool {
+	select {
+	case limit.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if limit.waiting.Add(1) > int64(cap(limit.slots)) {
+		limit.waiting.Add(-1)
+		return false
+	}
+	defer limit.waiting.Add(-1)
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case limit.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// limitConcurrency is a middleware that handles a route within a concurrency limit, answering 503 with a Retry-After
+// header when the server is too busy to queue the request.
+func limitConcurrency(limit *concurrencyLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit.slots == nil {
+			c.Next()
+			return
+		}
+		if !limit.acquire(c) {
+			limit.shed.Add(1)
+			// The body is not read, so the connection cannot be reused.
+			c.Header("Connection", "close")
+			c.Header("Retry-After", strconv.Itoa(int(max(queueTimeout, time.Second).Seconds())))
+			abortWithError(c, http.StatusServiceUnavailable, ErrOverloaded, nil)
+			return
+		}
+		defer func() { <-limit.slots }()
+		c.Next()
+	}
+}
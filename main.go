@@ -3,14 +3,17 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/gob"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
-	"runtime/debug"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -20,15 +23,47 @@ import (
 
 const maxUploadSize = 32 * 1024 * 1024 // 32 MiB maximum attachments upload size.
 
+const mediaCacheSize = 128 * 1024 * 1024 // 128 MiB of audio and video kept in memory for streaming.
+
+var mediaCache = NewObjectCache(mediaCacheSize)
+
+// baseurl is the address of the site that links in responses start with, from the BASEURL variable.
+var baseurl string
+
+// router is the engine created in main, kept so that handlers outside of main can render templates.
+var router *gin.Engine
+
 // PageInfo is passed to templates as "Page" to provide context.
 type PageInfo struct {
-	Title string
-	Path  string
+	Title   string
+	Path    string
+	Account *Account // The logged in account, or nil.
+	Lang    string   // The language the page is shown in; see T.
+	Site    *Site    // The branding of the deployment.
+	Claims  bool     // Whether the browser holds a claim token for anonymous uploads; see /mine.
+
+	Announcements []Announcement // The banners shown at the top of the page.
+	Maintenance   string         // The message shown while the site is in maintenance mode, or "".
+	Display       DisplayOptions // The rendering variants the page is shown in; see accessibility.go.
 }
 
-// NewPageInfo uses the current gin.Context request to provide a relative page path. The title parameter names the page.
+// NewPageInfo uses the current gin.Context request to provide a relative page path. The title parameter names the page,
+// and is translated into the language negotiated for the request.
 func NewPageInfo(c *gin.Context, title string) *PageInfo {
-	return &PageInfo{Title: title, Path: c.FullPath()}
+	lang := requestLanguage(c)
+	c.Header("Content-Language", lang)
+	c.Header("Vary", "Accept-Language")
+	return &PageInfo{
+		Title:         translate(lang, title),
+		Path:          c.FullPath(),
+		Account:       currentAccount(c),
+		Lang:          lang,
+		Site:          site.Load(),
+		Claims:        requestClaimToken(c) != "",
+		Announcements: pageAnnouncements(c),
+		Maintenance:   maintenanceBanner(c),
+		Display:       requestDisplayOptions(c),
+	}
 }
 
 func init() {
@@ -39,162 +74,869 @@ func init() {
 
 func main() {
 	// The .env file is loaded in the init() of db.go
-	var baseurl = os.Getenv("BASEURL")
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:]) // Run a command line operation instead of the webserver.
+	}
+
+	baseurl = os.Getenv("BASEURL")
 	if baseurl == "" {
 		log.Fatal("GOBASEURL environment variable has not been assigned")
 	}
 
+	loadFlag(&stripMetadata, "STRIP_METADATA")
+
 	r := gin.Default()
 	r.MaxMultipartMemory = maxUploadSize
-
-	initAWS() // Initialize AWS S3 and the s3Actions global.
+	router = r
+
+	initStorage()           // Open the object store for attachments, initializing AWS S3 if it is used.
+	initSigningKey()        // Load the key used to sign share links.
+	initQuotas()            // Load the storage quota limits.
+	initAccounts()          // Load the account registration settings.
+	initRequireLogin()      // Load whether anonymous visitors may view the site, and the paths they may always reach.
+	initTwoFactor()         // Load which roles must use two-factor authentication.
+	initSessions()          // Schedule the deletion of expired login sessions.
+	initSAML()              // Load the identity provider that users may log in with, if any.
+	initLDAP()              // Load the directory that passwords are checked against, if any.
+	initSCIM()              // Load the token that identity providers provision accounts with.
+	initErrorTracking()     // Report server errors to Sentry if it is configured.
+	initStats()             // Schedule the aggregation of the statistics shown at /stats.
+	initTrash()             // Schedule the purging of deleted uploads after their grace period.
+	initIdempotency()       // Schedule the forgetting of idempotency keys.
+	initDrafts()            // Schedule the deletion of abandoned drafts.
+	initLiveEdit()          // Schedule the deletion of abandoned live documents, and relay the changes made on other replicas.
+	initClipChannels()      // Schedule the deletion of abandoned clip channels, and relay the snippets pushed on other replicas.
+	initWebPush()           // Load the VAPID key that push messages are sent with, if any.
+	initCI()                // Load the retention labels of CI uploads.
+	initGeo()               // Load where the country of a request is read from.
+	initAnalytics()         // Schedule the writing and expiry of upload analytics, if enabled.
+	initAccessCodes()       // Schedule the removal of expired access codes.
+	initWatermarks()        // Load the text that downloaded images are watermarked with.
+	initUsage()             // Schedule the writing of usage for billing, if enabled.
+	initArchive()           // Schedule the archival of old attachments, if enabled.
+	initStorageEvents()     // Load the SNS topics that report changes to the bucket.
+	initIntegrity()         // Schedule the verification of stored objects against their checksums, if enabled.
+	initCompression()       // Load the size from which bodies and attachments are compressed.
+	initBodyLength()        // Load the maximum length of text bodies.
+	initSecretScanning()    // Load what happens to uploads containing credentials.
+	initRedaction()         // Load the patterns of personal data to redact on request, beyond the built-in ones.
+	initBodyObjects()       // Load the size from which bodies are stored as objects.
+	initThrottling()        // Load the download bandwidth limits.
+	initRateLimits()        // Load the request rate limit policies.
+	initLoadShedding()      // Load how many uploads and downloads are handled at once.
+	initShortIDs()          // Load the alphabet and length of the links of new uploads.
+	initUploadCache()       // Create the cache of upload rows, and warm it with the most recently viewed uploads.
+	initHotlinkProtection() // Load the sites allowed to link to attachments.
+	initCDN()               // Load the CDN that serves attachments, if any.
+	initExpiry()            // Schedule the deletion of expired uploads.
+	initFederation()        // Load the peer instances that missing uploads are mirrored from.
+	initRobots()            // Load what search engines may index.
+	initI18n()              // Load the message catalogs that pages and errors are translated with.
+	initTheme()             // Load the template and asset overrides and the branding of the site.
+	initHooks()             // Register the configured lifecycle hooks.
+	initDLP()               // Load the compliance scanner that new public uploads are sent to.
+	initVirusScan()         // Load the clamd daemon that attachments are scanned with.
+	initAnnouncements()     // Schedule the loading of the announcement banners.
+	initMaintenance()       // Enter and leave maintenance mode on signals and on the requests of other replicas.
+	initTerms()             // Load whether submitters must accept the terms of service.
+	initReload()            // Reload the configuration on SIGHUP and on the requests of other replicas.
+	startJobs()             // Run the scheduled background jobs.
 
 	// Declare custom functions for templates.
 	r.SetFuncMap(template.FuncMap{
 		"datestring": func(unix int64) string {
 			return time.Unix(unix, 0).Format(time.UnixDate)
 		},
+		// Escapes a filename for use as a single URL path segment.
+		"pathescape": url.PathEscape,
+		// Returns "video" or "audio" when the attachment filename can be played by the browser.
+		"mediakind": func(filename string) string {
+			return mediaKind(mime.TypeByExtension(filepath.Ext(filename)))
+		},
+		"filesize": formatBytes,
+		// Returns the name of a language to show.
+		"languagename": languageName,
+		// Returns the CDN URL that attachment links start with, or "" to link them on this site.
+		"cdn": func() string {
+			return cdnURL
+		},
+		// Returns the query that authorizes a download link when hotlink protection is enabled.
+		"downloadquery": DownloadQuery,
 	})
 
-	r.Static("/assets", "./assets") // Serve the /assets folder.
+	r.Use(assignRequestID)            // Give every request an id to find it in the logs by.
+	r.StaticFS("/assets", assetsFS()) // Serve the /assets folder, with the theme's assets over it.
+	r.Use(robotsHeader)               // Keep every page out of search engines in noindex mode.
+	r.Use(authenticate)               // Identify logged in accounts for every route below.
+	r.Use(requireLoginToView)         // Keep anonymous visitors out of instances that require logging in.
+	r.Use(restrictCountries)          // Keep the countries the site does not allow from viewing.
+	r.Use(rateLimitAPI)               // Limit the requests made with each API token.
+	r.Use(readOnlyDuringMaintenance)  // Refuse changes while the site is in maintenance mode.
 
-	route404 := func(c *gin.Context) {
-		r.LoadHTMLFiles("templates/layout.html", "templates/404.html")
-		c.HTML(http.StatusOK, "404.html", gin.H{
-			"Page": NewPageInfo(c, "404"),
-		})
-	}
 	r.NoRoute(route404) // Unhandled GET requests route to the 404 page.
 
 	// Home / Upload page.
 	r.GET("/", func(c *gin.Context) {
-		r.LoadHTMLFiles("templates/layout.html", "templates/index.html")
-		c.HTML(http.StatusOK, "index.html", gin.H{
-			"Page": NewPageInfo(c, ""),
+		// Logged in accounts may upload into any of their teams.
+		var teams []Team
+		if account := currentAccount(c); account != nil {
+			var err error
+			if teams, err = AccountTeams(account); err != nil {
+				log.Printf("failed to list teams of %v: %v", account.Username, err)
+			}
+		}
+
+		templates, err := ListPasteTemplates(currentAccount(c))
+		if err != nil {
+			log.Printf("failed to list paste templates: %v", err)
+		}
+
+		// Submitters who have not accepted the terms of service yet accept them with the upload.
+		terms, err := pendingTerms(c)
+		if err != nil {
+			log.Printf("failed to check the terms of service: %v", err)
+		}
+
+		renderPage(c, http.StatusOK, "index.html", gin.H{
+			"Page":          NewPageInfo(c, ""),
+			"StripMetadata": stripMetadata.Load(),
+			"MaxBodyLength": maxBodyLength,
+			"Languages":     languages,
+			"Teams":         teams,
+			"Terms":         terms,
+			"Templates":     templates,
 		})
 	})
 
 	// Fetch a previously uploaded message and attachments by its SHA-1 hash.
-	r.GET("/:hash", func(c *gin.Context) {
-		r.LoadHTMLFiles("templates/layout.html", "templates/submission.html")
-		// The hash needs to be in lowercase hex, as that's how the hashes are stored in the database.
-		hash := strings.ToLower(c.Param("hash"))
+	showUpload := func(c *gin.Context) {
+		// Hex IDs are read in lowercase, as that's how the hashes are stored in the database.
+		hash := uploadParam(c)
+
+		// Uploads are exported as PDF documents at /:hash.pdf; see pdf.go.
+		if id, ok := strings.CutSuffix(hash, ".pdf"); ok && isUploadID(id) {
+			servePDF(c, id)
+			return
+		}
 
 		// A GET request to /example could default to this route because it is the closest match.
 		// Here, we just reroute them to the 404 page if hash contains the name of an invalid route.
-		if !isValidHex(hash) {
-			route404(c)
+		if !isUploadID(hash) {
+			respondUploadNotFound(c, hash)
 			return
 		}
 
 		upload, err := GetUpload(hash) // Fetch the matching row from the database.
+		if err == sql.ErrNoRows && len(peers) > 0 {
+			// Short URLs of uploads submitted to a peer instance resolve here too, by mirroring the upload.
+			upload, err = MirrorFromPeers(c.Request.Context(), hash)
+		}
 
 		// If the row could not be found or the hash is invalid
 		if err != nil {
 			if err == ErrHashInvalid {
 				respondError(c, http.StatusBadRequest, err)
 			} else {
-				route404(c)
+				respondUploadNotFound(c, hash)
 				log.Printf("failed to fetch page with hash %v: %v", hash, err)
 			}
 			return
 		}
 
-		c.HTML(http.StatusOK, "submission.html", gin.H{
-			"Page":   NewPageInfo(c, hash),
-			"Upload": upload, // The row is passed to the template.
+		// Private uploads are only reachable through share links and team uploads through the team namespace.
+		// Both must look the same as missing ones.
+		if upload.Private || upload.TeamId != 0 {
+			route404(c)
+			return
+		}
+
+		renderUpload(c, hash, upload)
+	}
+	r.GET("/p/:hash", showUpload)
+	r.GET("/:hash", legacyUploadRoute(showUpload)) // Links from before /p/; see routes.go.
+
+	// View an upload through a signed share link. This is the only way to view private uploads.
+	r.GET("/share/:hash", func(c *gin.Context) {
+		hash := uploadParam(c)
+		upload, err := GetUpload(hash)
+		if err != nil || upload.Hash != hash { // Share links always carry the full hash.
+			route404(c)
+			return
+		}
+
+		if err = VerifyShareLink(upload, c.Query("sig"), c.Query("exp")); err != nil {
+			if err == ErrShareExpired {
+				respondError(c, http.StatusGone, err)
+			} else {
+				respondError(c, http.StatusForbidden, err)
+			}
+			return
+		}
+
+		renderUpload(c, upload.ShortHash(), upload)
+	})
+
+	// getOwnedUpload fetches the upload named by the :hash parameter and checks that the request comes from its owner.
+	// On failure an error has already been sent to the client and nil is returned.
+	getOwnedUpload := func(c *gin.Context) *UploadModel {
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return nil
+		}
+		if !upload.IsOwner(c) {
+			respondError(c, http.StatusForbidden, errors.New("a valid X-Edit-Token header is required"))
+			return nil
+		}
+		return upload
+	}
+
+	// Create a share link that expires after the "ttl" duration argument (24h by default).
+	r.POST("/api/v1/uploads/:hash/share", func(c *gin.Context) {
+		upload := getOwnedUpload(c)
+		if upload == nil {
+			return
+		}
+
+		ttl, err := parseShareTTL(c.Query("ttl"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		expires := time.Now().Add(ttl)
+		c.JSON(http.StatusOK, gin.H{
+			"url":        baseurl + ShareLink(upload, expires),
+			"expires_at": expires.UTC().Format(time.RFC3339),
+		})
+	})
+
+	// Revoke every share link of an upload by rotating its share secret.
+	r.POST("/api/v1/uploads/:hash/share/revoke", func(c *gin.Context) {
+		upload := getOwnedUpload(c)
+		if upload == nil {
+			return
+		}
+
+		if err := RotateShareSecret(upload.Hash); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Share links revoked",
 		})
 	})
 
 	// About page.
 	r.GET("/about", func(c *gin.Context) {
-		r.LoadHTMLFiles("templates/layout.html", "templates/about.html")
-		c.HTML(http.StatusOK, "about.html", gin.H{
+		renderPage(c, http.StatusOK, "about.html", gin.H{
 			"Page": NewPageInfo(c, "About"),
 		})
 	})
 
-	// Download attachment endpoint.
-	r.GET("/download", func(c *gin.Context) {
+	// serveAttachmentRange answers a Range request for an attachment, reading only the requested ranges from storage
+	// where it can.
+	serveAttachmentRange := func(c *gin.Context, hash string) {
+		file, contents, err := SeekFileObject(c.Request.Context(), hash)
+		if errors.Is(err, ErrObjectArchived) {
+			respondArchived(c, hash)
+			return
+		} else if err != nil {
+			route404(c)
+			return
+		}
+		defer contents.Close()
+
+		c.Writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+		c.Writer.Header().Set("ETag", `"`+hash+`"`)
+		setAttachmentCacheHeaders(c, hash)
+		// A download resumed in several requests is counted once, by the request for its start.
+		if c.Request.Method == http.MethodGet && strings.HasPrefix(c.GetHeader("Range"), "bytes=0-") {
+			recordAnalytics(c, analyticsDownload, hash)
+		}
+		throttleDownload(c)
+		http.ServeContent(c.Writer, c.Request, file.Filename, file.Modtime, contents)
+	}
+
+	// serveAttachment sends the attachment stored under hash to the client as a file download. The contents are copied
+	// to the client as they are read from storage, so a download holds no more than a small buffer of the file in memory.
+	serveAttachment := func(c *gin.Context, hash string) {
+		if !allowDownload(c, hash) {
+			respondError(c, http.StatusForbidden, ErrHotlink)
+			return
+		}
+		if !checkTakedown(c, hash) {
+			return
+		}
+		if redirectObjectAlias(c, hash) {
+			return
+		}
+		if !allowCountryDownload(c, hash) {
+			return
+		}
+		if !allowQuarantinedDownload(c, hash) || !allowInfectedDownload(c, hash) {
+			return
+		}
+		if !checkHooks(c, &HookPayload{Event: HookPreDownload, Object: hash}) {
+			return
+		}
+		if serveWatermarked(c, hash) {
+			return
+		}
+		// Byte ranges need a seekable reader of the file, which starts reading again wherever a range starts.
+		if c.GetHeader("Range") != "" {
+			serveAttachmentRange(c, hash)
+			return
+		}
+
+		file, contents, err := OpenFileObject(c.Request.Context(), hash)
+		if errors.Is(err, ErrObjectArchived) {
+			respondArchived(c, hash)
+			return
+		} else if err != nil {
+			route404(c)
+			return
+		}
+		defer contents.Close()
+
+		header := c.Writer.Header()
+		// Set the filename for the attachment. FormatMediaType takes care of quoting and non-ASCII names.
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+		// Objects are stored under the hash of their contents and never change, so the hash makes a strong ETag.
+		etag := `"` + hash + `"`
+		header.Set("ETag", etag)
+		header.Set("Last-Modified", file.Modtime.UTC().Format(http.TimeFormat))
+		setAttachmentCacheHeaders(c, hash)
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		contentType := file.ContentType()
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Length", strconv.FormatInt(file.Size, 10))
+		header.Set("Accept-Ranges", "bytes")
+		c.Status(http.StatusOK)
+		if c.Request.Method == http.MethodHead {
+			return
+		}
+		recordAnalytics(c, analyticsDownload, hash)
+		throttleDownload(c)
+		if _, err = io.Copy(c.Writer, contents); err != nil {
+			// The status has been sent already, so all that is left is to cut the response short.
+			log.Printf("Failed to send attachment %v: %v", hash, err)
+			c.Abort()
+		}
+	}
+
+	// Download attachment endpoint. The filename is only part of the path so that links and tools like wget see the
+	// real name of the file; the attachment is looked up by its hash alone.
+	downloadByPath := func(c *gin.Context) {
+		serveAttachment(c, c.Param("filehash"))
+	}
+	r.GET("/f/:filehash/:filename", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency), downloadByPath)
+	r.HEAD("/f/:filehash/:filename", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency), downloadByPath) // ServeContent omits the body for HEAD requests.
+
+	// Legacy download endpoint, kept as an alias so previously shared links keep working.
+	downloadByQuery := func(c *gin.Context) {
 		hash := c.Query("hash") // Client must request the full hash of the attachment stored on S3.
 		if hash == "" {
 			respondError(c, http.StatusBadRequest, errors.New(`"hash" argument required`))
+			return
+		}
+		serveAttachment(c, hash)
+	}
+	r.GET("/download", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency), downloadByQuery)
+	r.HEAD("/download", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency), downloadByQuery)
+
+	// Attachment metadata endpoint, so clients can check the size and type of a file before downloading it.
+	r.GET("/api/v1/files/:hash/meta", func(c *gin.Context) {
+		hash := c.Param("hash")
+		if hidden, err := hiddenAttachment(c, hash); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if hidden {
+			respondError(c, http.StatusNotFound, fmt.Errorf("attachment %v not found", hash))
+			return
+		}
+		// Only the start of the object is read, where its metadata is stored.
+		file, contents, err := OpenFileObject(c.Request.Context(), hash)
+		if errors.Is(err, ErrObjectArchived) {
+			respondArchived(c, hash)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusNotFound, fmt.Errorf("attachment %v not found", hash))
+			return
+		}
+		contents.Close()
+		scans, err := GetAttachmentScans(c.Request.Context(), []string{hash})
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
 		}
 
-		// Download the attachment object from S3 in parallel.
-		data, err := s3Actions.DownloadLargeObject(s3Bucket, hash)
-		if err != nil || len(data) == 0 {
-			route404(c)
+		c.JSON(http.StatusOK, gin.H{
+			"hash":         hash,
+			"filename":     file.Filename,
+			"size":         file.Size,
+			"content_type": file.ContentType(),
+			"modtime":      file.Modtime.UTC().Format(time.RFC3339),
+			"scan":         scanJSON(scans[hash]),
+		})
+	})
+
+	// Stream an audio or video attachment inline for the players on the submission page.
+	streamMedia := func(c *gin.Context) {
+		hash := c.Param("hash")
+		if !allowDownload(c, hash) {
+			respondError(c, http.StatusForbidden, ErrHotlink)
+			return
+		}
+		if !checkTakedown(c, hash) {
+			return
+		}
+		if !allowCountryDownload(c, hash) {
+			return
+		}
+		if !allowQuarantinedDownload(c, hash) || !allowInfectedDownload(c, hash) {
 			return
 		}
+		if !checkHooks(c, &HookPayload{Event: HookPreDownload, Object: hash}) {
+			return
+		}
+
+		// Players send a request for every byte range they seek to, so recently streamed objects are kept in memory.
+		file := mediaCache.Get(hash)
+		if file == nil {
+			var err error
+			if file, err = GetFileObject(hash); errors.Is(err, ErrObjectArchived) {
+				respondArchived(c, hash)
+				return
+			} else if err != nil {
+				route404(c)
+				return
+			}
+			mediaCache.Put(hash, file)
+		}
 
-		// We have to decode the gob data into a FileObject.
-		file := new(FileObject)
-		decoder := gob.NewDecoder(bytes.NewReader(data))
-		decoder.Decode(file)
+		// Only media is served inline; anything else could be rendered as a page on our own domain.
+		contentType := file.ContentType()
+		if mediaKind(contentType) == "" {
+			respondError(c, http.StatusUnsupportedMediaType, fmt.Errorf("attachment %v is not audio or video", hash))
+			return
+		}
 
-		// Set the filename for the attachment.
-		c.Writer.Header().Set("Content-Disposition", "attachment; filename="+file.Filename)
-		// Serve the attachment to the requesting client.
+		c.Writer.Header().Set("Content-Type", contentType)
+		c.Writer.Header().Set("Content-Disposition", "inline")
+		c.Writer.Header().Set("X-Content-Type-Options", "nosniff")
+		setAttachmentCacheHeaders(c, hash)
+		// ServeContent answers Range requests, which lets players seek without downloading the whole file.
+		throttleDownload(c)
 		http.ServeContent(c.Writer, c.Request, file.Filename, file.Modtime, bytes.NewReader(file.Contents))
+	}
+	r.GET("/stream/:hash", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency), streamMedia)
+	r.HEAD("/stream/:hash", meterUsage, rateLimit(PolicyDownload), limitConcurrency(downloadConcurrency), streamMedia)
+
+	// Report how much storage the requester has used: the logged in account, or the IP address of anonymous requests.
+	r.GET("/api/v1/me/quota", func(c *gin.Context) {
+		quota, err := GetQuota(c.ClientIP(), currentAccount(c), nil)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		response := gin.H{
+			"scope": quota.Scope,
+			"used":  quota.Used,
+			"limit": nil, // No limit.
+		}
+		if quota.Limit > 0 {
+			response["limit"] = quota.Limit
+			response["remaining"] = quota.Remaining()
+		}
+		c.JSON(http.StatusOK, response)
 	})
 
+	registerAccountRoutes(r)
+	registerTeamRoutes(r)
+	registerAdminRoutes(r)
+	registerDataRoutes(r)
+	registerDebugRoutes(r)
+	registerStatsRoutes(r)
+	registerTrashRoutes(r)
+	registerBatchRoutes(r)
+	registerStorageEventRoutes(r)
+	registerIntegrityRoutes(r)
+	registerClipRoutes(r)
+	registerClipChannelRoutes(r)
+	registerClipDeviceRoutes(r)
+	registerWebPushRoutes(r)
+	registerShareXRoutes(r)
+	registerDiscoveryRoutes(r)
+	registerFederationRoutes(r)
+	registerRobotsRoutes(r)
+	registerAnnouncementRoutes(r)
+	registerMaintenanceRoutes(r)
+	registerReloadRoutes(r)
+	registerDraftRoutes(r)
+	registerPasteTemplateRoutes(r)
+	registerLiveEditRoutes(r)
+	registerPrintRoutes(r)
+	registerExportRoutes(r)
+	registerTransferRoutes(r)
+	registerFavoriteRoutes(r)
+	registerRelatedRoutes(r)
+	registerVirusScanRoutes(r)
+	registerRawRoutes(r)
+	registerFileRoutes(r)
+	registerAttachmentEditRoutes(r)
+	registerBundleRoutes(r)
+	registerAccessibilityRoutes(r)
+	registerManifestRoutes(r)
+	registerCIRoutes(r)
+	registerAnalyticsRoutes(r)
+	registerGeoRoutes(r)
+	registerAccessCodeRoutes(r)
+	registerWatermarkRoutes(r)
+	registerDedupRoutes(r)
+	registerUsageRoutes(r)
+	registerPreflightRoutes(r)
+	registerBulkDeleteRoutes(r)
+	registerDLPRoutes(r)
+	registerTermsRoutes(r)
+	registerClaimRoutes(r)
+	registerTwoFactorRoutes(r)
+	registerSessionRoutes(r)
+	registerSAMLRoutes(r)
+	registerSCIMRoutes(r)
+
 	// Submit text and attachments endpoint.
-	r.POST("/submit", func(c *gin.Context) {
-		// It's easier to upload files using a multipart form in JavaScript.
-		form, _ := c.MultipartForm()
-		body := form.Value["body"][0]
+	r.POST("/submit", formPost, meterUsage, rateLimit(PolicySubmit), limitConcurrency(submitConcurrency), limitRequestBody(maxSubmitSize), idempotent, func(c *gin.Context) {
+		// It's easier to upload files using a multipart form in JavaScript. Browsers without it post the form of the
+		// index page as it is, URL-encoded when it has no files.
+		form, err := submittedForm(c)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondTooLarge(c, -1, maxSubmitSize)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusBadRequest, fmt.Errorf("invalid form: %v", err))
+			return
+		}
+		body := c.PostForm("body")
 		fileHeaders := form.File["files"]
+		keepMetadata := c.PostForm("keep_metadata") == "on"
+		account := currentAccount(c)
+		options := UploadOptions{
+			Private:    c.PostForm("private") == "on",
+			UploaderIP: c.ClientIP(),
+			Size:       int64(len(body)),
+		}
+		if account != nil {
+			options.AccountId = account.Id
+		}
+
+		// Uploads into a team are only allowed for its members.
+		var team *Team
+		if slug := c.PostForm("team"); slug != "" {
+			var role string
+			team, _ = GetTeam(slug)
+			if team != nil {
+				role, _ = team.Role(account)
+			}
+			if role == "" {
+				respondError(c, http.StatusForbidden, ErrNotTeamMember)
+				return
+			}
+			options.TeamId = team.Id
+		}
+		if publishAt := c.PostForm("publish_at"); publishAt != "" {
+			t, err := parseFormTime(publishAt)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, errors.New(`"publish_at" must be an RFC 3339 timestamp, or a date and time in UTC`))
+				return
+			}
+			options.PublishAt = t
+		}
+		if options.Language, err = parseLanguage(c.PostForm("language")); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		// Log dumps that are too long can keep their last lines instead of being refused.
+		keepLast, err := parseKeepLast(c.PostForm("keep_last_kb"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		// Reject uploads over the size limit or the quota before anything is stored.
+		var attachmentsSize int64
+		for _, fileHeader := range fileHeaders {
+			attachmentsSize += fileHeader.Size
+		}
+		if attachmentsSize > maxUploadSize {
+			respondTooLarge(c, attachmentsSize, maxUploadSize)
+			return
+		}
+		if !checkTerms(c, c.PostForm("accept_terms") == "on") {
+			return
+		}
+		body, truncated, ok := limitBodyLength(c, body, keepLast)
+		if !ok {
+			return
+		}
+		// Personal data is redacted before hooks or anything else see the text.
+		var redacted map[string]int
+		if c.PostForm("redact") == "on" {
+			body, redacted = redactBody(body)
+		}
+
+		// Hooks may refuse the upload, or change its text and privacy.
+		preSubmit := HookPayload{Event: HookPreSubmit, Body: body, Size: options.Size + attachmentsSize, Private: options.Private}
+		for _, fileHeader := range fileHeaders {
+			preSubmit.Files = append(preSubmit.Files, fileHeader.Filename)
+		}
+		if !checkHooks(c, &preSubmit) {
+			return
+		}
+		body, options.Private = preSubmit.Body, preSubmit.Private
+		options.Size = int64(len(body)) + attachmentsSize
+
+		quota, err := GetQuota(options.UploaderIP, account, team)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if err = quota.Check(options.Size); err != nil {
+			respondError(c, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+
+		// Clients may send the SHA-256 of each file, in the same order as the files, to detect corruption in transit.
+		clientChecksums := form.Value["sha256"]
+		if len(clientChecksums) != 0 && len(clientChecksums) != len(fileHeaders) {
+			respondError(c, http.StatusBadRequest, errors.New(`one "sha256" value is required per file, empty for files without one`))
+			return
+		}
+
+		// Credentials in the text or in text attachments are handled according to the secret scanning policy.
+		secrets := scanSecrets("", []byte(body))
 
 		fileNameHashPairs := make([]string, len(fileHeaders)) // Each item will look like "filename/hash" to easily store the pair in the database.
+		objects := make([][]byte, len(fileHeaders))
+		checksums := make([]string, len(fileHeaders)) // SHA-256 of the file contents as stored.
 		for i, fileHeader := range fileHeaders {
 			fileObject, err := NewFileObject(fileHeader, time.Now())
 			if err != nil {
 				respondError(c, http.StatusInternalServerError, fmt.Errorf("failed to open file %q: %v", fileHeader.Filename, err))
 				return
 			}
+			if len(clientChecksums) != 0 && clientChecksums[i] != "" && !strings.EqualFold(clientChecksums[i], sha256Hex(fileObject.Contents)) {
+				respondError(c, http.StatusBadRequest, fmt.Errorf("%q does not match its SHA-256, it was corrupted in transit", fileHeader.Filename))
+				return
+			}
 
-			// Encode the FileObject into a gob.
-			buffer := new(bytes.Buffer)
-			encoder := gob.NewEncoder(buffer)
-			encoder.Encode(fileObject)
-
-			// Hash the gob to use as the object key on S3 and for retrieving the upload in the database.
-			hash := fmt.Sprintf("%x", sha1.Sum(buffer.Bytes()))
+			secrets = append(secrets, scanSecrets(fileHeader.Filename, fileObject.Contents)...)
 
-			// Upload the file gob to S3 using the hash as the object key.
-			_, err = s3Actions.UploadObject(context.TODO(), s3Bucket, hash, buffer.Bytes())
+			fileNameHashPairs[i], objects[i], checksums[i], err = encodeAttachment(fileObject, stripMetadata.Load() && !keepMetadata, options.salted())
 			if err != nil {
-				respondError(c, http.StatusInternalServerError, fmt.Errorf("S3 object upload failed: %v", err))
+				respondError(c, http.StatusBadRequest, err)
 				return
 			}
+		}
+		if !checkSecrets(c, secrets, c.PostForm("confirm_secrets") == "on") {
+			return
+		}
 
-			fileNameHashPairs[i] = fmt.Sprintf("%s/%s", strings.TrimSpace(fileHeader.Filename), hash)
+		// Store the file gobs using their hashes as the object keys.
+		hash := UploadHash(body, fileNameHashPairs, options)
+		if err = storeAttachments(context.TODO(), hash, options.AccountId, fileNameHashPairs, objects, checksums); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
 		}
 
 		// Store the upload in the database.
-		hash, err := SubmitUpload(body, fileNameHashPairs)
+		editToken, existing, err := SubmitUpload(hash, body, fileNameHashPairs, options)
 		if err != nil {
 			respondError(c, http.StatusConflict, err)
 			return
 		}
+		notifyHooks(HookPayload{Event: HookPostSubmit, Hash: hash, Body: body, Files: preSubmit.Files, Size: options.Size,
+			Private: options.Private, AccountId: options.AccountId, IP: options.UploaderIP})
+
+		id := ShortHash(hash) // Only use a prefix of the hash to shorten the URL.
+		redirect := baseurl + uploadPath(id)
+		if team != nil {
+			redirect = fmt.Sprintf("%s/t/%s/%s", baseurl, team.Slug, id)
+		} else if options.Private {
+			// Private uploads have no public page, so send the submitter to a share link instead.
+			upload, err := GetUpload(hash)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			redirect = baseurl + ShareLink(upload, time.Now().Add(defaultShareTTL))
+		}
 
-		hash = hash[:10] // Only return the first 10 characters of the hash to shorten the URL.
+		claimToken := claimAnonymousUpload(c, hash, editToken)
 
-		c.JSON(http.StatusOK, gin.H{
-			"id":       hash,
-			"redirect": fmt.Sprintf("%s/%s", baseurl, hash),
+		response := gin.H{
+			"id":       id,
+			"redirect": redirect,
 			"message":  "Successfully uploaded",
-		})
+			"sha256":   checksums,
+		}
+		if editToken != "" {
+			// The token is only ever shown once; it is required to manage the upload later.
+			response["edit_token"] = editToken
+		}
+		describeDuplicate(response, existing)
+		describeNearDuplicate(response, hash)
+		if claimToken != "" {
+			response["claim_token"] = claimToken
+		}
+		if truncated != 0 {
+			response["truncated_bytes"] = truncated
+		}
+		if len(secrets) != 0 {
+			response["secrets"] = secrets
+		}
+		if redacted != nil {
+			response["redacted"] = redacted
+		}
+		if isFormPost(c) {
+			// The upload is claimed by the browser, so the edit token is not needed to manage it from there.
+			respondFormRedirect(c, redirect)
+			return
+		}
+		c.JSON(http.StatusOK, response)
 	})
 
+	reserveRegisteredRoutes(r)
 	r.Run() // Start the webserver.
 }
 
-func respondError(c *gin.Context, code int, err error) {
-	c.JSON(code, gin.H{
-		"message": err.Error(),
+// renderPage renders the named template from the templates folder inside of the layout. Templates of the theme take
+// precedence over the bundled ones.
+func renderPage(c *gin.Context, code int, name string, data gin.H) {
+	if wantsJSON(c) {
+		respondPageJSON(c, code, data)
+		return
+	}
+	router.LoadHTMLFiles(templatePath("layout.html"), templatePath(name))
+	c.HTML(code, name, data)
+}
+
+func route404(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		respondError(c, http.StatusNotFound, errors.New("no such API endpoint"))
+		return
+	} else if wantsJSON(c) {
+		respondError(c, http.StatusNotFound, errors.New("no such page"))
+		return
+	}
+	renderPage(c, http.StatusOK, "404.html", gin.H{
+		"Page": NewPageInfo(c, "404"),
 	})
-	log.Println("Error encountered serving request:", err.Error())
-	debug.PrintStack()
+}
+
+// renderUpload shows an upload on the submission page.
+// Uploads that were taken down show a tombstone, and embargoed uploads a placeholder with the time they unlock.
+// Quarantined uploads look missing to those who may not review them.
+func renderUpload(c *gin.Context, title string, upload *UploadModel) {
+	var share url.Values
+	if sig := c.Query("sig"); sig != "" {
+		share = url.Values{"sig": {sig}, "exp": {c.Query("exp")}}
+	}
+	renderSharedUpload(c, title, upload, share)
+}
+
+// renderSharedUpload renders an upload like renderUpload, for a viewer holding the sig and exp arguments of a share
+// link in share, if not nil, which the links to its other views carry along.
+func renderSharedUpload(c *gin.Context, title string, upload *UploadModel, share url.Values) {
+	if upload.hiddenByQuarantine(c) {
+		route404(c)
+		return
+	}
+	if wantsJSON(c) {
+		respondUploadJSON(c, upload)
+		return
+	}
+	if upload.TakedownAt != 0 {
+		renderPage(c, http.StatusUnavailableForLegalReasons, "tombstone.html", gin.H{
+			"Page":   NewPageInfo(c, title),
+			"Upload": upload,
+		})
+		return
+	}
+
+	if !upload.Published() {
+		renderPage(c, http.StatusNotFound, "embargo.html", gin.H{
+			"Page":      NewPageInfo(c, title),
+			"PublishAt": upload.PublishAt,
+		})
+		return
+	}
+
+	if !upload.allowsCountry(c) {
+		respondGeoBlocked(c)
+		return
+	}
+
+	missing, err := upload.MissingObjects()
+	if err != nil {
+		log.Printf("failed to check for missing attachments of %v: %v", upload.Hash, err)
+	}
+	// Viewers of a share link print, export, download and read the raw body through the same link.
+	path := uploadPath(upload.ShortHash())
+	printURL, pdfURL, exportURL, rawURL := path+"/print", path+".pdf", path+"/export.html", path+"/raw"
+	bundleURL := path + "/bundle.tar.gz"
+	if share != nil {
+		query := "?" + share.Encode()
+		path = uploadPath(upload.Hash)
+		printURL, pdfURL, exportURL = path+"/print"+query, path+".pdf"+query, path+"/export.html"+query
+		rawURL, bundleURL = path+"/raw"+query, path+"/bundle.tar.gz"+query
+	}
+	recordView(c, upload)
+	renderPage(c, http.StatusOK, "submission.html", gin.H{
+		"Page":      NewPageInfo(c, title),
+		"Upload":    upload, // The row is passed to the template.
+		"Missing":   missing,
+		"PrintURL":  printURL,
+		"ExportURL": exportURL,
+		"RawURL":    rawURL,
+		"BundleURL": bundleURL,
+		"PDFURL":    pdfURL,
+		"Analytics": ownerAnalytics(c, upload),
+		"Transfer":  transferForm(c, upload),
+		"Favorite":  favoriteButton(c, upload),
+		"Related":   relatedList(c, upload),
+		"Original":  nearDuplicateOf(c, upload),
+		"PushKey":   vapidPublicKey,
+	})
+}
+
+// describeDuplicate tells the submitter of an upload that already existed, adding its full hash and the time it was
+// first uploaded to a response. Nothing is added for new uploads, when existing is nil.
+func describeDuplicate(response gin.H, existing *UploadModel) {
+	if existing == nil {
+		return
+	}
+	response["deduplicated"] = true
+	response["hash"] = existing.Hash
+	response["created_at"] = time.Unix(existing.Timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+// mediaKind returns "video" or "audio" for MIME types that browsers can play inline, or an empty string otherwise.
+func mediaKind(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "video/"):
+		return "video"
+	case strings.HasPrefix(mediaType, "audio/"):
+		return "audio"
+	}
+	return ""
 }
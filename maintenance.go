@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// In maintenance mode the site is read-only: uploads stay viewable, but submissions and every other change are refused
+// with a banner explaining why, so that the database can be migrated or the bucket moved safely. It is turned on and
+// off by admins through the API, which reaches every replica, or for a single server with SIGUSR1 and SIGUSR2.
+
+// maintenanceChannel is the Postgres channel on which replicas tell each other to enter or leave maintenance mode.
+const maintenanceChannel = "copycat_maintenance"
+
+// defaultMaintenanceMessage is shown during maintenance when no other message is given.
+const defaultMaintenanceMessage = "Uploads are paused for maintenance. Existing uploads can still be viewed; please try again later."
+
+// maintenanceRetryAfter is the Retry-After sent with refused requests.
+const maintenanceRetryAfter = 5 * time.Minute
+
+// maintenanceMessage holds the message shown during maintenance, or nil when the site is not in maintenance.
+var maintenanceMessage atomic.Pointer[string]
+
+// maintenanceExempt are the paths that may still be posted to during maintenance, so that admins can log in to end it.
+var maintenanceExempt = []string{"/login", "/logout", "/saml/", "/api/v1/admin/maintenance"}
+
+func initMaintenance() {
+	// Servers started during maintenance, such as new replicas, can start in it.
+	if envBool("MAINTENANCE_MODE") {
+		setMaintenance(true, os.Getenv("MAINTENANCE_MESSAGE"))
+	}
+
+	notifyMaintenanceSignals()
+
+	listener := pq.NewListener(dbConnStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("maintenance listener: %v", err)
+		}
+	})
+	if err := listener.Listen(maintenanceChannel); err != nil {
+		log.Fatal("failed to listen for maintenance mode changes: ", err)
+	}
+	go func() {
+		for notification := range listener.Notify {
+			if notification == nil {
+				continue // A change missed while reconnecting is not resent; admins can set the mode again.
+			}
+			state, message, _ := strings.Cut(notification.Extra, "\n")
+			setMaintenance(state == "on", message)
+		}
+	}()
+}
+
+// setMaintenance enters or leaves maintenance mode on this server. An empty message shows the default one.
+func setMaintenance(on bool, message string) {
+	if !on {
+		if maintenanceMessage.Swap(nil) != nil {
+			log.Println("Left maintenance mode")
+		}
+		return
+	}
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	if maintenanceMessage.Swap(&message) == nil {
+		log.Println("Entered maintenance mode")
+	}
+}
+
+// broadcastMaintenance enters or leaves maintenance mode on every replica.
+func broadcastMaintenance(on bool, message string) error {
+	setMaintenance(on, message)
+	payload := "off"
+	if on {
+		payload = "on\n" + message
+	}
+	_, err := db.Exec("SELECT pg_notify($1, $2)", maintenanceChannel, payload)
+	return err
+}
+
+// maintenanceBanner returns the message to show on every page during maintenance, translated for the request, or "".
+func maintenanceBanner(c *gin.Context) string {
+	message := maintenanceMessage.Load()
+	if message == nil {
+		return ""
+	}
+	return translate(requestLanguage(c), *message)
+}
+
+// readOnlyDuringMaintenance is a middleware that refuses requests that could change anything during maintenance,
+// answering 503 with a Retry-After header.
+func readOnlyDuringMaintenance(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	banner := maintenanceBanner(c)
+	if banner == "" {
+		c.Next()
+		return
+	}
+	for _, path := range maintenanceExempt {
+		if c.Request.URL.Path == path || strings.HasSuffix(path, "/") && strings.HasPrefix(c.Request.URL.Path, path) {
+			c.Next()
+			return
+		}
+	}
+	// The body is not read, so the connection cannot be reused.
+	c.Header("Connection", "close")
+	c.Header("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+	abortWithError(c, http.StatusServiceUnavailable, &codedError{"maintenance", banner}, nil)
+}
+
+func registerMaintenanceRoutes(r *gin.Engine) {
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	admin.GET("/maintenance", func(c *gin.Context) {
+		message := maintenanceMessage.Load()
+		status := gin.H{
+			"maintenance": message != nil,
+		}
+		if message != nil {
+			status["message"] = *message
+		}
+		c.JSON(http.StatusOK, status)
+	})
+
+	// Enter maintenance mode on every replica, with an optional "message" to show instead of the default one.
+	admin.PUT("/maintenance", func(c *gin.Context) {
+		message := strings.TrimSpace(c.PostForm("message"))
+		if err := broadcastMaintenance(true, message); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(currentAccount(c).Username, "maintenance.enter", "", message, c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Maintenance mode entered",
+		})
+	})
+
+	admin.DELETE("/maintenance", func(c *gin.Context) {
+		if err := broadcastMaintenance(false, ""); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(currentAccount(c).Username, "maintenance.leave", "", "", c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Maintenance mode left",
+		})
+	})
+}
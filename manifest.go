@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A Manifest lists the checksums of an upload, so that recipients can verify what they downloaded and pipelines can
+// refer to an upload by exactly what it contained. The signature is an HMAC of the other fields made with the server's
+// signing key, like the signature of an ErasureReceipt, so a manifest can be checked later with VerifyManifest.
+type Manifest struct {
+	Hash       string         `json:"hash"`
+	Timestamp  string         `json:"timestamp"`
+	BodySHA256 string         `json:"body_sha256"`
+	Files      []ManifestFile `json:"files"`
+	IssuedAt   string         `json:"issued_at"`
+	Signature  string         `json:"signature"`
+}
+
+// A ManifestFile is an attachment in a Manifest. Its size and checksum are those of the file as downloaded.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func (m *Manifest) sign() string {
+	unsigned := *m
+	unsigned.Signature = ""
+	payload, _ := json.Marshal(unsigned)
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("manifest\n"))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyManifest reports whether a manifest was issued by this server and has not been altered.
+func VerifyManifest(m *Manifest) bool {
+	return hmac.Equal([]byte(m.Signature), []byte(m.sign()))
+}
+
+// NewManifest lists the checksums of an upload and signs them.
+func NewManifest(ctx context.Context, upload *UploadModel) (*Manifest, error) {
+	manifest := &Manifest{
+		Hash:       upload.Hash,
+		Timestamp:  time.Unix(upload.Timestamp, 0).UTC().Format(time.RFC3339),
+		BodySHA256: sha256Hex([]byte(upload.Body)),
+		Files:      make([]ManifestFile, len(upload.FileNames)),
+	}
+	for i, name := range upload.FileNames {
+		file, checksum, err := attachmentChecksum(ctx, upload.FileHashes[i])
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files[i] = ManifestFile{Name: name, Size: file.Size, SHA256: checksum}
+	}
+	manifest.IssuedAt = time.Now().UTC().Format(time.RFC3339)
+	manifest.Signature = manifest.sign()
+	return manifest, nil
+}
+
+// attachmentChecksum returns the metadata and the SHA-256 of the contents of an attachment. The checksum recorded when
+// the attachment was stored is used when there is one; older attachments are read to compute it.
+func attachmentChecksum(ctx context.Context, hash string) (*FileObject, string, error) {
+	var recorded string
+	err := db.QueryRowContext(ctx, "SELECT content_sha256 FROM Objects WHERE key = $1", hash).Scan(&recorded)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, "", err
+	}
+
+	file, contents, err := OpenFileObject(ctx, hash)
+	if err != nil {
+		return nil, "", err
+	}
+	defer contents.Close()
+	if recorded != "" {
+		return file, recorded, nil
+	}
+	digest := sha256.New()
+	if _, err = io.Copy(digest, contents); err != nil {
+		return nil, "", fmt.Errorf("failed to read attachment %v: %v", hash, err)
+	}
+	return file, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// sharedUpload returns the upload with the hash for an API request that may read it, directly or through a share link,
+// or nil after responding with an error.
+func sharedUpload(c *gin.Context, hash string) *UploadModel {
+	upload, err := GetUpload(hash)
+	if err != nil {
+		respondError(c, http.StatusNotFound, ErrUploadNotFound)
+		return nil
+	}
+	ok, err := upload.canView(c)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil
+	}
+	if !ok {
+		ok = upload.canViewShared(c, hash)
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, ErrUploadNotFound)
+		return nil
+	}
+	if upload.TakedownAt != 0 {
+		respondError(c, http.StatusUnavailableForLegalReasons, errors.New("this upload has been taken down"))
+		return nil
+	}
+	return upload
+}
+
+func registerManifestRoutes(r *gin.Engine) {
+	// Fetch the signed manifest of an upload. Whoever can read the upload through the API or a share link can fetch it.
+	r.GET("/api/v1/uploads/:hash/manifest", func(c *gin.Context) {
+		upload := sharedUpload(c, uploadParam(c))
+		if upload == nil {
+			return
+		}
+
+		manifest, err := NewManifest(c.Request.Context(), upload)
+		if errors.Is(err, ErrObjectArchived) {
+			respondError(c, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, manifest)
+	})
+
+	// Check that a manifest was issued by this server.
+	r.POST("/api/v1/manifests/verify", func(c *gin.Context) {
+		manifest := new(Manifest)
+		if err := c.ShouldBindJSON(manifest); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"valid": VerifyManifest(manifest),
+		})
+	})
+}
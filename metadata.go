@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMalformedImage = errors.New("image data is malformed")
+
+var (
+	jpegSignature = []byte{0xFF, 0xD8}
+	pngSignature  = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+)
+
+// StripMetadata removes EXIF, XMP and other descriptive metadata (GPS coordinates, camera serial numbers, timestamps)
+// from JPEG, PNG and HEIC images. The image data itself is never re-encoded. Contents that are not a supported image
+// format are returned unchanged with stripped set to false.
+func StripMetadata(contents []byte) (result []byte, stripped bool, err error) {
+	switch {
+	case bytes.HasPrefix(contents, jpegSignature):
+		result, err = stripJPEG(contents)
+	case bytes.HasPrefix(contents, pngSignature):
+		result, err = stripPNG(contents)
+	case isHEIF(contents):
+		result, err = stripHEIF(contents)
+	default:
+		return contents, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+// stripJPEG copies every segment of a JPEG except the APP1 (EXIF/XMP) and APP13 (Photoshop/IPTC) segments.
+// Once the start of scan marker is reached the remaining entropy-coded data is copied as-is.
+func stripJPEG(contents []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(contents)))
+	out.Write(jpegSignature)
+
+	i := len(jpegSignature)
+	for {
+		if i+4 > len(contents) || contents[i] != 0xFF {
+			return nil, ErrMalformedImage
+		}
+		marker := contents[i+1]
+		if marker == 0xFF { // Fill bytes may pad between segments.
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // Start of scan or end of image.
+			out.Write(contents[i:])
+			return out.Bytes(), nil
+		}
+
+		// The segment length includes the two length bytes but not the marker.
+		length := int(binary.BigEndian.Uint16(contents[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(contents) {
+			return nil, ErrMalformedImage
+		}
+		if marker != 0xE1 && marker != 0xED {
+			out.Write(contents[i:end])
+		}
+		i = end
+	}
+}
+
+// pngMetadataChunks are the ancillary PNG chunks that carry EXIF data, free-form text or a modification time.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNG copies every chunk of a PNG except the ones listed in pngMetadataChunks.
+func stripPNG(contents []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(contents)))
+	out.Write(pngSignature)
+
+	i := len(pngSignature)
+	for i < len(contents) {
+		if i+8 > len(contents) {
+			return nil, ErrMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(contents[i:]))
+		chunkType := string(contents[i+4 : i+8])
+		end := i + 12 + length // Length, type, data and CRC.
+		if length < 0 || end > len(contents) {
+			return nil, ErrMalformedImage
+		}
+		if !pngMetadataChunks[chunkType] {
+			out.Write(contents[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// heifBox is an ISO base media file format box. The data slice excludes the box header.
+type heifBox struct {
+	Type   string
+	Data   []byte
+	Offset int // Offset of Data relative to the slice the box was read from.
+}
+
+// readHEIFBoxes splits a byte slice into the sequence of boxes it contains.
+func readHEIFBoxes(data []byte) ([]heifBox, error) {
+	var boxes []heifBox
+	for i := 0; i < len(data); {
+		if i+8 > len(data) {
+			return nil, ErrMalformedImage
+		}
+		size := uint64(binary.BigEndian.Uint32(data[i:]))
+		boxType := string(data[i+4 : i+8])
+		header := uint64(8)
+		switch size {
+		case 0: // The box extends to the end of the data.
+			size = uint64(len(data) - i)
+		case 1: // A 64-bit size follows the type.
+			if i+16 > len(data) {
+				return nil, ErrMalformedImage
+			}
+			size = binary.BigEndian.Uint64(data[i+8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)-i) {
+			return nil, ErrMalformedImage
+		}
+		boxes = append(boxes, heifBox{
+			Type:   boxType,
+			Data:   data[i+int(header) : i+int(size)],
+			Offset: i + int(header),
+		})
+		i += int(size)
+	}
+	return boxes, nil
+}
+
+// isHEIF reports whether contents begins with an ftyp box naming a HEIF/HEIC brand.
+func isHEIF(contents []byte) bool {
+	if len(contents) < 12 || string(contents[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(contents[8:12]) {
+	case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+// heifReader reads big-endian integers of variable width from a box payload.
+type heifReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *heifReader) uint(size int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if size < 0 || r.pos+size > len(r.data) {
+		r.err = ErrMalformedImage
+		return 0
+	}
+	var v uint64
+	for _, b := range r.data[r.pos : r.pos+size] {
+		v = v<<8 | uint64(b)
+	}
+	r.pos += size
+	return v
+}
+
+func (r *heifReader) fourCC() string {
+	if r.err != nil || r.pos+4 > len(r.data) {
+		r.err = ErrMalformedImage
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+4])
+	r.pos += 4
+	return s
+}
+
+// stripHEIF overwrites the payload of every Exif item in a HEIF/HEIC file with zeros. Rewriting the file without those
+// items would require relocating every item offset in the iloc box, so the layout of the file is left untouched.
+func stripHEIF(contents []byte) ([]byte, error) {
+	result := bytes.Clone(contents)
+
+	top, err := readHEIFBoxes(result)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta *heifBox
+	for i := range top {
+		if top[i].Type == "meta" {
+			meta = &top[i]
+		}
+	}
+	if meta == nil || len(meta.Data) < 4 {
+		return nil, ErrMalformedImage
+	}
+	children, err := readHEIFBoxes(meta.Data[4:]) // Skip the full box version and flags.
+	if err != nil {
+		return nil, err
+	}
+
+	var iinf, iloc, idat *heifBox
+	for i := range children {
+		switch children[i].Type {
+		case "iinf":
+			iinf = &children[i]
+		case "iloc":
+			iloc = &children[i]
+		case "idat":
+			idat = &children[i]
+		}
+	}
+	if iinf == nil || iloc == nil {
+		return result, nil // No item information means there are no Exif items to strip.
+	}
+
+	exifItems, err := heifExifItems(iinf.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(exifItems) == 0 {
+		return result, nil
+	}
+
+	// Absolute offset of the idat payload, for items stored with construction method 1.
+	idatOffset := -1
+	if idat != nil {
+		idatOffset = meta.Offset + 4 + idat.Offset
+	}
+
+	r := &heifReader{data: iloc.Data}
+	version := r.uint(1)
+	r.uint(3) // Flags.
+	sizes := r.uint(2)
+	offsetSize, lengthSize := int(sizes>>12&0xF), int(sizes>>8&0xF)
+	baseOffsetSize, indexSize := int(sizes>>4&0xF), int(sizes&0xF)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	var itemCount uint64
+	if version < 2 {
+		itemCount = r.uint(2)
+	} else {
+		itemCount = r.uint(4)
+	}
+	for n := uint64(0); n < itemCount && r.err == nil; n++ {
+		var itemID uint64
+		if version < 2 {
+			itemID = r.uint(2)
+		} else {
+			itemID = r.uint(4)
+		}
+		constructionMethod := uint64(0)
+		if version == 1 || version == 2 {
+			constructionMethod = r.uint(2) & 0xF
+		}
+		r.uint(2) // Data reference index.
+		baseOffset := r.uint(baseOffsetSize)
+		extentCount := r.uint(2)
+		for e := uint64(0); e < extentCount && r.err == nil; e++ {
+			r.uint(indexSize)
+			extentOffset := r.uint(offsetSize)
+			extentLength := r.uint(lengthSize)
+			if r.err != nil || !exifItems[itemID] {
+				continue
+			}
+
+			start := baseOffset + extentOffset
+			switch constructionMethod {
+			case 0: // Offsets are relative to the start of the file.
+			case 1: // Offsets are relative to the idat box payload.
+				if idatOffset < 0 {
+					return nil, ErrMalformedImage
+				}
+				start += uint64(idatOffset)
+			default:
+				continue // Items constructed from other items carry no bytes of their own.
+			}
+			end := start + extentLength
+			if extentLength == 0 { // A zero length extent runs to the end of the file.
+				end = uint64(len(result))
+			}
+			if start > end || end > uint64(len(result)) {
+				return nil, ErrMalformedImage
+			}
+			clear(result[start:end])
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return result, nil
+}
+
+// heifExifItems returns the set of item IDs in an iinf box payload whose item type is Exif.
+func heifExifItems(iinf []byte) (map[uint64]bool, error) {
+	r := &heifReader{data: iinf}
+	version := r.uint(1)
+	r.uint(3) // Flags.
+	if version == 0 {
+		r.uint(2) // Entry count.
+	} else {
+		r.uint(4)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	entries, err := readHEIFBoxes(iinf[r.pos:])
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[uint64]bool)
+	for _, entry := range entries {
+		if entry.Type != "infe" {
+			continue
+		}
+		er := &heifReader{data: entry.Data}
+		infeVersion := er.uint(1)
+		er.uint(3) // Flags.
+		if infeVersion < 2 {
+			continue // Versions before 2 do not carry an item type.
+		}
+		var itemID uint64
+		if infeVersion == 2 {
+			itemID = er.uint(2)
+		} else {
+			itemID = er.uint(4)
+		}
+		er.uint(2) // Item protection index.
+		itemType := er.fourCC()
+		if er.err != nil {
+			return nil, er.err
+		}
+		if itemType == "Exif" {
+			items[itemID] = true
+		}
+	}
+	return items, nil
+}
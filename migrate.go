@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// MigrationStats summarize a storage migration.
+type MigrationStats struct {
+	Copied   int
+	Skipped  int      // Already in the destination according to the Objects table, from an earlier interrupted run.
+	Missing  []string // Referenced by an upload but not found in the source.
+	Archived []string // Archived in the source, and left to copy once their retrieval, which was started, finishes.
+}
+
+// referencedObjects returns the keys of every object referenced by an upload, including uploads in the trash and the
+// objects holding bodies.
+func referencedObjects(ctx context.Context) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT f FROM Uploads, unnest(files) AS f UNION SELECT body_key FROM Uploads WHERE body_key <> ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	var keys []string
+	for rows.Next() {
+		var pair string
+		if err = rows.Scan(&pair); err != nil {
+			return nil, err
+		}
+		if key := fileKey(pair); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, rows.Err()
+}
+
+// objectStoredIn reports whether the Objects table records key as copied to store.
+func objectStoredIn(ctx context.Context, key string, store ObjectStore) (bool, error) {
+	var current string
+	err := db.QueryRowContext(ctx, "SELECT store FROM Objects WHERE key = $1", key).Scan(&current)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return current == store.String(), err
+}
+
+// recordObject records in the Objects table that key is stored in store with the given checksum of the object, and
+// the checksum of the file contents inside it. An empty contentChecksum keeps the one recorded before.
+func recordObject(ctx context.Context, key string, store ObjectStore, checksum string, size int, contentChecksum string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO Objects(key, store, sha256, size, updated, content_sha256) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET store = excluded.store, sha256 = excluded.sha256, size = excluded.size, updated = excluded.updated,
+			content_sha256 = CASE WHEN excluded.content_sha256 <> '' THEN excluded.content_sha256 ELSE Objects.content_sha256 END`,
+		key, store.String(), checksum, size, time.Now().UTC().Unix(), contentChecksum)
+	return err
+}
+
+// MigrateStorage copies every object referenced by an upload from one store to another. Each copy is read back from
+// the destination and its SHA-256 compared with the source before it is recorded in the Objects table, and objects
+// recorded as copied are skipped, so an interrupted migration resumes where it stopped. The source is left as is.
+func MigrateStorage(ctx context.Context, from, to ObjectStore) (*MigrationStats, error) {
+	keys, err := referencedObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := new(MigrationStats)
+	for i, key := range keys {
+		done, err := objectStoredIn(ctx, key, to)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			stats.Skipped++
+			continue
+		}
+
+		exists, err := from.Exists(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			log.Printf("Object %s is missing from %v", key, from)
+			stats.Missing = append(stats.Missing, key)
+			continue
+		}
+		data, err := from.Get(ctx, key)
+		if errors.Is(err, ErrObjectArchived) {
+			if err = retrieveArchived(ctx, from, key); err != nil {
+				return nil, err
+			}
+			stats.Archived = append(stats.Archived, key)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+
+		if err = to.Put(ctx, key, data, nil); err != nil {
+			return nil, fmt.Errorf("failed to copy %v: %v", key, err)
+		}
+		copied, err := to.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read back %v: %v", key, err)
+		}
+		if copiedSum := sha256.Sum256(copied); !bytes.Equal(sum[:], copiedSum[:]) {
+			return nil, fmt.Errorf("checksum mismatch after copying %v", key)
+		}
+
+		if err = recordObject(ctx, key, to, hex.EncodeToString(sum[:]), len(data), ""); err != nil {
+			return nil, err
+		}
+		stats.Copied++
+		log.Printf("Copied %s (%d/%d)", key, i+1, len(keys))
+	}
+	return stats, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A new upload whose body is almost the same as an existing one, such as a stack trace that was reported before, is
+// linked to the existing upload on its page and in the response to its submission, so that a team gathers around one
+// canonical upload instead of many copies. Team uploads are compared with the other uploads of their team, and public
+// uploads with the other public ones, whose text the submitter already has nearly all of; private uploads are never
+// compared. Uploads linked to another are not linked to in turn, so every near duplicate points to the first upload.
+
+// nearDuplicateSimilarity is the estimated share of shingles a body needs in common with another to be linked to it.
+const nearDuplicateSimilarity = 0.9
+
+// LinkNearDuplicate links a new upload to the existing upload it is almost the same as, if there is one, and returns
+// the hash of that upload or "".
+func LinkNearDuplicate(ctx context.Context, hash, body string, options UploadOptions) (string, error) {
+	var scope string
+	var args []any
+	switch {
+	case options.TeamId != 0:
+		scope, args = "team_id = $4 AND duplicate_of = ''", []any{options.TeamId}
+	case options.Private:
+		return "", nil
+	default:
+		scope = "NOT private AND team_id = 0 AND publish_at <= $3 AND quarantined_at = 0 AND duplicate_of = ''"
+	}
+	alike, err := alikeUploads(ctx, hash, relatedSignature(body), nearDuplicateSimilarity, scope, args...)
+	if err != nil || len(alike) == 0 {
+		return "", err
+	}
+	original := alike[0].hash
+	if _, err = db.ExecContext(ctx, "UPDATE Uploads SET duplicate_of = $1 WHERE hash = $2", original, hash); err != nil {
+		return "", err
+	}
+	invalidateUpload(hash)
+	return original, nil
+}
+
+// linkNearDuplicate links a new upload to the upload it is almost the same as, logging failures, which only cost the
+// link.
+func linkNearDuplicate(hash, body string, options UploadOptions) {
+	if _, err := LinkNearDuplicate(context.Background(), hash, body, options); err != nil {
+		log.Printf("failed to look for near duplicates of upload %v: %v", hash, err)
+	}
+}
+
+// nearDuplicateOf returns the upload an upload is almost the same as, if it has one that the request may view.
+func nearDuplicateOf(c *gin.Context, upload *UploadModel) *linkedUpload {
+	if upload.DuplicateOf == "" {
+		return nil
+	}
+	original, err := GetUpload(upload.DuplicateOf)
+	if err != nil {
+		return nil
+	}
+	if list := visibleUploadList(c, []*UploadModel{original}); len(list) != 0 {
+		return &list[0]
+	}
+	return nil
+}
+
+// nearDuplicateOriginal returns the upload that the upload with the hash is almost the same as, or nil.
+func nearDuplicateOriginal(hash string) *UploadModel {
+	upload, err := GetUpload(hash)
+	if err != nil || upload.DuplicateOf == "" {
+		return nil
+	}
+	original, err := GetUpload(upload.DuplicateOf)
+	if err != nil {
+		return nil
+	}
+	return original
+}
+
+// describeNearDuplicate tells the submitter of a new upload which upload it is almost the same as, adding its hash and
+// link to a response.
+func describeNearDuplicate(response gin.H, hash string) {
+	original := nearDuplicateOriginal(hash)
+	if original == nil {
+		return
+	}
+	response["duplicate_of"] = gin.H{
+		"hash": original.Hash,
+		"url":  uploadLocation(original),
+	}
+}
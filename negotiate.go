@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API clients that send "Accept: application/json" never get HTML: pages answer with the JSON error of their status,
+// upload pages with the upload as the API describes it, and pages with nothing to describe with a 406. Browsers list
+// text/html first, or nothing in particular, so they keep getting the pages.
+
+var ErrNoJSON = errors.New("this page has no JSON representation, use the API at /api/v1 instead")
+
+// wantsJSON reports whether the client of a request prefers JSON to HTML, and marks the response as depending on the
+// Accept header so that caches keep both.
+func wantsJSON(c *gin.Context) bool {
+	if !strings.Contains(c.Writer.Header().Get("Vary"), "Accept") {
+		c.Writer.Header().Add("Vary", "Accept")
+	}
+	return c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON
+}
+
+// respondPageJSON answers a page for a JSON client: with the error of the page, which is its "Error" message when it
+// has one, or with ErrNoJSON when the page is not an error.
+func respondPageJSON(c *gin.Context, code int, data gin.H) {
+	if code < http.StatusBadRequest {
+		writeError(c, http.StatusNotAcceptable, errorBody(c, http.StatusNotAcceptable, ErrNoJSON, nil))
+		return
+	}
+	message, _ := data["Error"].(string)
+	if message == "" {
+		message = strings.ToLower(http.StatusText(code))
+	}
+	writeError(c, code, errorBody(c, code, errors.New(message), nil))
+}
+
+// respondUploadJSON answers an upload page for a JSON client, with the errors of the placeholders the page would show.
+func respondUploadJSON(c *gin.Context, upload *UploadModel) {
+	switch {
+	case upload.TakedownAt != 0:
+		respondError(c, http.StatusUnavailableForLegalReasons, errors.New("this upload has been taken down"))
+	case !upload.Published():
+		writeError(c, http.StatusNotFound, errorBody(c, http.StatusNotFound, ErrUploadNotFound, gin.H{
+			"publish_at": time.Unix(upload.PublishAt, 0).UTC().Format(time.RFC3339),
+		}))
+	case !upload.allowsCountry(c):
+		respondGeoBlocked(c)
+	default:
+		recordView(c, upload)
+		c.JSON(http.StatusOK, uploadJSON(upload))
+	}
+}
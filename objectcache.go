@@ -0,0 +1,91 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// An ObjectCache keeps recently downloaded FileObjects in memory, evicting the least recently used objects once the
+// total size of their contents exceeds the capacity. Media players request many small byte ranges of the same file
+// while seeking, and without the cache every one of those requests would download the whole object from S3 again.
+type ObjectCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List // Front is the most recently used.
+	items    map[string]*list.Element
+}
+
+type objectCacheEntry struct {
+	key    string
+	object *FileObject
+}
+
+// NewObjectCache creates an ObjectCache holding at most capacity bytes of file contents.
+func NewObjectCache(capacity int64) *ObjectCache {
+	return &ObjectCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached object for key, or nil if it is not cached.
+func (oc *ObjectCache) Get(key string) *FileObject {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	element, ok := oc.items[key]
+	if !ok {
+		return nil
+	}
+	oc.order.MoveToFront(element)
+	return element.Value.(*objectCacheEntry).object
+}
+
+// Put adds an object to the cache. Objects larger than the whole capacity are not cached.
+func (oc *ObjectCache) Put(key string, object *FileObject) {
+	size := int64(len(object.Contents))
+	if size > oc.capacity {
+		return
+	}
+
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	if element, ok := oc.items[key]; ok {
+		oc.order.MoveToFront(element)
+		return
+	}
+	oc.items[key] = oc.order.PushFront(&objectCacheEntry{key: key, object: object})
+	oc.size += size
+
+	for oc.size > oc.capacity {
+		oldest := oc.order.Back()
+		entry := oc.order.Remove(oldest).(*objectCacheEntry)
+		delete(oc.items, entry.key)
+		oc.size -= int64(len(entry.object.Contents))
+	}
+}
+
+// Remove drops the objects under keys from the cache, so that attachments that are deleted or hidden are not streamed
+// from memory anymore.
+func (oc *ObjectCache) Remove(keys ...string) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := oc.items[key]; ok {
+			entry := oc.order.Remove(element).(*objectCacheEntry)
+			delete(oc.items, key)
+			oc.size -= int64(len(entry.object.Contents))
+		}
+	}
+}
+
+// Stats returns the number of cached objects and the bytes they use.
+func (oc *ObjectCache) Stats() (objects int, bytes int64) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	return len(oc.items), oc.size
+}
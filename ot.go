@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf16"
+)
+
+// A TextOperation is a change to a text, as sent by the live editor: a sequence of components that together walk over
+// the whole text, each retaining, inserting or deleting characters. In JSON, a positive number retains that many
+// characters, a negative one deletes that many, and a string is inserted, as in [5, "hello", -3, 2]. Lengths and
+// positions are counted in UTF-16 code units, as in JavaScript strings, so texts are handled as []uint16.
+//
+// Operations on the same text made concurrently are combined by transformTextOperations, so that everyone editing it
+// ends up with the same text no matter in which order they see the changes.
+type TextOperation struct {
+	components   []textComponent
+	baseLength   int // The length of the texts the operation applies to.
+	targetLength int // The length of the texts it results in.
+}
+
+// A textComponent retains n characters when n > 0, deletes -n characters when n < 0, and otherwise inserts s.
+type textComponent struct {
+	n int
+	s []uint16
+}
+
+func (c textComponent) isRetain() bool { return c.n > 0 }
+func (c textComponent) isDelete() bool { return c.n < 0 }
+func (c textComponent) isInsert() bool { return c.n == 0 }
+
+var (
+	ErrOperationLength    = errors.New("the operation does not match the length of the text")
+	ErrOperationMalformed = errors.New("an operation must be a list of non-zero whole numbers and non-empty strings")
+)
+
+func (op *TextOperation) last() *textComponent {
+	if len(op.components) == 0 {
+		return nil
+	}
+	return &op.components[len(op.components)-1]
+}
+
+func (op *TextOperation) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	op.baseLength += n
+	op.targetLength += n
+	if last := op.last(); last != nil && last.isRetain() {
+		last.n += n
+	} else {
+		op.components = append(op.components, textComponent{n: n})
+	}
+}
+
+// insert adds an insertion. Insertions are kept before deletions at the same position, so that equal operations
+// always have the same components.
+func (op *TextOperation) insert(s []uint16) {
+	if len(s) == 0 {
+		return
+	}
+	op.targetLength += len(s)
+	last := op.last()
+	switch {
+	case last != nil && last.isInsert():
+		last.s = append(last.s, s...)
+	case last != nil && last.isDelete():
+		if n := len(op.components); n > 1 && op.components[n-2].isInsert() {
+			op.components[n-2].s = append(op.components[n-2].s, s...)
+		} else {
+			op.components = append(op.components, *last)
+			op.components[n-1] = textComponent{s: append([]uint16(nil), s...)}
+		}
+	default:
+		op.components = append(op.components, textComponent{s: append([]uint16(nil), s...)})
+	}
+}
+
+func (op *TextOperation) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	op.baseLength += n
+	if last := op.last(); last != nil && last.isDelete() {
+		last.n -= n
+	} else {
+		op.components = append(op.components, textComponent{n: -n})
+	}
+}
+
+// Apply returns the text that results from the operation, or ErrOperationLength if the text is not the one it was made
+// for.
+func (op *TextOperation) Apply(text []uint16) ([]uint16, error) {
+	if len(text) != op.baseLength {
+		return nil, ErrOperationLength
+	}
+	result := make([]uint16, 0, op.targetLength)
+	i := 0
+	for _, c := range op.components {
+		switch {
+		case c.isRetain():
+			result = append(result, text[i:i+c.n]...)
+			i += c.n
+		case c.isInsert():
+			result = append(result, c.s...)
+		default:
+			i -= c.n
+		}
+	}
+	return result, nil
+}
+
+// transformTextOperations returns the operations a' and b' that apply a and b to a text on which the other was applied
+// first, so that applying a then b' results in the same text as b then a'. Where both insert at the same position, the
+// insertion of a comes first.
+func transformTextOperations(a, b *TextOperation) (aPrime, bPrime *TextOperation, err error) {
+	if a.baseLength != b.baseLength {
+		return nil, nil, ErrOperationLength
+	}
+	aPrime, bPrime = new(TextOperation), new(TextOperation)
+	as, bs := a.components, b.components
+	var ac, bc *textComponent
+	next := func(components *[]textComponent) *textComponent {
+		if len(*components) == 0 {
+			return nil
+		}
+		c := (*components)[0]
+		*components = (*components)[1:]
+		return &c
+	}
+	ac, bc = next(&as), next(&bs)
+	for ac != nil || bc != nil {
+		if ac != nil && ac.isInsert() {
+			aPrime.insert(ac.s)
+			bPrime.retain(len(ac.s))
+			ac = next(&as)
+			continue
+		}
+		if bc != nil && bc.isInsert() {
+			aPrime.retain(len(bc.s))
+			bPrime.insert(bc.s)
+			bc = next(&bs)
+			continue
+		}
+		if ac == nil || bc == nil {
+			return nil, nil, ErrOperationLength
+		}
+		// Both retain or delete; the shorter is used up, and the rest of the longer is left for the next round.
+		an, bn := ac.n, bc.n
+		if an < 0 {
+			an = -an
+		}
+		if bn < 0 {
+			bn = -bn
+		}
+		n := min(an, bn)
+		switch {
+		case ac.isRetain() && bc.isRetain():
+			aPrime.retain(n)
+			bPrime.retain(n)
+		case ac.isDelete() && bc.isRetain():
+			aPrime.delete(n)
+		case ac.isRetain() && bc.isDelete():
+			bPrime.delete(n)
+		}
+		// When both delete, the characters are gone from either side and nothing remains to be done.
+		if ac = shorten(ac, n); ac == nil {
+			ac = next(&as)
+		}
+		if bc = shorten(bc, n); bc == nil {
+			bc = next(&bs)
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+// shorten returns a retaining or deleting component with n fewer characters, or nil if none are left.
+func shorten(c *textComponent, n int) *textComponent {
+	if c.n > 0 {
+		c.n -= n
+	} else {
+		c.n += n
+	}
+	if c.n == 0 {
+		return nil
+	}
+	return c
+}
+
+func (op *TextOperation) UnmarshalJSON(data []byte) error {
+	var components []any
+	if err := json.Unmarshal(data, &components); err != nil {
+		return ErrOperationMalformed
+	}
+	*op = TextOperation{}
+	for _, component := range components {
+		switch c := component.(type) {
+		case float64:
+			if c != math.Trunc(c) || c == 0 || math.Abs(c) > math.MaxInt32 {
+				return ErrOperationMalformed
+			}
+			if c > 0 {
+				op.retain(int(c))
+			} else {
+				op.delete(int(-c))
+			}
+		case string:
+			if c == "" {
+				return ErrOperationMalformed
+			}
+			op.insert(utf16.Encode([]rune(c)))
+		default:
+			return ErrOperationMalformed
+		}
+	}
+	return nil
+}
+
+func (op *TextOperation) MarshalJSON() ([]byte, error) {
+	components := make([]any, len(op.components))
+	for i, c := range op.components {
+		if c.isInsert() {
+			components[i] = string(utf16.Decode(c.s))
+		} else {
+			components[i] = c.n
+		}
+	}
+	return json.Marshal(components)
+}
+
+// checkUTF16 returns an error if a text has surrogate halves without their other half, which operations that split a
+// character leave behind.
+func checkUTF16(text []uint16) error {
+	for i := 0; i < len(text); i++ {
+		switch r := rune(text[i]); {
+		case utf16.IsSurrogate(r) && r < 0xdc00 && i+1 < len(text) && text[i+1] >= 0xdc00 && text[i+1] < 0xe000:
+			i++
+		case utf16.IsSurrogate(r):
+			return fmt.Errorf("the operation splits the character at %v", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// List endpoints share these query arguments: "limit" items per page, the opaque "cursor" of the next page, and the
+// "since" and "until" times to list between. Upload lists can also be filtered with "has_attachments" and "language".
+// Items are listed newest first, ordered by their time and then by id, so pages stay stable while items are being
+// added.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 100
+)
+
+var (
+	ErrListLimit  = fmt.Errorf(`"limit" must be a number between 1 and %v`, maxListLimit)
+	ErrListCursor = errors.New(`"cursor" is not valid, it must be copied from a previous page`)
+	ErrListTime   = errors.New(`"since" and "until" must be RFC 3339 times or Unix timestamps`)
+	ErrListFilter = errors.New(`"has_attachments" must be true or false`)
+)
+
+// A ListQuery holds the pagination and filters of a request to a list endpoint.
+type ListQuery struct {
+	Limit          int
+	After          *listCursor // The last item of the previous page, or nil for the first page.
+	Since, Until   int64       // Unix times, where 0 leaves the range open.
+	HasAttachments *bool
+	Language       string // One of languages, or "" for any.
+}
+
+// A listCursor marks an item of a list by the columns it is ordered by.
+type listCursor struct {
+	Time int64
+	Id   int64
+}
+
+func (cursor listCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", cursor.Time, cursor.Id)))
+}
+
+func parseListCursor(s string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrListCursor
+	}
+	t, id, ok := strings.Cut(string(data), ".")
+	cursor := new(listCursor)
+	if cursor.Time, err = strconv.ParseInt(t, 10, 64); !ok || err != nil {
+		return nil, ErrListCursor
+	}
+	if cursor.Id, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, ErrListCursor
+	}
+	return cursor, nil
+}
+
+// parseListTime reads a time argument, which may be an RFC 3339 time or a Unix timestamp.
+func parseListTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, ErrListTime
+	}
+	return t.UTC().Unix(), nil
+}
+
+// parseListQuery reads the pagination and filter arguments of a request. On failure an error has been sent and false
+// is returned.
+func parseListQuery(c *gin.Context) (ListQuery, bool) {
+	query := ListQuery{Limit: defaultListLimit}
+	var err error
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 || query.Limit > maxListLimit {
+			err = ErrListLimit
+		}
+	}
+	if cursor := c.Query("cursor"); err == nil && cursor != "" {
+		query.After, err = parseListCursor(cursor)
+	}
+	if err == nil {
+		query.Since, err = parseListTime(c.Query("since"))
+	}
+	if err == nil {
+		query.Until, err = parseListTime(c.Query("until"))
+	}
+	if attachments := c.Query("has_attachments"); err == nil && attachments != "" {
+		var has bool
+		if has, err = strconv.ParseBool(attachments); err != nil {
+			err = ErrListFilter
+		}
+		query.HasAttachments = &has
+	}
+	if err == nil {
+		query.Language, err = parseLanguage(c.Query("language"))
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return query, false
+	}
+	return query, true
+}
+
+// clauses returns the conditions that select a page of a list ordered by timeColumn, starting with " AND", and the
+// ORDER BY and LIMIT clauses after them. One more item than the limit is selected, to tell whether there is a next
+// page. Their arguments are appended to args, which hold those of the query before them.
+func (query ListQuery) clauses(timeColumn, idColumn string, args []any) (string, []any) {
+	var sql strings.Builder
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if query.Since != 0 {
+		sql.WriteString(" AND " + timeColumn + " >= " + arg(query.Since))
+	}
+	if query.Until != 0 {
+		sql.WriteString(" AND " + timeColumn + " < " + arg(query.Until))
+	}
+	if query.After != nil {
+		sql.WriteString(" AND (" + timeColumn + ", " + idColumn + ") < (" + arg(query.After.Time) + ", " + arg(query.After.Id) + ")")
+	}
+	if query.HasAttachments != nil {
+		if *query.HasAttachments {
+			sql.WriteString(" AND cardinality(files) > 0")
+		} else {
+			sql.WriteString(" AND cardinality(files) = 0")
+		}
+	}
+	if query.Language != "" {
+		sql.WriteString(" AND language = " + arg(query.Language))
+	}
+	sql.WriteString(" ORDER BY " + timeColumn + " DESC, " + idColumn + " DESC LIMIT " + arg(query.Limit+1))
+	return sql.String(), args
+}
+
+// pageUploads selects a page of uploads with a query selecting uploadColumns, which is completed by the clauses of the
+// list query, and returns the cursor of the next page, or nil if this is the last. sortTime returns the value of the
+// column that the list is ordered by.
+func pageUploads(query ListQuery, selection string, args []any, timeColumn string, sortTime func(*UploadModel) int64) ([]*UploadModel, *listCursor, error) {
+	clauses, args := query.clauses(timeColumn, "id", args)
+	rows, err := db.Query(selection+clauses, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	uploads := []*UploadModel{}
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(uploads) <= query.Limit {
+		return uploads, nil, nil
+	}
+	uploads = uploads[:query.Limit]
+	last := uploads[len(uploads)-1]
+	return uploads, &listCursor{Time: sortTime(last), Id: int64(last.Id)}, nil
+}
+
+// setListLinks sets the Link header of a page to the first page, and to the next page if there is one, keeping the
+// other arguments of the request. The cursor of the next page is also returned for the response body, or "".
+func setListLinks(c *gin.Context, next *listCursor) string {
+	link := func(cursor string, rel string) string {
+		query := c.Request.URL.Query()
+		if cursor == "" {
+			query.Del("cursor")
+		} else {
+			query.Set("cursor", cursor)
+		}
+		u := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+		return "<" + baseurl + u.String() + `>; rel="` + rel + `"`
+	}
+	links := []string{link("", "first")}
+	cursor := ""
+	if next != nil {
+		cursor = next.String()
+		links = append(links, link(cursor, "next"))
+	}
+	c.Header("Link", strings.Join(links, ", "))
+	return cursor
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Paste templates are reusable starting points for uploads, such as a bug report or an incident log, that fill in the
+// text of the upload page when one is picked. Admins define the templates shared with everyone, and accounts may add
+// their own, which only they see.
+
+const maxTemplateNameLength = 64
+
+var (
+	ErrTemplateNotFound = errors.New("template not found")
+	ErrTemplateName     = errors.New(`a "name" of at most 64 characters is required`)
+)
+
+// A PasteTemplate pre-fills the upload page.
+type PasteTemplate struct {
+	Id        int64  `json:"id"`
+	Name      string `json:"name"`
+	Body      string `json:"body"`
+	Language  string `json:"language"`   // The language chosen with the template, or "" to detect it.
+	AccountId int64  `json:"account_id"` // The account whose own template it is, or 0 for templates shared with everyone.
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Shared reports whether the template is offered to everyone.
+func (t *PasteTemplate) Shared() bool {
+	return t.AccountId == 0
+}
+
+// ListPasteTemplates returns the shared templates and those of the account, which may be nil, by name.
+func ListPasteTemplates(account *Account) ([]PasteTemplate, error) {
+	var accountId int64
+	if account != nil {
+		accountId = account.Id
+	}
+	rows, err := db.Query(`SELECT id, name, body, language, account_id, created_by, created_at FROM PasteTemplates
+		WHERE account_id = 0 OR account_id = $1 ORDER BY name, id`, accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	templates := []PasteTemplate{}
+	for rows.Next() {
+		var t PasteTemplate
+		if err = rows.Scan(&t.Id, &t.Name, &t.Body, &t.Language, &t.AccountId, &t.CreatedBy, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// GetPasteTemplate returns a template by id, or ErrTemplateNotFound.
+func GetPasteTemplate(id int64) (*PasteTemplate, error) {
+	t := new(PasteTemplate)
+	err := db.QueryRow("SELECT id, name, body, language, account_id, created_by, created_at FROM PasteTemplates WHERE id = $1",
+		id).Scan(&t.Id, &t.Name, &t.Body, &t.Language, &t.AccountId, &t.CreatedBy, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTemplateNotFound
+	}
+	return t, err
+}
+
+// CreatePasteTemplate stores a new template and sets its id.
+func CreatePasteTemplate(t *PasteTemplate) error {
+	t.CreatedAt = time.Now().UTC().Unix()
+	return db.QueryRow(`INSERT INTO PasteTemplates(name, body, language, account_id, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`, t.Name, t.Body, t.Language, t.AccountId, t.CreatedBy, t.CreatedAt).Scan(&t.Id)
+}
+
+// UpdatePasteTemplate saves the name, body and language of a template.
+func UpdatePasteTemplate(t *PasteTemplate) error {
+	_, err := db.Exec("UPDATE PasteTemplates SET name = $1, body = $2, language = $3 WHERE id = $4", t.Name, t.Body, t.Language, t.Id)
+	return err
+}
+
+func DeletePasteTemplate(id int64) error {
+	_, err := db.Exec("DELETE FROM PasteTemplates WHERE id = $1", id)
+	return err
+}
+
+// bindPasteTemplate reads the name, body and language of a template from a request. On failure an error has been sent
+// and false is returned.
+func bindPasteTemplate(c *gin.Context, t *PasteTemplate) bool {
+	t.Name = strings.TrimSpace(c.PostForm("name"))
+	if t.Name == "" || len([]rune(t.Name)) > maxTemplateNameLength {
+		respondError(c, http.StatusBadRequest, ErrTemplateName)
+		return false
+	}
+	t.Body = c.PostForm("body")
+	if !utf8.ValidString(t.Body) {
+		respondError(c, http.StatusBadRequest, errors.New(`"body" must be UTF-8 text`))
+		return false
+	}
+	if maxBodyLength != 0 && int64(len(t.Body)) > maxBodyLength {
+		respondError(c, http.StatusRequestEntityTooLarge, errors.New("the template is longer than the text of an upload may be"))
+		return false
+	}
+	var err error
+	if t.Language, err = parseLanguage(c.PostForm("language")); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// editablePasteTemplate returns the template of the request that the account may change: its own, or a shared one
+// for admins. On failure an error has been sent and nil is returned.
+func editablePasteTemplate(c *gin.Context, account *Account) *PasteTemplate {
+	id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	t, err := GetPasteTemplate(id)
+	if errors.Is(err, ErrTemplateNotFound) || err == nil && !t.Shared() && t.AccountId != account.Id {
+		respondError(c, http.StatusNotFound, ErrTemplateNotFound)
+		return nil
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil
+	}
+	if t.Shared() && !account.HasRole(RoleAdmin) {
+		respondError(c, http.StatusForbidden, errors.New("only admins may change shared templates"))
+		return nil
+	}
+	return t
+}
+
+func registerPasteTemplateRoutes(r *gin.Engine) {
+	// Everyone sees the shared templates, and accounts their own too.
+	r.GET("/api/v1/templates", func(c *gin.Context) {
+		templates, err := ListPasteTemplates(currentAccount(c))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"templates": templates,
+		})
+	})
+
+	templates := r.Group("/api/v1/templates", requireRole(RoleUser))
+
+	// Add a template of the account, or with shared=true, a template shared with everyone, which only admins may add.
+	templates.POST("", limitRequestBody(maxSubmitSize), func(c *gin.Context) {
+		account := currentAccount(c)
+		t := &PasteTemplate{AccountId: account.Id, CreatedBy: account.Username}
+		if !bindPasteTemplate(c, t) {
+			return
+		}
+		if c.PostForm("shared") == "true" {
+			if !account.HasRole(RoleAdmin) {
+				respondError(c, http.StatusForbidden, errors.New("only admins may add shared templates"))
+				return
+			}
+			t.AccountId = 0
+		}
+		if err := CreatePasteTemplate(t); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if t.Shared() {
+			RecordAudit(account.Username, "template.create", strconv.FormatInt(t.Id, 10), t.Name, c.ClientIP())
+		}
+		c.JSON(http.StatusCreated, t)
+	})
+
+	templates.PUT("/:id", limitRequestBody(maxSubmitSize), func(c *gin.Context) {
+		account := currentAccount(c)
+		t := editablePasteTemplate(c, account)
+		if t == nil || !bindPasteTemplate(c, t) {
+			return
+		}
+		if err := UpdatePasteTemplate(t); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if t.Shared() {
+			RecordAudit(account.Username, "template.update", c.Param("id"), t.Name, c.ClientIP())
+		}
+		c.JSON(http.StatusOK, t)
+	})
+
+	templates.DELETE("/:id", func(c *gin.Context) {
+		account := currentAccount(c)
+		t := editablePasteTemplate(c, account)
+		if t == nil {
+			return
+		}
+		if err := DeletePasteTemplate(t.Id); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if t.Shared() {
+			RecordAudit(account.Username, "template.delete", c.Param("id"), t.Name, c.ClientIP())
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Template deleted",
+		})
+	})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Uploads are exported as PDF documents for archival and for attaching to tickets. The documents are written by hand
+// rather than with a library: the text is laid out in lines of a monospaced font, which only needs the standard fonts
+// that every PDF reader has, so no fonts are embedded. Characters outside of Windows-1252, which those fonts are limited
+// to, are printed as question marks.
+
+const (
+	pdfPageWidth  = 595.28 // A4, in points.
+	pdfPageHeight = 841.89
+	pdfMargin     = 50
+	pdfFontSize   = 9
+	pdfLineHeight = 11
+	// pdfColumns is how many characters of Courier, which are 0.6 em wide, fit between the margins.
+	pdfColumns  = 91
+	pdfTabWidth = 4
+	// maxPDFPages bounds the work of exporting very long uploads; the rest of the text is left out.
+	maxPDFPages = 500
+)
+
+// pdfColors are the fill colors of the kinds of tokens, as PDF operators.
+var pdfColors = map[tokenKind]string{
+	tokenPlain:    "0 g",
+	tokenKeyword:  "0 0 0.55 rg",
+	tokenString:   "0.64 0.08 0.08 rg",
+	tokenComment:  "0.42 0.45 0.48 rg",
+	tokenNumber:   "0.5 0 0.5 rg",
+	tokenInserted: "0 0.45 0 rg",
+	tokenDeleted:  "0.7 0 0 rg",
+	tokenMeta:     "0.4 0.4 0.4 rg",
+}
+
+// A pdfDocument lays out text on pages, top to bottom.
+type pdfDocument struct {
+	header    string          // Shown at the top of every page.
+	pages     []*bytes.Buffer // The content streams of the pages.
+	y         float64         // The baseline of the next line on the last page.
+	truncated bool            // Whether text was left out because the document has maxPDFPages pages.
+}
+
+func newPDFDocument(header string) *pdfDocument {
+	doc := &pdfDocument{header: header}
+	doc.newPage()
+	return doc
+}
+
+// pdfString encodes text as a PDF string literal in Windows-1252.
+func pdfString(text string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range text {
+		c, ok := charmap.Windows1252.EncodeRune(r)
+		if !ok {
+			c = '?'
+		}
+		switch c {
+		case '\\', '(', ')':
+			b.WriteByte('\\')
+		case '\r':
+			b.WriteString(`\r`)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// newPage starts a page with the header, and returns false if the document already has maxPDFPages pages.
+func (doc *pdfDocument) newPage() bool {
+	if len(doc.pages) == maxPDFPages {
+		doc.truncated = true
+		return false
+	}
+	page := new(bytes.Buffer)
+	fmt.Fprintf(page, "BT /F2 8 Tf 0.4 g %d %.2f Td %s Tj ET\n", pdfMargin, pdfPageHeight-30, pdfString(doc.header))
+	fmt.Fprintf(page, "0.4 G 0.5 w %d %.2f m %.2f %.2f l S\n", pdfMargin, pdfPageHeight-36, pdfPageWidth-pdfMargin,
+		pdfPageHeight-36)
+	doc.pages = append(doc.pages, page)
+	doc.y = pdfPageHeight - pdfMargin - 10
+	return true
+}
+
+// space makes room for a line of the given height, and returns false if there is none left.
+func (doc *pdfDocument) space(height float64) bool {
+	if doc.truncated {
+		return false
+	}
+	if doc.y-height < pdfMargin && !doc.newPage() {
+		return false
+	}
+	doc.y -= height
+	return true
+}
+
+// Heading writes a line of text in bold Helvetica.
+func (doc *pdfDocument) Heading(text string, size float64) {
+	if doc.space(size * 1.4) {
+		fmt.Fprintf(doc.pages[len(doc.pages)-1], "BT /F3 %.1f Tf 0 g %d %.2f Td %s Tj ET\n", size, pdfMargin, doc.y,
+			pdfString(text))
+	}
+}
+
+// Line writes a line of text in Helvetica, cut short if it is wider than the page.
+func (doc *pdfDocument) Line(text string) {
+	if runes := []rune(text); len(runes) > pdfColumns {
+		text = string(runes[:pdfColumns-1]) + "…"
+	}
+	if doc.space(pdfLineHeight + 2) {
+		fmt.Fprintf(doc.pages[len(doc.pages)-1], "BT /F2 %d Tf 0 g %d %.2f Td %s Tj ET\n", pdfFontSize, pdfMargin, doc.y,
+			pdfString(text))
+	}
+}
+
+// Gap leaves an empty space.
+func (doc *pdfDocument) Gap(height float64) {
+	doc.space(height)
+}
+
+// Code writes highlighted text in Courier, expanding tabs and wrapping lines that are wider than the page.
+func (doc *pdfDocument) Code(tokens []token) {
+	var line []token
+	var current strings.Builder
+	kind, column, wrapped := tokenPlain, 0, false
+	flush := func() {
+		if current.Len() > 0 {
+			line = append(line, token{kind, current.String()})
+			current.Reset()
+		}
+	}
+	endLine := func() bool {
+		flush()
+		ok := doc.codeLine(line)
+		line, column = line[:0], 0
+		return ok
+	}
+	for _, t := range tokens {
+		if t.kind != kind {
+			flush()
+			kind = t.kind
+		}
+		for _, r := range t.text {
+			switch r {
+			case '\r':
+				continue
+			case '\n':
+				// A line as wide as the page has already ended.
+				if !wrapped && !endLine() {
+					return
+				}
+				wrapped = false
+				continue
+			case '\t':
+				n := pdfTabWidth - column%pdfTabWidth
+				current.WriteString(strings.Repeat(" ", n))
+				column += n
+			default:
+				current.WriteRune(r)
+				column++
+			}
+			if wrapped = column >= pdfColumns; wrapped && !endLine() {
+				return
+			}
+		}
+	}
+	if current.Len() > 0 || len(line) > 0 {
+		endLine()
+	}
+}
+
+func (doc *pdfDocument) codeLine(line []token) bool {
+	if !doc.space(pdfLineHeight) {
+		return false
+	}
+	page := doc.pages[len(doc.pages)-1]
+	fmt.Fprintf(page, "BT /F1 %d Tf %d %.2f Td", pdfFontSize, pdfMargin, doc.y)
+	for _, t := range line {
+		fmt.Fprintf(page, " %s %s Tj", pdfColors[t.kind], pdfString(t.text))
+	}
+	page.WriteString(" ET\n")
+	return true
+}
+
+// Render writes the document with page numbers in the footer, and a note on the last page if it was truncated.
+func (doc *pdfDocument) Render(w io.Writer, title, creator, truncatedNote string, created time.Time) (int64, error) {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(format string, args ...any) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n", len(offsets))
+		fmt.Fprintf(&out, format, args...)
+		out.WriteString("\nendobj\n")
+	}
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1 to 6 are the catalog, the page tree, the fonts and the document information; every page is followed by
+	// its content stream.
+	const firstPage = 7
+	kids := make([]string, len(doc.pages))
+	for i := range doc.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(doc.pages))
+	for _, font := range []string{"Courier", "Helvetica", "Helvetica-Bold"} {
+		object("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", font)
+	}
+	object("<< /Title %s /Creator %s /Producer %s /CreationDate (D:%s) >>", pdfString(title), pdfString(creator),
+		pdfString(creator), created.UTC().Format("20060102150405Z"))
+
+	for i, page := range doc.pages {
+		fmt.Fprintf(page, "BT /F2 8 Tf 0.4 g %.2f 30 Td %s Tj ET\n", pdfPageWidth-pdfMargin-40,
+			pdfString(fmt.Sprintf("%d / %d", i+1, len(doc.pages))))
+		if doc.truncated && i == len(doc.pages)-1 {
+			fmt.Fprintf(page, "BT /F2 8 Tf 0.7 0 0 rg %d 30 Td %s Tj ET\n", pdfMargin, pdfString(truncatedNote))
+		}
+		var stream bytes.Buffer
+		zw := zlib.NewWriter(&stream)
+		zw.Write(page.Bytes())
+		zw.Close()
+
+		object("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R "+
+			"/F3 5 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, firstPage+2*i+1)
+		object("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", stream.Len(), stream.Bytes())
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 6 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.WriteTo(w)
+}
+
+// servePDF responds with an upload exported as a PDF document: its metadata, its highlighted text and the names of its
+// attachments.
+func servePDF(c *gin.Context, hash string) {
+	upload := printableUpload(c, hash)
+	if upload == nil {
+		return
+	}
+	lang := requestLanguage(c)
+	siteName := site.Load().Name
+	id := upload.ShortHash()
+	created := time.Unix(upload.Timestamp, 0)
+
+	doc := newPDFDocument(siteName + " · " + id + " · " + created.Format(time.UnixDate))
+	doc.Heading(id, 16)
+	doc.Line(translate(lang, "Uploaded: %v", created.Format(time.UnixDate)))
+	if upload.Language != "" {
+		doc.Line(translate(lang, "Language: %v", translate(lang, languageName(upload.Language))))
+	}
+	doc.Gap(pdfLineHeight)
+	doc.Code(highlight(upload.Language, upload.Body))
+	if len(upload.FileNames) > 0 {
+		doc.Gap(pdfLineHeight)
+		doc.Heading(translate(lang, "Attachments"), 11)
+		for _, name := range upload.FileNames {
+			doc.Line("• " + name)
+		}
+	}
+
+	c.Header("Content-Type", "application/pdf")
+	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%v.pdf"`, id))
+	c.Status(http.StatusOK)
+	note := translate(lang, "The rest of the text is not included: a document has at most %d pages.", maxPDFPages)
+	doc.Render(c.Writer, siteName+" · "+id, siteName, note, created)
+}
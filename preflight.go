@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Clients can ask whether a submission would be accepted before sending it, so that a submission over a limit or the
+// quota fails at once instead of after megabytes were transferred. Only what can be told from the declared sizes is
+// checked: copycat does not restrict the types of attachments, and hooks and secret scanning need the contents, so
+// a submission that passes the preflight may still be refused by them.
+
+const (
+	maxPreflightFiles = 1000    // Files a submission may declare.
+	maxPreflightSize  = 1 << 50 // Bytes a declared size may have, so that sums of them cannot overflow.
+)
+
+var ErrPreflightSize = fmt.Errorf("a submission may declare at most %d files, with sizes between 0 and 1 PiB", maxPreflightFiles)
+
+// preflightRequest is the body of POST /api/v1/uploads/preflight, declaring a submission like the form of /submit.
+type preflightRequest struct {
+	BodyBytes   int64   `json:"body_bytes"`
+	FileSizes   []int64 `json:"file_sizes"` // One size per attachment.
+	Team        string  `json:"team"`
+	KeepLastKB  string  `json:"keep_last_kb"`
+	AcceptTerms bool    `json:"accept_terms"`
+}
+
+// preflightProblem describes a reason a submission would be refused, with the status code /submit would answer.
+func preflightProblem(c *gin.Context, status int, err error) gin.H {
+	return gin.H{
+		"status":  status,
+		"code":    errorCode(status, err),
+		"message": translate(requestLanguage(c), err.Error()),
+	}
+}
+
+// preflightSubmission returns the problems that /submit would refuse a submission for, in the order it checks them,
+// and the quota the submission would count against.
+func preflightSubmission(c *gin.Context, request *preflightRequest) ([]gin.H, *Quota, error) {
+	problems := []gin.H{}
+	account := currentAccount(c)
+
+	var team *Team
+	if request.Team != "" {
+		var role string
+		team, _ = GetTeam(request.Team)
+		if team != nil {
+			role, _ = team.Role(account)
+		}
+		if role == "" {
+			problems = append(problems, preflightProblem(c, http.StatusForbidden, ErrNotTeamMember))
+			team = nil
+		}
+	}
+	keepLast, err := parseKeepLast(request.KeepLastKB)
+	if err != nil {
+		problems = append(problems, preflightProblem(c, http.StatusBadRequest, err))
+	}
+
+	var attachmentsSize int64
+	for _, size := range request.FileSizes {
+		attachmentsSize += size
+	}
+	if attachmentsSize > maxUploadSize {
+		problems = append(problems, preflightProblem(c, http.StatusRequestEntityTooLarge,
+			tooLargeError(attachmentsSize, maxUploadSize)))
+	} else if attachmentsSize+request.BodyBytes > maxSubmitSize {
+		problems = append(problems, preflightProblem(c, http.StatusRequestEntityTooLarge,
+			tooLargeError(attachmentsSize+request.BodyBytes, maxSubmitSize)))
+	}
+
+	terms, err := pendingTerms(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if terms != nil && !request.AcceptTerms && c.GetHeader("X-Accept-Terms") != strconv.FormatInt(terms.Version, 10) {
+		problems = append(problems, preflightProblem(c, http.StatusForbidden, ErrTermsNotAccepted))
+	}
+
+	bodySize := request.BodyBytes
+	if keepLast == 0 && maxBodyLength != 0 && bodySize > maxBodyLength {
+		problems = append(problems, preflightProblem(c, http.StatusRequestEntityTooLarge, bodyTooLongError(bodySize)))
+	} else if keepLast != 0 {
+		bodySize = min(bodySize, keepLast)
+	}
+
+	quota, err := GetQuota(c.ClientIP(), account, team)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = quota.Check(bodySize + attachmentsSize); err != nil {
+		problems = append(problems, preflightProblem(c, http.StatusRequestEntityTooLarge, err))
+	}
+	return problems, quota, nil
+}
+
+func registerPreflightRoutes(r *gin.Engine) {
+	// Tell whether a submission declared by its sizes would be accepted by /submit, and why not.
+	r.POST("/api/v1/uploads/preflight", func(c *gin.Context) {
+		var request preflightRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if request.BodyBytes < 0 || request.BodyBytes > maxPreflightSize || len(request.FileSizes) > maxPreflightFiles {
+			respondError(c, http.StatusBadRequest, ErrPreflightSize)
+			return
+		}
+		for _, size := range request.FileSizes {
+			if size < 0 || size > maxPreflightSize {
+				respondError(c, http.StatusBadRequest, ErrPreflightSize)
+				return
+			}
+		}
+
+		problems, quota, err := preflightSubmission(c, &request)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"accepted": len(problems) == 0,
+			"problems": problems,
+			"quota": gin.H{
+				"scope":     quota.Scope,
+				"used":      quota.Used,
+				"limit":     quota.Limit, // 0 means there is no limit.
+				"remaining": quota.Remaining(),
+			},
+			"limits": gin.H{
+				"max_request_bytes":     maxSubmitSize,
+				"max_attachments_bytes": maxUploadSize,
+				"max_body_bytes":        maxBodyLength, // 0 means there is no limit of its own.
+			},
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The print view of an upload shows its text and text attachments without the header, footer and scripts of the site,
+// laid out for paper: long lines wrap, every attachment starts on a new page, and each page repeats the upload it comes
+// from. Attachments that are not text, or too large to print, are only listed.
+
+// maxPrintedAttachmentSize is the largest attachment whose text is printed.
+const maxPrintedAttachmentSize = 1024 * 1024
+
+// A printedAttachment is an attachment in the print view, with its text, or the reason it has none.
+type printedAttachment struct {
+	Name   string
+	Text   string
+	Reason string
+}
+
+// printedAttachments reads the text attachments of an upload for the print view.
+func printedAttachments(c *gin.Context, upload *UploadModel) []printedAttachment {
+	attachments := make([]printedAttachment, len(upload.FileNames))
+	for i, name := range upload.FileNames {
+		attachments[i].Name = name
+		attachments[i].Text, attachments[i].Reason = printedText(c, upload.FileHashes[i])
+	}
+	return attachments
+}
+
+// printedText returns the text of an attachment, or why it is not printed.
+func printedText(c *gin.Context, hash string) (text string, reason string) {
+	if _, err := requestHooks(c, &HookPayload{Event: HookPreDownload, Object: hash}); err != nil {
+		return "", "This attachment is not available."
+	}
+	if infected, err := attachmentInfected(c.Request.Context(), hash); err != nil || infected {
+		return "", "This attachment is not available."
+	}
+	file, contents, err := OpenFileObject(c.Request.Context(), hash)
+	if errors.Is(err, ErrObjectArchived) {
+		return "", "This attachment is archived and must be restored before it can be printed."
+	} else if err != nil {
+		log.Printf("failed to open attachment %v for printing: %v", hash, err)
+		return "", "This attachment is not available."
+	}
+	defer contents.Close()
+	if file.Size > maxPrintedAttachmentSize {
+		return "", "This attachment is too large to print."
+	}
+	data, err := io.ReadAll(io.LimitReader(contents, maxPrintedAttachmentSize+1))
+	if err != nil {
+		log.Printf("failed to read attachment %v for printing: %v", hash, err)
+		return "", "This attachment is not available."
+	}
+	if len(data) > maxPrintedAttachmentSize {
+		return "", "This attachment is too large to print."
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", "This attachment is not text."
+	}
+	return string(data), ""
+}
+
+// printableUpload returns the upload with the hash to print, export or serve raw, or nil after responding with an
+// error. Whoever can read the upload through the API or a share link can print it.
+func printableUpload(c *gin.Context, hash string) *UploadModel {
+	upload, err := GetUpload(hash)
+	if err != nil {
+		route404(c)
+		return nil
+	}
+	ok, err := upload.canView(c)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil
+	}
+	// Private uploads are also printed through their share links.
+	if !ok {
+		ok = upload.canViewShared(c, hash)
+	}
+	if !ok || upload.TakedownAt != 0 {
+		route404(c)
+		return nil
+	}
+	return upload
+}
+
+func registerPrintRoutes(r *gin.Engine) {
+	// Show an upload laid out for printing.
+	showPrint := func(c *gin.Context) {
+		upload := printableUpload(c, uploadParam(c))
+		if upload == nil {
+			return
+		}
+
+		renderPage(c, http.StatusOK, "print.html", gin.H{
+			"Page":        NewPageInfo(c, upload.ShortHash()),
+			"Upload":      upload,
+			"Attachments": printedAttachments(c, upload),
+		})
+	}
+	r.GET("/p/:hash/print", showPrint)
+	r.GET("/:hash/print", legacyUploadRoute(showPrint))
+}
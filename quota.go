@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Storage limits in bytes for each kind of uploader. A limit of 0 means there is no limit.
+var (
+	ipQuota      int64 // Anonymous uploads, per IP address.
+	accountQuota int64 // Uploads by a logged in account.
+	teamQuota    int64 // Uploads into a team, shared by all of its members.
+)
+
+func initQuotas() {
+	ipQuota = envInt64("QUOTA_IP_BYTES", 0)
+	accountQuota = envInt64("QUOTA_ACCOUNT_BYTES", 0)
+	teamQuota = envInt64("QUOTA_TEAM_BYTES", 0)
+}
+
+// A Quota is the storage limit that applies to an uploader and how much of it is already used.
+type Quota struct {
+	Scope string // "ip", "account" or "team".
+	Used  int64
+	Limit int64 // 0 means there is no limit.
+}
+
+// GetQuota returns the quota that applies to an upload into team (may be nil) by account (may be nil) from ip.
+// Team uploads count against the team, other uploads against the account, and anonymous uploads against the IP.
+func GetQuota(ip string, account *Account, team *Team) (*Quota, error) {
+	quota := &Quota{Scope: "ip", Limit: ipQuota}
+	column, value := "uploader_ip", any(ip)
+	switch {
+	case team != nil:
+		quota.Scope, quota.Limit = "team", teamQuota
+		column, value = "team_id", team.Id
+	case account != nil:
+		quota.Scope, quota.Limit = "account", accountQuota
+		column, value = "account_id", account.Id
+	}
+
+	used, err := GetUsage(column, value)
+	if err != nil {
+		return nil, err
+	}
+	quota.Used = used
+	return quota, nil
+}
+
+// Remaining returns the number of bytes that may still be stored, or -1 if there is no limit.
+func (q *Quota) Remaining() int64 {
+	if q.Limit <= 0 {
+		return -1
+	}
+	return max(q.Limit-q.Used, 0)
+}
+
+// Check returns a *QuotaExceededError if storing size more bytes would exceed the quota.
+func (q *Quota) Check(size int64) error {
+	if q.Limit > 0 && q.Used+size > q.Limit {
+		return &QuotaExceededError{Quota: *q, Requested: size}
+	}
+	return nil
+}
+
+// A QuotaExceededError is returned when storing an upload would take an uploader over their quota.
+type QuotaExceededError struct {
+	Quota
+	Requested int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s storage quota exceeded: %s of %s used, and this upload needs %s more",
+		e.Scope, formatBytes(e.Used), formatBytes(e.Limit), formatBytes(e.Requested))
+}
+
+// formatBytes formats a byte count using binary units, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Request rate limit policies. Each route class has its own limit per client, where clients are accounts when logged
+// in and IP addresses otherwise, and requests with an API token also count against the api policy of their account.
+const (
+	PolicySubmit   = "submit"
+	PolicyDownload = "download"
+	PolicySearch   = "search"
+	PolicyAPI      = "api"
+)
+
+var ErrRateLimited = errors.New("too many requests, please slow down and try again later")
+
+// A RateLimit allows Requests per Window, in bursts of up to all of them.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// parseRateLimit parses a limit like "20/m": a number of requests per s, m, h or d, or per a duration like "90s".
+func parseRateLimit(s string) (RateLimit, error) {
+	count, window, ok := strings.Cut(strings.TrimSpace(s), "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q must be a positive number of requests per window, like 20/m", s)
+	}
+	limit := RateLimit{Requests: n}
+	switch window {
+	case "s":
+		limit.Window = time.Second
+	case "m":
+		limit.Window = time.Minute
+	case "h":
+		limit.Window = time.Hour
+	case "d":
+		limit.Window = 24 * time.Hour
+	default:
+		if limit.Window, err = time.ParseDuration(window); err != nil || limit.Window <= 0 {
+			return RateLimit{}, fmt.Errorf("rate limit %q must have a window of s, m, h, d or a duration", s)
+		}
+	}
+	return limit, nil
+}
+
+// UnmarshalJSON reads a limit in the format of parseRateLimit.
+func (l *RateLimit) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	limit, err := parseRateLimit(s)
+	*l = limit
+	return err
+}
+
+// rateLimitConfig holds the limits of each policy, and the limits that replace them for some accounts, such as an
+// integration that syncs many uploads. Policies without a limit are unlimited.
+type rateLimitConfig struct {
+	Policies map[string]RateLimit            `json:"policies"`
+	Accounts map[string]map[string]RateLimit `json:"accounts"` // By username, then policy.
+}
+
+// rateLimits holds the *rateLimitConfig in use, which is replaced when the configuration is reloaded.
+var rateLimits atomic.Pointer[rateLimitConfig]
+
+// rateLimiters holds the token bucket of every client of every policy on this replica.
+var rateLimiters = struct {
+	sync.Mutex
+	m map[string]*rate.Limiter
+}{m: make(map[string]*rate.Limiter)}
+
+func initRateLimits() {
+	if err := loadRateLimits(); err != nil {
+		log.Fatal(err)
+	}
+	RegisterReloader("rate limits", loadRateLimits)
+
+	RegisterJob(&Job{
+		Name:         "rate-limiters",
+		Interval:     10 * time.Minute,
+		EveryReplica: true,
+		Run: func(context.Context) error {
+			pruneRateLimiters()
+			return nil
+		},
+	})
+}
+
+// loadRateLimits reads the policies of RATE_LIMITS_FILE, and those of RATE_LIMITS, like "submit=20/m,api=5000/h",
+// which replace them. Buckets of clients whose limit changed start over.
+func loadRateLimits() error {
+	config := new(rateLimitConfig)
+	if path := os.Getenv("RATE_LIMITS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read RATE_LIMITS_FILE: %v", err)
+		}
+		if err = json.Unmarshal(data, config); err != nil {
+			return fmt.Errorf("failed to parse RATE_LIMITS_FILE: %v", err)
+		}
+	}
+	if config.Policies == nil {
+		config.Policies = make(map[string]RateLimit)
+	}
+	for _, pair := range strings.Split(os.Getenv("RATE_LIMITS"), ",") {
+		policy, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			return fmt.Errorf("RATE_LIMITS environment variable is invalid: %v", err)
+		}
+		config.Policies[strings.TrimSpace(policy)] = limit
+	}
+	rateLimits.Store(config)
+	return nil
+}
+
+// pruneRateLimiters forgets the clients whose buckets have refilled, which are no different from new ones.
+func pruneRateLimiters() {
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+	now := time.Now()
+	for key, limiter := range rateLimiters.m {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(rateLimiters.m, key)
+		}
+	}
+}
+
+// rateLimitPolicies describes the limit of every policy for clients.
+func rateLimitPolicies() gin.H {
+	policies := gin.H{}
+	for policy, limit := range rateLimits.Load().Policies {
+		policies[policy] = gin.H{
+			"requests":       limit.Requests,
+			"window_seconds": int64(limit.Window.Seconds()),
+		}
+	}
+	return policies
+}
+
+// policyLimit returns the limit of a policy for an account, which may be nil, and whether there is one.
+func policyLimit(policy string, account *Account) (RateLimit, bool) {
+	config := rateLimits.Load()
+	if account != nil {
+		if limit, ok := config.Accounts[account.Username][policy]; ok {
+			return limit, true
+		}
+	}
+	limit, ok := config.Policies[policy]
+	return limit, ok
+}
+
+func rateLimiterFor(key string, limit RateLimit) *rate.Limiter {
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+	limiter, ok := rateLimiters.m[key]
+	every := rate.Every(limit.Window / time.Duration(limit.Requests))
+	if !ok || limiter.Limit() != every || limiter.Burst() != limit.Requests {
+		// A changed limit starts a new bucket.
+		limiter = rate.NewLimiter(every, limit.Requests)
+		rateLimiters.m[key] = limiter
+	}
+	return limiter
+}
+
+// checkRateLimit takes a request from the bucket of the client in a policy, and sets the X-RateLimit headers. Requests
+// over the limit are answered with 429 and false is returned.
+func checkRateLimit(c *gin.Context, policy string) bool {
+	account := currentAccount(c)
+	limit, ok := policyLimit(policy, account)
+	if !ok {
+		return true
+	}
+	client := "ip:" + c.ClientIP()
+	if account != nil {
+		client = "account:" + strconv.FormatInt(account.Id, 10)
+	}
+	limiter := rateLimiterFor(policy+" "+client, limit)
+
+	now := time.Now()
+	allowed := limiter.AllowN(now, 1)
+	tokens := max(limiter.TokensAt(now), 0)
+	perSecond := float64(limiter.Limit())
+	c.Header("X-RateLimit-Policy", policy)
+	c.Header("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(limit.Requests)-tokens)/perSecond))))
+	if allowed {
+		return true
+	}
+
+	retryAfter := int(math.Ceil((1 - tokens) / perSecond))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	abortWithError(c, http.StatusTooManyRequests, ErrRateLimited, gin.H{
+		"policy":              policy,
+		"limit":               limit.Requests,
+		"window_seconds":      int64(limit.Window.Seconds()),
+		"retry_after_seconds": retryAfter,
+	})
+	return false
+}
+
+// rateLimit is a middleware that limits the requests of each client to a route with a policy.
+func rateLimit(policy string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if checkRateLimit(c, policy) {
+			c.Next()
+		}
+	}
+}
+
+// rateLimitAPI is a middleware that counts every request made with an API token against the api policy of its
+// account, whatever the route.
+func rateLimitAPI(c *gin.Context) {
+	if strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") && currentAccount(c) != nil && !checkRateLimit(c, PolicyAPI) {
+		return
+	}
+	c.Next()
+}
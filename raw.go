@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The body of an upload is served as is at /p/<hash>/raw, for tools that fetch it. It is plain text unless the owner
+// sets a few response headers of their own, such as a JSON content type, so that raw URLs can serve machine-readable
+// payloads. Only headers that cannot turn the raw view into a page running scripts on this site can be set: content
+// types that browsers do not render as documents, and the sandbox policy sent with every raw view stays in place.
+
+// rawContentTypes are the media types an owner may serve the body of an upload as, always in UTF-8.
+var rawContentTypes = []string{
+	"text/plain", "text/csv", "text/tab-separated-values", "text/markdown", "text/x-diff",
+	"application/json", "application/ld+json", "application/x-ndjson", "application/yaml", "application/toml",
+}
+
+// rawCacheDirectives are the Cache-Control directives an owner may set; max-age and s-maxage take a number of seconds.
+var rawCacheDirectives = []string{"public", "private", "no-cache", "no-store", "must-revalidate", "immutable"}
+
+// rawHeaderRules check the value of every header an owner may set, and return it as it is sent.
+var rawHeaderRules = map[string]func(value string) (string, error){
+	"Content-Type": func(value string) (string, error) {
+		mediaType, _, err := mime.ParseMediaType(value)
+		if err != nil || !slices.Contains(rawContentTypes, mediaType) {
+			return "", fmt.Errorf("Content-Type must be one of %v", strings.Join(rawContentTypes, ", "))
+		}
+		return mediaType + "; charset=utf-8", nil
+	},
+	"Content-Disposition": func(value string) (string, error) {
+		disposition, params, err := mime.ParseMediaType(value)
+		if err != nil || disposition != "inline" && disposition != "attachment" {
+			return "", errors.New(`Content-Disposition must be "inline" or "attachment", with an optional filename`)
+		}
+		if filename, ok := params["filename"]; ok {
+			return mime.FormatMediaType(disposition, map[string]string{"filename": filename}), nil
+		}
+		return disposition, nil
+	},
+	"Cache-Control": func(value string) (string, error) {
+		var directives []string
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			name, seconds, hasSeconds := strings.Cut(directive, "=")
+			if hasSeconds && (name == "max-age" || name == "s-maxage") {
+				if n, err := strconv.ParseUint(seconds, 10, 32); err == nil {
+					directives = append(directives, name+"="+strconv.FormatUint(n, 10))
+					continue
+				}
+			} else if !hasSeconds && slices.Contains(rawCacheDirectives, name) {
+				directives = append(directives, name)
+				continue
+			}
+			return "", fmt.Errorf("Cache-Control may only have max-age, s-maxage and %v", strings.Join(rawCacheDirectives, ", "))
+		}
+		return strings.Join(directives, ", "), nil
+	},
+	"Access-Control-Allow-Origin": func(value string) (string, error) {
+		if value != "*" {
+			return "", errors.New(`Access-Control-Allow-Origin may only be "*"`)
+		}
+		return value, nil
+	},
+}
+
+// normalizeRawHeaders checks the headers an owner sets, and returns them as they are sent.
+func normalizeRawHeaders(headers map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(headers))
+	for name, value := range headers {
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		rule, ok := rawHeaderRules[name]
+		if !ok {
+			names := make([]string, 0, len(rawHeaderRules))
+			for allowed := range rawHeaderRules {
+				names = append(names, allowed)
+			}
+			slices.Sort(names)
+			return nil, fmt.Errorf("%v cannot be set, only %v can", name, strings.Join(names, ", "))
+		}
+		sent, err := rule(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		normalized[name] = sent
+	}
+	return normalized, nil
+}
+
+// GetRawHeaders returns the headers the owner of an upload set for its raw view.
+func GetRawHeaders(ctx context.Context, hash string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, value FROM RawHeaders WHERE upload_hash = $1", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	headers := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err = rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		headers[name] = value
+	}
+	return headers, rows.Err()
+}
+
+// SetRawHeaders replaces the headers of the raw view of an upload with normalized ones.
+func SetRawHeaders(ctx context.Context, hash string, headers map[string]string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "DELETE FROM RawHeaders WHERE upload_hash = $1", hash); err != nil {
+		return err
+	}
+	for name, value := range headers {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO RawHeaders(upload_hash, name, value) VALUES ($1, $2, $3)",
+			hash, name, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func registerRawRoutes(r *gin.Engine) {
+	// Serve the body of an upload as is, with the headers its owner set.
+	showRaw := func(c *gin.Context) {
+		upload := printableUpload(c, uploadParam(c))
+		if upload == nil {
+			return
+		}
+		headers, err := GetRawHeaders(c.Request.Context(), upload.Hash)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		contentType := "text/plain; charset=utf-8"
+		for name, value := range headers {
+			if name == "Content-Type" {
+				contentType = value
+			} else {
+				c.Header(name, value)
+			}
+		}
+		// Whatever the content type, nothing in the body may run as part of this site.
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+		c.Data(http.StatusOK, contentType, []byte(upload.Body))
+	}
+	r.GET("/p/:hash/raw", showRaw)
+	r.GET("/:hash/raw", legacyUploadRoute(showRaw))
+
+	// Fetch the headers set for the raw view of an upload.
+	r.GET("/api/v1/uploads/:hash/headers", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		headers, err := GetRawHeaders(c.Request.Context(), upload.Hash)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"headers": headers})
+	})
+
+	// Replace the headers of the raw view of an upload with {"headers": {"Content-Type": "application/json"}}.
+	r.PUT("/api/v1/uploads/:hash/headers", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		var body struct {
+			Headers map[string]string `json:"headers"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		headers, err := normalizeRawHeaders(body.Headers)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err = SetRawHeaders(c.Request.Context(), upload.Hash, headers); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"headers": headers})
+	})
+
+	// Remove the headers of the raw view of an upload, serving it as plain text again.
+	r.DELETE("/api/v1/uploads/:hash/headers", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		if err := SetRawHeaders(c.Request.Context(), upload.Hash, nil); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Submitters can ask for personal data to be redacted from the text of their upload before it is stored, such as
+// when pasting logs full of customer emails and addresses. Matches are replaced by a placeholder naming what was
+// removed, and the submitter is told how many of each were.
+
+// A redaction replaces a kind of personal data. Matches that valid rejects are kept.
+type redaction struct {
+	kind    string
+	pattern *regexp.Regexp
+	valid   func(string) bool
+}
+
+// redactions are applied in order, so that the addresses inside emails are redacted as emails.
+var redactions = []redaction{
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), nil},
+	{"IP address", regexp.MustCompile(`\b[0-9A-Fa-f]{0,4}(:[0-9A-Fa-f]{0,4}){2,7}(%\w+)?\b|\b\d{1,3}(\.\d{1,3}){3}\b`), func(s string) bool {
+		// IPv6 addresses may name a zone. Bare colons, as in "std::vector", are not addresses.
+		ip, _, _ := strings.Cut(s, "%")
+		return s[0] != ':' && net.ParseIP(ip) != nil
+	}},
+	{"phone number", regexp.MustCompile(`(\+\d{1,3}[ .-]?)?(\(\d{2,4}\)|\d{2,4})[ .-]\d{3,4}[ .-]\d{3,4}\b|\+\d{7,15}\b`), nil},
+}
+
+func initRedaction() {
+	path := os.Getenv("REDACT_PATTERNS_FILE")
+	if path == "" {
+		return
+	}
+	// The file maps the names of kinds of data to the regular expressions matching them, such as customer numbers.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal("failed to read REDACT_PATTERNS_FILE: ", err)
+	}
+	var patterns map[string]string
+	if err = json.Unmarshal(data, &patterns); err != nil {
+		log.Fatal("failed to parse REDACT_PATTERNS_FILE: ", err)
+	}
+	kinds := make([]string, 0, len(patterns))
+	for kind := range patterns {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	for _, kind := range kinds {
+		pattern, err := regexp.Compile(patterns[kind])
+		if err != nil {
+			log.Fatalf("REDACT_PATTERNS_FILE has an invalid pattern for %q: %v", kind, err)
+		}
+		redactions = append(redactions, redaction{kind: kind, pattern: pattern})
+	}
+}
+
+// redactBody replaces the personal data in a body with placeholders like "[redacted email]", and returns how many of
+// each kind were replaced.
+func redactBody(body string) (string, map[string]int) {
+	counts := make(map[string]int)
+	for _, r := range redactions {
+		placeholder := fmt.Sprintf("[redacted %s]", r.kind)
+		body = r.pattern.ReplaceAllStringFunc(body, func(match string) string {
+			if r.valid != nil && !r.valid(match) {
+				return match
+			}
+			counts[r.kind]++
+			return placeholder
+		})
+	}
+	return body, counts
+}
+
+// redactionSummary describes how many of each kind of data were redacted, for the headers of responses that have no
+// body to describe them in.
+func redactionSummary(counts map[string]int) string {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	summary := make([]string, len(kinds))
+	for i, kind := range kinds {
+		summary[i] = fmt.Sprintf("%s=%d", kind, counts[kind])
+	}
+	return strings.Join(summary, ", ")
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Upload pages list related uploads, whose bodies are much alike, to spot duplicates such as the same error reported
+// twice. Bodies are compared by the MinHash signatures of their word shingles, computed when they are submitted, and
+// candidates are found by locality-sensitive hashing: signatures are cut into bands, and uploads sharing the bucket of
+// any band are compared. Numbers are ignored, so that logs differing only in timestamps, addresses or line numbers are
+// alike. Only uploads that viewers can already find are suggested: those of the team an upload belongs to, and those
+// of the viewer's own account, so that public uploads are never discovered through uploads that resemble them.
+
+const (
+	relatedShingleSize   = 3          // Words in a shingle.
+	relatedMinShingles   = 5          // Shingles a body needs to be compared with others.
+	relatedMaxBodyBytes  = 256 * 1024 // Bytes of a body that are shingled, to keep huge bodies cheap.
+	relatedBands         = 16         // Bands a signature is cut into.
+	relatedRowsPerBand   = 4          // Values in a band; with 16 bands, bodies about half alike become candidates.
+	relatedCandidates    = 50         // Candidates compared with an upload.
+	relatedLimit         = 5          // Related uploads shown.
+	relatedMinSimilarity = 0.5        // Estimated share of shingles in common for uploads to be related.
+	relatedIndexBatch    = 100        // Uploads indexed at a time by the job.
+)
+
+// relatedSeeds pick the hash functions of a signature, one for each of its values.
+var relatedSeeds = func() []uint64 {
+	seeds := make([]uint64, relatedBands*relatedRowsPerBand)
+	state := uint64(0x636f7079636174)
+	for i := range seeds {
+		state += 0x9e3779b97f4a7c15
+		seeds[i] = mix64(state)
+	}
+	return seeds
+}()
+
+func init() {
+	RegisterJob(&Job{
+		Name:     "related-index",
+		Interval: 10 * time.Minute,
+		Run:      indexUnsignedUploads,
+	})
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads every bit of x over the result.
+func mix64(x uint64) uint64 {
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// relatedSignature returns the MinHash signature of a body, or nil when it is too short to be compared.
+func relatedSignature(body string) []int64 {
+	if len(body) > relatedMaxBodyBytes {
+		body = body[:relatedMaxBodyBytes]
+	}
+	words := strings.FieldsFunc(strings.ToLower(body), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	// Words with digits in them are mostly numbers, hashes and addresses that differ between otherwise equal bodies.
+	for i, word := range words {
+		if strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+			words[i] = "#"
+		}
+	}
+	if len(words)-relatedShingleSize+1 < relatedMinShingles {
+		return nil
+	}
+
+	signature := make([]uint64, len(relatedSeeds))
+	for i := range signature {
+		signature[i] = ^uint64(0)
+	}
+	for i := 0; i+relatedShingleSize <= len(words); i++ {
+		h := fnv.New64a()
+		for _, word := range words[i : i+relatedShingleSize] {
+			h.Write([]byte(word))
+			h.Write([]byte{0})
+		}
+		shingle := h.Sum64()
+		for j, seed := range relatedSeeds {
+			signature[j] = min(signature[j], mix64(shingle^seed))
+		}
+	}
+	values := make([]int64, len(signature))
+	for i, value := range signature {
+		values[i] = int64(value)
+	}
+	return values
+}
+
+// relatedBuckets returns the bucket of every band of a signature. The band is hashed along with its values, so that
+// equal values in different bands fall into different buckets.
+func relatedBuckets(signature []int64) []int64 {
+	if len(signature) == 0 {
+		return nil
+	}
+	buckets := make([]int64, relatedBands)
+	for band := range buckets {
+		h := fnv.New64a()
+		h.Write([]byte{byte(band)})
+		for _, value := range signature[band*relatedRowsPerBand : (band+1)*relatedRowsPerBand] {
+			h.Write(binary.BigEndian.AppendUint64(nil, uint64(value)))
+		}
+		buckets[band] = int64(h.Sum64())
+	}
+	return buckets
+}
+
+// similarity estimates the share of shingles two bodies have in common from their signatures.
+func similarity(a, b []int64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a))
+}
+
+// IndexRelated records the signature of the body of an upload, replacing the one it had. Bodies too short to be
+// compared get an empty signature, so that the job does not index them again.
+func IndexRelated(ctx context.Context, hash, body string) error {
+	signature := relatedSignature(body)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "DELETE FROM UploadBands WHERE upload_hash = $1", hash); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO UploadSignatures(upload_hash, signature) VALUES ($1, $2)
+		ON CONFLICT (upload_hash) DO UPDATE SET signature = EXCLUDED.signature`,
+		hash, pq.Int64Array(signature)); err != nil {
+		return err
+	}
+	if buckets := relatedBuckets(signature); len(buckets) > 0 {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO UploadBands(upload_hash, bucket) SELECT $1, unnest($2::BIGINT[])",
+			hash, pq.Int64Array(buckets)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// indexRelated indexes a new upload in the background.
+func indexRelated(hash, body string) {
+	go func() {
+		if err := IndexRelated(context.Background(), hash, body); err != nil {
+			log.Printf("failed to index upload %v for related uploads: %v", hash, err)
+		}
+	}()
+}
+
+// indexUnsignedUploads indexes a batch of the uploads that have no signature yet, which were submitted before related
+// uploads were suggested or whose indexing failed.
+func indexUnsignedUploads(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT "+uploadColumns+` FROM Uploads WHERE takedown_at = 0
+		AND NOT EXISTS (SELECT 1 FROM UploadSignatures WHERE upload_hash = hash) ORDER BY id LIMIT $1`, relatedIndexBatch)
+	if err != nil {
+		return err
+	}
+	var uploads []*UploadModel
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		uploads = append(uploads, upload)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err = upload.loadBody(ctx); err != nil {
+			return err
+		}
+		if err = IndexRelated(ctx, upload.Hash, upload.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An alikeUpload is an upload whose body is alike to another one, with their estimated similarity.
+type alikeUpload struct {
+	hash       string
+	similarity float64
+}
+
+// alikeUploads returns the uploads other than hash whose signatures are at least minSimilarity alike to signature, the
+// most alike first. Only uploads matching the condition scope are compared, whose arguments start at $4.
+func alikeUploads(ctx context.Context, hash string, signature []int64, minSimilarity float64, scope string,
+	args ...any) ([]alikeUpload, error) {
+	if len(signature) == 0 {
+		return nil, nil
+	}
+	rows, err := db.QueryContext(ctx, `SELECT upload_hash, signature FROM UploadSignatures WHERE upload_hash <> $1
+		AND upload_hash IN (SELECT upload_hash FROM UploadBands WHERE bucket = ANY($2))
+		AND upload_hash IN (SELECT hash FROM Uploads WHERE deleted_at = 0 AND takedown_at = 0
+			AND (expires_at = 0 OR expires_at > $3) AND (`+scope+`))
+		LIMIT `+strconv.Itoa(relatedCandidates),
+		append([]any{hash, pq.Int64Array(relatedBuckets(signature)), time.Now().UTC().Unix()}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var alike []alikeUpload
+	for rows.Next() {
+		var other string
+		var otherSignature pq.Int64Array
+		if err = rows.Scan(&other, &otherSignature); err != nil {
+			return nil, err
+		}
+		if s := similarity(signature, otherSignature); s >= minSimilarity {
+			alike = append(alike, alikeUpload{other, s})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(alike, func(a, b alikeUpload) int {
+		return cmp.Or(cmp.Compare(b.similarity, a.similarity), strings.Compare(a.hash, b.hash))
+	})
+	return alike, nil
+}
+
+// RelatedUploads returns the uploads most alike to an upload among those the request may find, the most alike first.
+func RelatedUploads(c *gin.Context, upload *UploadModel) ([]*UploadModel, error) {
+	var accountId int64
+	if account := currentAccount(c); account != nil {
+		accountId = account.Id
+	}
+	if accountId == 0 && upload.TeamId == 0 {
+		return nil, nil
+	}
+	var signature pq.Int64Array
+	err := db.QueryRow("SELECT signature FROM UploadSignatures WHERE upload_hash = $1", upload.Hash).Scan(&signature)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	alike, err := alikeUploads(c.Request.Context(), upload.Hash, signature, relatedMinSimilarity,
+		"team_id <> 0 AND team_id = $4 OR account_id <> 0 AND account_id = $5", upload.TeamId, accountId)
+	if err != nil {
+		return nil, err
+	}
+	related := []*UploadModel{}
+	for _, candidate := range alike {
+		if len(related) == relatedLimit {
+			break
+		}
+		// The candidate may have been deleted or expired since.
+		if other, err := GetUpload(candidate.hash); err == nil {
+			related = append(related, other)
+		}
+	}
+	return related, nil
+}
+
+// relatedList returns the related uploads shown on the page of an upload, which the request may view.
+func relatedList(c *gin.Context, upload *UploadModel) []linkedUpload {
+	related, err := RelatedUploads(c, upload)
+	if err != nil {
+		log.Printf("failed to find uploads related to %v: %v", upload.Hash, err)
+		return nil
+	}
+	return visibleUploadList(c, related)
+}
+
+func registerRelatedRoutes(r *gin.Engine) {
+	// The uploads alike to an upload that the request may view.
+	r.GET("/api/v1/uploads/:hash/related", func(c *gin.Context) {
+		upload := viewableUpload(c)
+		if upload == nil {
+			return
+		}
+		related, err := RelatedUploads(c, upload)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"uploads": uploadListJSON(visibleUploadList(c, related)),
+		})
+	})
+}
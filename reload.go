@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/lpernett/godotenv"
+)
+
+// Parts of the configuration can be reloaded without a restart, so that in-flight transfers are not dropped: the
+// .env file is read again and every registered reloader applies the variables it is responsible for. A server reloads
+// on SIGHUP, and every replica reloads when an admin asks for it through the API. Other settings, such as the database
+// and the storage, still need a restart.
+
+// reloadChannel is the Postgres channel on which replicas tell each other to reload, with the origin of the request
+// as the payload.
+const reloadChannel = "copycat_reload"
+
+// reloadOrigin identifies this server in reload notifications, so that it does not reload twice.
+var reloadOrigin = randomToken()
+
+// processEnv holds the names of the variables set in the environment of the process, which the .env file does not
+// override, on start as on reload. Package variables are initialized before the .env file is loaded.
+var processEnv = func() map[string]bool {
+	names := make(map[string]bool)
+	for _, pair := range os.Environ() {
+		name, _, _ := strings.Cut(pair, "=")
+		names[name] = true
+	}
+	return names
+}()
+
+// envFileNames holds the names of the variables the .env file set when it was last loaded, so that the ones removed
+// from it are unset on reload instead of keeping their old values.
+var envFileNames map[string]bool
+
+// loadEnvFile reads the .env file and sets its variables in the environment, except those set in the environment of
+// the process. Variables it set before and that are no longer in the file are unset.
+func loadEnvFile() error {
+	values, err := godotenv.Read()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for name, value := range values {
+		if !processEnv[name] {
+			os.Setenv(name, value)
+			names[name] = true
+		}
+	}
+	for name := range envFileNames {
+		if !names[name] {
+			os.Unsetenv(name)
+		}
+	}
+	envFileNames = names
+	return nil
+}
+
+// A reloader applies the current environment to a part of the configuration. When the new configuration is invalid,
+// it returns an error and keeps the one in use.
+type reloader struct {
+	name   string
+	reload func() error
+}
+
+var reloaders []reloader
+
+// reloadMutex keeps reloads from running at the same time.
+var reloadMutex sync.Mutex
+
+// RegisterReloader adds a part of the configuration that is reloaded by reloadConfig.
+func RegisterReloader(name string, reload func() error) {
+	reloaders = append(reloaders, reloader{name, reload})
+}
+
+// loadFlag sets a feature flag from the boolean environment variable name, now and on every reload.
+func loadFlag(flag *atomic.Bool, name string) {
+	flag.Store(envBool(name))
+	RegisterReloader(name, func() error {
+		flag.Store(envBool(name))
+		return nil
+	})
+}
+
+// reloadConfig reads the .env file again and reloads every registered part of the configuration. Parts that fail to
+// reload keep their configuration, and their errors are returned together.
+func reloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if err := loadEnvFile(); err != nil {
+		return fmt.Errorf("failed to read the .env file: %v", err)
+	}
+
+	var errs []error
+	for _, r := range reloaders {
+		if err := r.reload(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", r.name, err))
+		}
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		log.Printf("Reloaded the configuration with errors: %v", err)
+	} else {
+		log.Println("Reloaded the configuration")
+	}
+	return err
+}
+
+func initReload() {
+	// Banners are reloaded along with the rest, rather than on the next refresh of announcements.
+	RegisterReloader("announcements", loadAnnouncements)
+
+	notifyReloadSignal()
+	listenForReloads()
+}
+
+// listenForReloads reloads the configuration when another replica asks for it on reloadChannel.
+func listenForReloads() {
+	listener := pq.NewListener(dbConnStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("reload listener: %v", err)
+		}
+	})
+	if err := listener.Listen(reloadChannel); err != nil {
+		log.Fatal("failed to listen for configuration reloads: ", err)
+	}
+	go func() {
+		for notification := range listener.Notify {
+			if notification != nil && notification.Extra != reloadOrigin {
+				reloadConfig()
+			}
+		}
+	}()
+}
+
+func registerReloadRoutes(r *gin.Engine) {
+	// Reload the configuration on every replica. The errors reported are those of this server; the other replicas log
+	// theirs.
+	r.POST("/api/v1/admin/reload", requireRole(RoleAdmin), func(c *gin.Context) {
+		err := reloadConfig()
+		RecordAudit(currentAccount(c).Username, "config.reload", "", "", c.ClientIP())
+		if _, notifyErr := db.Exec("SELECT pg_notify($1, $2)", reloadChannel, reloadOrigin); notifyErr != nil {
+			respondError(c, http.StatusInternalServerError, fmt.Errorf("failed to ask the other replicas to reload: %v", notifyErr))
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusUnprocessableEntity, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Configuration reloaded",
+		})
+	})
+}
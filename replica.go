@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// replicatedStore writes every object to a primary and a replica store, for example buckets in two regions, and
+// reads from the replica when the primary fails. It is used when STORAGE_REPLICA is set.
+type replicatedStore struct {
+	primary, replica ObjectStore
+}
+
+// Get falls back to the replica when the primary fails, unless the object is merely archived in the primary.
+func (s replicatedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.primary.Get(ctx, key)
+	if err == nil || errors.Is(err, ErrObjectArchived) {
+		return data, err
+	}
+	log.Printf("Reading %v from %v failed, falling back to %v: %v", key, s.primary, s.replica, err)
+	return s.replica.Get(ctx, key)
+}
+
+func (s replicatedStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := s.primary.Open(ctx, key)
+	if err == nil || errors.Is(err, ErrObjectArchived) {
+		return body, err
+	}
+	log.Printf("Reading %v from %v failed, falling back to %v: %v", key, s.primary, s.replica, err)
+	return s.replica.Open(ctx, key)
+}
+
+func (s replicatedStore) OpenAt(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	body, err := openObjectAt(ctx, s.primary, key, offset)
+	if err == nil || errors.Is(err, ErrObjectArchived) {
+		return body, err
+	}
+	log.Printf("Reading %v from %v failed, falling back to %v: %v", key, s.primary, s.replica, err)
+	return openObjectAt(ctx, s.replica, key, offset)
+}
+
+// Put only succeeds once the object is in both stores, so that every stored upload can survive losing one of them.
+func (s replicatedStore) Put(ctx context.Context, key string, data []byte, tags ObjectTags) error {
+	if err := s.primary.Put(ctx, key, data, tags); err != nil {
+		return err
+	}
+	if err := s.replica.Put(ctx, key, data, tags); err != nil {
+		return fmt.Errorf("failed to replicate to %v: %v", s.replica, err)
+	}
+	return nil
+}
+
+func (s replicatedStore) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := s.primary.Exists(ctx, key)
+	if err == nil && exists {
+		return true, nil
+	}
+	return s.replica.Exists(ctx, key)
+}
+
+func (s replicatedStore) Delete(ctx context.Context, keys []string) error {
+	return errors.Join(s.primary.Delete(ctx, keys), s.replica.Delete(ctx, keys))
+}
+
+func (s replicatedStore) SetTags(ctx context.Context, key string, tags ObjectTags) error {
+	return errors.Join(s.primary.SetTags(ctx, key, tags), s.replica.SetTags(ctx, key, tags))
+}
+
+// Archive only archives the primary's copy; the replica is left readable as the disaster recovery copy.
+func (s replicatedStore) Archive(ctx context.Context, key string) error {
+	primary, ok := s.primary.(ArchivingStore)
+	if !ok {
+		return fmt.Errorf("%v cannot archive", s.primary)
+	}
+	return primary.Archive(ctx, key)
+}
+
+func (s replicatedStore) Retrieve(ctx context.Context, key string) error {
+	primary, ok := s.primary.(ArchivingStore)
+	if !ok {
+		return fmt.Errorf("%v cannot archive", s.primary)
+	}
+	return primary.Retrieve(ctx, key)
+}
+
+func (s replicatedStore) String() string {
+	return s.primary.String() + " (replica " + s.replica.String() + ")"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Internal instances can be closed to anonymous visitors with REQUIRE_LOGIN, so that viewing, downloading and
+// submitting all need an account or an API token. Browsers are sent to the login page, and other clients get a 401.
+// Logging in, the callers that authenticate in their own way and health checks are exempt, along with the paths in
+// LOGIN_EXEMPT_PATHS.
+
+// loginExemptPaths are always reachable without logging in. Paths ending in "/" exempt everything under them.
+var loginExemptPaths = []string{
+	"/login", "/login/2fa", "/logout", "/register", "/saml/", // Logging in.
+	"/scim/", "/api/v1/federation/", "/api/v1/storage/events", // Identity providers, peers and S3 notifications.
+	"/healthz", "/robots.txt", "/.well-known/copycat.json",
+}
+
+var (
+	requireLogin     atomic.Bool
+	extraExemptPaths atomic.Pointer[[]string] // From LOGIN_EXEMPT_PATHS.
+)
+
+func initRequireLogin() {
+	loadFlag(&requireLogin, "REQUIRE_LOGIN")
+	loadLoginExemptPaths()
+	RegisterReloader("LOGIN_EXEMPT_PATHS", func() error {
+		loadLoginExemptPaths()
+		return nil
+	})
+}
+
+func loadLoginExemptPaths() {
+	var paths []string
+	for _, path := range strings.Split(os.Getenv("LOGIN_EXEMPT_PATHS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	extraExemptPaths.Store(&paths)
+}
+
+// loginExempt reports whether a path may be requested without logging in.
+func loginExempt(path string) bool {
+	for _, paths := range [][]string{loginExemptPaths, *extraExemptPaths.Load()} {
+		for _, exempt := range paths {
+			if path == exempt || strings.HasSuffix(exempt, "/") && strings.HasPrefix(path, exempt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireLoginToView is a middleware that, with REQUIRE_LOGIN set, only lets logged in accounts continue to the paths
+// that are not exempt.
+func requireLoginToView(c *gin.Context) {
+	if !requireLogin.Load() || currentAccount(c) != nil || loginExempt(c.Request.URL.Path) {
+		c.Next()
+		return
+	}
+	// Only pages redirect; downloads and API requests are made by clients that cannot log in on a page.
+	path := c.Request.URL.Path
+	if c.Request.Method == http.MethodGet && !strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/f/") &&
+		!strings.HasPrefix(path, "/stream/") && path != "/download" && !wantsJSON(c) {
+		c.Redirect(http.StatusSeeOther, "/login")
+		c.Abort()
+		return
+	}
+	abortWithError(c, http.StatusUnauthorized, ErrLoginRequired, nil)
+}
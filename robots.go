@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sitemapLimit is the most URLs a sitemap may list. Older uploads are left out beyond it.
+const sitemapLimit = 50000
+
+// Search engine settings. With noindex, search engines are asked to stay away from the whole site. Public uploads are
+// only listed in /sitemap.xml when sitemap is set, as the list makes every one of them easy to find and scrape.
+// robotsTxt replaces the generated robots.txt when it is set.
+var (
+	noindex   atomic.Bool
+	sitemap   atomic.Bool
+	robotsTxt atomic.Pointer[[]byte]
+)
+
+func initRobots() {
+	if err := loadRobots(); err != nil {
+		log.Fatal(err)
+	}
+	RegisterReloader("robots", loadRobots)
+}
+
+func loadRobots() error {
+	var txt []byte
+	if path := os.Getenv("ROBOTS_TXT_FILE"); path != "" {
+		var err error
+		if txt, err = os.ReadFile(path); err != nil {
+			return fmt.Errorf("could not read ROBOTS_TXT_FILE: %v", err)
+		}
+	}
+	robotsTxt.Store(&txt)
+	noindex.Store(os.Getenv("ROBOTS") == "noindex")
+	sitemap.Store(os.Getenv("SITEMAP") == "true")
+	return nil
+}
+
+// robotsHeader asks search engines not to index any response when the site is not to be indexed. Unlike robots.txt,
+// it also keeps pages that are linked from elsewhere out of search results.
+func robotsHeader(c *gin.Context) {
+	if noindex.Load() {
+		c.Header("X-Robots-Tag", "noindex, nofollow")
+	}
+	c.Next()
+}
+
+// PublicUploads returns the short hashes and times of the most recent uploads that anyone may view, newest first.
+func PublicUploads(limit int) (hashes []string, timestamps []int64, err error) {
+	rows, err := db.Query(`SELECT hash, short_alphabet, short_length, timestamp FROM Uploads WHERE NOT private AND team_id = 0 AND deleted_at = 0
+		AND takedown_at = 0 AND quarantined_at = 0 AND publish_at <= $1 AND (expires_at = 0 OR expires_at > $1) ORDER BY id DESC LIMIT $2`,
+		time.Now().UTC().Unix(), limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var upload UploadModel
+		if err = rows.Scan(&upload.Hash, &upload.ShortAlphabet, &upload.ShortLength, &upload.Timestamp); err != nil {
+			return nil, nil, err
+		}
+		hashes = append(hashes, upload.ShortHash())
+		timestamps = append(timestamps, upload.Timestamp)
+	}
+	return hashes, timestamps, rows.Err()
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+func registerRobotsRoutes(r *gin.Engine) {
+	r.GET("/robots.txt", func(c *gin.Context) {
+		if txt := *robotsTxt.Load(); txt != nil {
+			c.Data(http.StatusOK, "text/plain; charset=utf-8", txt)
+			return
+		}
+		if noindex.Load() {
+			c.String(http.StatusOK, "User-agent: *\nDisallow: /\n")
+			return
+		}
+		// Share links lead to private uploads and the API and attachments are no use in search results.
+		txt := "User-agent: *\nDisallow: /api/\nDisallow: /share/\nDisallow: /f/\nDisallow: /download\nDisallow: /stream/\n"
+		if sitemap.Load() {
+			txt += "\nSitemap: " + baseurl + "/sitemap.xml\n"
+		}
+		c.String(http.StatusOK, txt)
+	})
+
+	r.GET("/sitemap.xml", func(c *gin.Context) {
+		if noindex.Load() || !sitemap.Load() {
+			route404(c)
+			return
+		}
+		hashes, timestamps, err := PublicUploads(sitemapLimit)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		urls := sitemapURLSet{URLs: make([]sitemapURL, len(hashes))}
+		for i, hash := range hashes {
+			urls.URLs[i] = sitemapURL{
+				Loc:     baseurl + uploadPath(hash),
+				LastMod: time.Unix(timestamps[i], 0).UTC().Format(time.DateOnly),
+			}
+		}
+		c.XML(http.StatusOK, urls)
+	})
+}
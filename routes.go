@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upload pages live at /p/:hash. The older links at /:hash keep working, but only for words that can never become a
+// page: the first path segment of every registered route is reserved, along with the pages in reservedRoutes that may
+// be added later, so that adding a page never takes over the links of an upload or the other way around.
+
+// reservedRoutes are the first path segments that never name an upload. Registered routes are added at startup.
+var reservedRoutes = map[string]bool{
+	"admin":    true,
+	"browse":   true,
+	"explore":  true,
+	"help":     true,
+	"new":      true,
+	"search":   true,
+	"settings": true,
+}
+
+// reserveRegisteredRoutes reserves the first path segment of every route of r. It is called once all routes are
+// registered, before the server starts.
+func reserveRegisteredRoutes(r *gin.Engine) {
+	for _, route := range r.Routes() {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(route.Path, "/"), "/")
+		if segment != "" && !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			reservedRoutes[segment] = true
+		}
+	}
+}
+
+// uploadPath returns the path of the page of an upload named by its short hash.
+func uploadPath(shortHash string) string {
+	return "/p/" + shortHash
+}
+
+// legacyUploadRoute serves an upload page at its older path, unless the first segment is reserved, and points to the
+// canonical path with a Link header.
+func legacyUploadRoute(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hash := uploadParam(c)
+		if reservedRoutes[hash] {
+			route404(c)
+			return
+		}
+		path := uploadPath(hash) + strings.TrimPrefix(c.Request.URL.Path, "/"+c.Param("hash"))
+		c.Header("Link", "<"+baseurl+path+`>; rel="canonical"`)
+		handler(c)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// samlRequestCookie holds the id of the authentication request sent to the identity provider, so that only a
+	// response to it is accepted.
+	samlRequestCookie   = "copycat_saml"
+	samlRequestLifetime = 10 * time.Minute
+)
+
+var ErrSAMLResponseInvalid = errors.New("the response of the identity provider was not accepted")
+
+// samlProvider lets an enterprise identity provider such as Okta or Azure AD log users in with SAML 2.0, or is nil
+// when SAML_IDP_METADATA is not set.
+var samlProvider *saml.ServiceProvider
+
+var (
+	samlUsernameAttribute string // Attribute holding the username, or "" for the NameID of the subject.
+	samlGroupsAttribute   string
+	samlGroups            GroupMapping
+)
+
+func initSAML() {
+	metadata := os.Getenv("SAML_IDP_METADATA")
+	if metadata == "" {
+		return
+	}
+	idp, err := loadIDPMetadata(metadata)
+	if err != nil {
+		log.Fatal("failed to load the SAML_IDP_METADATA of the identity provider: ", err)
+	}
+	keyPair, err := tls.LoadX509KeyPair(os.Getenv("SAML_CERT_FILE"), os.Getenv("SAML_KEY_FILE"))
+	if err != nil {
+		log.Fatal("SAML_CERT_FILE and SAML_KEY_FILE environment variables must name a certificate and RSA key: ", err)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		log.Fatal("SAML_KEY_FILE environment variable must name an RSA key")
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		log.Fatal("failed to parse SAML_CERT_FILE: ", err)
+	}
+	metadataURL, _ := url.Parse(baseurl + "/saml/metadata")
+	acsURL, _ := url.Parse(baseurl + "/saml/acs")
+
+	samlProvider = &saml.ServiceProvider{
+		EntityID:          os.Getenv("SAML_ENTITY_ID"), // Defaults to the metadata URL.
+		Key:               key,
+		Certificate:       cert,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idp,
+		AllowIDPInitiated: envBool("SAML_ALLOW_IDP_INITIATED"),
+	}
+	samlUsernameAttribute = os.Getenv("SAML_USERNAME_ATTRIBUTE")
+	if samlGroupsAttribute = os.Getenv("SAML_GROUPS_ATTRIBUTE"); samlGroupsAttribute == "" {
+		samlGroupsAttribute = "groups"
+	}
+	samlGroups = GroupMapping{
+		Roles: parseGroupMap(os.Getenv("SAML_ROLE_MAP")),
+		Teams: parseGroupMap(os.Getenv("SAML_TEAM_MAP")),
+	}
+	if err = samlGroups.Validate(); err != nil {
+		log.Fatal("SAML_ROLE_MAP environment variable must map groups to roles: ", err)
+	}
+}
+
+// loadIDPMetadata reads the metadata of the identity provider from a URL or a file.
+func loadIDPMetadata(location string) (*saml.EntityDescriptor, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://") {
+		var resp *http.Response
+		if resp, err = (&http.Client{Timeout: 30 * time.Second}).Get(location); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%v answered %v", location, resp.Status)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	} else {
+		data, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	idp := new(saml.EntityDescriptor)
+	if err = xml.Unmarshal(data, idp); err != nil {
+		return nil, err
+	}
+	return idp, nil
+}
+
+func samlRequestSignature(payload string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("saml\n" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setSAMLRequest remembers the id of an authentication request. The response is posted to us from the site of the
+// identity provider, so the cookie must be SameSite=None to be sent with it, which browsers only allow when Secure.
+func setSAMLRequest(c *gin.Context, id string) {
+	payload := id + " " + strconv.FormatInt(time.Now().Add(samlRequestLifetime).Unix(), 10)
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie(samlRequestCookie, base64.RawURLEncoding.EncodeToString([]byte(payload))+"."+samlRequestSignature(payload),
+		int(samlRequestLifetime.Seconds()), "/saml/", "", true, true)
+}
+
+// samlRequestIds returns the id of the pending authentication request of the browser, if any.
+func samlRequestIds(c *gin.Context) []string {
+	cookie, _ := c.Cookie(samlRequestCookie)
+	encoded, signature, _ := strings.Cut(cookie, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(samlRequestSignature(string(payload)))) {
+		return nil
+	}
+	id, expStr, _ := strings.Cut(string(payload), " ")
+	exp, _ := strconv.ParseInt(expStr, 10, 64)
+	if time.Now().Unix() > exp {
+		return nil
+	}
+	return []string{id}
+}
+
+// samlAttribute returns the values of an attribute of the assertion, matched by its name or friendly name.
+func samlAttribute(assertion *saml.Assertion, name string) []string {
+	var values []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name == name || attribute.FriendlyName == name {
+				for _, value := range attribute.Values {
+					values = append(values, value.Value)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// samlAccount returns the account of the subject of an assertion, creating it on its first login, and brings its role
+// and team memberships up to date with its groups.
+func samlAccount(assertion *saml.Assertion, ip string) (*Account, error) {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, ErrSAMLResponseInvalid
+	}
+	subject := assertion.Subject.NameID.Value
+	name := subject
+	if samlUsernameAttribute != "" {
+		values := samlAttribute(assertion, samlUsernameAttribute)
+		if len(values) == 0 {
+			return nil, fmt.Errorf("the identity provider did not send the %v attribute", samlUsernameAttribute)
+		}
+		name = values[0]
+	}
+
+	account, created, err := ExternalAccount("saml:"+subject, externalUsername(name))
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		RecordAudit("identity provider", "account.create", account.Username, "saml", ip)
+	}
+	if err = samlGroups.Apply(account, samlAttribute(assertion, samlGroupsAttribute), ip); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func registerSAMLRoutes(r *gin.Engine) {
+	// Configure the identity provider with this.
+	r.GET("/saml/metadata", func(c *gin.Context) {
+		if samlProvider == nil {
+			route404(c)
+			return
+		}
+		metadata, err := xml.MarshalIndent(samlProvider.Metadata(), "", "  ")
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+	})
+
+	// Send the browser to the identity provider to log in.
+	r.GET("/saml/login", func(c *gin.Context) {
+		if samlProvider == nil {
+			route404(c)
+			return
+		}
+		req, err := samlProvider.MakeAuthenticationRequest(samlProvider.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+			saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		redirect, err := req.Redirect("", samlProvider)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		setSAMLRequest(c, req.ID)
+		c.Redirect(http.StatusSeeOther, redirect.String())
+	})
+
+	// The assertion consumer service, where the identity provider posts its response once the user logged in.
+	r.POST("/saml/acs", func(c *gin.Context) {
+		if samlProvider == nil {
+			route404(c)
+			return
+		}
+		assertion, err := samlProvider.ParseResponse(c.Request, samlRequestIds(c))
+		if err != nil {
+			// Why a response was rejected is only logged, since the details could help forge one.
+			if invalid, ok := err.(*saml.InvalidResponseError); ok {
+				err = invalid.PrivateErr
+			}
+			log.Printf("rejected a SAML response from %v: %v", c.ClientIP(), err)
+			respondError(c, http.StatusForbidden, ErrSAMLResponseInvalid)
+			return
+		}
+		c.SetSameSite(http.SameSiteNoneMode)
+		c.SetCookie(samlRequestCookie, "", -1, "/saml/", "", true, true)
+
+		account, err := samlAccount(assertion, c.ClientIP())
+		if err == ErrSAMLResponseInvalid || err == ErrExternalUsernameTaken || err == ErrAccountDisabled {
+			respondError(c, http.StatusForbidden, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if account.TwoFactor {
+			setTwoFactorPending(c, account)
+			renderPage(c, http.StatusOK, "login.html", gin.H{
+				"Page":      NewPageInfo(c, "Log in"),
+				"TwoFactor": true,
+			})
+			return
+		}
+		if err = setSession(c, account); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if account.MustEnrollTwoFactor() {
+			c.Redirect(http.StatusSeeOther, "/account/2fa")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/")
+	})
+}
@@ -0,0 +1,764 @@
+package main
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SCIM 2.0 (RFC 7643 and 7644) lets an identity provider such as Okta or Azure AD create, update and deactivate
+// accounts, and manage the members of teams, which it sees as groups. Usernames are made from the userName of the
+// provider like those of single sign-on, so that the first SAML login of a provisioned account is linked to it. Only
+// accounts that SCIM created are managed by it: local accounts, such as those of the administrators, are neither listed,
+// changed nor deactivated through SCIM, and are left out of the members of groups.
+const (
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimPageSize     = 100
+)
+
+var (
+	ErrSCIMNotFound      = errors.New("resource not found")
+	ErrSCIMFilterInvalid = errors.New(`only filters like 'userName eq "name"', 'externalId eq "id"' and 'displayName eq "name"' are supported`)
+)
+
+// scimToken is the bearer token the identity provider authenticates with, from SCIM_TOKEN. SCIM is disabled without it.
+var scimToken string
+
+func initSCIM() {
+	scimToken = os.Getenv("SCIM_TOKEN")
+}
+
+// A scimError is the body of a failed SCIM request.
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+func scimJSON(c *gin.Context, code int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		code, data = http.StatusInternalServerError, []byte(`{"status":"500"}`)
+	}
+	c.Data(code, "application/scim+json", data)
+}
+
+func respondSCIMError(c *gin.Context, code int, scimType string, err error) {
+	scimJSON(c, code, scimError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(code),
+		ScimType: scimType,
+		Detail:   err.Error(),
+	})
+}
+
+// requireSCIM is a middleware that only lets the identity provider continue.
+func requireSCIM(c *gin.Context) {
+	if scimToken == "" {
+		route404(c)
+		c.Abort()
+		return
+	}
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !hmac.Equal([]byte(token), []byte(scimToken)) {
+		respondSCIMError(c, http.StatusUnauthorized, "", errors.New("invalid SCIM token"))
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// A scimUser is an account as SCIM sees it.
+type scimUser struct {
+	Id         int64
+	Username   string
+	Created    int64
+	Disabled   bool
+	ExternalId string
+}
+
+const scimUserColumns = "id, username, created, disabled, scim_external_id"
+
+func scanSCIMUser(row rowScanner) (*scimUser, error) {
+	user := new(scimUser)
+	if err := row.Scan(&user.Id, &user.Username, &user.Created, &user.Disabled, &user.ExternalId); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (user *scimUser) resource() gin.H {
+	id := strconv.FormatInt(user.Id, 10)
+	return gin.H{
+		"schemas":    []string{scimUserSchema},
+		"id":         id,
+		"externalId": user.ExternalId,
+		"userName":   user.Username,
+		"active":     !user.Disabled,
+		"meta": gin.H{
+			"resourceType": "User",
+			"created":      time.Unix(user.Created, 0).UTC().Format(time.RFC3339),
+			"location":     baseurl + "/scim/v2/Users/" + id,
+		},
+	}
+}
+
+// GetSCIMUser fetches an account provisioned through SCIM by the id SCIM knows it by.
+func GetSCIMUser(id string) (*scimUser, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanSCIMUser(db.QueryRow("SELECT "+scimUserColumns+" FROM Accounts WHERE id = $1 AND provisioned", n))
+}
+
+// ProvisionSCIMUser marks an account created by SCIM as provisioned, which puts it under the management of SCIM.
+func ProvisionSCIMUser(id int64) error {
+	_, err := db.Exec("UPDATE Accounts SET provisioned = TRUE WHERE id = $1", id)
+	return err
+}
+
+// UpdateSCIMUser stores the attributes of a user that SCIM manages. Accounts that were not provisioned through SCIM
+// are not found.
+func UpdateSCIMUser(user *scimUser) error {
+	account, err := scanAccount(db.QueryRow("SELECT "+accountColumns+" FROM Accounts WHERE id = $1 AND provisioned", user.Id))
+	if err != nil {
+		return err
+	}
+	if user.Username != account.Username {
+		if err = RenameAccount(account, user.Username); err != nil {
+			return err
+		}
+	}
+	if user.Disabled != account.Disabled {
+		if err = SetDisabled(account, user.Disabled); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("UPDATE Accounts SET scim_external_id = $1 WHERE id = $2", user.ExternalId, user.Id)
+	return err
+}
+
+// scimFilterPattern matches the only kind of filter identity providers need: equality with one attribute.
+var scimFilterPattern = regexp.MustCompile(`(?i)^\s*(userName|externalId|displayName)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// parseSCIMFilter returns the attribute and value of a filter, or "" for no filter.
+func parseSCIMFilter(filter string) (attribute, value string, err error) {
+	if filter == "" {
+		return "", "", nil
+	}
+	m := scimFilterPattern.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", ErrSCIMFilterInvalid
+	}
+	if err = json.Unmarshal([]byte(`"`+m[2]+`"`), &value); err != nil {
+		return "", "", ErrSCIMFilterInvalid
+	}
+	return strings.ToLower(m[1]), value, nil
+}
+
+// scimPage returns the 0-based offset and the size of the page of a list request.
+func scimPage(c *gin.Context) (offset, count int) {
+	start, err := strconv.Atoi(c.Query("startIndex"))
+	if err != nil || start < 1 {
+		start = 1
+	}
+	count, err = strconv.Atoi(c.Query("count"))
+	if err != nil || count < 0 || count > scimPageSize {
+		count = scimPageSize
+	}
+	return start - 1, count
+}
+
+func scimList(c *gin.Context, offset, total int, resources []gin.H) {
+	if resources == nil {
+		resources = []gin.H{}
+	}
+	scimJSON(c, http.StatusOK, gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   offset + 1,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// ListSCIMUsers returns a page of the accounts provisioned through SCIM, optionally only those whose username or
+// external id equals a value, and the number of accounts that match.
+func ListSCIMUsers(column, value string, offset, count int) ([]*scimUser, int, error) {
+	where := "provisioned"
+	args := []any{}
+	if column != "" {
+		where += " AND " + column + " = $1"
+		args = append(args, value)
+	}
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM Accounts WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query("SELECT "+scimUserColumns+" FROM Accounts WHERE "+where+" ORDER BY id"+
+		" OFFSET "+strconv.Itoa(offset)+" LIMIT "+strconv.Itoa(count), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []*scimUser
+	for rows.Next() {
+		user, err := scanSCIMUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+// scimGroup returns a team as a SCIM group, with its members that SCIM provisioned.
+func scimGroup(team *Team) (gin.H, error) {
+	rows, err := db.Query(`SELECT a.id, a.username FROM TeamMembers m JOIN Accounts a ON a.id = m.account_id
+		WHERE m.team_id = $1 AND a.provisioned ORDER BY a.id`, team.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []gin.H{}
+	for rows.Next() {
+		var id int64
+		var username string
+		if err = rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		members = append(members, gin.H{
+			"value":   strconv.FormatInt(id, 10),
+			"display": username,
+			"$ref":    baseurl + "/scim/v2/Users/" + strconv.FormatInt(id, 10),
+		})
+	}
+	id := strconv.FormatInt(team.Id, 10)
+	return gin.H{
+		"schemas":     []string{scimGroupSchema},
+		"id":          id,
+		"displayName": team.Name,
+		"members":     members,
+		"meta": gin.H{
+			"resourceType": "Group",
+			"created":      time.Unix(team.Created, 0).UTC().Format(time.RFC3339),
+			"location":     baseurl + "/scim/v2/Groups/" + id,
+		},
+	}, rows.Err()
+}
+
+// GetTeamByID fetches a team by its id.
+func GetTeamByID(id string) (*Team, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	team := new(Team)
+	err = db.QueryRow("SELECT id, slug, name, created FROM Teams WHERE id = $1", n).Scan(&team.Id, &team.Slug, &team.Name, &team.Created)
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// ListSCIMTeams returns a page of teams, optionally only the one whose slug or name equals a value, and the number of
+// teams that match.
+func ListSCIMTeams(name string, offset, count int) ([]*Team, int, error) {
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM Teams WHERE $1 = '' OR slug = $1 OR name = $1", name).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query(`SELECT id, slug, name, created FROM Teams WHERE $1 = '' OR slug = $1 OR name = $1
+		ORDER BY id OFFSET $2 LIMIT $3`, name, offset, count)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var teams []*Team
+	for rows.Next() {
+		team := new(Team)
+		if err = rows.Scan(&team.Id, &team.Slug, &team.Name, &team.Created); err != nil {
+			return nil, 0, err
+		}
+		teams = append(teams, team)
+	}
+	return teams, total, rows.Err()
+}
+
+// teamSlug turns the display name of a group into a valid team slug.
+func teamSlug(name string) string {
+	return strings.Trim(strings.ReplaceAll(externalUsername(name), "_", "-"), "-")
+}
+
+// A scimMember is a member of a group in a request, by the id of its account.
+type scimMember struct {
+	Value string `json:"value"`
+}
+
+// addSCIMMembers adds accounts provisioned through SCIM to the team as members. Accounts that are already members keep
+// their role.
+func addSCIMMembers(team *Team, members []scimMember) error {
+	for _, member := range members {
+		account, err := scanAccount(db.QueryRow("SELECT "+accountColumns+" FROM Accounts WHERE id = $1 AND provisioned",
+			parseSCIMId(member.Value)))
+		if err == sql.ErrNoRows {
+			return ErrSCIMNotFound
+		} else if err != nil {
+			return err
+		}
+		role, err := team.Role(account)
+		if err != nil {
+			return err
+		}
+		if role == "" {
+			if err = team.SetMember(account, TeamRoleMember); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeSCIMMembers removes accounts provisioned through SCIM from the team, or every such member when ids is nil.
+// Owners are never removed, so that the team keeps someone who can manage it in copycat, and neither are local accounts.
+func removeSCIMMembers(team *Team, ids []int64) error {
+	const provisioned = " AND account_id IN (SELECT id FROM Accounts WHERE provisioned)"
+	if ids == nil {
+		_, err := db.Exec("DELETE FROM TeamMembers WHERE team_id = $1 AND role <> $2"+provisioned, team.Id, TeamRoleOwner)
+		return err
+	}
+	for _, id := range ids {
+		if _, err := db.Exec("DELETE FROM TeamMembers WHERE team_id = $1 AND account_id = $2 AND role <> $3"+provisioned, team.Id, id, TeamRoleOwner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseSCIMId(id string) int64 {
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return n
+}
+
+// scimBool reads a boolean of a PATCH operation. Azure AD sends them as the strings "True" and "False".
+func scimBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(s)
+}
+
+// A scimPatch is the body of a PATCH request.
+type scimPatch struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimMemberPathPattern matches the path of a PATCH operation that removes one member, like members[value eq "12"].
+var scimMemberPathPattern = regexp.MustCompile(`(?i)^members\[value eq "(\d+)"\]$`)
+
+func registerSCIMRoutes(r *gin.Engine) {
+	scim := r.Group("/scim/v2", requireSCIM)
+
+	scim.GET("/ServiceProviderConfig", func(c *gin.Context) {
+		scimJSON(c, http.StatusOK, gin.H{
+			"schemas":        []string{scimConfigSchema},
+			"patch":          gin.H{"supported": true},
+			"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         gin.H{"supported": true, "maxResults": scimPageSize},
+			"changePassword": gin.H{"supported": false},
+			"sort":           gin.H{"supported": false},
+			"etag":           gin.H{"supported": false},
+			"authenticationSchemes": []gin.H{{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer token",
+				"description": "The SCIM_TOKEN of the instance",
+			}},
+		})
+	})
+
+	// respondUserError answers with the SCIM error for a failure to store a user.
+	respondUserError := func(c *gin.Context, err error) {
+		switch err {
+		case ErrUsernameTaken:
+			respondSCIMError(c, http.StatusConflict, "uniqueness", err)
+		case ErrUsernameInvalid:
+			respondSCIMError(c, http.StatusBadRequest, "invalidValue", err)
+		case sql.ErrNoRows:
+			respondSCIMError(c, http.StatusNotFound, "", ErrSCIMNotFound)
+		default:
+			respondSCIMError(c, http.StatusInternalServerError, "", err)
+		}
+	}
+
+	// The user of the :id parameter, or nil after answering with 404.
+	paramUser := func(c *gin.Context) *scimUser {
+		user, err := GetSCIMUser(c.Param("id"))
+		if err != nil {
+			respondUserError(c, err)
+			return nil
+		}
+		return user
+	}
+
+	scim.GET("/Users", func(c *gin.Context) {
+		attribute, value, err := parseSCIMFilter(c.Query("filter"))
+		if err != nil || attribute == "displayname" {
+			respondSCIMError(c, http.StatusBadRequest, "invalidFilter", ErrSCIMFilterInvalid)
+			return
+		}
+		column := map[string]string{"username": "username", "externalid": "scim_external_id"}[attribute]
+		if column == "username" {
+			value = externalUsername(value)
+		}
+		offset, count := scimPage(c)
+		users, total, err := ListSCIMUsers(column, value, offset, count)
+		if err != nil {
+			respondUserError(c, err)
+			return
+		}
+		resources := make([]gin.H, len(users))
+		for i, user := range users {
+			resources[i] = user.resource()
+		}
+		scimList(c, offset, total, resources)
+	})
+
+	scim.GET("/Users/:id", func(c *gin.Context) {
+		if user := paramUser(c); user != nil {
+			scimJSON(c, http.StatusOK, user.resource())
+		}
+	})
+
+	// A user as sent by POST and PUT requests.
+	type userBody struct {
+		UserName   string `json:"userName"`
+		ExternalId string `json:"externalId"`
+		Active     *bool  `json:"active"`
+	}
+
+	scim.POST("/Users", func(c *gin.Context) {
+		var body userBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondSCIMError(c, http.StatusBadRequest, "invalidSyntax", err)
+			return
+		}
+		account, _, err := CreateAccount(externalUsername(body.UserName), randomToken(), RoleUser)
+		if err != nil {
+			respondUserError(c, err)
+			return
+		}
+		if err = ProvisionSCIMUser(account.Id); err != nil {
+			respondUserError(c, err)
+			return
+		}
+		user := &scimUser{Id: account.Id, Username: account.Username, Created: account.Created, ExternalId: body.ExternalId}
+		user.Disabled = body.Active != nil && !*body.Active
+		if err = UpdateSCIMUser(user); err != nil {
+			respondUserError(c, err)
+			return
+		}
+		RecordAudit("identity provider", "account.create", account.Username, "scim", c.ClientIP())
+		scimJSON(c, http.StatusCreated, user.resource())
+	})
+
+	scim.PUT("/Users/:id", func(c *gin.Context) {
+		user := paramUser(c)
+		if user == nil {
+			return
+		}
+		var body userBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondSCIMError(c, http.StatusBadRequest, "invalidSyntax", err)
+			return
+		}
+		if body.UserName != "" {
+			user.Username = externalUsername(body.UserName)
+		}
+		user.ExternalId = body.ExternalId
+		user.Disabled = body.Active != nil && !*body.Active
+		if err := UpdateSCIMUser(user); err != nil {
+			respondUserError(c, err)
+			return
+		}
+		scimJSON(c, http.StatusOK, user.resource())
+	})
+
+	scim.PATCH("/Users/:id", func(c *gin.Context) {
+		user := paramUser(c)
+		if user == nil {
+			return
+		}
+		var patch scimPatch
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			respondSCIMError(c, http.StatusBadRequest, "invalidSyntax", err)
+			return
+		}
+		for _, op := range patch.Operations {
+			if strings.ToLower(op.Op) != "replace" && strings.ToLower(op.Op) != "add" {
+				respondSCIMError(c, http.StatusBadRequest, "invalidPath", errors.New(`only "add" and "replace" operations are supported for users`))
+				return
+			}
+			// Without a path, the value holds the attributes to replace.
+			values := map[string]json.RawMessage{strings.ToLower(op.Path): op.Value}
+			if op.Path == "" {
+				var attributes map[string]json.RawMessage
+				if err := json.Unmarshal(op.Value, &attributes); err != nil {
+					respondSCIMError(c, http.StatusBadRequest, "invalidValue", err)
+					return
+				}
+				values = make(map[string]json.RawMessage)
+				for name, value := range attributes {
+					values[strings.ToLower(name)] = value
+				}
+			}
+			for name, value := range values {
+				var err error
+				switch name {
+				case "active":
+					var active bool
+					active, err = scimBool(value)
+					user.Disabled = !active
+				case "username":
+					var username string
+					err = json.Unmarshal(value, &username)
+					user.Username = externalUsername(username)
+				case "externalid":
+					err = json.Unmarshal(value, &user.ExternalId)
+				}
+				// Other attributes, such as names and emails, are not stored and ignored.
+				if err != nil {
+					respondSCIMError(c, http.StatusBadRequest, "invalidValue", err)
+					return
+				}
+			}
+		}
+		if err := UpdateSCIMUser(user); err != nil {
+			respondUserError(c, err)
+			return
+		}
+		scimJSON(c, http.StatusOK, user.resource())
+	})
+
+	// Deleting a user deactivates its account, which keeps its uploads.
+	scim.DELETE("/Users/:id", func(c *gin.Context) {
+		user := paramUser(c)
+		if user == nil {
+			return
+		}
+		user.Disabled = true
+		if err := UpdateSCIMUser(user); err != nil {
+			respondUserError(c, err)
+			return
+		}
+		RecordAudit("identity provider", "account.disable", user.Username, "scim", c.ClientIP())
+		c.Status(http.StatusNoContent)
+	})
+
+	// respondGroupError answers with the SCIM error for a failure to store a group.
+	respondGroupError := func(c *gin.Context, err error) {
+		switch err {
+		case ErrTeamSlugTaken:
+			respondSCIMError(c, http.StatusConflict, "uniqueness", err)
+		case ErrTeamSlugInvalid:
+			respondSCIMError(c, http.StatusBadRequest, "invalidValue", err)
+		case ErrSCIMNotFound, sql.ErrNoRows:
+			respondSCIMError(c, http.StatusNotFound, "", ErrSCIMNotFound)
+		default:
+			respondSCIMError(c, http.StatusInternalServerError, "", err)
+		}
+	}
+
+	paramTeam := func(c *gin.Context) *Team {
+		team, err := GetTeamByID(c.Param("id"))
+		if err != nil {
+			respondGroupError(c, err)
+			return nil
+		}
+		return team
+	}
+
+	respondGroup := func(c *gin.Context, code int, team *Team) {
+		group, err := scimGroup(team)
+		if err != nil {
+			respondGroupError(c, err)
+			return
+		}
+		scimJSON(c, code, group)
+	}
+
+	scim.GET("/Groups", func(c *gin.Context) {
+		attribute, value, err := parseSCIMFilter(c.Query("filter"))
+		if err != nil || (attribute != "" && attribute != "displayname") {
+			respondSCIMError(c, http.StatusBadRequest, "invalidFilter", ErrSCIMFilterInvalid)
+			return
+		}
+		offset, count := scimPage(c)
+		teams, total, err := ListSCIMTeams(value, offset, count)
+		if err != nil {
+			respondGroupError(c, err)
+			return
+		}
+		resources := make([]gin.H, len(teams))
+		for i, team := range teams {
+			if resources[i], err = scimGroup(team); err != nil {
+				respondGroupError(c, err)
+				return
+			}
+		}
+		scimList(c, offset, total, resources)
+	})
+
+	scim.GET("/Groups/:id", func(c *gin.Context) {
+		if team := paramTeam(c); team != nil {
+			respondGroup(c, http.StatusOK, team)
+		}
+	})
+
+	// A group as sent by POST and PUT requests.
+	type groupBody struct {
+		DisplayName string       `json:"displayName"`
+		Members     []scimMember `json:"members"`
+	}
+
+	scim.POST("/Groups", func(c *gin.Context) {
+		var body groupBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondSCIMError(c, http.StatusBadRequest, "invalidSyntax", err)
+			return
+		}
+		team, err := CreateTeam(teamSlug(body.DisplayName), body.DisplayName, nil)
+		if err != nil {
+			respondGroupError(c, err)
+			return
+		}
+		RecordAudit("identity provider", "team.create", team.Slug, "scim", c.ClientIP())
+		if err = addSCIMMembers(team, body.Members); err != nil {
+			respondGroupError(c, err)
+			return
+		}
+		respondGroup(c, http.StatusCreated, team)
+	})
+
+	scim.PUT("/Groups/:id", func(c *gin.Context) {
+		team := paramTeam(c)
+		if team == nil {
+			return
+		}
+		var body groupBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondSCIMError(c, http.StatusBadRequest, "invalidSyntax", err)
+			return
+		}
+		err := team.Rename(body.DisplayName)
+		if err == nil {
+			err = removeSCIMMembers(team, nil)
+		}
+		if err == nil {
+			err = addSCIMMembers(team, body.Members)
+		}
+		if err != nil {
+			respondGroupError(c, err)
+			return
+		}
+		respondGroup(c, http.StatusOK, team)
+	})
+
+	scim.PATCH("/Groups/:id", func(c *gin.Context) {
+		team := paramTeam(c)
+		if team == nil {
+			return
+		}
+		var patch scimPatch
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			respondSCIMError(c, http.StatusBadRequest, "invalidSyntax", err)
+			return
+		}
+		for _, operation := range patch.Operations {
+			op, path := strings.ToLower(operation.Op), strings.ToLower(operation.Path)
+			var name string
+			var members []scimMember
+			var err error
+			if path == "displayname" {
+				err = json.Unmarshal(operation.Value, &name)
+			} else if path == "members" && len(operation.Value) > 0 {
+				err = json.Unmarshal(operation.Value, &members)
+			}
+			if err != nil {
+				respondSCIMError(c, http.StatusBadRequest, "invalidValue", err)
+				return
+			}
+
+			switch {
+			case path == "displayname" && op == "replace":
+				err = team.Rename(name)
+			case path == "members" && op == "add":
+				err = addSCIMMembers(team, members)
+			case path == "members" && op == "replace":
+				if err = removeSCIMMembers(team, nil); err == nil {
+					err = addSCIMMembers(team, members)
+				}
+			case path == "members" && op == "remove":
+				// Azure AD lists the members to remove in the value; without one, every member is removed.
+				var ids []int64
+				if members != nil {
+					ids = make([]int64, len(members))
+					for i, member := range members {
+						ids[i] = parseSCIMId(member.Value)
+					}
+				}
+				err = removeSCIMMembers(team, ids)
+			case op == "remove" && scimMemberPathPattern.MatchString(operation.Path):
+				// Okta names the member to remove in the path.
+				err = removeSCIMMembers(team, []int64{parseSCIMId(scimMemberPathPattern.FindStringSubmatch(operation.Path)[1])})
+			default:
+				respondSCIMError(c, http.StatusBadRequest, "invalidPath", errors.New(`only "displayName" and "members" can be changed`))
+				return
+			}
+			if err != nil {
+				respondGroupError(c, err)
+				return
+			}
+		}
+		respondGroup(c, http.StatusOK, team)
+	})
+
+	// Teams hold uploads, so deleting a group only removes its members; the team itself is deleted in copycat.
+	scim.DELETE("/Groups/:id", func(c *gin.Context) {
+		team := paramTeam(c)
+		if team == nil {
+			return
+		}
+		if err := removeSCIMMembers(team, nil); err != nil {
+			respondGroupError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Uploads are scanned for credentials before they are stored, since keys and tokens pasted by mistake are public the
+// moment the upload is. The SECRET_SCAN_POLICY decides what happens when one is found: the submitter is warned, has to
+// confirm the upload, or the upload is refused.
+const (
+	SecretsOff     = "off"
+	SecretsWarn    = "warn"
+	SecretsConfirm = "confirm"
+	SecretsBlock   = "block"
+)
+
+var (
+	ErrSecretsFound       = errors.New("the upload appears to contain credentials, such as keys or tokens; remove them and upload it again")
+	ErrSecretsUnconfirmed = errors.New("the upload appears to contain credentials, such as keys or tokens; remove them, or confirm that they may be uploaded")
+)
+
+// secretPolicy holds one of SecretsOff, SecretsWarn, SecretsConfirm or SecretsBlock.
+var secretPolicy atomic.Pointer[string]
+
+// A secretPattern matches a kind of credential. Only formats that are unlikely to match anything else are scanned for,
+// so that submitters are not trained to dismiss the warning.
+type secretPattern struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+var secretPatterns = []secretPattern{
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS secret access key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+]{40}\b`)},
+	{"Private key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`)},
+	{"GitLab token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+	{"Slack webhook", regexp.MustCompile(`https://hooks\.slack\.com/services/T[A-Za-z0-9]+/B[A-Za-z0-9]+/[A-Za-z0-9]+`)},
+	{"Stripe key", regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{24,}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"npm token", regexp.MustCompile(`\bnpm_[A-Za-z0-9]{36}\b`)},
+}
+
+// A SecretFinding is a credential found in an upload. The credential itself is never repeated back.
+type SecretFinding struct {
+	Kind string `json:"kind"`
+	File string `json:"file,omitempty"` // The attachment it was found in, or "" for the body.
+	Line int    `json:"line"`
+}
+
+// secretScanStats are the metrics of secret scanning, published under "secret_scan" at /debug/vars.
+var secretScanStats struct {
+	Warned    atomic.Int64
+	Confirmed atomic.Int64
+	Refused   atomic.Int64
+}
+
+func initSecretScanning() {
+	if err := loadSecretPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	RegisterReloader("secret scanning", loadSecretPolicy)
+	expvar.Publish("secret_scan", expvar.Func(func() any {
+		return map[string]int64{
+			"warned":    secretScanStats.Warned.Load(),
+			"confirmed": secretScanStats.Confirmed.Load(),
+			"refused":   secretScanStats.Refused.Load(),
+		}
+	}))
+}
+
+// loadSecretPolicy reads SECRET_SCAN_POLICY, keeping the policy in use when it is invalid.
+func loadSecretPolicy() error {
+	policy := os.Getenv("SECRET_SCAN_POLICY")
+	switch policy {
+	case "":
+		policy = SecretsWarn
+	case SecretsOff, SecretsWarn, SecretsConfirm, SecretsBlock:
+	default:
+		return errors.New(`SECRET_SCAN_POLICY environment variable must be "off", "warn", "confirm" or "block"`)
+	}
+	secretPolicy.Store(&policy)
+	return nil
+}
+
+// scanSecrets returns the credentials found in the body of an upload, or in a text attachment when file is its name.
+// Attachments that are not text, such as images and archives, are not scanned.
+func scanSecrets(file string, contents []byte) []SecretFinding {
+	if *secretPolicy.Load() == SecretsOff || (file != "" && !isText(contents)) {
+		return nil
+	}
+	var findings []SecretFinding
+	for i, line := range bytes.Split(contents, []byte("\n")) {
+		for _, secret := range secretPatterns {
+			if secret.pattern.Match(line) {
+				findings = append(findings, SecretFinding{Kind: secret.kind, File: file, Line: i + 1})
+			}
+		}
+	}
+	return findings
+}
+
+// isText reports whether the start of the contents of an attachment looks like text.
+func isText(contents []byte) bool {
+	start := contents[:min(len(contents), 8192)]
+	// The cut may have split a character.
+	for i := 0; i < utf8.UTFMax && len(start) > 0 && len(start) < len(contents) && !utf8.RuneStart(contents[len(start)]); i++ {
+		start = start[:len(start)-1]
+	}
+	return utf8.Valid(start) && bytes.IndexByte(start, 0) < 0
+}
+
+// checkSecrets applies the policy to the credentials found in an upload. Unless they were confirmed under the confirm
+// policy, found credentials are refused with 422 and listed, along with whether confirming would allow the upload. On
+// refusal false is returned.
+func checkSecrets(c *gin.Context, findings []SecretFinding, confirmed bool) bool {
+	if len(findings) == 0 {
+		return true
+	}
+	policy, err := *secretPolicy.Load(), ErrSecretsFound
+	switch {
+	case policy == SecretsWarn:
+		secretScanStats.Warned.Add(1)
+		return true
+	case policy == SecretsConfirm && confirmed:
+		secretScanStats.Confirmed.Add(1)
+		return true
+	case policy == SecretsConfirm:
+		err = ErrSecretsUnconfirmed
+	}
+	secretScanStats.Refused.Add(1)
+	abortWithError(c, http.StatusUnprocessableEntity, err, gin.H{
+		"secrets": findings,
+		"confirm": policy == SecretsConfirm,
+	})
+	return false
+}
+
+// secretKinds lists the kinds of credentials found, for the headers of responses that have no body to list them in.
+func secretKinds(findings []SecretFinding) string {
+	var kinds []string
+	for _, finding := range findings {
+		if !slices.Contains(kinds, finding.Kind) {
+			kinds = append(kinds, finding.Kind)
+		}
+	}
+	return strings.Join(kinds, ", ")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionTouchInterval limits how often the last use of a session is written, so that browsing does not write to the
+// database on every request.
+const sessionTouchInterval = time.Minute
+
+// A Session is a browser logged in to an account. The cookie holds a random token, and only its SHA-256 is stored, so
+// sessions can be listed and revoked from the server.
+type Session struct {
+	Id        int64
+	AccountId int64
+	Created   int64
+	LastSeen  int64
+	Expires   int64
+	IP        string
+	UserAgent string
+
+	Current bool // Whether this is the session of the request that listed it.
+}
+
+// Device describes the browser and operating system of the session from its User-Agent.
+func (s *Session) Device() string {
+	return describeDevice(s.UserAgent)
+}
+
+func initSessions() {
+	RegisterJob(&Job{
+		Name:     "sessions",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "DELETE FROM Sessions WHERE expires < $1", time.Now().UTC().Unix())
+			return err
+		},
+	})
+}
+
+// setSession logs the browser in as account. The cookie is SameSite=Lax so that other sites cannot submit forms
+// to us on the user's behalf.
+func setSession(c *gin.Context, account *Account) error {
+	token := randomToken()
+	now := time.Now().UTC()
+	_, err := db.Exec(`INSERT INTO Sessions(token_hash, account_id, created, last_seen, expires, ip, user_agent)
+		VALUES ($1, $2, $3, $3, $4, $5, $6)`,
+		hashToken(token), account.Id, now.Unix(), now.Add(sessionLifetime).Unix(), c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		return err
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, token, int(sessionLifetime.Seconds()), "/", "", c.Request.TLS != nil, true)
+	return nil
+}
+
+// clearSession logs the browser out, ending its session on the server too.
+func clearSession(c *gin.Context) {
+	if token, err := c.Cookie(sessionCookie); err == nil {
+		if _, err = db.Exec("DELETE FROM Sessions WHERE token_hash = $1", hashToken(token)); err != nil {
+			log.Printf("failed to delete a session: %v", err)
+		}
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+}
+
+// sessionFromCookie returns the unexpired session of the request's cookie and records that it was used, or nil.
+func sessionFromCookie(c *gin.Context) *Session {
+	token, err := c.Cookie(sessionCookie)
+	if err != nil || token == "" {
+		return nil
+	}
+	s := new(Session)
+	now := time.Now().UTC().Unix()
+	err = db.QueryRow(`SELECT id, account_id, created, last_seen, expires, ip, user_agent FROM Sessions
+		WHERE token_hash = $1 AND expires > $2`, hashToken(token), now).
+		Scan(&s.Id, &s.AccountId, &s.Created, &s.LastSeen, &s.Expires, &s.IP, &s.UserAgent)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("failed to look up a session: %v", err)
+		}
+		return nil
+	}
+
+	if now-s.LastSeen >= int64(sessionTouchInterval.Seconds()) || s.IP != c.ClientIP() {
+		s.LastSeen, s.IP = now, c.ClientIP()
+		if _, err = db.Exec("UPDATE Sessions SET last_seen = $1, ip = $2 WHERE id = $3", s.LastSeen, s.IP, s.Id); err != nil {
+			log.Printf("failed to update session %v: %v", s.Id, err)
+		}
+	}
+	s.Current = true
+	c.Set("session", s)
+	return s
+}
+
+// AccountSessions returns the unexpired sessions of an account, the most recently used first.
+func AccountSessions(account *Account) ([]*Session, error) {
+	rows, err := db.Query(`SELECT id, account_id, created, last_seen, expires, ip, user_agent FROM Sessions
+		WHERE account_id = $1 AND expires > $2 ORDER BY last_seen DESC`, account.Id, time.Now().UTC().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		s := new(Session)
+		if err = rows.Scan(&s.Id, &s.AccountId, &s.Created, &s.LastSeen, &s.Expires, &s.IP, &s.UserAgent); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession logs out one session of an account, and reports whether it existed.
+func RevokeSession(account *Account, id int64) (bool, error) {
+	result, err := db.Exec("DELETE FROM Sessions WHERE id = $1 AND account_id = $2", id, account.Id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RevokeOtherSessions logs out every session of an account except the one with the given id, which may be 0 to log
+// out all of them.
+func RevokeOtherSessions(account *Account, keep int64) error {
+	_, err := db.Exec("DELETE FROM Sessions WHERE account_id = $1 AND id <> $2", account.Id, keep)
+	return err
+}
+
+// currentSession returns the session of the request, or nil for requests without one, such as those with an API token.
+func currentSession(c *gin.Context) *Session {
+	if s, ok := c.Get("session"); ok {
+		return s.(*Session)
+	}
+	return nil
+}
+
+// describeDevice names the browser and operating system in a User-Agent header, like "Firefox on Windows".
+func describeDevice(userAgent string) string {
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		// Order matters: Edge and Opera also claim to be Chrome, and Chrome claims to be Safari.
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, system := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, system.token) {
+			return browser + " on " + system.name
+		}
+	}
+	return browser
+}
+
+func registerSessionRoutes(r *gin.Engine) {
+	r.GET("/account/sessions", func(c *gin.Context) {
+		account := currentAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		sessions, err := AccountSessions(account)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if current := currentSession(c); current != nil {
+			for _, s := range sessions {
+				s.Current = s.Id == current.Id
+			}
+		}
+		renderPage(c, http.StatusOK, "sessions.html", gin.H{
+			"Page":     NewPageInfo(c, "Sessions"),
+			"Sessions": sessions,
+		})
+	})
+
+	r.POST("/account/sessions/:id/revoke", func(c *gin.Context) {
+		account := currentAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		found, err := RevokeSession(account, id)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if !found {
+			respondError(c, http.StatusNotFound, errors.New("session not found"))
+			return
+		}
+		if current := currentSession(c); current != nil && current.Id == id {
+			clearSession(c)
+			c.Redirect(http.StatusSeeOther, "/")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/account/sessions")
+	})
+
+	// Log out everywhere else, for example after a device was lost.
+	r.POST("/account/sessions/revoke-others", func(c *gin.Context) {
+		account := currentAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		var keep int64
+		if current := currentSession(c); current != nil {
+			keep = current.Id
+		}
+		if err := RevokeOtherSessions(account, keep); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "account.sessions.revoke", account.Username, "", c.ClientIP())
+		c.Redirect(http.StatusSeeOther, "/account/sessions")
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	ErrShareExpired   = errors.New("this share link has expired")
+	ErrShareSignature = errors.New("this share link is invalid or has been revoked")
+)
+
+// signingKey is the server secret used to sign share links.
+var signingKey []byte
+
+// initSigningKey loads the SIGNING_KEY variable. Without one, a random key is generated and every signed link stops
+// working when the server restarts.
+func initSigningKey() {
+	if key := os.Getenv("SIGNING_KEY"); key != "" {
+		signingKey = []byte(key)
+		return
+	}
+	log.Println("SIGNING_KEY variable not set, signed links will not survive a restart")
+	signingKey = make([]byte, 32)
+	if _, err := rand.Read(signingKey); err != nil {
+		log.Fatal("Could not generate a signing key:", err)
+	}
+}
+
+// randomToken returns 128 random bits encoded as hex.
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms.
+	}
+	return hex.EncodeToString(b)
+}
+
+// hashToken returns the SHA-256 of a token as hex. Only hashes of tokens are stored in the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasEditToken reports whether the request carries the edit token that was returned when the upload was submitted.
+// The token is read from the X-Edit-Token header.
+func (upload *UploadModel) HasEditToken(c *gin.Context) bool {
+	token := c.GetHeader("X-Edit-Token")
+	if token == "" || upload.editToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(upload.editToken)) == 1
+}
+
+// IsOwner reports whether the request comes from the owner of the upload: the submitter holding its edit token or
+// claim token, or the logged in account that uploaded it.
+func (upload *UploadModel) IsOwner(c *gin.Context) bool {
+	if account := currentAccount(c); account != nil && upload.AccountId != 0 && account.Id == upload.AccountId {
+		return true
+	}
+	return upload.HasEditToken(c) || upload.IsClaimed(c)
+}
+
+// ownedUpload returns the upload named by the :hash parameter if the request comes from its owner, or nil after
+// responding with an error. The uploads of others look missing, so that nothing is told about which exist.
+func ownedUpload(c *gin.Context) *UploadModel {
+	upload, err := GetUpload(uploadParam(c))
+	if err != nil || !upload.IsOwner(c) {
+		respondError(c, http.StatusNotFound, ErrUploadNotFound)
+		return nil
+	}
+	return upload
+}
+
+// shareSignature signs the full upload hash and expiry together with the upload's share secret.
+func shareSignature(upload *UploadModel, expires int64) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(upload.Hash + "\n" + strconv.FormatInt(expires, 10) + "\n" + upload.shareSecret))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ShareLink returns a path to the upload that is valid until expires.
+func ShareLink(upload *UploadModel, expires time.Time) string {
+	return "/share/" + upload.Hash + "?" + shareQuery(upload, expires).Encode()
+}
+
+// shareQuery returns the exp and sig arguments of a share link to the upload that is valid until expires.
+func shareQuery(upload *UploadModel, expires time.Time) url.Values {
+	exp := expires.Unix()
+	return url.Values{"exp": {strconv.FormatInt(exp, 10)}, "sig": {shareSignature(upload, exp)}}
+}
+
+// VerifyShareLink checks the sig and exp query arguments of a share link against the upload.
+func VerifyShareLink(upload *UploadModel, sig string, exp string) error {
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrShareSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(shareSignature(upload, expires))) {
+		return ErrShareSignature
+	}
+	if time.Now().Unix() > expires {
+		return ErrShareExpired
+	}
+	return nil
+}
+
+// canViewShared reports whether a request may read an upload through the share link in its query, which always carries
+// the full hash. Share links only grant access to private uploads: the embargo, quarantine and country rule of the
+// upload still apply, as they do on the page of the link. Callers answer taken down uploads themselves.
+func (upload *UploadModel) canViewShared(c *gin.Context, hash string) bool {
+	if c.Query("sig") == "" || upload.Hash != hash || VerifyShareLink(upload, c.Query("sig"), c.Query("exp")) != nil {
+		return false
+	}
+	return upload.Published() && !upload.hiddenByQuarantine(c) && upload.allowsCountry(c)
+}
+
+// parseShareTTL reads the lifetime of a share link, like "90m" or "48h". An empty string selects the default.
+func parseShareTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultShareTTL, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 || ttl > maxShareTTL {
+		return 0, errors.New(`"ttl" must be a duration between 1s and 720h`)
+	}
+	return ttl, nil
+}
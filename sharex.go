@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func registerShareXRoutes(r *gin.Engine) {
+	// Upload a single file from a screenshot tool like ShareX, which expects the direct URL of the file in the response.
+	// Accounts authenticate with an API token in the Authorization header, like the rest of the API.
+	r.POST("/api/v1/sharex", meterUsage, rateLimit(PolicySubmit), limitConcurrency(submitConcurrency), limitRequestBody(maxSubmitSize), func(c *gin.Context) {
+		fileHeader, err := c.FormFile("file")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondTooLarge(c, -1, maxSubmitSize)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusBadRequest, errors.New(`a file is required in the "file" field`))
+			return
+		}
+		if fileHeader.Size > maxUploadSize {
+			respondTooLarge(c, fileHeader.Size, maxUploadSize)
+			return
+		}
+
+		account := currentAccount(c)
+		options := UploadOptions{
+			UploaderIP: c.ClientIP(),
+			Size:       fileHeader.Size,
+		}
+		if account != nil {
+			options.AccountId = account.Id
+		}
+		if !checkTerms(c, false) {
+			return
+		}
+		preSubmit := HookPayload{Event: HookPreSubmit, Files: []string{fileHeader.Filename}, Size: options.Size}
+		if !checkHooks(c, &preSubmit) {
+			return
+		}
+		options.Private = preSubmit.Private
+
+		quota, err := GetQuota(options.UploaderIP, account, nil)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if err = quota.Check(options.Size); err != nil {
+			respondError(c, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+
+		fileObject, err := NewFileObject(fileHeader, time.Now())
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, fmt.Errorf("failed to open file %q: %v", fileHeader.Filename, err))
+			return
+		}
+		secrets := scanSecrets(fileHeader.Filename, fileObject.Contents)
+		if !checkSecrets(c, secrets, c.GetHeader("X-Confirm-Secrets") == "true") {
+			return
+		}
+		pair, object, checksum, err := encodeAttachment(fileObject, stripMetadata.Load(), options.salted())
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		pairs := []string{pair}
+		hash := UploadHash("", pairs, options)
+		if err = storeAttachments(c.Request.Context(), hash, options.AccountId, pairs, [][]byte{object}, []string{checksum}); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		editToken, existing, err := SubmitUpload(hash, "", pairs, options)
+		if err != nil {
+			respondError(c, http.StatusConflict, err)
+			return
+		}
+		notifyHooks(HookPayload{Event: HookPostSubmit, Hash: hash, Files: preSubmit.Files, Size: options.Size,
+			Private: options.Private, AccountId: options.AccountId, IP: options.UploaderIP})
+
+		// Link the file through the CDN when there is one. Signed links expire, so with hotlink protection enabled the
+		// direct URL only works when it is opened from this site.
+		fileURL := baseurl
+		if cdnURL != "" {
+			fileURL = cdnURL
+		}
+		response := gin.H{
+			"url":     fileURL + "/f/" + fileKey(pair) + "/" + url.PathEscape(strings.TrimSpace(fileHeader.Filename)),
+			"page":    baseurl + uploadPath(ShortHash(hash)),
+			"sha256":  checksum,
+			"message": "Successfully uploaded",
+		}
+		if editToken != "" {
+			response["edit_token"] = editToken
+		}
+		describeDuplicate(response, existing)
+		if claimToken := claimAnonymousUpload(c, hash, editToken); claimToken != "" {
+			response["claim_token"] = claimToken
+		}
+		if len(secrets) != 0 {
+			response["secrets"] = secrets
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// A ShareX custom uploader for this instance, to import with File > Import > Custom uploader from URL.
+	r.GET("/api/v1/sharex/config", func(c *gin.Context) {
+		c.Header("Content-Disposition", `attachment; filename="copycat.sxcu"`)
+		c.JSON(http.StatusOK, gin.H{
+			"Version":         "15.0.0",
+			"Name":            "copycat",
+			"DestinationType": "ImageUploader, TextUploader, FileUploader",
+			"RequestMethod":   "POST",
+			"RequestURL":      baseurl + "/api/v1/sharex",
+			"Body":            "MultipartFormData",
+			"FileFormName":    "file",
+			"URL":             "{json:url}",
+			"ErrorMessage":    "{json:message}",
+		})
+	})
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Links name uploads by a prefix of their hash, like git does with commits. Every upload gets the shortest prefix that
+// no earlier upload's hash starts with, and at least SHORT_ID_LENGTH characters so that links stay hard to guess. An
+// upload that shares the prefix of an earlier one gets a longer prefix instead of taking over its links, and a prefix
+// only finds the uploads whose own prefix is not longer than it, so that short links never become ambiguous.
+//
+// The hash can be written in hex, as it is stored, or in base56 for shorter links; SHORT_ID_ALPHABET picks which one
+// new uploads get, and SHORT_ID_LENGTH how many characters at least. Every upload remembers the alphabet its link was
+// written in, so changing either keeps existing links working, and a new link is never one that an existing upload's
+// link in another alphabet would be read as.
+//
+// Base56 is base62 without the characters that look or sound alike, 0, O and o, and 1, l and I, so that links read
+// aloud or written down by hand come out right. Its links end in a check character, which catches a wrong character or two
+// that were swapped, and an ID that fails the check is answered with the link it was most likely meant to be.
+
+// minShortHash is the length of the short hashes of uploads that share no prefix with others, and of the ones from
+// before it could be set.
+const minShortHash = 10
+
+// minShortIDLength is the shortest SHORT_ID_LENGTH allowed.
+const minShortIDLength = 6
+
+// ErrIDTypo is answered for an ID that names no upload but is one typo away from the link of one.
+var ErrIDTypo = errors.New("no upload has this ID, but one has an ID that differs from it by a single character")
+
+// An idAlphabet writes a hash as a number in another base, in as many digits as the largest SHA-1 hash takes.
+type idAlphabet struct {
+	Name   string
+	Digits string
+	Fold   bool // Whether IDs are read in any case.
+	Check  bool // Whether links end in a check character; see checkDigit.
+	width  int
+}
+
+var (
+	hexAlphabet    = newIDAlphabet("hex", "0123456789abcdef", true, false)
+	base56Alphabet = newIDAlphabet("base56", "23456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz", false, true)
+
+	// idAlphabets are the alphabets IDs are read in, in the order they are tried.
+	idAlphabets = []*idAlphabet{hexAlphabet, base56Alphabet}
+)
+
+// maxHash is the largest SHA-1 hash.
+var maxHash = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 160), big.NewInt(1))
+
+var (
+	shortAlphabet = hexAlphabet  // The alphabet of the links of new uploads.
+	shortLength   = minShortHash // The least number of characters of the links of new uploads.
+)
+
+func newIDAlphabet(name, digits string, fold, check bool) *idAlphabet {
+	alphabet := &idAlphabet{Name: name, Digits: digits, Fold: fold, Check: check}
+	alphabet.width = len(alphabet.encode(maxHash))
+	return alphabet
+}
+
+// initShortIDs loads the alphabet and length of the links of new uploads.
+func initShortIDs() {
+	if name := os.Getenv("SHORT_ID_ALPHABET"); name != "" {
+		shortAlphabet = nil
+		for _, alphabet := range idAlphabets {
+			if alphabet.Name == name {
+				shortAlphabet = alphabet
+			}
+		}
+		if shortAlphabet == nil {
+			log.Fatalf(`SHORT_ID_ALPHABET must be "hex" or "base56", not %q`, name)
+		}
+	}
+	shortLength = int(envInt64("SHORT_ID_LENGTH", minShortHash))
+	if shortLength < minShortIDLength || shortLength > shortAlphabet.width {
+		log.Fatalf("SHORT_ID_LENGTH must be between %d and %d for %v IDs", minShortIDLength, shortAlphabet.width,
+			shortAlphabet.Name)
+	}
+}
+
+// encode writes n in the alphabet, padded to the width of a hash.
+func (alphabet *idAlphabet) encode(n *big.Int) string {
+	base := big.NewInt(int64(len(alphabet.Digits)))
+	n, digit := new(big.Int).Set(n), new(big.Int)
+	var id []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, digit)
+		id = append(id, alphabet.Digits[digit.Int64()])
+	}
+	for len(id) < alphabet.width {
+		id = append(id, alphabet.Digits[0])
+	}
+	for i, j := 0, len(id)-1; i < j; i, j = i+1, j-1 {
+		id[i], id[j] = id[j], id[i]
+	}
+	return string(id)
+}
+
+// Encode writes a hash in the alphabet.
+func (alphabet *idAlphabet) Encode(hash string) string {
+	n, ok := new(big.Int).SetString(hash, 16)
+	if !ok {
+		return hash
+	}
+	return alphabet.encode(n)
+}
+
+// checkDigit returns the check character of a link written in the alphabet, with the Luhn mod N algorithm: it differs
+// whenever a single character of the link is wrong, and for most pairs of adjacent characters that are swapped.
+func (alphabet *idAlphabet) checkDigit(id string) byte {
+	base := len(alphabet.Digits)
+	sum, factor := 0, 2
+	for i := len(id) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(alphabet.Digits, id[i])
+		sum += addend/base + addend%base
+		factor = 3 - factor
+	}
+	return alphabet.Digits[(base-sum%base)%base]
+}
+
+// Link returns the link of an upload whose hash is written as id in the alphabet, with length characters of it.
+func (alphabet *idAlphabet) Link(id string, length int) string {
+	id = id[:min(length, len(id))]
+	if alphabet.Check {
+		return id + string(alphabet.checkDigit(id))
+	}
+	return id
+}
+
+// parse returns the prefix of the hash written in the alphabet that a link is, and false if the link is not written in
+// the alphabet or fails its check.
+func (alphabet *idAlphabet) parse(link string) (string, bool) {
+	if alphabet.Fold {
+		link = strings.ToLower(link)
+	}
+	for i := 0; i < len(link); i++ {
+		if strings.IndexByte(alphabet.Digits, link[i]) < 0 {
+			return "", false
+		}
+	}
+	if !alphabet.Check {
+		return link, link != ""
+	}
+	if len(link) < 2 {
+		return "", false
+	}
+	id := link[:len(link)-1]
+	return id, alphabet.checkDigit(id) == link[len(link)-1]
+}
+
+// hashRange returns the first and last hashes whose IDs in the alphabet start with id, and false if no hash does.
+// Since IDs are numbers padded to the same width, the hashes starting with one are all those between the two, which the
+// index of the hash column finds.
+func (alphabet *idAlphabet) hashRange(id string) (first, last string, ok bool) {
+	if id == "" || len(id) > alphabet.width {
+		return "", "", false
+	}
+	base := big.NewInt(int64(len(alphabet.Digits)))
+	n := new(big.Int)
+	for i := 0; i < len(id); i++ {
+		n.Mul(n, base).Add(n, big.NewInt(int64(strings.IndexByte(alphabet.Digits, id[i]))))
+	}
+	scale := new(big.Int).Exp(base, big.NewInt(int64(alphabet.width-len(id))), nil)
+	low := new(big.Int).Mul(n, scale)
+	if low.Cmp(maxHash) > 0 {
+		return "", "", false
+	}
+	high := new(big.Int).Add(n, big.NewInt(1))
+	high.Mul(high, scale).Sub(high, big.NewInt(1))
+	if high.Cmp(maxHash) > 0 {
+		high.Set(maxHash)
+	}
+	return fmt.Sprintf("%040x", low), fmt.Sprintf("%040x", high), true
+}
+
+// idCondition returns the SQL condition matching the uploads that link is the link of in any of alphabets, with its
+// placeholders numbered from $n, or an empty condition if link is not written in any of them.
+func idCondition(link string, alphabets []*idAlphabet, n int) (string, []any) {
+	var conditions []string
+	var args []any
+	for _, alphabet := range alphabets {
+		id, ok := alphabet.parse(link)
+		if !ok {
+			continue
+		}
+		first, last, ok := alphabet.hashRange(id)
+		if !ok {
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("hash BETWEEN $%d AND $%d AND short_alphabet = $%d AND short_length <= $%d",
+			n, n+1, n+2, n+3))
+		args = append(args, first, last, alphabet.Name, len(id))
+		n += 4
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// uploadCondition returns the SQL condition matching the upload named by id with its placeholders numbered from $1, or
+// ErrHashInvalid. The full hash always names an upload, whatever the alphabet of its link.
+func uploadCondition(id string) (string, []any, error) {
+	if len(id) == 40 && isValidHex(id) {
+		return "hash = $1", []any{strings.ToLower(id)}, nil
+	}
+	if len(id) < minShortIDLength || len(id) > 40 {
+		return "", nil, ErrHashInvalid
+	}
+	condition, args := idCondition(id, idAlphabets, 1)
+	if condition == "" {
+		return "", nil, ErrHashInvalid
+	}
+	return condition, args, nil
+}
+
+// isUploadID reports whether id could name an upload.
+func isUploadID(id string) bool {
+	_, _, err := uploadCondition(id)
+	return err == nil
+}
+
+// normalizeUploadID writes an upload ID the way links of new uploads are written. Hex IDs are read in any case.
+func normalizeUploadID(id string) string {
+	if shortAlphabet.Fold {
+		return strings.ToLower(id)
+	}
+	return id
+}
+
+// uploadParam returns the ID of the upload named by the :hash parameter of a request.
+func uploadParam(c *gin.Context) string {
+	return normalizeUploadID(c.Param("hash"))
+}
+
+// matchesUploadID reports whether id names the upload with the full hash in any alphabet, regardless of the length of
+// its link.
+func matchesUploadID(hash, link string) bool {
+	for _, alphabet := range idAlphabets {
+		if id, ok := alphabet.parse(link); ok && strings.HasPrefix(alphabet.Encode(hash), id) {
+			return true
+		}
+	}
+	return false
+}
+
+// alphabetNamed returns the alphabet with a name, or hex for uploads from before alphabets could be chosen.
+func alphabetNamed(name string) *idAlphabet {
+	for _, alphabet := range idAlphabets {
+		if alphabet.Name == name {
+			return alphabet
+		}
+	}
+	return hexAlphabet
+}
+
+// ShortHash returns the ID that the links of an upload use.
+func (upload *UploadModel) ShortHash() string {
+	if upload.ShortLength == 0 {
+		return upload.Hash[:minShortHash]
+	}
+	alphabet := alphabetNamed(upload.ShortAlphabet)
+	return alphabet.Link(alphabet.Encode(upload.Hash), upload.ShortLength)
+}
+
+// ShortHash returns the ID that the links of the upload with the full hash use, for uploads that were just submitted.
+// The full hash is returned when it cannot be found out.
+func ShortHash(hash string) string {
+	upload := UploadModel{Hash: hash}
+	if err := db.QueryRow("SELECT short_alphabet, short_length FROM Uploads WHERE hash = $1", hash).
+		Scan(&upload.ShortAlphabet, &upload.ShortLength); err != nil {
+		log.Printf("failed to read the short hash of %v: %v", hash, err)
+		return hash
+	}
+	return upload.ShortHash()
+}
+
+// commonPrefixLength returns how many characters a and b start with in common.
+func commonPrefixLength(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// assignShortHash sets the short hash of an upload that was just inserted with a short length as long as its hash. The
+// hashes sharing the longest prefix with it are the ones next to it in order, in every alphabet. Uploads inserted at
+// the same time see each other, and both get a longer prefix. The prefix is then made longer for as long as it reads
+// as the link of an existing upload in another alphabet.
+func assignShortHash(ctx context.Context, hash string) error {
+	alphabet := shortAlphabet
+	id := alphabet.Encode(hash)
+	longest := 0
+	for _, query := range []string{
+		"SELECT hash FROM Uploads WHERE hash < $1 ORDER BY hash DESC LIMIT 1",
+		"SELECT hash FROM Uploads WHERE hash > $1 ORDER BY hash LIMIT 1",
+	} {
+		var neighbor string
+		err := db.QueryRowContext(ctx, query, hash).Scan(&neighbor)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		longest = max(longest, commonPrefixLength(id, alphabet.Encode(neighbor)))
+	}
+
+	var others []*idAlphabet
+	for _, other := range idAlphabets {
+		if other != alphabet {
+			others = append(others, other)
+		}
+	}
+	length := min(max(longest+1, shortLength), len(id))
+	for ; length < len(id); length++ {
+		condition, args := idCondition(alphabet.Link(id, length), others, 2)
+		if condition == "" {
+			break
+		}
+		var taken bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM Uploads WHERE hash <> $1 AND "+condition+")",
+			append([]any{hash}, args...)...).Scan(&taken); err != nil {
+			return err
+		} else if !taken {
+			break
+		}
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE Uploads SET short_alphabet = $1, short_length = $2 WHERE hash = $3",
+		alphabet.Name, length, hash); err != nil {
+		return err
+	}
+	invalidateUpload(hash)
+	return nil
+}
+
+// nearMisses returns the links in the alphabet that link could have been meant as, with one character changed or two
+// adjacent ones swapped, which pass their check.
+func (alphabet *idAlphabet) nearMisses(link string) []string {
+	if !alphabet.Check || len(link) < minShortIDLength || len(link) > alphabet.width+1 {
+		return nil
+	}
+	var links []string
+	seen := make(map[string]bool)
+	try := func(candidate string) {
+		if _, ok := alphabet.parse(candidate); ok && !seen[candidate] {
+			seen[candidate] = true
+			links = append(links, candidate)
+		}
+	}
+	for i := 0; i < len(link); i++ {
+		for j := 0; j < len(alphabet.Digits); j++ {
+			if alphabet.Digits[j] != link[i] {
+				try(link[:i] + alphabet.Digits[j:j+1] + link[i+1:])
+			}
+		}
+		if i+1 < len(link) && link[i] != link[i+1] {
+			try(link[:i] + link[i+1:i+2] + link[i:i+1] + link[i+2:])
+		}
+	}
+	return links
+}
+
+// SuggestUploadID returns the link of the upload anyone may view that a link naming no upload was most likely meant as,
+// or an empty string when no such upload or more than one is one typo away. Only links in an alphabet with check
+// characters are corrected, as others may be a typo away from many uploads.
+func SuggestUploadID(link string) string {
+	if !shortAlphabet.Check {
+		return ""
+	}
+	var conditions []string
+	var args []any
+	for _, candidate := range shortAlphabet.nearMisses(link) {
+		condition, candidateArgs := idCondition(candidate, []*idAlphabet{shortAlphabet}, len(args)+1)
+		conditions = append(conditions, condition)
+		args = append(args, candidateArgs...)
+	}
+	if len(conditions) == 0 {
+		return ""
+	}
+	rows, err := db.Query("SELECT hash, short_alphabet, short_length FROM Uploads WHERE ("+strings.Join(conditions, " OR ")+
+		fmt.Sprintf(`) AND NOT private AND team_id = 0 AND deleted_at = 0 AND quarantined_at = 0 AND publish_at <= $%d
+		AND (expires_at = 0 OR expires_at > $%[1]d) LIMIT 2`, len(args)+1), append(args, time.Now().UTC().Unix())...)
+	if err != nil {
+		log.Printf("failed to look for the upload %v was meant as: %v", link, err)
+		return ""
+	}
+	defer rows.Close()
+	var suggestions []string
+	for rows.Next() {
+		var upload UploadModel
+		if err = rows.Scan(&upload.Hash, &upload.ShortAlphabet, &upload.ShortLength); err != nil {
+			log.Printf("failed to look for the upload %v was meant as: %v", link, err)
+			return ""
+		}
+		suggestions = append(suggestions, upload.ShortHash())
+	}
+	if len(suggestions) != 1 {
+		return ""
+	}
+	return suggestions[0]
+}
+
+// respondUploadNotFound answers a request for the page of an upload that a link names no upload of, pointing to the
+// upload it was most likely meant for when there is one.
+func respondUploadNotFound(c *gin.Context, link string) {
+	suggestion := SuggestUploadID(link)
+	if suggestion == "" {
+		route404(c)
+		return
+	}
+	if wantsJSON(c) {
+		writeError(c, http.StatusNotFound, errorBody(c, http.StatusNotFound, ErrIDTypo, gin.H{
+			"suggestion": suggestion,
+			"url":        baseurl + uploadPath(suggestion),
+		}))
+		return
+	}
+	renderPage(c, http.StatusNotFound, "404.html", gin.H{
+		"Page":       NewPageInfo(c, "404"),
+		"Suggestion": suggestion,
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+// notifyMaintenanceSignals does nothing, as there are no user signals on this system; maintenance mode is toggled
+// through the API instead.
+func notifyMaintenanceSignals() {}
+
+// notifyReloadSignal does nothing, as there is no SIGHUP on this system; the configuration is reloaded through the API
+// instead.
+func notifyReloadSignal() {}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyMaintenanceSignals enters maintenance mode on SIGUSR1 and leaves it on SIGUSR2.
+func notifyMaintenanceSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			setMaintenance(sig == syscall.SIGUSR1, os.Getenv("MAINTENANCE_MESSAGE"))
+		}
+	}()
+}
+
+// notifyReloadSignal reloads the configuration on SIGHUP.
+func notifyReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reloadConfig()
+		}
+	}()
+}
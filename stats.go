@@ -0,0 +1,187 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	statsDays         = 30 // Days of history in the uploads per day chart.
+	statsTopLanguages = 10
+)
+
+// Statistics settings. publicStats shows /stats to everyone instead of only to admins.
+var (
+	publicStats   atomic.Bool
+	statsInterval time.Duration
+)
+
+// Stats are aggregate counts over all uploads. They are computed periodically by aggregateStats, so that viewing
+// them never scans the uploads table.
+type Stats struct {
+	Uploads      int64           `json:"uploads"`
+	Attachments  int64           `json:"attachments"`
+	StorageBytes int64           `json:"storage_bytes"`
+	PerDay       []DayCount      `json:"uploads_per_day"` // Oldest first, including days without uploads.
+	TopLanguages []LanguageCount `json:"top_languages"`
+	Updated      int64           `json:"updated"`
+}
+
+// A DayCount is the number of uploads made on one day.
+type DayCount struct {
+	Date    string `json:"date"` // YYYY-MM-DD in UTC.
+	Uploads int64  `json:"uploads"`
+	Percent int    `json:"-"` // Of the busiest day, for drawing the chart.
+}
+
+// A LanguageCount is the number of attachments written in a language, which is guessed from the file extension.
+type LanguageCount struct {
+	Language    string `json:"language"`
+	Attachments int64  `json:"attachments"`
+}
+
+// currentStats holds the latest aggregated *Stats, or nil until the first aggregation finishes.
+var currentStats atomic.Pointer[Stats]
+
+func initStats() {
+	loadFlag(&publicStats, "STATS_PUBLIC")
+	statsInterval = time.Duration(envInt64("STATS_INTERVAL_SECONDS", 600)) * time.Second
+	if statsInterval <= 0 {
+		log.Fatal("STATS_INTERVAL_SECONDS environment variable must be positive")
+	}
+
+	// The statistics are kept in memory, so every replica computes its own.
+	RegisterJob(&Job{
+		Name:         "stats",
+		Interval:     statsInterval,
+		EveryReplica: true,
+		Run: func(context.Context) error {
+			return aggregateStats()
+		},
+	})
+}
+
+// aggregateStats computes the statistics and replaces currentStats.
+func aggregateStats() error {
+	stats := &Stats{Updated: time.Now().UTC().Unix()}
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0), COALESCE(SUM(cardinality(files)), 0) FROM Uploads").
+		Scan(&stats.Uploads, &stats.StorageBytes, &stats.Attachments)
+	if err != nil {
+		return err
+	}
+
+	// Uploads per day, with the days without any filled in as zero.
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, -(statsDays - 1))
+	rows, err := db.Query("SELECT timestamp / 86400, COUNT(*) FROM Uploads WHERE timestamp >= $1 GROUP BY 1", first.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	counts := make(map[int64]int64)
+	for rows.Next() {
+		var day, n int64
+		if err = rows.Scan(&day, &n); err != nil {
+			return err
+		}
+		counts[day] = n
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	var busiest int64
+	for date := first; !date.After(today); date = date.AddDate(0, 0, 1) {
+		n := counts[date.Unix()/86400]
+		busiest = max(busiest, n)
+		stats.PerDay = append(stats.PerDay, DayCount{Date: date.Format(time.DateOnly), Uploads: n})
+	}
+	for i := range stats.PerDay {
+		if busiest > 0 {
+			stats.PerDay[i].Percent = int(stats.PerDay[i].Uploads * 100 / busiest)
+		}
+	}
+
+	// Attachments by file extension, merged by language since several extensions may share one.
+	rows, err = db.Query(`SELECT ext, COUNT(*) FROM (
+			SELECT lower(substring(f FROM '\.([A-Za-z0-9+#]{1,10})$')) AS ext FROM Uploads, unnest(files) AS f
+		) AS extensions WHERE ext IS NOT NULL GROUP BY ext`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	languages := make(map[string]int64)
+	for rows.Next() {
+		var ext string
+		var n int64
+		if err = rows.Scan(&ext, &n); err != nil {
+			return err
+		}
+		language := "." + ext
+		if id, ok := extensionLanguages[language]; ok {
+			language = languageName(id)
+		}
+		languages[language] += n
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for language, n := range languages {
+		stats.TopLanguages = append(stats.TopLanguages, LanguageCount{language, n})
+	}
+	slices.SortFunc(stats.TopLanguages, func(a, b LanguageCount) int {
+		if a.Attachments != b.Attachments {
+			return cmp.Compare(b.Attachments, a.Attachments)
+		}
+		return strings.Compare(a.Language, b.Language)
+	})
+	if len(stats.TopLanguages) > statsTopLanguages {
+		stats.TopLanguages = stats.TopLanguages[:statsTopLanguages]
+	}
+
+	currentStats.Store(stats)
+	return nil
+}
+
+// viewableStats returns the current statistics if the request may see them. Otherwise an error has been sent and nil
+// is returned.
+func viewableStats(c *gin.Context) *Stats {
+	if !publicStats.Load() && !currentAccount(c).HasRole(RoleAdmin) {
+		route404(c)
+		return nil
+	}
+	stats := currentStats.Load()
+	if stats == nil {
+		respondError(c, http.StatusServiceUnavailable, errors.New("statistics have not been computed yet"))
+	}
+	return stats
+}
+
+func registerStatsRoutes(r *gin.Engine) {
+	r.GET("/stats", func(c *gin.Context) {
+		stats := viewableStats(c)
+		if stats == nil {
+			return
+		}
+		renderPage(c, http.StatusOK, "stats.html", gin.H{
+			"Page":  NewPageInfo(c, "Statistics"),
+			"Stats": stats,
+		})
+	})
+
+	r.GET("/api/v1/stats", func(c *gin.Context) {
+		stats := viewableStats(c)
+		if stats == nil {
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// An ObjectStore holds the encoded attachments, keyed by the SHA-1 of their contents.
+type ObjectStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error) // Streams an object instead of reading it into memory.
+	Put(ctx context.Context, key string, data []byte, tags ObjectTags) error
+	Exists(ctx context.Context, key string) (bool, error)
+	Delete(ctx context.Context, keys []string) error
+	SetTags(ctx context.Context, key string, tags ObjectTags) error // Replaces all tags of an object.
+	String() string                                                 // The spec that opens the store again, e.g. "s3://bucket".
+}
+
+// ObjectTags label stored objects for lifecycle rules and cost allocation reports. Stores without tag support ignore
+// them. See uploadObjectTags for the tags that are set.
+type ObjectTags map[string]string
+
+// uploadObjectTags returns the tags of the objects of an upload: the upload hash, the uploader ("anonymous" or
+// "account:<id>") and, for uploads in the trash, the date after which they may be deleted.
+func uploadObjectTags(hash string, accountId int64, expires time.Time) ObjectTags {
+	tags := ObjectTags{"upload": hash, "uploader": "anonymous"}
+	if accountId != 0 {
+		tags["uploader"] = "account:" + strconv.FormatInt(accountId, 10)
+	}
+	if !expires.IsZero() {
+		tags["expires"] = expires.UTC().Format(time.DateOnly)
+	}
+	return tags
+}
+
+// tagUploadObjects replaces the tags of every object of an upload that it does not share with other uploads, so that
+// lifecycle rules never expire an object another upload still needs. Tags are informational, so failures are logged
+// rather than returned.
+func tagUploadObjects(ctx context.Context, upload *UploadModel, expires time.Time) {
+	tags := uploadObjectTags(upload.Hash, upload.AccountId, expires)
+	keys, err := exclusiveObjectKeys(ctx, upload)
+	if err != nil {
+		log.Printf("failed to tag the objects of upload %v: %v", upload.Hash, err)
+		return
+	}
+	for _, key := range keys {
+		if err := objectStore.SetTags(ctx, key, tags); err != nil {
+			log.Printf("failed to tag object %v of upload %v: %v", key, upload.Hash, err)
+		}
+	}
+}
+
+// ErrObjectArchived is returned by Get for objects in an archive storage class, which must be retrieved first.
+var ErrObjectArchived = errors.New("the object is archived and must be retrieved before it can be read")
+
+// An ArchivingStore can move objects to cheaper archive storage and retrieve them again on demand.
+type ArchivingStore interface {
+	ObjectStore
+	Archive(ctx context.Context, key string) error
+	Retrieve(ctx context.Context, key string) error // Starts a retrieval; Get succeeds once it finishes.
+}
+
+// A RangeStore can stream an object from an offset without reading what comes before it, such as with the ranged
+// GETs of S3.
+type RangeStore interface {
+	OpenAt(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+}
+
+// openObjectAt streams an object from an offset, skipping the bytes before it in stores that cannot start there.
+func openObjectAt(ctx context.Context, store ObjectStore, key string, offset int64) (io.ReadCloser, error) {
+	if store, ok := store.(RangeStore); ok {
+		return store.OpenAt(ctx, key, offset)
+	}
+	body, err := store.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.CopyN(io.Discard, body, offset); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+// objectStore is where attachments are stored, configured by the STORAGE environment variable.
+var objectStore ObjectStore
+
+func initStorage() {
+	spec := os.Getenv("STORAGE")
+	if spec == "" {
+		spec = "s3"
+	}
+	store, err := OpenStore(spec)
+	if err != nil {
+		log.Fatal("Could not open the STORAGE object store: ", err)
+	}
+	objectStore = store
+
+	if spec := os.Getenv("STORAGE_REPLICA"); spec != "" {
+		replica, err := OpenStore(spec)
+		if err != nil {
+			log.Fatal("Could not open the STORAGE_REPLICA object store: ", err)
+		}
+		objectStore = replicatedStore{store, replica}
+	}
+}
+
+// OpenStore opens an object store from its spec: "s3://<bucket>", "s3://<bucket>?region=<region>" for a bucket
+// outside the default region, or "fs:<directory>" for the local filesystem. The shorthands "s3" and "fs" use the
+// S3_BUCKET and STORAGE_DIR environment variables.
+func OpenStore(spec string) (ObjectStore, error) {
+	switch spec {
+	case "s3":
+		spec = "s3://" + os.Getenv("S3_BUCKET")
+	case "fs":
+		spec = "fs:" + os.Getenv("STORAGE_DIR")
+	}
+
+	if bucket, ok := strings.CutPrefix(spec, "s3://"); ok {
+		bucket, query, _ := strings.Cut(bucket, "?")
+		if bucket == "" {
+			return nil, errors.New("S3 bucket name missing, set S3_BUCKET")
+		}
+		options, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		storageClass, err := s3StorageClass()
+		if err != nil {
+			return nil, err
+		}
+		region := options.Get("region")
+		return s3Store{NewS3Actions(region), bucket, region, storageClass}, nil
+	}
+	if dir, ok := strings.CutPrefix(spec, "fs:"); ok {
+		if dir == "" {
+			return nil, errors.New("directory missing, set STORAGE_DIR")
+		}
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+		return fsStore{dir}, nil
+	}
+	return nil, fmt.Errorf(`unknown object store %q, expected "s3://<bucket>" or "fs:<directory>"`, spec)
+}
+
+// s3Store keeps objects in an S3 bucket.
+type s3Store struct {
+	actions      S3Actions
+	bucket       string
+	region       string             // Empty for the default region.
+	storageClass types.StorageClass // Of new objects, or empty for the bucket's default.
+}
+
+func (s s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.actions.DownloadLargeObject(s.bucket, key)
+	var archived *types.InvalidObjectState
+	if errors.As(err, &archived) {
+		return nil, ErrObjectArchived
+	}
+	return data, err
+}
+
+func (s s3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.OpenAt(ctx, key, 0)
+}
+
+func (s s3Store) OpenAt(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	body, err := s.actions.OpenObject(ctx, s.bucket, key, offset)
+	var archived *types.InvalidObjectState
+	if errors.As(err, &archived) {
+		return nil, ErrObjectArchived
+	}
+	return body, err
+}
+
+func (s s3Store) Put(ctx context.Context, key string, data []byte, tags ObjectTags) error {
+	tagging := make(url.Values)
+	for k, v := range tags {
+		tagging.Set(k, v)
+	}
+	_, err := s.actions.UploadObject(ctx, s.bucket, key, data, s.storageClass, tagging.Encode())
+	return err
+}
+
+func (s s3Store) SetTags(ctx context.Context, key string, tags ObjectTags) error {
+	return s.actions.PutObjectTags(ctx, s.bucket, key, tags)
+}
+
+func (s s3Store) Archive(ctx context.Context, key string) error {
+	return s.actions.ArchiveObject(ctx, s.bucket, key)
+}
+
+func (s s3Store) Retrieve(ctx context.Context, key string) error {
+	return s.actions.RestoreArchivedObject(ctx, s.bucket, key, archiveRetrievalDays)
+}
+
+func (s s3Store) Exists(ctx context.Context, key string) (bool, error) {
+	return s.actions.ObjectExists(ctx, s.bucket, key)
+}
+
+func (s s3Store) Delete(ctx context.Context, keys []string) error {
+	return s.actions.DeleteObjects(ctx, s.bucket, keys)
+}
+
+func (s s3Store) String() string {
+	if s.region != "" {
+		return "s3://" + s.bucket + "?region=" + s.region
+	}
+	return "s3://" + s.bucket
+}
+
+// fsStore keeps objects as files in a local directory, for single server deployments and development.
+type fsStore struct {
+	dir string
+}
+
+// path returns the file of an object. Keys are hex hashes, with the prefix of body objects for those, so anything else
+// is refused rather than risk a key escaping the directory.
+func (s fsStore) path(key string) (string, error) {
+	if hash := strings.TrimPrefix(key, bodyObjectPrefix); hash == "" || !isValidHex(hash) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s fsStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (s fsStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s fsStore) OpenAt(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put writes to a temporary file first, so that a crash never leaves a partially written object behind.
+// The filesystem has no place for tags, so they are ignored.
+func (s fsStore) Put(ctx context.Context, key string, data []byte, tags ObjectTags) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".tmp-"+key+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s fsStore) Exists(ctx context.Context, key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s fsStore) Delete(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		path, err := s.path(key)
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s fsStore) SetTags(ctx context.Context, key string, tags ObjectTags) error {
+	return nil
+}
+
+func (s fsStore) String() string {
+	return "fs:" + s.dir
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// S3 can notify an SNS topic when objects are deleted or restored, and SNS can deliver those notifications to
+// /api/v1/storage/events over HTTPS. Objects that a live upload still references but that were deleted outside of
+// copycat, by a person, a lifecycle rule or a tool, are recorded in the MissingObjects table, and the pages of their
+// uploads warn that attachments are missing until the objects are stored again.
+
+var ErrStorageEventInvalid = errors.New("the storage event notification is not signed by a trusted SNS topic")
+
+// storageEventTopics are the ARNs of the SNS topics whose notifications are trusted, or empty when S3 events are not
+// consumed.
+var storageEventTopics []string
+
+// snsCertHost matches the hosts SNS serves its signing certificates and subscription confirmations from.
+var snsCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsCerts caches the signing certificates of SNS by URL.
+var snsCerts = struct {
+	sync.Mutex
+	m map[string]*x509.Certificate
+}{m: make(map[string]*x509.Certificate)}
+
+func initStorageEvents() {
+	for _, arn := range strings.Split(os.Getenv("S3_EVENTS_TOPIC_ARN"), ",") {
+		if arn = strings.TrimSpace(arn); arn != "" {
+			storageEventTopics = append(storageEventTopics, arn)
+		}
+	}
+}
+
+// An snsMessage is a message delivered by SNS to an HTTPS subscription.
+type snsMessage struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string
+}
+
+// signedString returns the fields of the message that SNS signs, in the order it signs them.
+func (m *snsMessage) signedString() string {
+	fields := []string{"Message", m.Message, "MessageId", m.MessageId}
+	if m.Type == "Notification" {
+		if m.Subject != "" {
+			fields = append(fields, "Subject", m.Subject)
+		}
+		fields = append(fields, "Timestamp", m.Timestamp, "TopicArn", m.TopicArn, "Type", m.Type)
+	} else {
+		fields = append(fields, "SubscribeURL", m.SubscribeURL, "Timestamp", m.Timestamp, "Token", m.Token,
+			"TopicArn", m.TopicArn, "Type", m.Type)
+	}
+	return strings.Join(fields, "\n") + "\n"
+}
+
+// snsURL checks that a URL in a message points at SNS itself, so that a forged message cannot make the server fetch
+// anything else.
+func snsURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "https" || !snsCertHost.MatchString(u.Host) {
+		return nil, ErrStorageEventInvalid
+	}
+	return u, nil
+}
+
+// snsCertificate fetches the certificate SNS signed a message with.
+func snsCertificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	u, err := snsURL(certURL)
+	if err != nil || !strings.HasSuffix(u.Path, ".pem") {
+		return nil, ErrStorageEventInvalid
+	}
+	snsCerts.Lock()
+	cert, ok := snsCerts.m[certURL]
+	snsCerts.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the SNS certificate %v: %v", certURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("the SNS certificate %v is not PEM encoded", certURL)
+	}
+	if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, err
+	}
+	snsCerts.Lock()
+	snsCerts.m[certURL] = cert
+	snsCerts.Unlock()
+	return cert, nil
+}
+
+// verifySNSMessage checks that a message comes from one of the trusted topics and carries a valid SNS signature.
+func verifySNSMessage(ctx context.Context, m *snsMessage) error {
+	if !slices.Contains(storageEventTopics, m.TopicArn) {
+		return ErrStorageEventInvalid
+	}
+	var h hash.Hash
+	var algorithm crypto.Hash
+	switch m.SignatureVersion {
+	case "1":
+		h, algorithm = sha1.New(), crypto.SHA1
+	case "2":
+		h, algorithm = sha256.New(), crypto.SHA256
+	default:
+		return ErrStorageEventInvalid
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return ErrStorageEventInvalid
+	}
+	cert, err := snsCertificate(ctx, m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return ErrStorageEventInvalid
+	}
+	h.Write([]byte(m.signedString()))
+	if rsa.VerifyPKCS1v15(key, algorithm, h.Sum(nil), signature) != nil {
+		return ErrStorageEventInvalid
+	}
+	return nil
+}
+
+// s3Event is the part of an S3 event notification that copycat reads.
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+}
+
+// handleS3Event records the objects that an S3 event notification reports as deleted or stored again.
+func handleS3Event(message string) error {
+	var event s3Event
+	if err := json.Unmarshal([]byte(message), &event); err != nil {
+		return err
+	}
+	// Only events of the primary bucket count; a replica losing an object does not make an attachment unavailable.
+	store := objectStore
+	if replicated, ok := store.(replicatedStore); ok {
+		store = replicated.primary
+	}
+	bucket := ""
+	if s3, ok := store.(s3Store); ok {
+		bucket = s3.bucket
+	}
+	for _, record := range event.Records {
+		if bucket != "" && record.S3.Bucket.Name != bucket {
+			continue
+		}
+		key, err := url.QueryUnescape(record.S3.Object.Key) // Keys are form encoded in notifications.
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(record.EventName, "ObjectRemoved:"), strings.HasPrefix(record.EventName, "LifecycleExpiration:"):
+			err = MarkObjectMissing(key, record.EventName)
+		case strings.HasPrefix(record.EventName, "ObjectCreated:"), record.EventName == "ObjectRestore:Completed":
+			err = MarkObjectFound(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkObjectMissing records that an object was deleted from storage outside of copycat, if an upload that is not in
+// the trash still references it. Objects of purged and trashed uploads are expected to disappear.
+func MarkObjectMissing(key, reason string) error {
+	result, err := db.Exec(`INSERT INTO MissingObjects(key, since, reason) SELECT $1, $2, $3
+		WHERE EXISTS (SELECT 1 FROM Uploads, unnest(files) AS f WHERE deleted_at = 0 AND f LIKE '%/' || $1)
+		ON CONFLICT (key) DO NOTHING`, key, time.Now().UTC().Unix(), reason)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Object %v was deleted from storage (%v) but is still referenced by an upload", key, reason)
+		RecordAudit("storage", "object.missing", key, reason, "")
+	}
+	return nil
+}
+
+// MarkObjectFound records that an object is stored again.
+func MarkObjectFound(key string) error {
+	result, err := db.Exec("DELETE FROM MissingObjects WHERE key = $1", key)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		RecordAudit("storage", "object.found", key, "", "")
+	}
+	return nil
+}
+
+// MissingObjects returns the keys of the attachments of an upload whose objects are recorded as missing.
+func (upload *UploadModel) MissingObjects() (map[string]bool, error) {
+	if len(storageEventTopics) == 0 || len(upload.FileHashes) == 0 {
+		return nil, nil
+	}
+	rows, err := db.Query("SELECT key FROM MissingObjects WHERE key = ANY($1)", pq.Array(upload.FileHashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	missing := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		missing[key] = true
+	}
+	return missing, rows.Err()
+}
+
+func registerStorageEventRoutes(r *gin.Engine) {
+	// Receive S3 event notifications through an SNS HTTPS subscription.
+	r.POST("/api/v1/storage/events", func(c *gin.Context) {
+		if len(storageEventTopics) == 0 {
+			route404(c)
+			return
+		}
+		var message snsMessage
+		// SNS sends JSON with a text/plain content type.
+		if err := json.NewDecoder(io.LimitReader(c.Request.Body, 256*1024)).Decode(&message); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if err := verifySNSMessage(c.Request.Context(), &message); err != nil {
+			respondError(c, http.StatusForbidden, err)
+			return
+		}
+
+		switch message.Type {
+		case "SubscriptionConfirmation":
+			u, err := snsURL(message.SubscribeURL)
+			if err != nil {
+				respondError(c, http.StatusForbidden, err)
+				return
+			}
+			req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, u.String(), nil)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				respondError(c, http.StatusBadGateway, fmt.Errorf("failed to confirm the SNS subscription: %v", err))
+				return
+			}
+			resp.Body.Close()
+			log.Printf("Confirmed the SNS subscription to %v", message.TopicArn)
+		case "Notification":
+			if err := handleS3Event(message.Message); err != nil {
+				// SNS retries failed deliveries.
+				respondError(c, http.StatusInternalServerError, fmt.Errorf("failed to handle an S3 event: %v", err))
+				return
+			}
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Team membership roles. Owners and admins manage the member list, but only owners can grant or revoke those roles.
+const (
+	TeamRoleOwner  = "owner"
+	TeamRoleAdmin  = "admin"
+	TeamRoleMember = "member"
+)
+
+const teamUploadsPageSize = 50
+
+var (
+	ErrTeamSlugInvalid = errors.New("team names must be 2 to 32 lowercase letters, digits or dashes")
+	ErrTeamSlugTaken   = errors.New("that team name is already taken")
+	ErrTeamRoleInvalid = errors.New(`role must be "owner", "admin" or "member"`)
+	ErrNotTeamMember   = errors.New("you are not a member of that team")
+	ErrTeamPermission  = errors.New("your role in this team does not allow that")
+	ErrLastTeamOwner   = errors.New("a team must keep at least one owner")
+)
+
+var teamSlugPattern = regexp.MustCompile(`^[a-z0-9-]{2,32}$`)
+
+// A Team is a shared namespace for uploads. Team uploads are only visible to members, at /t/<slug>/<hash>.
+type Team struct {
+	Id      int64
+	Slug    string
+	Name    string
+	Created int64
+}
+
+// A TeamMember is an account's membership in a team.
+type TeamMember struct {
+	Username string
+	Role     string
+	Joined   int64
+}
+
+func isValidTeamRole(role string) bool {
+	return role == TeamRoleOwner || role == TeamRoleAdmin || role == TeamRoleMember
+}
+
+// CreateTeam creates a team with owner as its first member. Teams created by an identity provider through SCIM have
+// no owner, and owner is nil.
+func CreateTeam(slug, name string, owner *Account) (*Team, error) {
+	if !teamSlugPattern.MatchString(slug) {
+		return nil, ErrTeamSlugInvalid
+	}
+	if name == "" {
+		name = slug
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	team := &Team{Slug: slug, Name: name, Created: time.Now().UTC().Unix()}
+	err = tx.QueryRow("INSERT INTO Teams(slug, name, created) VALUES ($1, $2, $3) RETURNING id", slug, name, team.Created).Scan(&team.Id)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok && err.Code == "23505" { // unique_violation
+			return nil, ErrTeamSlugTaken
+		}
+		return nil, err
+	}
+	if owner != nil {
+		_, err = tx.Exec("INSERT INTO TeamMembers(team_id, account_id, role, joined) VALUES ($1, $2, $3, $4)", team.Id, owner.Id, TeamRoleOwner, team.Created)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return team, tx.Commit()
+}
+
+// GetTeam fetches a team by its slug.
+func GetTeam(slug string) (*Team, error) {
+	team := new(Team)
+	err := db.QueryRow("SELECT id, slug, name, created FROM Teams WHERE slug = $1", slug).Scan(&team.Id, &team.Slug, &team.Name, &team.Created)
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// AccountTeams lists the teams account is a member of.
+func AccountTeams(account *Account) ([]Team, error) {
+	rows, err := db.Query(`SELECT t.id, t.slug, t.name, t.created FROM Teams t JOIN TeamMembers m ON m.team_id = t.id
+		WHERE m.account_id = $1 ORDER BY t.name`, account.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams []Team
+	for rows.Next() {
+		var team Team
+		if err = rows.Scan(&team.Id, &team.Slug, &team.Name, &team.Created); err != nil {
+			return nil, err
+		}
+		teams = append(teams, team)
+	}
+	return teams, rows.Err()
+}
+
+// Role returns the role of account in the team, or an empty string if it is not a member.
+func (team *Team) Role(account *Account) (string, error) {
+	if account == nil {
+		return "", nil
+	}
+	var role string
+	err := db.QueryRow("SELECT role FROM TeamMembers WHERE team_id = $1 AND account_id = $2", team.Id, account.Id).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// Members lists the members of the team, owners first.
+func (team *Team) Members() ([]TeamMember, error) {
+	rows, err := db.Query(`SELECT a.username, m.role, m.joined FROM TeamMembers m JOIN Accounts a ON a.id = m.account_id
+		WHERE m.team_id = $1 ORDER BY m.role = 'owner' DESC, m.role = 'admin' DESC, a.username`, team.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []TeamMember
+	for rows.Next() {
+		var member TeamMember
+		if err = rows.Scan(&member.Username, &member.Role, &member.Joined); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// SetMember adds account to the team with role, or changes its role if it is already a member.
+func (team *Team) SetMember(account *Account, role string) error {
+	if !isValidTeamRole(role) {
+		return ErrTeamRoleInvalid
+	}
+	_, err := db.Exec(`INSERT INTO TeamMembers(team_id, account_id, role, joined) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (team_id, account_id) DO UPDATE SET role = excluded.role`, team.Id, account.Id, role, time.Now().UTC().Unix())
+	return err
+}
+
+// Rename changes the display name of the team. Its slug stays the same, so that links to it keep working.
+func (team *Team) Rename(name string) error {
+	if name == "" {
+		name = team.Slug
+	}
+	if _, err := db.Exec("UPDATE Teams SET name = $1 WHERE id = $2", name, team.Id); err != nil {
+		return err
+	}
+	team.Name = name
+	return nil
+}
+
+// RemoveMember removes account from the team.
+func (team *Team) RemoveMember(account *Account) error {
+	_, err := db.Exec("DELETE FROM TeamMembers WHERE team_id = $1 AND account_id = $2", team.Id, account.Id)
+	return err
+}
+
+// ownerCount returns the number of owners of the team.
+func (team *Team) ownerCount() (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM TeamMembers WHERE team_id = $1 AND role = $2", team.Id, TeamRoleOwner).Scan(&n)
+	return n, err
+}
+
+// Uploads returns the most recent uploads of the team, optionally only those whose body or attachment names contain
+// the search string.
+func (team *Team) Uploads(search string) ([]*UploadModel, error) {
+	rows, err := db.Query("SELECT "+uploadColumns+` FROM Uploads WHERE team_id = $1 AND deleted_at = 0
+		AND ($2 = '' OR body ILIKE '%' || $2 || '%' OR array_to_string(files, ' ') ILIKE '%' || $2 || '%')
+		ORDER BY timestamp DESC LIMIT $3`, team.Id, escapeLike(search), teamUploadsPageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []*UploadModel
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern so that s is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// memberTeam fetches the team named by the :team parameter and the role of the requesting account in it.
+// Teams are invisible to non-members, so a 404 page is shown for both missing teams and teams the account is not
+// part of. On failure nil is returned.
+func memberTeam(c *gin.Context) (*Team, string) {
+	team, err := GetTeam(c.Param("team"))
+	if err != nil {
+		route404(c)
+		return nil, ""
+	}
+	role, err := team.Role(currentAccount(c))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, ""
+	}
+	if role == "" {
+		route404(c)
+		return nil, ""
+	}
+	return team, role
+}
+
+func registerTeamRoutes(r *gin.Engine) {
+	// Team browse and search page.
+	r.GET("/t/:team", rateLimit(PolicySearch), func(c *gin.Context) {
+		team, _ := memberTeam(c)
+		if team == nil {
+			return
+		}
+
+		search := c.Query("q")
+		uploads, err := team.Uploads(search)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		members, err := team.Members()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		renderPage(c, http.StatusOK, "team.html", gin.H{
+			"Page":    NewPageInfo(c, team.Name),
+			"Team":    team,
+			"Uploads": uploads,
+			"Members": members,
+			"Search":  search,
+		})
+	})
+
+	// View an upload in the team namespace.
+	r.GET("/t/:team/:hash", func(c *gin.Context) {
+		team, _ := memberTeam(c)
+		if team == nil {
+			return
+		}
+
+		hash := uploadParam(c)
+		upload, err := GetUpload(hash)
+		if err != nil || upload.TeamId != team.Id {
+			route404(c)
+			return
+		}
+		renderUpload(c, hash, upload)
+	})
+
+	// Create a team owned by the requesting account.
+	r.POST("/api/v1/teams", func(c *gin.Context) {
+		account := requireAccount(c)
+		if account == nil {
+			return
+		}
+
+		team, err := CreateTeam(c.PostForm("slug"), c.PostForm("name"), account)
+		if err == ErrTeamSlugInvalid || err == ErrTeamSlugTaken {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"slug": team.Slug,
+			"name": team.Name,
+			"url":  "/t/" + team.Slug,
+		})
+	})
+
+	// manageMember checks that the requesting account may change the membership of the named account, which has
+	// currentRole in the team (empty if it is not a member) and will have newRole (empty when it is being removed).
+	// On success the team and target account are returned; otherwise an error has been sent.
+	manageMember := func(c *gin.Context, username string, newRole string) (*Team, *Account) {
+		if requireAccount(c) == nil {
+			return nil, nil
+		}
+		team, role := memberTeam(c)
+		if team == nil {
+			return nil, nil
+		}
+
+		target, err := GetAccount(username)
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrAccountNotFound)
+			return nil, nil
+		}
+		targetRole, err := team.Role(target)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return nil, nil
+		}
+
+		// Admins may only manage plain members. Owners may manage anyone, and anyone may leave.
+		privileged := func(r string) bool { return r == TeamRoleOwner || r == TeamRoleAdmin }
+		leaving := target.Id == currentAccount(c).Id && newRole == ""
+		if !leaving && (role == TeamRoleMember || role == TeamRoleAdmin && (privileged(targetRole) || privileged(newRole))) {
+			respondError(c, http.StatusForbidden, ErrTeamPermission)
+			return nil, nil
+		}
+
+		if targetRole == TeamRoleOwner && newRole != TeamRoleOwner {
+			owners, err := team.ownerCount()
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return nil, nil
+			}
+			if owners <= 1 {
+				respondError(c, http.StatusConflict, ErrLastTeamOwner)
+				return nil, nil
+			}
+		}
+		return team, target
+	}
+
+	// Add a member or change their role.
+	r.POST("/api/v1/teams/:team/members", func(c *gin.Context) {
+		role := c.DefaultPostForm("role", TeamRoleMember)
+		if !isValidTeamRole(role) {
+			respondError(c, http.StatusBadRequest, ErrTeamRoleInvalid)
+			return
+		}
+
+		team, target := manageMember(c, c.PostForm("username"), role)
+		if team == nil {
+			return
+		}
+		if err := team.SetMember(target, role); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"username": target.Username,
+			"role":     role,
+		})
+	})
+
+	// Remove a member from the team.
+	r.DELETE("/api/v1/teams/:team/members/:username", func(c *gin.Context) {
+		team, target := manageMember(c, c.Param("username"), "")
+		if team == nil {
+			return
+		}
+		if err := team.RemoveMember(target); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Member removed",
+		})
+	})
+}
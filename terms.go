@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// termsCookie holds the version of the terms of service that an anonymous browser accepted.
+const termsCookie = "copycat_terms"
+
+// ErrTermsNotAccepted is returned for uploads by submitters who have not accepted the current terms of service.
+var ErrTermsNotAccepted = errors.New("you must accept the terms of service at /terms before uploading")
+
+// requireTerms makes submitters accept the current terms of service before their first upload, from REQUIRE_TERMS.
+var requireTerms bool
+
+// Terms are a version of the terms of service. Publishing new terms creates a new version, which everyone has to
+// accept again.
+type Terms struct {
+	Version     int64  `json:"version"`
+	Text        string `json:"text"`
+	PublishedAt int64  `json:"published_at"`
+	PublishedBy string `json:"-"`
+}
+
+// Paragraphs splits the text of the terms at blank lines, for the /terms page.
+func (t *Terms) Paragraphs() []string {
+	var paragraphs []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(t.Text, "\r\n", "\n"), "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			paragraphs = append(paragraphs, paragraph)
+		}
+	}
+	return paragraphs
+}
+
+func initTerms() {
+	requireTerms = envBool("REQUIRE_TERMS")
+}
+
+// CurrentTerms returns the latest version of the terms of service, or nil if none have been published.
+func CurrentTerms() (*Terms, error) {
+	t := new(Terms)
+	err := db.QueryRow("SELECT version, text, published_at, published_by FROM Terms ORDER BY version DESC LIMIT 1").
+		Scan(&t.Version, &t.Text, &t.PublishedAt, &t.PublishedBy)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+// PublishTerms stores a new version of the terms of service.
+func PublishTerms(text, publishedBy string) (*Terms, error) {
+	t := &Terms{Text: text, PublishedAt: time.Now().UTC().Unix(), PublishedBy: publishedBy}
+	err := db.QueryRow("INSERT INTO Terms(text, published_at, published_by) VALUES ($1, $2, $3) RETURNING version",
+		t.Text, t.PublishedAt, t.PublishedBy).Scan(&t.Version)
+	return t, err
+}
+
+// HasAcceptedTerms reports whether an account accepted a version of the terms of service.
+func HasAcceptedTerms(account *Account, version int64) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM TermsAcceptances WHERE account_id = $1 AND version = $2", account.Id, version).Scan(&n)
+	return n > 0, err
+}
+
+// RecordTermsAcceptance records when and from where an account accepted a version of the terms of service.
+func RecordTermsAcceptance(account *Account, version int64, ip string) error {
+	_, err := db.Exec(`INSERT INTO TermsAcceptances(account_id, version, accepted_at, ip) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`, account.Id, version, time.Now().UTC().Unix(), ip)
+	return err
+}
+
+// termsAccepted reports whether the client of the request accepted the terms: accounts by a recorded acceptance,
+// and anonymous browsers by the terms cookie.
+func termsAccepted(c *gin.Context, terms *Terms) (bool, error) {
+	if account := currentAccount(c); account != nil {
+		return HasAcceptedTerms(account, terms.Version)
+	}
+	cookie, _ := c.Cookie(termsCookie)
+	return cookie == strconv.FormatInt(terms.Version, 10), nil
+}
+
+// acceptTerms records that the client of the request accepted the terms.
+func acceptTerms(c *gin.Context, terms *Terms) error {
+	if account := currentAccount(c); account != nil {
+		return RecordTermsAcceptance(account, terms.Version, c.ClientIP())
+	}
+	c.SetCookie(termsCookie, strconv.FormatInt(terms.Version, 10), 365*24*60*60, "/", "", c.Request.TLS != nil, true)
+	return nil
+}
+
+// pendingTerms returns the terms that the client of the request still has to accept before uploading, or nil.
+func pendingTerms(c *gin.Context) (*Terms, error) {
+	if !requireTerms {
+		return nil, nil
+	}
+	terms, err := CurrentTerms()
+	if terms == nil || err != nil {
+		return nil, err
+	}
+	accepted, err := termsAccepted(c, terms)
+	if accepted || err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+// checkTerms makes sure that the submitter of an upload accepted the current terms of service, when they are
+// required. A submission accepts them itself when accept is true, as with the checkbox of the upload form, or with
+// the current version in an X-Accept-Terms header. Otherwise an error has been sent and false is returned.
+func checkTerms(c *gin.Context, accept bool) bool {
+	terms, err := pendingTerms(c)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return false
+	}
+	if terms == nil {
+		return true
+	}
+	if !accept && c.GetHeader("X-Accept-Terms") != strconv.FormatInt(terms.Version, 10) {
+		respondError(c, http.StatusForbidden, ErrTermsNotAccepted)
+		return false
+	}
+	if err = acceptTerms(c, terms); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return false
+	}
+	return true
+}
+
+func registerTermsRoutes(r *gin.Engine) {
+	r.GET("/terms", func(c *gin.Context) {
+		terms, err := CurrentTerms()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if terms == nil {
+			route404(c)
+			return
+		}
+		pending, err := pendingTerms(c)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		renderPage(c, http.StatusOK, "terms.html", gin.H{
+			"Page":    NewPageInfo(c, "Terms of service"),
+			"Terms":   terms,
+			"Pending": pending != nil,
+		})
+	})
+
+	// Accept the current terms, then go back to the page they were accepted on.
+	r.POST("/terms/accept", func(c *gin.Context) {
+		terms, err := CurrentTerms()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if terms == nil {
+			route404(c)
+			return
+		}
+		if err = acceptTerms(c, terms); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		redirect := "/"
+		if referer, err := url.Parse(c.Request.Referer()); err == nil && referer.Host == c.Request.Host && referer.Path != "/terms" {
+			redirect = referer.RequestURI()
+		}
+		c.Redirect(http.StatusSeeOther, redirect)
+	})
+
+	r.GET("/api/v1/terms", func(c *gin.Context) {
+		terms, err := CurrentTerms()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if terms == nil {
+			respondError(c, http.StatusNotFound, errors.New("no terms of service have been published"))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"version":      terms.Version,
+			"text":         terms.Text,
+			"published_at": terms.PublishedAt,
+			"required":     requireTerms,
+		})
+	})
+
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	// Publish a new version of the terms of service, which everyone has to accept again when they are required.
+	admin.PUT("/terms", func(c *gin.Context) {
+		text := strings.TrimSpace(c.PostForm("text"))
+		if text == "" {
+			respondError(c, http.StatusBadRequest, errors.New(`the "text" of the terms is required`))
+			return
+		}
+		account := currentAccount(c)
+		terms, err := PublishTerms(text, account.Username)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "terms.publish", strconv.FormatInt(terms.Version, 10), "", c.ClientIP())
+		c.JSON(http.StatusOK, terms)
+	})
+}
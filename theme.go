@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// themeDir is a directory of operator-provided overrides, from the THEME_DIR variable. A file in its templates/ or
+// assets/ subdirectory is used instead of the bundled file of the same name, so a theme only needs to contain the
+// files it changes.
+var themeDir atomic.Pointer[string]
+
+// Site is the branding of the deployment, passed to templates as .Page.Site.
+type Site struct {
+	Name        string
+	Logo        string // URL of an image shown next to the name, or empty for none.
+	FooterLinks []FooterLink
+}
+
+// A FooterLink is shown at the bottom of every page.
+type FooterLink struct {
+	Label string
+	URL   string
+}
+
+var site atomic.Pointer[Site]
+
+func initTheme() {
+	if err := loadTheme(); err != nil {
+		log.Fatal(err)
+	}
+	RegisterReloader("theme", loadTheme)
+}
+
+// loadTheme loads the theme directory and the branding variables: SITE_NAME, SITE_LOGO and FOOTER_LINKS, which is a
+// comma separated list of label=URL pairs.
+func loadTheme() error {
+	dir := os.Getenv("THEME_DIR")
+	if dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("THEME_DIR %q is not a directory", dir)
+		}
+	}
+
+	branding := &Site{Name: "Copycat", Logo: os.Getenv("SITE_LOGO")}
+	if name := os.Getenv("SITE_NAME"); name != "" {
+		branding.Name = name
+	}
+	for _, pair := range strings.Split(os.Getenv("FOOTER_LINKS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		label, url, ok := strings.Cut(pair, "=")
+		if !ok || label == "" || url == "" {
+			return fmt.Errorf("FOOTER_LINKS entry %q must be label=URL", pair)
+		}
+		branding.FooterLinks = append(branding.FooterLinks, FooterLink{strings.TrimSpace(label), strings.TrimSpace(url)})
+	}
+
+	themeDir.Store(&dir)
+	site.Store(branding)
+	return nil
+}
+
+// templatePath returns the file of the named template, preferring the theme's override.
+func templatePath(name string) string {
+	if dir := *themeDir.Load(); dir != "" {
+		path := filepath.Join(dir, "templates", name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join("templates", name)
+}
+
+// assetsFS serves the bundled assets with the assets of the current theme layered over them. Like r.Static, it does
+// not list directories.
+func assetsFS() http.FileSystem {
+	return themeAssets{}
+}
+
+// themeAssets opens assets from the theme in use when they are opened, so that reloading the theme changes them.
+type themeAssets struct{}
+
+func (themeAssets) Open(name string) (http.File, error) {
+	dir := *themeDir.Load()
+	if dir == "" {
+		return gin.Dir("assets", false).Open(name)
+	}
+	return overlayFS{gin.Dir(filepath.Join(dir, "assets"), false), gin.Dir("assets", false)}.Open(name)
+}
+
+// overlayFS opens a file from the first of its file systems that has it.
+type overlayFS []http.FileSystem
+
+func (layers overlayFS) Open(name string) (http.File, error) {
+	var err error
+	for _, layer := range layers {
+		var file http.File
+		if file, err = layer.Open(name); err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return file, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Download bandwidth limits in bytes per second, or nil when unlimited. connectionRate applies to every download on
+// its own, while globalDownloadLimiter is shared by all downloads of this replica.
+var (
+	connectionRate        rate.Limit
+	globalDownloadLimiter *rate.Limiter
+)
+
+func initThrottling() {
+	perConnection := envInt64("DOWNLOAD_RATE_BYTES", 0)
+	global := envInt64("DOWNLOAD_GLOBAL_RATE_BYTES", 0)
+	if perConnection < 0 || global < 0 {
+		log.Fatal("DOWNLOAD_RATE_BYTES and DOWNLOAD_GLOBAL_RATE_BYTES environment variables must not be negative")
+	}
+	if perConnection > 0 {
+		connectionRate = rate.Limit(perConnection)
+	}
+	if global > 0 {
+		globalDownloadLimiter = newBandwidthLimiter(rate.Limit(global))
+	}
+}
+
+// newBandwidthLimiter creates a token bucket of bytes that allows bursts of up to a second of bandwidth, capped at the
+// buffer size used to stream objects.
+func newBandwidthLimiter(limit rate.Limit) *rate.Limiter {
+	return rate.NewLimiter(limit, int(min(int64(limit), objectBufferSize)))
+}
+
+// throttleDownload limits the bandwidth of the response to the configured download limits.
+func throttleDownload(c *gin.Context) {
+	var limiters []*rate.Limiter
+	if connectionRate != 0 {
+		limiters = append(limiters, newBandwidthLimiter(connectionRate))
+	}
+	if globalDownloadLimiter != nil {
+		limiters = append(limiters, globalDownloadLimiter)
+	}
+	if len(limiters) > 0 {
+		c.Writer = &throttledWriter{c.Writer, c.Request.Context(), limiters}
+	}
+}
+
+// throttledWriter delays writes to a response until every limiter allows them. Writes are split into chunks no larger
+// than the smallest burst, so that a limiter never refuses a chunk outright.
+type throttledWriter struct {
+	gin.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	chunk := len(p)
+	for _, limiter := range w.limiters {
+		chunk = min(chunk, limiter.Burst())
+	}
+
+	written := 0
+	for written < len(p) {
+		n := min(chunk, len(p)-written)
+		for _, limiter := range w.limiters {
+			// Fails once the client disconnects, which ends the download.
+			if err := limiter.WaitN(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.ResponseWriter.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
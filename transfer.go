@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The owner of an upload can give it to another account or to a team, for example when someone leaves a project. The
+// upload then counts against the quota of its new owner, which must have room for it, and is managed by them alone:
+// the edit token and claims of the previous owner stop working. Uploads given to a team become visible to its members
+// only, and team uploads given to an account become private, so that a transfer never makes an upload public. An
+// account is only offered the upload, and becomes its owner once it accepts, so that nobody is given content, or has
+// their quota used, against their will.
+
+var (
+	ErrTransferTarget        = errors.New(`exactly one of "username" and "team" is required`)
+	ErrTransferSame          = errors.New("the upload already belongs there")
+	ErrTransferOfferNotFound = errors.New("transfer offer not found")
+)
+
+// A TransferOffer is an upload offered to an account by its owner.
+type TransferOffer struct {
+	Hash      string `json:"hash"`
+	OfferedBy string `json:"offered_by"` // The username of the owner, or "anonymous" for the holder of the edit token.
+	CreatedAt int64  `json:"created_at"`
+}
+
+// OfferTransfer offers an upload to the account to, on behalf of by, replacing an earlier offer of it. The offer only
+// stands while the upload still belongs to whoever made it.
+func OfferTransfer(ctx context.Context, upload *UploadModel, to *Account, by string) error {
+	if upload.TeamId == 0 && upload.AccountId == to.Id {
+		return ErrTransferSame
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO TransferOffers(upload_hash, account_id, from_account_id, from_team_id, offered_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (upload_hash) DO UPDATE SET account_id = excluded.account_id,
+		from_account_id = excluded.from_account_id, from_team_id = excluded.from_team_id, offered_by = excluded.offered_by,
+		created_at = excluded.created_at`,
+		upload.Hash, to.Id, upload.AccountId, upload.TeamId, by, time.Now().UTC().Unix())
+	return err
+}
+
+// ListTransferOffers returns the uploads offered to an account, the most recent offer first.
+func ListTransferOffers(ctx context.Context, account *Account) ([]TransferOffer, error) {
+	rows, err := db.QueryContext(ctx, `SELECT upload_hash, offered_by, created_at FROM TransferOffers WHERE account_id = $1
+		ORDER BY created_at DESC`, account.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	offers := []TransferOffer{}
+	for rows.Next() {
+		var offer TransferOffer
+		if err = rows.Scan(&offer.Hash, &offer.OfferedBy, &offer.CreatedAt); err != nil {
+			return nil, err
+		}
+		offers = append(offers, offer)
+	}
+	return offers, rows.Err()
+}
+
+// AcceptTransfer gives the upload with hash to the account it was offered to, and returns it as it is now. An offer of
+// an upload that changed owners since is dropped, and ErrTransferOfferNotFound is returned.
+func AcceptTransfer(ctx context.Context, hash string, account *Account) (*UploadModel, error) {
+	var fromAccount, fromTeam int64
+	err := db.QueryRowContext(ctx, "SELECT from_account_id, from_team_id FROM TransferOffers WHERE upload_hash = $1 AND account_id = $2",
+		hash, account.Id).Scan(&fromAccount, &fromTeam)
+	if err == sql.ErrNoRows {
+		return nil, ErrTransferOfferNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	upload, err := GetUpload(hash)
+	if err != nil || upload.AccountId != fromAccount || upload.TeamId != fromTeam {
+		if _, err = DeclineTransfer(ctx, hash, account); err != nil {
+			return nil, err
+		}
+		return nil, ErrTransferOfferNotFound
+	}
+	if err = TransferUpload(ctx, upload, account, nil, account); err != nil {
+		return nil, err
+	}
+	return GetUpload(hash)
+}
+
+// DeclineTransfer drops the offer of the upload with hash to an account, and reports whether there was one.
+func DeclineTransfer(ctx context.Context, hash string, account *Account) (bool, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM TransferOffers WHERE upload_hash = $1 AND account_id = $2", hash, account.Id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// TransferUpload gives an upload to the account to, or to the team when it is not nil, on behalf of the account by,
+// which must be a member of the team. The ownership and quota are checked and changed in one transaction, so that
+// concurrent uploads cannot take the new owner over its quota unnoticed.
+func TransferUpload(ctx context.Context, upload *UploadModel, to *Account, team *Team, by *Account) error {
+	if team != nil && upload.TeamId == team.Id || team == nil && upload.TeamId == 0 && upload.AccountId == to.Id {
+		return ErrTransferSame
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var size int64
+	if err = tx.QueryRowContext(ctx, "SELECT size FROM Uploads WHERE hash = $1 FOR UPDATE", upload.Hash).
+		Scan(&size); err != nil {
+		return err
+	}
+	// Quotas are summed like GetQuota does; see quota.go.
+	quota := &Quota{Scope: "account", Limit: accountQuota}
+	column, owner := "account_id", int64(0)
+	if team != nil {
+		quota.Scope, quota.Limit = "team", teamQuota
+		column, owner = "team_id", team.Id
+	} else {
+		owner = to.Id
+	}
+	if err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(size), 0) FROM Uploads WHERE "+column+" = $1 AND hash <> $2 AND deleted_at = 0",
+		owner, upload.Hash).Scan(&quota.Used); err != nil {
+		return err
+	}
+	if err = quota.Check(size); err != nil {
+		return err
+	}
+
+	if team != nil {
+		_, err = tx.ExecContext(ctx, "UPDATE Uploads SET team_id = $1, account_id = $2, edit_token = '' WHERE hash = $3",
+			team.Id, by.Id, upload.Hash)
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE Uploads SET account_id = $1, team_id = 0, private = private OR team_id <> 0,
+			edit_token = '' WHERE hash = $2`, to.Id, upload.Hash)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM Claims WHERE upload_hash = $1", upload.Hash); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM TransferOffers WHERE upload_hash = $1", upload.Hash); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	invalidateUpload(upload.Hash)
+	return nil
+}
+
+// transferFromRequest transfers the upload of a request to the team named by the "team" form field, or offers it to
+// the account named by "username", and returns the upload as it is now, with whether it was only offered. Otherwise
+// an error has been sent and nil is returned.
+func transferFromRequest(c *gin.Context) (*UploadModel, bool) {
+	upload := ownedUpload(c)
+	if upload == nil {
+		return nil, false
+	}
+	username, slug := strings.TrimSpace(c.PostForm("username")), strings.TrimSpace(c.PostForm("team"))
+	if (username == "") == (slug == "") {
+		respondError(c, http.StatusBadRequest, ErrTransferTarget)
+		return nil, false
+	}
+
+	account := currentAccount(c)
+	var to *Account
+	var team *Team
+	var err error
+	if slug != "" {
+		// Only members may put uploads into a team.
+		var role string
+		if team, err = GetTeam(slug); err == nil {
+			role, err = team.Role(account)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			respondError(c, http.StatusInternalServerError, err)
+			return nil, false
+		} else if role == "" {
+			respondError(c, http.StatusForbidden, ErrNotTeamMember)
+			return nil, false
+		}
+	} else if to, err = GetAccount(username); err != nil || to.Disabled {
+		respondError(c, http.StatusNotFound, ErrAccountNotFound)
+		return nil, false
+	}
+
+	actor := "anonymous"
+	if account != nil {
+		actor = account.Username
+	}
+	if to != nil {
+		if err = OfferTransfer(c.Request.Context(), upload, to, actor); err == ErrTransferSame {
+			respondError(c, http.StatusConflict, err)
+			return nil, false
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return nil, false
+		}
+		RecordAudit(actor, "upload.transfer.offer", upload.Hash, "to "+to.Username, c.ClientIP())
+		return upload, true
+	}
+
+	err = TransferUpload(c.Request.Context(), upload, nil, team, account)
+	var quotaErr *QuotaExceededError
+	switch {
+	case errors.As(err, &quotaErr):
+		respondError(c, http.StatusRequestEntityTooLarge, err)
+		return nil, false
+	case err == ErrTransferSame:
+		respondError(c, http.StatusConflict, err)
+		return nil, false
+	case err != nil:
+		RecordAudit(actor, "upload.transfer", upload.Hash, "failed: "+err.Error(), c.ClientIP())
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	RecordAudit(actor, "upload.transfer", upload.Hash, "to team "+team.Slug, c.ClientIP())
+
+	if upload, err = GetUpload(upload.Hash); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return upload, false
+}
+
+// uploadLocation returns the page of an upload where it is now, or "" when it has none but share links.
+func uploadLocation(upload *UploadModel) string {
+	if upload.TeamId != 0 {
+		team, err := GetTeamByID(fmt.Sprint(upload.TeamId))
+		if err != nil {
+			log.Printf("failed to find the team of upload %v: %v", upload.Hash, err)
+			return ""
+		}
+		return baseurl + "/t/" + team.Slug + "/" + upload.ShortHash()
+	} else if upload.Private {
+		return ""
+	}
+	return baseurl + uploadPath(upload.ShortHash())
+}
+
+// transferForm returns what the form to transfer an upload shows on its page, with the teams it may be given to, or
+// nil when the viewer is not its owner. Only the logged in account that uploaded it is shown the form.
+func transferForm(c *gin.Context, upload *UploadModel) gin.H {
+	account := currentAccount(c)
+	if account == nil || upload.AccountId != account.Id {
+		return nil
+	}
+	teams, err := AccountTeams(account)
+	if err != nil {
+		log.Printf("failed to list teams of %v: %v", account.Username, err)
+	}
+	return gin.H{
+		"Action": uploadPath(upload.Hash) + "/transfer",
+		"Teams":  teams,
+	}
+}
+
+func registerTransferRoutes(r *gin.Engine) {
+	// Give an upload to a team, or offer it to another account, as its owner.
+	r.POST("/api/v1/uploads/:hash/transfer", func(c *gin.Context) {
+		upload, offered := transferFromRequest(c)
+		if upload == nil {
+			return
+		}
+		if offered {
+			c.JSON(http.StatusAccepted, gin.H{
+				"hash":    upload.Hash,
+				"pending": true,
+			})
+			return
+		}
+		response := gin.H{
+			"hash":    upload.Hash,
+			"private": upload.Private,
+		}
+		if location := uploadLocation(upload); location != "" {
+			response["url"] = location
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// The form on the upload page, which leads to the upload where it is now.
+	r.POST("/p/:hash/transfer", func(c *gin.Context) {
+		upload, offered := transferFromRequest(c)
+		if upload == nil {
+			return
+		}
+		location := uploadLocation(upload)
+		if offered {
+			location = uploadPath(upload.ShortHash())
+		} else if location == "" {
+			location = "/"
+		}
+		c.Redirect(http.StatusSeeOther, location)
+	})
+
+	// The uploads offered to the account, and accepting or declining them.
+	r.GET("/api/v1/me/transfers", requireRole(RoleUser), func(c *gin.Context) {
+		offers, err := ListTransferOffers(c.Request.Context(), currentAccount(c))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"offers": offers,
+		})
+	})
+
+	r.POST("/api/v1/me/transfers/:hash/accept", requireRole(RoleUser), func(c *gin.Context) {
+		account := currentAccount(c)
+		upload, err := AcceptTransfer(c.Request.Context(), c.Param("hash"), account)
+		var quotaErr *QuotaExceededError
+		switch {
+		case errors.Is(err, ErrTransferOfferNotFound):
+			respondError(c, http.StatusNotFound, err)
+			return
+		case errors.As(err, &quotaErr):
+			respondError(c, http.StatusRequestEntityTooLarge, err)
+			return
+		case err != nil:
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "upload.transfer", upload.Hash, "to "+account.Username, c.ClientIP())
+		response := gin.H{
+			"hash":    upload.Hash,
+			"private": upload.Private,
+		}
+		if location := uploadLocation(upload); location != "" {
+			response["url"] = location
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	r.DELETE("/api/v1/me/transfers/:hash", requireRole(RoleUser), func(c *gin.Context) {
+		if found, err := DeclineTransfer(c.Request.Context(), c.Param("hash"), currentAccount(c)); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if !found {
+			respondError(c, http.StatusNotFound, ErrTransferOfferNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Transfer declined",
+		})
+	})
+}
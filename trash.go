@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trashGrace is how long deleted uploads stay in the trash, where they can be restored, before their attachments
+// are deleted from storage for good. With a grace period of 0, deletions are immediate.
+var trashGrace time.Duration
+
+var (
+	ErrNotUploadOwner     = errors.New("only the owner of an upload may delete it")
+	ErrNotInTrash         = errors.New("upload not found in the trash")
+	ErrUploadInTrash      = errors.New("an identical upload is in the trash, and only its owner may restore it")
+	ErrDeletedByModerator = errors.New("this upload was deleted by a moderator, and only a moderator may restore it")
+)
+
+func initTrash() {
+	trashGrace = time.Duration(envInt64("TRASH_DAYS", 30)) * 24 * time.Hour
+
+	RegisterJob(&Job{
+		Name:     "trash",
+		Interval: time.Hour,
+		Run:      purgeExpiredTrash,
+	})
+}
+
+// TrashUpload moves an upload to the trash, or purges it right away when there is no grace period. Its objects are
+// tagged with the end of the grace period, so bucket lifecycle rules can act on them too. by names the moderator or
+// admin deleting it, and is "" when its owner does; owners cannot restore what a moderator deleted.
+func TrashUpload(ctx context.Context, upload *UploadModel, by string) error {
+	if trashGrace == 0 {
+		_, _, err := PurgeUpload(ctx, upload.Hash)
+		return err
+	}
+	now := time.Now()
+	if err := SetUploadDeleted(upload.Hash, now.UTC().Unix(), by); err != nil {
+		return err
+	}
+	tagUploadObjects(ctx, upload, now.Add(trashGrace))
+	purgeCDN(ctx, upload)
+	return nil
+}
+
+// RestoreUpload takes an upload out of the trash.
+func RestoreUpload(ctx context.Context, upload *UploadModel) error {
+	if err := SetUploadDeleted(upload.Hash, 0, ""); err != nil {
+		return err
+	}
+	tagUploadObjects(ctx, upload, time.Time{})
+	return nil
+}
+
+// purgeExpiredTrash permanently deletes the uploads whose grace period in the trash is over.
+func purgeExpiredTrash(ctx context.Context) error {
+	hashes, err := ExpiredTrash(time.Now().Add(-trashGrace).UTC().Unix())
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, _, err = PurgeUpload(ctx, hash); err != nil {
+			return fmt.Errorf("failed to purge %v: %v", hash, err)
+		}
+		RecordAudit("system", "upload.purge", hash, "trash grace period over", "")
+	}
+	return nil
+}
+
+// trashJSON describes uploads in the trash and when they will be purged.
+func trashJSON(uploads []*UploadModel) []gin.H {
+	list := make([]gin.H, len(uploads))
+	for i, upload := range uploads {
+		list[i] = gin.H{
+			"hash":       upload.Hash,
+			"deleted_at": time.Unix(upload.DeletedAt, 0).UTC().Format(time.RFC3339),
+			"purge_at":   time.Unix(upload.DeletedAt, 0).Add(trashGrace).UTC().Format(time.RFC3339),
+		}
+	}
+	return list
+}
+
+func registerTrashRoutes(r *gin.Engine) {
+	// Delete an upload as its owner: the submitter holding its edit token, or the account that uploaded it.
+	r.DELETE("/api/v1/uploads/:hash", func(c *gin.Context) {
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		if !upload.IsOwner(c) {
+			respondError(c, http.StatusForbidden, ErrNotUploadOwner)
+			return
+		}
+		if !checkHooks(c, &HookPayload{Event: HookPreDelete, Hash: upload.Hash, Files: upload.FileNames, Private: upload.Private}) {
+			return
+		}
+		if err = TrashUpload(c.Request.Context(), upload, ""); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload deleted",
+		})
+	})
+
+	// Restore an upload from the trash as its owner.
+	r.POST("/api/v1/uploads/:hash/restore", func(c *gin.Context) {
+		upload, err := GetTrashedUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrNotInTrash)
+			return
+		}
+		if !upload.IsOwner(c) {
+			respondError(c, http.StatusForbidden, errors.New("only the owner of an upload may restore it"))
+			return
+		}
+		var deletedBy string
+		var size int64
+		if err = db.QueryRowContext(c.Request.Context(), "SELECT deleted_by, size FROM Uploads WHERE hash = $1", upload.Hash).
+			Scan(&deletedBy, &size); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if deletedBy != "" {
+			respondError(c, http.StatusForbidden, ErrDeletedByModerator)
+			return
+		}
+		// Uploads in the trash do not count against the quota, so they must fit in it again.
+		quota, err := uploadQuota(c.Request.Context(), upload)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if err = quota.Check(size); err != nil {
+			respondError(c, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err = RestoreUpload(c.Request.Context(), upload); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload restored",
+		})
+	})
+
+	// List the uploads of the logged in account that are in the trash.
+	r.GET("/api/v1/me/trash", func(c *gin.Context) {
+		account := requireAccount(c)
+		if account == nil {
+			return
+		}
+		query, ok := parseListQuery(c)
+		if !ok {
+			return
+		}
+		uploads, next, err := ListTrash("account_id", account.Id, query)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"uploads":     trashJSON(uploads),
+			"next_cursor": setListLinks(c, next),
+		})
+	})
+
+	moderation := r.Group("/api/v1/moderation", requireRole(RoleModerator))
+
+	// List the most recently deleted uploads of everyone.
+	moderation.GET("/trash", func(c *gin.Context) {
+		query, ok := parseListQuery(c)
+		if !ok {
+			return
+		}
+		uploads, next, err := ListTrash("", nil, query)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"uploads":     trashJSON(uploads),
+			"next_cursor": setListLinks(c, next),
+		})
+	})
+
+	moderation.POST("/uploads/:hash/restore", func(c *gin.Context) {
+		upload, err := GetTrashedUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrNotInTrash)
+			return
+		}
+		if err = RestoreUpload(c.Request.Context(), upload); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(currentAccount(c).Username, "upload.restore", upload.Hash, "", c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Upload restored",
+		})
+	})
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// twoFactorCookie holds the account that entered its password but still has to enter a code to log in.
+	twoFactorCookie   = "copycat_2fa"
+	twoFactorLifetime = 5 * time.Minute
+	totpPeriod        = 30 // Seconds each code is valid for.
+	recoveryCodeCount = 10
+	// maxTwoFactorFailures is how many wrong codes end a pending login. The account refuses codes until
+	// twoFactorLifetime has passed since the last wrong one, so that entering the password again allows no more guesses.
+	maxTwoFactorFailures = 5
+)
+
+var (
+	ErrTwoFactorFailed   = errors.New("incorrect authentication code")
+	ErrTwoFactorRequired = errors.New("your role requires two-factor authentication, enable it at /account/2fa")
+	ErrTwoFactorLocked   = errors.New("too many incorrect authentication codes, log in again in a few minutes")
+)
+
+// twoFactorRole is the least privileged role that must use two-factor authentication, from the REQUIRE_2FA variable,
+// or "" when it is optional for everyone.
+var twoFactorRole string
+
+func initTwoFactor() {
+	twoFactorRole = os.Getenv("REQUIRE_2FA")
+	if _, ok := roleRanks[twoFactorRole]; twoFactorRole != "" && !ok {
+		log.Fatal("REQUIRE_2FA environment variable must be a role: ", ErrRoleInvalid)
+	}
+}
+
+// MustEnrollTwoFactor reports whether the account's role requires two-factor authentication but it is not enabled.
+func (account *Account) MustEnrollTwoFactor() bool {
+	return twoFactorRole != "" && account.HasRole(twoFactorRole) && !account.TwoFactor
+}
+
+// BeginTwoFactor generates a new TOTP secret for the account, which replaces any earlier unconfirmed one. It is only
+// enabled once EnableTwoFactor confirms that the authenticator app produces valid codes.
+func BeginTwoFactor(account *Account) (*otp.Key, error) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: site.Load().Name, AccountName: account.Username})
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("UPDATE Accounts SET totp_secret = $1 WHERE id = $2 AND NOT totp_enabled", key.Secret(), account.Id)
+	return key, err
+}
+
+// EnableTwoFactor checks a code against the secret from BeginTwoFactor, then enables two-factor authentication and
+// returns new recovery codes, which are not stored in plaintext.
+func EnableTwoFactor(account *Account, code string) ([]string, error) {
+	ok, err := verifyTOTP(account, code)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrTwoFactorFailed
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("DELETE FROM RecoveryCodes WHERE account_id = $1", account.Id); err != nil {
+		return nil, err
+	}
+	for i := range codes {
+		token := randomToken()
+		codes[i] = token[:5] + "-" + token[5:10]
+		if _, err = tx.Exec("INSERT INTO RecoveryCodes(account_id, code_hash) VALUES ($1, $2)", account.Id, hashToken(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = tx.Exec("UPDATE Accounts SET totp_enabled = TRUE WHERE id = $1", account.Id); err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// DisableTwoFactor turns two-factor authentication off and forgets the secret and recovery codes.
+func DisableTwoFactor(account *Account) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("UPDATE Accounts SET totp_enabled = FALSE, totp_secret = '', totp_last_step = 0 WHERE id = $1", account.Id); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM RecoveryCodes WHERE account_id = $1", account.Id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecoveryCodesLeft returns how many unused recovery codes the account has.
+func RecoveryCodesLeft(account *Account) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM RecoveryCodes WHERE account_id = $1", account.Id).Scan(&n)
+	return n, err
+}
+
+// verifyTOTP checks a code from the authenticator app, allowing for one period of clock drift. Each code is accepted
+// only once, so a code that was observed cannot be replayed.
+func verifyTOTP(account *Account, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	if err := db.QueryRow("SELECT totp_secret, totp_last_step FROM Accounts WHERE id = $1", account.Id).Scan(&secret, &lastStep); err != nil {
+		return false, err
+	}
+	if secret == "" {
+		return false, nil
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	now := time.Now()
+	for _, drift := range []int64{-1, 0, 1} {
+		t := now.Add(time.Duration(drift*totpPeriod) * time.Second)
+		step := t.Unix() / totpPeriod
+		ok, err := totp.ValidateCustom(code, secret, t, totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+		if err != nil || !ok || step <= lastStep {
+			continue
+		}
+		result, err := db.Exec("UPDATE Accounts SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1", step, account.Id)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n > 0, err
+	}
+	return false, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// VerifySecondFactor checks a code from the authenticator app, or else uses up a recovery code.
+func VerifySecondFactor(account *Account, code string) (bool, error) {
+	if ok, err := verifyTOTP(account, code); ok || err != nil {
+		return ok, err
+	}
+	result, err := db.Exec("DELETE FROM RecoveryCodes WHERE account_id = $1 AND code_hash = $2", account.Id, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// twoFactorLocked reports whether too many wrong codes were entered for the account within twoFactorLifetime.
+func twoFactorLocked(account *Account) (bool, error) {
+	var locked bool
+	err := db.QueryRow("SELECT totp_failures >= $1 AND totp_failed_at >= $2 FROM Accounts WHERE id = $3",
+		maxTwoFactorFailures, time.Now().Add(-twoFactorLifetime).Unix(), account.Id).Scan(&locked)
+	return locked, err
+}
+
+// recordTwoFactorFailure counts a wrong code entered for the account, starting over when the last one is older than
+// twoFactorLifetime, and reports whether the pending login must end.
+func recordTwoFactorFailure(account *Account) (bool, error) {
+	now := time.Now()
+	var failures int
+	err := db.QueryRow(`UPDATE Accounts SET totp_failed_at = $1,
+		totp_failures = CASE WHEN totp_failed_at < $2 THEN 1 ELSE totp_failures + 1 END
+		WHERE id = $3 RETURNING totp_failures`, now.Unix(), now.Add(-twoFactorLifetime).Unix(), account.Id).Scan(&failures)
+	return failures >= maxTwoFactorFailures, err
+}
+
+// twoFactorSignature signs the payload of the two-factor cookie, separately from session cookies so that one can never
+// be used as the other.
+func twoFactorSignature(payload string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte("2fa\n" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setTwoFactorPending remembers that the browser entered the password of account, for twoFactorLifetime.
+func setTwoFactorPending(c *gin.Context, account *Account) {
+	payload := fmt.Sprintf("%d.%d", account.Id, time.Now().Add(twoFactorLifetime).Unix())
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(twoFactorCookie, payload+"."+twoFactorSignature(payload), int(twoFactorLifetime.Seconds()), "/", "", c.Request.TLS != nil, true)
+}
+
+// twoFactorPendingAccount returns the account whose password the browser entered, or nil.
+func twoFactorPendingAccount(c *gin.Context) *Account {
+	cookie, err := c.Cookie(twoFactorCookie)
+	if err != nil {
+		return nil
+	}
+	i := strings.LastIndexByte(cookie, '.')
+	if i < 0 || !hmac.Equal([]byte(cookie[i+1:]), []byte(twoFactorSignature(cookie[:i]))) {
+		return nil
+	}
+	idStr, expStr, _ := strings.Cut(cookie[:i], ".")
+	id, _ := strconv.ParseInt(idStr, 10, 64)
+	exp, _ := strconv.ParseInt(expStr, 10, 64)
+	if time.Now().Unix() > exp {
+		return nil
+	}
+	account, _ := GetAccountByID(id)
+	return account
+}
+
+// qrCodeDataURL renders text, such as a key for authenticator apps or the link that pairs a clip device, as a QR code
+// image to scan. The image is embedded in the page, so that the secret never appears in a URL that could be logged.
+func qrCodeDataURL(text string) (template.URL, error) {
+	code, err := qr.Encode(text, qr.M, qr.Auto)
+	if err != nil {
+		return "", err
+	}
+	img, err := barcode.Scale(code, 200, 200)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func registerTwoFactorRoutes(r *gin.Engine) {
+	renderTwoFactor := func(c *gin.Context, code int, data gin.H) {
+		data["Page"] = NewPageInfo(c, "Two-factor authentication")
+		renderPage(c, code, "twofactor.html", data)
+	}
+
+	// Enrollment shows a new secret to scan until a code confirms it; afterwards the page allows turning it off.
+	enrollment := func(c *gin.Context, code int, account *Account, err error) {
+		data := gin.H{"Enabled": account.TwoFactor}
+		if err != nil {
+			data["Error"] = err.Error()
+		}
+		if account.TwoFactor {
+			left, err := RecoveryCodesLeft(account)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			data["RecoveryCodesLeft"] = left
+		} else {
+			key, err := BeginTwoFactor(account)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			qr, err := qrCodeDataURL(key.String())
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			data["Secret"] = key.Secret()
+			data["QRCode"] = qr
+		}
+		renderTwoFactor(c, code, data)
+	}
+
+	r.GET("/account/2fa", func(c *gin.Context) {
+		account := currentAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		enrollment(c, http.StatusOK, account, nil)
+	})
+
+	r.POST("/account/2fa/enable", func(c *gin.Context) {
+		account := currentAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		codes, err := EnableTwoFactor(account, c.PostForm("code"))
+		if err == ErrTwoFactorFailed {
+			// A new secret is shown, since the app may have scanned a different one than the last one stored.
+			enrollment(c, http.StatusBadRequest, account, err)
+			return
+		} else if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "account.2fa.enable", account.Username, "", c.ClientIP())
+		// Sessions started with only the password are logged out, in case it was the password that leaked.
+		var keep int64
+		if current := currentSession(c); current != nil {
+			keep = current.Id
+		}
+		if err = RevokeOtherSessions(account, keep); err != nil {
+			log.Printf("failed to log out the other sessions of %v: %v", account.Username, err)
+		}
+		renderTwoFactor(c, http.StatusOK, gin.H{
+			"Enabled":       true,
+			"RecoveryCodes": codes,
+		})
+	})
+
+	// Turning two-factor authentication off needs the password and a current code.
+	r.POST("/account/2fa/disable", func(c *gin.Context) {
+		account := currentAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		if _, err := Login(account.Username, c.PostForm("password"), c.ClientIP()); err != nil {
+			enrollment(c, http.StatusUnauthorized, account, err)
+			return
+		}
+		ok, err := VerifySecondFactor(account, c.PostForm("code"))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if !ok {
+			enrollment(c, http.StatusUnauthorized, account, ErrTwoFactorFailed)
+			return
+		}
+		if err = DisableTwoFactor(account); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(account.Username, "account.2fa.disable", account.Username, "", c.ClientIP())
+		c.Redirect(http.StatusSeeOther, "/account/2fa")
+	})
+
+	// The second step of logging in, after the password was accepted by POST /login.
+	r.POST("/login/2fa", func(c *gin.Context) {
+		account := twoFactorPendingAccount(c)
+		if account == nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		// Codes are guessed one at a time, so after a few wrong ones the login has to start over, and is refused meanwhile.
+		endLogin := func() {
+			c.SetCookie(twoFactorCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+			renderPage(c, http.StatusTooManyRequests, "login.html", gin.H{
+				"Page":  NewPageInfo(c, "Log in"),
+				"SSO":   samlProvider != nil,
+				"Error": ErrTwoFactorLocked.Error(),
+			})
+		}
+		locked, err := twoFactorLocked(account)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if locked {
+			endLogin()
+			return
+		}
+		ok, err := VerifySecondFactor(account, c.PostForm("code"))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		} else if !ok {
+			if locked, err = recordTwoFactorFailure(account); err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			} else if locked {
+				endLogin()
+				return
+			}
+			renderPage(c, http.StatusUnauthorized, "login.html", gin.H{
+				"Page":      NewPageInfo(c, "Log in"),
+				"TwoFactor": true,
+				"Error":     ErrTwoFactorFailed.Error(),
+			})
+			return
+		}
+		c.SetCookie(twoFactorCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+		if _, err = db.Exec("UPDATE Accounts SET totp_failures = 0 WHERE id = $1", account.Id); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if err = setSession(c, account); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/")
+	})
+
+	// Turn off two-factor authentication for an account that lost its authenticator and recovery codes.
+	r.POST("/api/v1/admin/accounts/:username/2fa/reset", requireRole(RoleAdmin), func(c *gin.Context) {
+		target, err := GetAccount(c.Param("username"))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrAccountNotFound)
+			return
+		}
+		if err = DisableTwoFactor(target); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		RecordAudit(currentAccount(c).Username, "account.2fa.reset", target.Username, "", c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Two-factor authentication disabled",
+		})
+	})
+}
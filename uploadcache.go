@@ -0,0 +1,226 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// An UploadCache keeps the rows of recently viewed uploads in memory, so that popular uploads are not read from the
+// database on every view. Entries are keyed by the hash prefix they were looked up with, expire after a while in case
+// another replica changed them, and are dropped right away when this replica changes them. A nil UploadCache caches
+// nothing.
+type UploadCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // Front is the most recently used.
+	items    map[string]*list.Element
+}
+
+type uploadCacheEntry struct {
+	key    string
+	upload *UploadModel
+	loaded time.Time
+}
+
+// NewUploadCache creates an UploadCache holding at most capacity uploads for up to ttl each.
+func NewUploadCache(capacity int, ttl time.Duration) *UploadCache {
+	return &UploadCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// uploadCache caches GetUpload, or is nil when UPLOAD_CACHE_SIZE is 0.
+var uploadCache *UploadCache
+
+// recordAccess enables tracking when uploads were last read from the database, which the cache is warmed with.
+var recordAccess bool
+
+// accessInterval limits how often the last access of an upload is written.
+const accessInterval = time.Hour
+
+// uploadsChannel is the PostgreSQL notification channel that the hashes of changed uploads are sent on, so that every
+// replica drops them from its cache right away instead of serving them until they expire.
+const uploadsChannel = "copycat_uploads"
+
+func initUploadCache() {
+	size := envInt64("UPLOAD_CACHE_SIZE", 0)
+	ttl := time.Duration(envInt64("UPLOAD_CACHE_TTL_SECONDS", 60)) * time.Second
+	warm := envInt64("WARM_CACHE_UPLOADS", 0)
+	if size < 0 || ttl < 0 || warm < 0 {
+		log.Fatal("UPLOAD_CACHE_SIZE, UPLOAD_CACHE_TTL_SECONDS and WARM_CACHE_UPLOADS environment variables must not be negative")
+	}
+	if size == 0 {
+		return
+	}
+	uploadCache = NewUploadCache(int(size), ttl)
+	listenForUploadChanges()
+	if warm == 0 {
+		return
+	}
+	recordAccess = true
+
+	// Fill the cache before serving, so that a restart under load does not send every view to the database at once.
+	start := time.Now()
+	uploads, err := RecentlyAccessedUploads(int(min(warm, size)))
+	if err != nil {
+		log.Printf("failed to warm the upload cache: %v", err)
+		return
+	}
+	for _, upload := range uploads {
+		uploadCache.Put(upload.ShortHash(), upload) // Links use the short hash.
+	}
+	log.Printf("warmed the upload cache with %v uploads in %v", len(uploads), time.Since(start).Round(time.Millisecond))
+}
+
+// Get returns a copy of the cached upload for key, or nil if it is not cached or has expired.
+func (uc *UploadCache) Get(key string) *UploadModel {
+	if uc == nil {
+		return nil
+	}
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	element, ok := uc.items[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*uploadCacheEntry)
+	now := time.Now()
+	if now.Sub(entry.loaded) > uc.ttl || entry.upload.ExpiresAt != 0 && entry.upload.ExpiresAt <= now.UTC().Unix() {
+		uc.order.Remove(element)
+		delete(uc.items, key)
+		return nil
+	}
+	uc.order.MoveToFront(element)
+	upload := *entry.upload
+	return &upload
+}
+
+// Put adds an upload to the cache under key, evicting the least recently used upload when it is full.
+func (uc *UploadCache) Put(key string, upload *UploadModel) {
+	if uc == nil {
+		return
+	}
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	copied := *upload
+	entry := &uploadCacheEntry{key: key, upload: &copied, loaded: time.Now()}
+	if element, ok := uc.items[key]; ok {
+		element.Value = entry
+		uc.order.MoveToFront(element)
+		return
+	}
+	uc.items[key] = uc.order.PushFront(entry)
+	if uc.order.Len() > uc.capacity {
+		oldest := uc.order.Back()
+		delete(uc.items, uc.order.Remove(oldest).(*uploadCacheEntry).key)
+	}
+}
+
+// Invalidate drops every cached upload whose hash starts with hash, under whichever prefix it was looked up with.
+func (uc *UploadCache) Invalidate(hash string) {
+	if uc == nil {
+		return
+	}
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	for key, element := range uc.items {
+		if strings.HasPrefix(element.Value.(*uploadCacheEntry).upload.Hash, hash) {
+			uc.order.Remove(element)
+			delete(uc.items, key)
+		}
+	}
+}
+
+// Clear drops every cached upload.
+func (uc *UploadCache) Clear() {
+	if uc == nil {
+		return
+	}
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.order.Init()
+	clear(uc.items)
+}
+
+// Stats returns the number of cached uploads.
+func (uc *UploadCache) Stats() int {
+	if uc == nil {
+		return 0
+	}
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return len(uc.items)
+}
+
+// RecentlyAccessedUploads returns the visible uploads that were read from the database most recently.
+func RecentlyAccessedUploads(limit int) ([]*UploadModel, error) {
+	rows, err := db.Query("SELECT "+uploadColumns+` FROM Uploads WHERE last_accessed <> 0 AND deleted_at = 0
+		AND (expires_at = 0 OR expires_at > $1) ORDER BY last_accessed DESC LIMIT $2`, time.Now().UTC().Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []*UploadModel
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// touchUpload records that an upload was read from the database, at most once per accessInterval.
+func touchUpload(hash string) {
+	now := time.Now().UTC().Unix()
+	_, err := db.Exec("UPDATE Uploads SET last_accessed = $1 WHERE hash = $2 AND last_accessed < $3",
+		now, hash, now-int64(accessInterval.Seconds()))
+	if err != nil {
+		log.Printf("failed to record the access of upload %v: %v", hash, err)
+	}
+}
+
+// invalidateUpload drops a changed upload from the cache of this replica, and tells the other replicas to do the same.
+// It is called after the change, so that no replica caches the upload again as it was.
+func invalidateUpload(hash string) {
+	uploadCache.Invalidate(hash)
+	if _, err := db.Exec("SELECT pg_notify($1, $2)", uploadsChannel, hash); err != nil {
+		log.Printf("failed to notify other servers of the change of upload %v: %v", hash, err)
+	}
+}
+
+// listenForUploadChanges invalidates the uploads that other replicas notify of on uploadsChannel.
+func listenForUploadChanges() {
+	listener := pq.NewListener(dbConnStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("upload change listener: %v", err)
+		}
+	})
+	if err := listener.Listen(uploadsChannel); err != nil {
+		log.Fatal("failed to listen for upload changes: ", err)
+	}
+	go func() {
+		for notification := range listener.Notify {
+			if notification == nil {
+				// The connection was lost and reestablished, so notifications may have been missed.
+				uploadCache.Clear()
+				continue
+			}
+			uploadCache.Invalidate(notification.Extra)
+		}
+	}()
+}
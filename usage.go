@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hosted operators bill their customers, or charge departments back, for what they store and transfer. With
+// USAGE_ACCOUNTING set, the bytes received by the submission routes and sent by the download routes are added up per
+// month, account and API key, and the bytes each account stores are recorded every hour along with the most it stored
+// in the month. Transfers count against whoever made the request: anonymous requests against account 0, and requests
+// with the API token of an account against that token, so the usage of a token that was reset is kept apart from the
+// usage of the new one. Counts are gathered in memory and written every minute, like analytics.
+
+var ErrUsageMonth = errors.New(`"month" must be a month like 2026-01`)
+
+var usageAccounting atomic.Bool
+
+// maxUsagePending bounds the counts kept in memory between writes; transfers beyond are not counted.
+const maxUsagePending = 100000
+
+// A usageKey is what transfers are counted by.
+type usageKey struct {
+	month     string // YYYY-MM in UTC.
+	accountId int64
+	apiKey    string // The apiKeyID of the token the request was made with, or "" for sessions and anonymous requests.
+}
+
+// usageCounts are the transfers of a usageKey.
+type usageCounts struct {
+	received, sent, requests int64
+}
+
+var pendingUsage = struct {
+	sync.Mutex
+	counts map[usageKey]usageCounts
+}{counts: make(map[usageKey]usageCounts)}
+
+func initUsage() {
+	loadFlag(&usageAccounting, "USAGE_ACCOUNTING")
+
+	RegisterJob(&Job{
+		Name:         "usage",
+		Interval:     time.Minute,
+		EveryReplica: true,
+		Run:          flushUsage,
+	})
+	RegisterJob(&Job{
+		Name:     "stored usage",
+		Interval: time.Hour,
+		Run:      recordStoredUsage,
+	})
+}
+
+// apiKeyID identifies an API token by the start of its hash, which is all that is stored of it.
+func apiKeyID(tokenHash string) string {
+	return tokenHash[:min(len(tokenHash), 12)]
+}
+
+// countingReader counts the bytes read from a request body or an object.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// meterUsage is a middleware that counts the bytes of the request body read and of the response sent.
+func meterUsage(c *gin.Context) {
+	if !usageAccounting.Load() {
+		c.Next()
+		return
+	}
+	body := &countingReader{ReadCloser: c.Request.Body}
+	c.Request.Body = body
+	c.Next()
+
+	key := usageKey{month: time.Now().UTC().Format("2006-01"), apiKey: c.GetString("apiKey")}
+	if account := currentAccount(c); account != nil {
+		key.accountId = account.Id
+	}
+	pendingUsage.Lock()
+	defer pendingUsage.Unlock()
+	if counts, ok := pendingUsage.counts[key]; ok || len(pendingUsage.counts) < maxUsagePending {
+		counts.received += body.n
+		counts.sent += int64(max(c.Writer.Size(), 0))
+		counts.requests++
+		pendingUsage.counts[key] = counts
+	}
+}
+
+// flushUsage adds the pending counts to the MonthlyUsage table. Counts that could not be written are kept for the next
+// try.
+func flushUsage(ctx context.Context) error {
+	pendingUsage.Lock()
+	counts := pendingUsage.counts
+	pendingUsage.counts = make(map[usageKey]usageCounts)
+	pendingUsage.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	err := writeUsage(ctx, counts)
+	if err != nil {
+		pendingUsage.Lock()
+		for key, c := range counts {
+			if pending, ok := pendingUsage.counts[key]; ok || len(pendingUsage.counts) < maxUsagePending {
+				pending.received += c.received
+				pending.sent += c.sent
+				pending.requests += c.requests
+				pendingUsage.counts[key] = pending
+			}
+		}
+		pendingUsage.Unlock()
+	}
+	return err
+}
+
+func writeUsage(ctx context.Context, counts map[usageKey]usageCounts) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, c := range counts {
+		_, err = tx.ExecContext(ctx, `INSERT INTO MonthlyUsage(month, account_id, api_key, received_bytes, sent_bytes, requests)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (month, account_id, api_key) DO UPDATE SET received_bytes = MonthlyUsage.received_bytes + excluded.received_bytes,
+				sent_bytes = MonthlyUsage.sent_bytes + excluded.sent_bytes, requests = MonthlyUsage.requests + excluded.requests`,
+			key.month, key.accountId, key.apiKey, c.received, c.sent, c.requests)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// recordStoredUsage records the bytes every account stores, and the most it stored this month. Storage is counted
+// against the account and not an API key.
+func recordStoredUsage(ctx context.Context) error {
+	if !usageAccounting.Load() {
+		return nil
+	}
+	month := time.Now().UTC().Format("2006-01")
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Accounts that deleted all of their uploads store nothing anymore.
+	if _, err = tx.ExecContext(ctx, "UPDATE MonthlyUsage SET stored_bytes = 0 WHERE month = $1 AND api_key = ''", month); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO MonthlyUsage(month, account_id, api_key, stored_bytes, peak_stored_bytes)
+		SELECT $1, account_id, '', SUM(size), SUM(size) FROM Uploads GROUP BY account_id
+		ON CONFLICT (month, account_id, api_key) DO UPDATE SET stored_bytes = excluded.stored_bytes,
+			peak_stored_bytes = GREATEST(MonthlyUsage.peak_stored_bytes, excluded.stored_bytes)`, month)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// A UsageRecord is the usage of an account, or of one of its API keys, in a month.
+type UsageRecord struct {
+	Month           string `json:"month"`
+	AccountId       int64  `json:"account_id"` // 0 for anonymous requests and uploads.
+	Username        string `json:"username"`
+	APIKey          string `json:"api_key"` // "" for the storage of the account and for requests without an API token.
+	StoredBytes     int64  `json:"stored_bytes"`
+	PeakStoredBytes int64  `json:"peak_stored_bytes"`
+	ReceivedBytes   int64  `json:"received_bytes"`
+	SentBytes       int64  `json:"sent_bytes"`
+	Requests        int64  `json:"requests"`
+}
+
+// GetUsageRecords returns the usage of every account in a month, by account and API key.
+func GetUsageRecords(ctx context.Context, month string) ([]UsageRecord, error) {
+	rows, err := db.QueryContext(ctx, `SELECT u.month, u.account_id, COALESCE(a.username, ''), u.api_key, u.stored_bytes,
+			u.peak_stored_bytes, u.received_bytes, u.sent_bytes, u.requests
+		FROM MonthlyUsage AS u LEFT JOIN Accounts AS a ON a.id = u.account_id
+		WHERE u.month = $1 ORDER BY u.account_id, u.api_key`, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []UsageRecord{}
+	for rows.Next() {
+		var r UsageRecord
+		if err = rows.Scan(&r.Month, &r.AccountId, &r.Username, &r.APIKey, &r.StoredBytes, &r.PeakStoredBytes,
+			&r.ReceivedBytes, &r.SentBytes, &r.Requests); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// writeUsageCSV writes usage records as CSV with a header line.
+func writeUsageCSV(w io.Writer, records []UsageRecord) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"month", "account_id", "username", "api_key", "stored_bytes", "peak_stored_bytes", "received_bytes",
+		"sent_bytes", "requests"})
+	for _, r := range records {
+		out.Write([]string{r.Month, strconv.FormatInt(r.AccountId, 10), r.Username, r.APIKey,
+			strconv.FormatInt(r.StoredBytes, 10), strconv.FormatInt(r.PeakStoredBytes, 10),
+			strconv.FormatInt(r.ReceivedBytes, 10), strconv.FormatInt(r.SentBytes, 10), strconv.FormatInt(r.Requests, 10)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func registerUsageRoutes(r *gin.Engine) {
+	admin := r.Group("/api/v1/admin", requireRole(RoleAdmin))
+
+	// Export the usage of a month, the current one by default, as JSON or with ?format=csv as CSV.
+	admin.GET("/usage", func(c *gin.Context) {
+		month := c.DefaultQuery("month", time.Now().UTC().Format("2006-01"))
+		if _, err := time.Parse("2006-01", month); err != nil {
+			respondError(c, http.StatusBadRequest, ErrUsageMonth)
+			return
+		}
+		records, err := GetUsageRecords(c.Request.Context(), month)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		switch c.Query("format") {
+		case "", "json":
+			c.JSON(http.StatusOK, gin.H{"month": month, "usage": records})
+		case "csv":
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Header("Content-Disposition", `attachment; filename="usage-`+month+`.csv"`)
+			c.Status(http.StatusOK)
+			writeUsageCSV(c.Writer, records)
+		default:
+			respondError(c, http.StatusBadRequest, errors.New(`"format" must be json or csv`))
+		}
+	})
+}
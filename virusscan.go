@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Attachments can be scanned for malware by a ClamAV daemon at CLAMD_ADDRESS. New attachments are scanned in the
+// background once they are stored, and the scan job rescans the others whenever clamd loads a newer signature
+// database, so that malware recognized later is still found. Every attachment is in one of four states: pending until
+// it is scanned, clean, infected, or unscannable when it is too large or cannot be read. Infected attachments are only
+// downloaded by moderators; pending ones are served meanwhile.
+
+const (
+	ScanPending     = "pending"
+	ScanClean       = "clean"
+	ScanInfected    = "infected"
+	ScanUnscannable = "unscannable"
+)
+
+const (
+	virusScanBatch     = 100              // Attachments scanned at a time by the job.
+	clamdChunkSize     = 64 * 1024        // Bytes sent to clamd at a time.
+	clamdVersionMaxAge = 10 * time.Minute // How long the signature database version is trusted for.
+)
+
+var ErrAttachmentInfected = errors.New("this attachment contains malware and cannot be downloaded")
+
+var (
+	clamdAddress   string // "host:port", or "unix:" followed by the path of a socket; empty disables scanning.
+	virusScanMax   int64
+	clamdTimeout   time.Duration
+	clamdVersioned struct {
+		sync.Mutex
+		version string
+		at      time.Time
+	}
+)
+
+func init() {
+	RegisterJob(&Job{
+		Name:     "virus-scan",
+		Interval: time.Minute,
+		Run:      scanAttachmentBatch,
+	})
+}
+
+// initVirusScan loads the clamd daemon that attachments are scanned with, if any.
+func initVirusScan() {
+	clamdAddress = os.Getenv("CLAMD_ADDRESS")
+	virusScanMax = envInt64("VIRUS_SCAN_MAX_BYTES", 25*1024*1024)
+	clamdTimeout = time.Duration(envInt64("CLAMD_TIMEOUT_SECONDS", 60)) * time.Second
+}
+
+// dialClamd connects to clamd and sends it a command, in the null-terminated form that lets it answer likewise.
+func dialClamd(ctx context.Context, command string) (net.Conn, error) {
+	network, address := "tcp", clamdAddress
+	if path, ok := strings.CutPrefix(clamdAddress, "unix:"); ok {
+		network, address = "unix", path
+	}
+	dialer := net.Dialer{Timeout: clamdTimeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+	if _, err = conn.Write([]byte("z" + command + "\x00")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send %v to clamd: %v", command, err)
+	}
+	return conn, nil
+}
+
+// readClamdReply reads the null-terminated reply of clamd to a command.
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the reply of clamd: %v", err)
+	}
+	return strings.TrimSuffix(reply, "\x00"), nil
+}
+
+// clamdVersion returns the version of the signature database clamd uses, which changes whenever it loads an update.
+func clamdVersion(ctx context.Context) (string, error) {
+	clamdVersioned.Lock()
+	defer clamdVersioned.Unlock()
+	if clamdVersioned.version != "" && time.Since(clamdVersioned.at) < clamdVersionMaxAge {
+		return clamdVersioned.version, nil
+	}
+	conn, err := dialClamd(ctx, "VERSION")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return "", err
+	}
+	// For example "ClamAV 1.0.3/27093/Thu Oct 12 07:23:11 2023", where 27093 is the database version.
+	version := reply
+	if parts := strings.Split(reply, "/"); len(parts) >= 2 {
+		version = parts[1]
+	}
+	clamdVersioned.version, clamdVersioned.at = version, time.Now()
+	return version, nil
+}
+
+// clamdScan streams contents to clamd and returns the state it finds them in, with the name of the malware found or
+// why they could not be scanned.
+func clamdScan(ctx context.Context, contents io.Reader) (status, result string, err error) {
+	conn, err := dialClamd(ctx, "INSTREAM")
+	if err != nil {
+		return "", "", err
+	}
+	defer conn.Close()
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		n, err := io.ReadFull(contents, chunk)
+		if n > 0 {
+			if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, uint32(n))); err != nil {
+				return "", "", fmt.Errorf("failed to stream to clamd: %v", err)
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return "", "", fmt.Errorf("failed to stream to clamd: %v", err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", "", err
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", "", fmt.Errorf("failed to stream to clamd: %v", err)
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return "", "", err
+	}
+
+	// The reply is "stream: OK", "stream: <name> FOUND" or "<reason> ERROR".
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanClean, "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanInfected, strings.TrimSuffix(reply, " FOUND"), nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return ScanUnscannable, strings.TrimSuffix(reply, " ERROR"), nil
+	}
+	return "", "", fmt.Errorf("unexpected reply from clamd: %q", reply)
+}
+
+// ScanAttachment scans an attachment with clamd and records the state it is in.
+func ScanAttachment(ctx context.Context, key string) (status string, err error) {
+	version, err := clamdVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	var result string
+	file, contents, err := OpenFileObject(ctx, key)
+	switch {
+	case errors.Is(err, ErrObjectArchived):
+		status, result = ScanUnscannable, "archived"
+	case err != nil:
+		return "", err
+	case file.Size > virusScanMax:
+		contents.Close()
+		status, result = ScanUnscannable, "too large"
+	default:
+		status, result, err = clamdScan(ctx, contents)
+		contents.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	_, err = db.ExecContext(ctx, `UPDATE Objects SET scan_status = $1, scan_result = $2, scan_version = $3, scanned_at = $4
+		WHERE key = $5`, status, result, version, time.Now().UTC().Unix(), key)
+	if err == nil && status == ScanInfected {
+		log.Printf("attachment %v is infected with %v", key, result)
+		RecordAudit("clamd", "object.infected", key, result, "")
+	}
+	return status, err
+}
+
+// requestVirusScan scans new attachments in the background, if there is a scanner. The job scans those that fail.
+func requestVirusScan(keys []string) {
+	if clamdAddress == "" || len(keys) == 0 {
+		return
+	}
+	go func() {
+		for _, key := range keys {
+			ctx, cancel := context.WithTimeout(context.Background(), clamdTimeout)
+			if _, err := ScanAttachment(ctx, key); err != nil {
+				log.Printf("failed to scan attachment %v: %v", key, err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// scanAttachmentBatch scans the attachments that were not scanned yet, and then the ones scanned longest ago with an
+// older signature database than clamd has now.
+func scanAttachmentBatch(ctx context.Context) error {
+	if clamdAddress == "" {
+		return nil
+	}
+	version, err := clamdVersion(ctx)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT key FROM Objects WHERE key NOT LIKE $1 AND scan_version <> $2
+		ORDER BY scan_status <> $3, scanned_at LIMIT $4`, bodyObjectPrefix+"%", version, ScanPending, virusScanBatch)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err = ScanAttachment(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An AttachmentScan is the state an attachment was found in by the last scan.
+type AttachmentScan struct {
+	Status    string
+	Result    string // The malware found, or why the attachment could not be scanned.
+	ScannedAt int64
+}
+
+// GetAttachmentScans returns the scans of attachments by their keys. Attachments with no record are pending.
+func GetAttachmentScans(ctx context.Context, keys []string) (map[string]AttachmentScan, error) {
+	scans := make(map[string]AttachmentScan, len(keys))
+	for _, key := range keys {
+		scans[key] = AttachmentScan{Status: ScanPending}
+	}
+	rows, err := db.QueryContext(ctx, "SELECT key, scan_status, scan_result, scanned_at FROM Objects WHERE key = ANY($1)",
+		pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var scan AttachmentScan
+		if err = rows.Scan(&key, &scan.Status, &scan.Result, &scan.ScannedAt); err != nil {
+			return nil, err
+		}
+		scans[key] = scan
+	}
+	return scans, rows.Err()
+}
+
+func scanJSON(scan AttachmentScan) gin.H {
+	described := gin.H{"status": scan.Status}
+	if scan.Result != "" {
+		described["result"] = scan.Result
+	}
+	if scan.ScannedAt != 0 {
+		described["scanned_at"] = time.Unix(scan.ScannedAt, 0).UTC().Format(time.RFC3339)
+	}
+	return described
+}
+
+// attachmentInfected reports whether the last scan of an attachment found malware.
+func attachmentInfected(ctx context.Context, key string) (bool, error) {
+	var status string
+	err := db.QueryRowContext(ctx, "SELECT scan_status FROM Objects WHERE key = $1", key).Scan(&status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return status == ScanInfected, err
+}
+
+// allowInfectedDownload reports whether an attachment may be downloaded by the request, which infected attachments
+// may only be by moderators. Otherwise an error has been sent.
+func allowInfectedDownload(c *gin.Context, key string) bool {
+	infected, err := attachmentInfected(c.Request.Context(), key)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return false
+	} else if infected && !currentAccount(c).HasRole(RoleModerator) {
+		respondError(c, http.StatusForbidden, ErrAttachmentInfected)
+		return false
+	}
+	return true
+}
+
+func registerVirusScanRoutes(r *gin.Engine) {
+	// The scan state of every attachment of an upload.
+	r.GET("/api/v1/uploads/:hash/scans", func(c *gin.Context) {
+		upload := viewableUpload(c)
+		if upload == nil {
+			return
+		}
+		scans, err := GetAttachmentScans(c.Request.Context(), upload.FileHashes)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		files := make([]gin.H, len(upload.FileNames))
+		for i, name := range upload.FileNames {
+			files[i] = gin.H{
+				"name": name,
+				"hash": upload.FileHashes[i],
+				"scan": scanJSON(scans[upload.FileHashes[i]]),
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"scanning": clamdAddress != "",
+			"files":    files,
+		})
+	})
+
+	// Scan the attachments of an upload again, for example after a false positive was fixed in the signatures.
+	r.POST("/api/v1/moderation/uploads/:hash/rescan", requireRole(RoleModerator), func(c *gin.Context) {
+		if clamdAddress == "" {
+			respondError(c, http.StatusServiceUnavailable, errors.New("virus scanning is not configured"))
+			return
+		}
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		files := make([]gin.H, len(upload.FileHashes))
+		for i, key := range upload.FileHashes {
+			status, err := ScanAttachment(c.Request.Context(), key)
+			if err != nil {
+				respondError(c, http.StatusBadGateway, err)
+				return
+			}
+			files[i] = gin.H{
+				"name":   upload.FileNames[i],
+				"hash":   key,
+				"status": status,
+			}
+		}
+		RecordAudit(currentAccount(c).Username, "upload.rescan", upload.Hash, "", c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{
+			"files": files,
+		})
+	})
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Images downloaded from sensitive uploads carry a watermark naming who downloaded them, so that a leaked copy can be
+// traced back to where it leaked from. Owners mark their uploads as sensitive, and WATERMARK_IMAGES marks every upload.
+// The text is WATERMARK_TEXT with placeholders for the request filled in, tiled across the image in a small bitmap font,
+// so no font files are needed. PNG and JPEG images are watermarked; other images of sensitive uploads are not served at
+// all, and neither are images too large to decode safely. Watermarked downloads are never cached.
+
+const (
+	defaultWatermarkText = "{account} {ip} {time}"
+	maxWatermarkText     = 80         // Characters of the expanded text drawn; the rest is cut off.
+	maxWatermarkPixels   = 25_000_000 // Larger images are refused rather than decoded.
+	watermarkOpacity     = 0.35
+)
+
+var ErrWatermark = errors.New("this image cannot be watermarked, so it is not available for download")
+
+var (
+	watermarkImages atomic.Bool // Whether the images of every upload are watermarked.
+	watermarkText   string
+)
+
+func initWatermarks() {
+	loadFlag(&watermarkImages, "WATERMARK_IMAGES")
+	watermarkText = os.Getenv("WATERMARK_TEXT")
+	if watermarkText == "" {
+		watermarkText = defaultWatermarkText
+	}
+}
+
+// expandWatermark fills in the placeholders of WATERMARK_TEXT for a request: {account}, {ip}, {time} and {request}.
+func expandWatermark(c *gin.Context) string {
+	account := "anonymous"
+	if a := currentAccount(c); a != nil {
+		account = a.Username
+	}
+	text := strings.NewReplacer(
+		"{account}", account,
+		"{ip}", c.ClientIP(),
+		"{time}", time.Now().UTC().Format("2006-01-02 15:04Z"),
+		"{request}", requestID(c),
+	).Replace(watermarkText)
+	if runes := []rune(text); len(runes) > maxWatermarkText {
+		text = string(runes[:maxWatermarkText])
+	}
+	return text
+}
+
+// isWatermarked reports whether the downloads of an attachment are watermarked, which they are if any sensitive upload
+// has it.
+func isWatermarked(ctx context.Context, key string) (bool, error) {
+	if watermarkImages.Load() {
+		return true, nil
+	}
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM WatermarkedObjects WHERE key = $1)", key).Scan(&exists)
+	return exists, err
+}
+
+// SetUploadWatermark marks an upload as sensitive, or not, and purges its attachments from the CDN so that no copy
+// without a watermark is served from there.
+func SetUploadWatermark(ctx context.Context, upload *UploadModel, enabled bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "UPDATE Uploads SET watermark = $1 WHERE hash = $2", enabled, upload.Hash); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM WatermarkedObjects WHERE upload_hash = $1", upload.Hash); err != nil {
+		return err
+	}
+	if enabled {
+		for _, key := range upload.FileHashes {
+			if _, err = tx.ExecContext(ctx, `INSERT INTO WatermarkedObjects(key, upload_hash) VALUES ($1, $2)
+				ON CONFLICT DO NOTHING`, key, upload.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	invalidateUpload(upload.Hash)
+	if enabled {
+		purgeCDN(ctx, upload)
+	}
+	return nil
+}
+
+// serveWatermarked sends an image attachment with a watermark if its downloads are watermarked, and reports whether it
+// has responded. Other attachments are left to the caller.
+func serveWatermarked(c *gin.Context, hash string) bool {
+	ok, err := isWatermarked(c.Request.Context(), hash)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return true
+	} else if !ok {
+		return false
+	}
+
+	file, contents, err := OpenFileObject(c.Request.Context(), hash)
+	if errors.Is(err, ErrObjectArchived) {
+		respondArchived(c, hash)
+		return true
+	} else if err != nil {
+		route404(c)
+		return true
+	}
+	defer contents.Close()
+	r := bufio.NewReader(contents)
+	mediaType, ok := imageMediaType(file, r)
+	if !ok {
+		return false
+	}
+
+	var out bytes.Buffer
+	if err = watermark(&out, r, expandWatermark(c)); err != nil {
+		log.Printf("failed to watermark attachment %v: %v", hash, err)
+		respondError(c, http.StatusUnprocessableEntity, ErrWatermark)
+		return true
+	}
+	header := c.Writer.Header()
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+	header.Set("Cache-Control", "private, no-store")
+	header.Set("Accept-Ranges", "none")
+	header.Set("Content-Length", strconv.Itoa(out.Len()))
+	header.Set("Content-Type", mediaType)
+	c.Status(http.StatusOK)
+	if c.Request.Method == http.MethodHead {
+		return true
+	}
+	recordAnalytics(c, analyticsDownload, hash)
+	throttleDownload(c)
+	out.WriteTo(c.Writer)
+	return true
+}
+
+// imageMediaType returns the media type of an attachment read from r, and whether it is an image, which watermarked
+// downloads are only for. Images are recognized by their contents too, so that renaming one does not leave it without a
+// watermark.
+func imageMediaType(file *FileObject, r *bufio.Reader) (string, bool) {
+	start, _ := r.Peek(512)
+	mediaType, _, _ := mime.ParseMediaType(file.ContentType())
+	if sniffed := http.DetectContentType(start); strings.HasPrefix(sniffed, "image/") {
+		return sniffed, true
+	}
+	return mediaType, strings.HasPrefix(mediaType, "image/")
+}
+
+// watermark decodes a PNG or JPEG image, draws the text over it and encodes it again in the same format.
+func watermark(w io.Writer, r io.Reader, text string) error {
+	var data bytes.Buffer
+	if _, err := data.ReadFrom(r); err != nil {
+		return err
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data.Bytes()))
+	if err != nil {
+		return err
+	}
+	if format != "png" && format != "jpeg" {
+		return fmt.Errorf("%v images are not supported", format)
+	}
+	if config.Width*config.Height > maxWatermarkPixels {
+		return fmt.Errorf("the image has %dx%d pixels, more than %d", config.Width, config.Height, maxWatermarkPixels)
+	}
+	src, _, err := image.Decode(&data)
+	if err != nil {
+		return err
+	}
+	img := image.NewNRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	drawWatermark(img, strings.ToUpper(text))
+
+	if format == "png" {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+}
+
+// drawWatermark tiles the text across the image in rows, each shifted against the one above, in white with a dark
+// shadow so that it shows on light and dark images alike.
+func drawWatermark(img *image.NRGBA, text string) {
+	bounds := img.Bounds()
+	// Glyphs are drawn with square dots of scale pixels, so the text keeps its size relative to the image.
+	scale := max(1, min(bounds.Dx(), bounds.Dy())/250)
+	runes := []rune(text)
+	width := (len(runes)*(glyphWidth+1) + 4) * scale
+	height := (glyphHeight + 2) * scale
+	for row, y := 0, bounds.Min.Y+height; y < bounds.Max.Y; row, y = row+1, y+4*height {
+		for x := bounds.Min.X - (row%2)*width/2; x < bounds.Max.X; x += width {
+			drawText(img, runes, x+scale, y+scale, scale, color.NRGBA{0, 0, 0, 255})
+			drawText(img, runes, x, y, scale, color.NRGBA{255, 255, 255, 255})
+		}
+	}
+}
+
+// drawText blends a line of text into the image, with its top left corner at x and y.
+func drawText(img *image.NRGBA, text []rune, x, y, scale int, c color.NRGBA) {
+	for i, r := range text {
+		glyph, ok := watermarkFont[r]
+		if !ok {
+			glyph = watermarkFont['?']
+		}
+		left := x + i*(glyphWidth+1)*scale
+		for row, bits := range glyph {
+			for col := 0; col < glyphWidth; col++ {
+				if bits&(1<<(glyphWidth-1-col)) == 0 {
+					continue
+				}
+				dot := image.Rect(left+col*scale, y+row*scale, left+(col+1)*scale, y+(row+1)*scale).Intersect(img.Bounds())
+				for py := dot.Min.Y; py < dot.Max.Y; py++ {
+					for px := dot.Min.X; px < dot.Max.X; px++ {
+						blend(img, px, py, c)
+					}
+				}
+			}
+		}
+	}
+}
+
+// blend mixes a color into a pixel at watermarkOpacity.
+func blend(img *image.NRGBA, x, y int, c color.NRGBA) {
+	i := img.PixOffset(x, y)
+	pix := img.Pix[i : i+4 : i+4]
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a)*(1-watermarkOpacity) + float64(b)*watermarkOpacity)
+	}
+	pix[0], pix[1], pix[2] = mix(pix[0], c.R), mix(pix[1], c.G), mix(pix[2], c.B)
+	pix[3] = max(pix[3], mix(pix[3], 255))
+}
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// watermarkFont has the glyphs of the characters watermarks are written with, in rows of glyphWidth bits. Letters are
+// drawn in upper case, and characters without a glyph as question marks.
+var watermarkFont = map[rune][glyphHeight]uint8{
+	' ': {},
+	'A': {0b01110, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'B': {0b11110, 0b10001, 0b10001, 0b11110, 0b10001, 0b10001, 0b11110},
+	'C': {0b01110, 0b10001, 0b10000, 0b10000, 0b10000, 0b10001, 0b01110},
+	'D': {0b11110, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b11110},
+	'E': {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b11111},
+	'F': {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b10000},
+	'G': {0b01110, 0b10001, 0b10000, 0b10111, 0b10001, 0b10001, 0b01111},
+	'H': {0b10001, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'I': {0b01110, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	'J': {0b00111, 0b00010, 0b00010, 0b00010, 0b00010, 0b10010, 0b01100},
+	'K': {0b10001, 0b10010, 0b10100, 0b11000, 0b10100, 0b10010, 0b10001},
+	'L': {0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b11111},
+	'M': {0b10001, 0b11011, 0b10101, 0b10101, 0b10001, 0b10001, 0b10001},
+	'N': {0b10001, 0b10001, 0b11001, 0b10101, 0b10011, 0b10001, 0b10001},
+	'O': {0b01110, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'P': {0b11110, 0b10001, 0b10001, 0b11110, 0b10000, 0b10000, 0b10000},
+	'Q': {0b01110, 0b10001, 0b10001, 0b10001, 0b10101, 0b10010, 0b01101},
+	'R': {0b11110, 0b10001, 0b10001, 0b11110, 0b10100, 0b10010, 0b10001},
+	'S': {0b01111, 0b10000, 0b10000, 0b01110, 0b00001, 0b00001, 0b11110},
+	'T': {0b11111, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100},
+	'U': {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'V': {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01010, 0b00100},
+	'W': {0b10001, 0b10001, 0b10001, 0b10101, 0b10101, 0b10101, 0b01010},
+	'X': {0b10001, 0b10001, 0b01010, 0b00100, 0b01010, 0b10001, 0b10001},
+	'Y': {0b10001, 0b10001, 0b01010, 0b00100, 0b00100, 0b00100, 0b00100},
+	'Z': {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0b11111},
+	'0': {0b01110, 0b10001, 0b10011, 0b10101, 0b11001, 0b10001, 0b01110},
+	'1': {0b00100, 0b01100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	'2': {0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0b01000, 0b11111},
+	'3': {0b11111, 0b00010, 0b00100, 0b00010, 0b00001, 0b10001, 0b01110},
+	'4': {0b00010, 0b00110, 0b01010, 0b10010, 0b11111, 0b00010, 0b00010},
+	'5': {0b11111, 0b10000, 0b11110, 0b00001, 0b00001, 0b10001, 0b01110},
+	'6': {0b00110, 0b01000, 0b10000, 0b11110, 0b10001, 0b10001, 0b01110},
+	'7': {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b01000, 0b01000},
+	'8': {0b01110, 0b10001, 0b10001, 0b01110, 0b10001, 0b10001, 0b01110},
+	'9': {0b01110, 0b10001, 0b10001, 0b01111, 0b00001, 0b00010, 0b01100},
+	'.': {0, 0, 0, 0, 0, 0b01100, 0b01100},
+	',': {0, 0, 0, 0, 0b01100, 0b00100, 0b01000},
+	':': {0, 0b01100, 0b01100, 0, 0b01100, 0b01100, 0},
+	'-': {0, 0, 0, 0b11111, 0, 0, 0},
+	'_': {0, 0, 0, 0, 0, 0, 0b11111},
+	'+': {0, 0b00100, 0b00100, 0b11111, 0b00100, 0b00100, 0},
+	'=': {0, 0, 0b11111, 0, 0b11111, 0, 0},
+	'/': {0, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0},
+	'(': {0b00010, 0b00100, 0b01000, 0b01000, 0b01000, 0b00100, 0b00010},
+	')': {0b01000, 0b00100, 0b00010, 0b00010, 0b00010, 0b00100, 0b01000},
+	'@': {0b01110, 0b10001, 0b10111, 0b10101, 0b10111, 0b10000, 0b01110},
+	'#': {0b01010, 0b01010, 0b11111, 0b01010, 0b11111, 0b01010, 0b01010},
+	'?': {0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0, 0b00100},
+	'·': {0, 0, 0, 0b01100, 0b01100, 0, 0},
+}
+
+func registerWatermarkRoutes(r *gin.Engine) {
+	// Fetch whether the images of an upload are watermarked.
+	r.GET("/api/v1/uploads/:hash/watermark", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"enabled": upload.Watermark || watermarkImages.Load()})
+	})
+
+	// Turn the watermarks of an upload on or off with {"enabled": true}.
+	r.PUT("/api/v1/uploads/:hash/watermark", func(c *gin.Context) {
+		upload := ownedUpload(c)
+		if upload == nil {
+			return
+		}
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.Enabled == nil {
+			respondError(c, http.StatusBadRequest, errors.New(`"enabled" must be true or false`))
+			return
+		}
+		if err := SetUploadWatermark(c.Request.Context(), upload, *body.Enabled); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"enabled": *body.Enabled || watermarkImages.Load()})
+	})
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Web Push notifies browsers through the push service of each browser, even while no page of this site is open.
+// Devices paired with a clip channel subscribe to the snippets pushed to it, and anyone who can read an upload can
+// watch it to be told when its owners add or remove attachments. Messages are encrypted for the browser that
+// subscribed (RFC 8291), so the push services cannot read them, and the server identifies itself to them with the
+// VAPID key pair (RFC 8292) in VAPID_PRIVATE_KEY, which `copycat vapid-key` generates. Without a key there is no push.
+
+var (
+	ErrPushSubscription = errors.New(`the push subscription must have an https "endpoint" and "keys" with "p256dh" and "auth"`)
+	ErrPushGone         = errors.New("the push subscription has expired or was unsubscribed")
+)
+
+const (
+	pushTTL         = 24 * time.Hour // How long push services keep a message for a browser that is offline.
+	pushRecordSize  = 4096           // The record size of encrypted messages, which fit in one record.
+	pushPreviewSize = 120            // The characters of a snippet shown in its notification.
+)
+
+var (
+	vapidKey       *ecdsa.PrivateKey // The key the server signs its requests to push services with, or nil.
+	vapidPublicKey string            // The public key that browsers subscribe with, in URL-safe base64.
+	vapidSubject   string            // How the operators of push services can contact the operator of this instance.
+
+	// pushClient sends messages to push services. Endpoints are given by browsers, so it refuses to connect to the
+	// addresses of the network the server is in.
+	pushClient = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: refusePrivateAddress}).DialContext},
+	}
+)
+
+func initWebPush() {
+	if key := os.Getenv("VAPID_PRIVATE_KEY"); key != "" {
+		var err error
+		if vapidKey, vapidPublicKey, err = parseVAPIDKey(key); err != nil {
+			log.Fatal("VAPID_PRIVATE_KEY must be a P-256 private key in URL-safe base64: ", err)
+		}
+	}
+	vapidSubject = os.Getenv("VAPID_SUBJECT")
+	if vapidSubject == "" {
+		vapidSubject = baseurl
+	}
+
+	RegisterJob(&Job{
+		Name:     "push subscriptions",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "DELETE FROM UploadWatches w WHERE NOT EXISTS (SELECT 1 FROM Uploads WHERE hash = w.upload_hash)")
+			if err != nil {
+				return err
+			}
+			_, err = db.ExecContext(ctx, `DELETE FROM PushSubscriptions s WHERE created_at < $1
+				AND NOT EXISTS (SELECT 1 FROM ClipPushSubscriptions WHERE endpoint = s.endpoint)
+				AND NOT EXISTS (SELECT 1 FROM UploadWatches WHERE endpoint = s.endpoint)`, time.Now().Add(-time.Hour).UTC().Unix())
+			return err
+		},
+	})
+}
+
+// parseVAPIDKey parses a private key as generated by `copycat vapid-key`, returning it with its public key.
+func parseVAPIDKey(encoded string) (*ecdsa.PrivateKey, string, error) {
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, "", err
+	}
+	public := key.PublicKey().Bytes() // Uncompressed: 0x04, X, Y.
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(public[1:33]), Y: new(big.Int).SetBytes(public[33:])},
+		D:         new(big.Int).SetBytes(d),
+	}, base64.RawURLEncoding.EncodeToString(public), nil
+}
+
+// generateVAPIDKey returns a new private key for VAPID_PRIVATE_KEY, with its public key.
+func generateVAPIDKey() (string, string, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.Bytes()), base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// refusePrivateAddress refuses connections to loopback, private and link-local addresses.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to connect to %s", host)
+	}
+	return nil
+}
+
+// A PushSubscription is where a browser is sent messages, as its PushSubscription.toJSON() describes it.
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"` // The public key of the browser that messages are encrypted for.
+		Auth   string `json:"auth"`   // The secret that authenticates the messages.
+	} `json:"keys"`
+}
+
+// A PushMessage is shown by the service worker of the browser as a notification.
+type PushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body,omitempty"`
+	URL   string `json:"url"`           // The page opened by clicking the notification.
+	Tag   string `json:"tag,omitempty"` // Notifications with the same tag replace each other.
+}
+
+// decodePushKey decodes a key of a subscription, which browsers encode in URL-safe base64, usually without padding.
+func decodePushKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// check returns ErrPushSubscription if a subscription cannot be sent messages.
+func (sub *PushSubscription) check() error {
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return ErrPushSubscription
+	}
+	public, err := decodePushKey(sub.Keys.P256dh)
+	if err != nil {
+		return ErrPushSubscription
+	}
+	if _, err = ecdh.P256().NewPublicKey(public); err != nil {
+		return ErrPushSubscription
+	}
+	if auth, err := decodePushKey(sub.Keys.Auth); err != nil || len(auth) != 16 {
+		return ErrPushSubscription
+	}
+	return nil
+}
+
+// encryptPush encrypts a message for a subscription as the body of a request with the aes128gcm content encoding.
+func encryptPush(sub *PushSubscription, message []byte) ([]byte, error) {
+	userAgentBytes, err := decodePushKey(sub.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	userAgent, err := ecdh.P256().NewPublicKey(userAgentBytes)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := decodePushKey(sub.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	server, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := server.ECDH(userAgent)
+	if err != nil {
+		return nil, err
+	}
+	serverBytes := server.PublicKey().Bytes()
+
+	// The key material combines the shared secret with the authentication secret of the browser, and a random salt
+	// makes the key and nonce of every message different.
+	keyInfo := append(append([]byte("WebPush: info\x00"), userAgentBytes...), serverBytes...)
+	ikm := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, auth, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek, nonce := make([]byte, 16), make([]byte, 12)
+	if _, err = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header holds the salt, the record size and the public key of the server; the message is a single record,
+	// ended by the delimiter 2.
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(pushRecordSize))
+	body.WriteByte(byte(len(serverBytes)))
+	body.Write(serverBytes)
+	body.Write(gcm.Seal(nil, nonce, append(message, 2), nil))
+	return body.Bytes(), nil
+}
+
+// vapidAuthorization returns the Authorization header that identifies the server to the push service of an endpoint.
+func vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": vapidSubject,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, vapidKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, base64.RawURLEncoding.EncodeToString(signature), vapidPublicKey), nil
+}
+
+// SendPush sends a message to a subscription. ErrPushGone is returned when the browser no longer accepts messages.
+func SendPush(ctx context.Context, sub *PushSubscription, message PushMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	body, err := encryptPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int64(pushTTL.Seconds())))
+	req.Header.Set("Urgency", "normal")
+	if message.Tag != "" {
+		req.Header.Set("Topic", hashToken(message.Tag)[:32]) // Topics may only use URL-safe base64 characters.
+	}
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrPushGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service answered %s", resp.Status)
+	}
+	return nil
+}
+
+// savePushSubscription stores a subscription, updating the keys of one that was stored before.
+func savePushSubscription(tx *sql.Tx, sub *PushSubscription) error {
+	_, err := tx.Exec(`INSERT INTO PushSubscriptions(endpoint, p256dh, auth, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (endpoint) DO UPDATE SET p256dh = excluded.p256dh, auth = excluded.auth`,
+		sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, time.Now().UTC().Unix())
+	return err
+}
+
+// SubscribeClipChannel subscribes a browser to the snippets pushed to a channel by the holder of a key of it. The
+// subscription ends when the device it was made with is revoked.
+func SubscribeClipChannel(channel *ClipChannel, sub *PushSubscription) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = savePushSubscription(tx, sub); err != nil {
+		return err
+	}
+	var deviceId sql.NullString
+	if channel.Device != nil {
+		deviceId = sql.NullString{String: channel.Device.Id, Valid: true}
+	}
+	_, err = tx.Exec(`INSERT INTO ClipPushSubscriptions(channel_id, device_id, endpoint) VALUES ($1, $2, $3)
+		ON CONFLICT (channel_id, endpoint) DO UPDATE SET device_id = excluded.device_id`, channel.Id, deviceId, sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnsubscribeClipChannel ends the subscription of a browser to a channel.
+func UnsubscribeClipChannel(channelId, endpoint string) error {
+	_, err := db.Exec("DELETE FROM ClipPushSubscriptions WHERE channel_id = $1 AND endpoint = $2", channelId, endpoint)
+	return err
+}
+
+// WatchUpload subscribes a browser to the changes to an upload.
+func WatchUpload(hash string, sub *PushSubscription) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = savePushSubscription(tx, sub); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO UploadWatches(upload_hash, endpoint, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		hash, sub.Endpoint, time.Now().UTC().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnwatchUpload ends the subscription of a browser to the changes to an upload.
+func UnwatchUpload(hash, endpoint string) error {
+	_, err := db.Exec("DELETE FROM UploadWatches WHERE upload_hash = $1 AND endpoint = $2", hash, endpoint)
+	return err
+}
+
+// pushSubscriptions returns the subscriptions selected by a query of their endpoints.
+func pushSubscriptions(query string, args ...any) ([]PushSubscription, error) {
+	rows, err := db.Query("SELECT endpoint, p256dh, auth FROM PushSubscriptions WHERE endpoint IN ("+query+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []PushSubscription
+	for rows.Next() {
+		var sub PushSubscription
+		if err = rows.Scan(&sub.Endpoint, &sub.Keys.P256dh, &sub.Keys.Auth); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// broadcastPush sends a message to subscriptions in the background, forgetting those that are gone.
+func broadcastPush(subs []PushSubscription, message PushMessage) {
+	if len(subs) == 0 {
+		return
+	}
+	go func() {
+		for i := range subs {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := SendPush(ctx, &subs[i], message)
+			cancel()
+			if errors.Is(err, ErrPushGone) {
+				if _, err = db.Exec("DELETE FROM PushSubscriptions WHERE endpoint = $1", subs[i].Endpoint); err != nil {
+					log.Printf("failed to forget a push subscription: %v", err)
+				}
+			} else if err != nil {
+				log.Printf("failed to send a push message to %v: %v", pushHost(subs[i].Endpoint), err)
+			}
+		}
+	}()
+}
+
+// pushHost returns the host of the endpoint of a subscription, to log it by without the part that identifies the browser.
+func pushHost(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// notifyClipPushed tells the browsers subscribed to a channel of a snippet pushed to it, except those of the device
+// that pushed it.
+func notifyClipPushed(channel *ClipChannel, snippet *ClipSnippet) {
+	if vapidKey == nil {
+		return
+	}
+	var deviceId sql.NullString
+	if channel.Device != nil {
+		deviceId = sql.NullString{String: channel.Device.Id, Valid: true}
+	}
+	subs, err := pushSubscriptions("SELECT endpoint FROM ClipPushSubscriptions WHERE channel_id = $1 AND device_id IS DISTINCT FROM $2",
+		channel.Id, deviceId)
+	if err != nil {
+		log.Printf("failed to find the push subscriptions of clip channel %v: %v", channel.Id, err)
+		return
+	}
+	message := PushMessage{
+		Title: "New clip",
+		Body:  snippet.Body,
+		URL:   "/clip/" + channel.Id + "/history",
+		Tag:   "clip:" + channel.Id,
+	}
+	if snippet.Device != "" {
+		message.Title = "New clip from " + snippet.Device
+	}
+	if utf8.RuneCountInString(message.Body) > pushPreviewSize {
+		message.Body = string([]rune(message.Body)[:pushPreviewSize]) + "…"
+	}
+	broadcastPush(subs, message)
+}
+
+// notifyUploadWatchers tells the browsers watching an upload that it changed.
+func notifyUploadWatchers(upload *UploadModel, change string) {
+	if vapidKey == nil {
+		return
+	}
+	subs, err := pushSubscriptions("SELECT endpoint FROM UploadWatches WHERE upload_hash = $1", upload.Hash)
+	if err != nil {
+		log.Printf("failed to find the watchers of upload %v: %v", upload.Hash, err)
+		return
+	}
+	broadcastPush(subs, PushMessage{
+		Title: "Upload " + upload.ShortHash() + " changed",
+		Body:  change,
+		URL:   uploadPath(upload.ShortHash()),
+		Tag:   "upload:" + upload.Hash,
+	})
+}
+
+// requireWebPush is a middleware that hides the push endpoints of instances without a VAPID key.
+func requireWebPush(c *gin.Context) {
+	if vapidKey == nil {
+		route404(c)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// bindPushSubscription reads the subscription in the JSON body of a request. On failure an error has been sent and
+// nil is returned.
+func bindPushSubscription(c *gin.Context) *PushSubscription {
+	sub := new(PushSubscription)
+	if err := c.ShouldBindJSON(sub); err != nil {
+		respondError(c, http.StatusBadRequest, ErrPushSubscription)
+		return nil
+	}
+	if err := sub.check(); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return nil
+	}
+	return sub
+}
+
+func registerWebPushRoutes(r *gin.Engine) {
+	push := r.Group("", requireWebPush)
+
+	// The public key that browsers subscribe with, as the applicationServerKey of PushManager.subscribe.
+	push.GET("/api/v1/push/key", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"public_key": vapidPublicKey})
+	})
+
+	// Subscribe a browser to the snippets of a clip channel, with the subscription as JSON. Any key of the channel
+	// subscribes; the subscription ends with the device it was made with.
+	push.POST("/api/v1/clip/:channel/push", rateLimit(PolicyAPI), limitRequestBody(64<<10), func(c *gin.Context) {
+		channel := openClipChannel(c)
+		if channel == nil {
+			return
+		}
+		sub := bindPushSubscription(c)
+		if sub == nil {
+			return
+		}
+		if err := SubscribeClipChannel(channel, sub); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusCreated)
+	})
+	push.DELETE("/api/v1/clip/:channel/push", limitRequestBody(64<<10), func(c *gin.Context) {
+		channel := openClipChannel(c)
+		if channel == nil {
+			return
+		}
+		var body struct {
+			Endpoint string `json:"endpoint"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, http.StatusBadRequest, ErrPushSubscription)
+			return
+		}
+		if err := UnsubscribeClipChannel(channel.Id, body.Endpoint); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Watch an upload, to be told when its attachments change. Whoever can read the upload through the API or a share
+	// link can watch it.
+	push.POST("/api/v1/uploads/:hash/watch", rateLimit(PolicyAPI), limitRequestBody(64<<10), func(c *gin.Context) {
+		upload := sharedUpload(c, uploadParam(c))
+		if upload == nil {
+			return
+		}
+		sub := bindPushSubscription(c)
+		if sub == nil {
+			return
+		}
+		if err := WatchUpload(upload.Hash, sub); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusCreated)
+	})
+	// Stop watching an upload. The endpoint of the subscription is only known to its browser, so it is enough.
+	push.DELETE("/api/v1/uploads/:hash/watch", limitRequestBody(64<<10), func(c *gin.Context) {
+		upload, err := GetUpload(uploadParam(c))
+		if err != nil {
+			respondError(c, http.StatusNotFound, ErrUploadNotFound)
+			return
+		}
+		var body struct {
+			Endpoint string `json:"endpoint"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, http.StatusBadRequest, ErrPushSubscription)
+			return
+		}
+		if err := UnwatchUpload(upload.Hash, body.Endpoint); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}